@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/Schera-ole/metrics/internal/agent"
+	"github.com/Schera-ole/metrics/internal/grpcserver"
+	"github.com/Schera-ole/metrics/pkg/metricspb"
+)
+
+const (
+	// streamChunkSize is the maximum number of metrics sent in one stream message.
+	streamChunkSize = 100
+
+	// streamTimeout bounds a single attempt to stream a batch.
+	streamTimeout = 10 * time.Second
+
+	// retryAfterKey is the trailer in which the server asks to wait before retrying when it throttles the agent.
+	retryAfterKey = "retry-after"
+
+	// realIPKey is the metadata key in which the agent reports its own address, like the X-Real-IP header.
+	realIPKey = "x-real-ip"
+)
+
+// grpcTransport streams batches to the StreamMetrics RPC.
+type grpcTransport struct {
+	// conn is the connection to the server
+	conn *grpc.ClientConn
+
+	// client is the metrics API client
+	client metricspb.MetricsClient
+
+	// key signs every stream message, empty to disable signing
+	key string
+
+	// retrier retries failed streams
+	retrier *retrier
+
+	// address is the host:port of the gRPC API
+	address string
+}
+
+// newGRPCTransport creates a transport connected to the gRPC API at address.
+//
+// The connection uses TLS with tlsConfig, or is unencrypted if tlsConfig is nil.
+func newGRPCTransport(address string, key string, tlsConfig *tls.Config, retrier *retrier) (*grpcTransport, error) {
+
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("error creating grpc client for %s: %w", address, err)
+	}
+	return &grpcTransport{
+		conn:    conn,
+		client:  metricspb.NewMetricsClient(conn),
+		key:     key,
+		retrier: retrier,
+		address: address,
+	}, nil
+}
+
+// prepareStreamRequests splits the metrics into signed stream messages.
+func prepareStreamRequests(metrics []agent.Metric, key string) ([]*metricspb.UpdateMetricsRequest, error) {
+
+	var requests []*metricspb.UpdateMetricsRequest
+	for _, dto := range metricsToDTO(metrics) {
+		if len(requests) == 0 || len(requests[len(requests)-1].Metrics) == streamChunkSize {
+			requests = append(requests, &metricspb.UpdateMetricsRequest{})
+		}
+		last := requests[len(requests)-1]
+		last.Metrics = append(last.Metrics, grpcserver.DTOToProto(dto))
+	}
+	if key == "" {
+		return requests, nil
+	}
+	for _, req := range requests {
+		if err := req.Sign(key); err != nil {
+			return nil, err
+		}
+	}
+	return requests, nil
+}
+
+// Send implements Transport.
+func (t *grpcTransport) Send(ctx context.Context, metrics []agent.Metric) error {
+
+	requests, err := prepareStreamRequests(metrics, t.key)
+	if err != nil {
+		return fmt.Errorf("error preparing metrics payload: %w", err)
+	}
+	if len(requests) == 0 {
+		return nil
+	}
+	if ip, err := outboundIP(t.address); err == nil {
+		ctx = metadata.AppendToOutgoingContext(ctx, realIPKey, ip)
+	} else {
+		log.Printf("Error detecting outbound address: %v", err)
+	}
+	return t.retrier.do(ctx, func() (bool, error) {
+		after, err := t.stream(ctx, requests)
+		if err == nil {
+			return false, nil
+		}
+		err = fmt.Errorf("error streaming metrics: %w", err)
+		if after > 0 {
+			return true, &retryAfterError{err: err, after: after}
+		}
+		return isRetryableStatus(err), err
+	})
+}
+
+// stream sends all requests over a single stream and waits for the server to store them.
+//
+// If the server rejects the stream with a retry-after trailer, the requested delay is returned.
+func (t *grpcTransport) stream(ctx context.Context, requests []*metricspb.UpdateMetricsRequest) (time.Duration, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, streamTimeout)
+	defer cancel()
+
+	stream, err := t.client.StreamMetrics(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, req := range requests {
+		if err := stream.Send(req); err != nil {
+			if errors.Is(err, io.EOF) {
+				// The server ended the stream, its status is returned by CloseAndRecv
+				break
+			}
+			return 0, err
+		}
+	}
+	_, err = stream.CloseAndRecv()
+	if err == nil {
+		return 0, nil
+	}
+	switch status.Code(err) {
+	case codes.ResourceExhausted, codes.Unavailable:
+		if values := stream.Trailer().Get(retryAfterKey); len(values) > 0 {
+			if after, ok := parseRetryAfter(values[0], time.Now()); ok {
+				return after, err
+			}
+		}
+	}
+	return 0, err
+}
+
+// isRetryableStatus reports whether a gRPC error is transient, like network errors and 5xx responses in HTTP.
+func isRetryableStatus(err error) bool {
+
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted, codes.Internal:
+		return true
+	}
+	return false
+}
+
+// Close implements Transport.
+func (t *grpcTransport) Close() error {
+
+	return t.conn.Close()
+}
@@ -1,13 +1,15 @@
 // Package main implements the metrics collection agent.
 //
-// It collects system and runtime metrics at regular intervals and sends them
-// to the metrics server. The agent supports configurable polling intervals,
-// rate limiting, and secure communication with the server.
+// It collects system and runtime metrics every poll interval, aggregates them and
+// sends the aggregate to the metrics server every report interval. The agent supports
+// configurable polling and reporting intervals, rate limiting, and secure communication
+// with the server.
 package main
 
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/json"
@@ -40,16 +42,10 @@ var (
 	buildCommit  string = "N/A"
 )
 
-// Counter tracks the number of times metrics have been collected.
-type Counter struct {
-	// Value is the current count of metric collection cycles
-	Value int64
-}
-
 // collectMetrics gathers runtime metrics from the Go runtime.
 //
 // It collects memory statistics, garbage collector information, and a random value.
-func collectMetrics(counter *Counter) []agent.Metric {
+func collectMetrics() []agent.Metric {
 
 	var metrics []agent.Metric
 	var MemStats runtime.MemStats
@@ -62,9 +58,9 @@ func collectMetrics(counter *Counter) []agent.Metric {
 		value := msValue.FieldByName(metric)
 		metrics = append(metrics, agent.Metric{Name: field.Name, Type: models.Gauge, Value: value.Interface()})
 	}
-	counter.Value += 1
 	metrics = append(metrics, agent.Metric{Name: "RandomValue", Type: models.Gauge, Value: rand.Float64()})
-	metrics = append(metrics, agent.Metric{Name: "PollCount", Type: models.Counter, Value: counter.Value})
+	// The server adds every counter value to its total, so only the delta of this poll is sent
+	metrics = append(metrics, agent.Metric{Name: "PollCount", Type: models.Counter, Value: int64(1)})
 
 	return metrics
 }
@@ -114,14 +110,15 @@ func countHashString(compressedBody []byte, key string) string {
 	return fmt.Sprintf("%x", hash)
 }
 
-// prepareMetricsPayload prepares the metrics data for sending.
-func prepareMetricsPayload(metrics []agent.Metric, key string) ([]byte, string, error) {
-	// Prepare the data to send
+// metricsToDTO converts collected metrics to the DTOs understood by the server.
+func metricsToDTO(metrics []agent.Metric) []models.MetricsDTO {
+
 	var sendingData []models.MetricsDTO
 	for _, metric := range metrics {
 		reqMetrics := models.MetricsDTO{
-			ID:    metric.Name,
-			MType: metric.Type,
+			ID:     metric.Name,
+			MType:  metric.Type,
+			Labels: metric.Labels,
 		}
 		switch reqMetrics.MType {
 		case models.Gauge:
@@ -141,6 +138,13 @@ func prepareMetricsPayload(metrics []agent.Metric, key string) ([]byte, string,
 		}
 		sendingData = append(sendingData, reqMetrics)
 	}
+	return sendingData
+}
+
+// prepareMetricsPayload prepares the metrics data for sending.
+func prepareMetricsPayload(metrics []agent.Metric, key string) ([]byte, string, error) {
+	// Prepare the data to send
+	sendingData := metricsToDTO(metrics)
 	jsonData, err := json.Marshal(sendingData)
 	if err != nil {
 		return nil, "", fmt.Errorf("error creating json")
@@ -162,25 +166,16 @@ func prepareMetricsPayload(metrics []agent.Metric, key string) ([]byte, string,
 }
 
 // sendWithRetry sends a batch of metrics to the server with retry logic.
-func sendWithRetry(client *http.Client, payload []byte, hash string, url string, key string) error {
-	delays := []time.Duration{1 * time.Second, 3 * time.Second, 5 * time.Second}
-	var lastErr error
-
-	for attempt := 0; attempt < 4; attempt++ {
-		if attempt > 0 {
-			if attempt <= len(delays) {
-				delay := delays[attempt-1]
-				fmt.Printf("Retry attempt %d after %v delay\n", attempt, delay)
-				time.Sleep(delay)
-			}
-		}
+//
+// headers are added to every request, for example to mark the payload as encrypted.
+func sendWithRetry(ctx context.Context, retrier *retrier, client *http.Client, payload []byte, hash string, url string, key string, headers http.Header) error {
 
+	return retrier.do(ctx, func() (bool, error) {
 		// Create a new reader for each attempt since it gets consumed
 		payloadReader := bytes.NewReader(payload)
-		request, err := http.NewRequest(http.MethodPost, url, payloadReader)
+		request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, payloadReader)
 		if err != nil {
-			lastErr = fmt.Errorf("error creating request for %s: %w", url, err)
-			continue
+			return false, fmt.Errorf("error creating request for %s: %w", url, err)
 		}
 		request.Header.Set("Content-Type", "application/json")
 		request.Header.Set("Accept-Encoding", "gzip")
@@ -188,45 +183,37 @@ func sendWithRetry(client *http.Client, payload []byte, hash string, url string,
 		if key != "" {
 			request.Header.Set("HashSHA256", hash)
 		}
+		for name, values := range headers {
+			request.Header[name] = values
+		}
 
 		response, err := client.Do(request)
 		if err != nil {
-			lastErr = fmt.Errorf("error sending request for %s: %w", url, err)
 			// Check if the error is retryable
-			if isRetryableError(err) {
-				fmt.Printf("Retryable error occurred: %v\n", err)
-				continue
-			} else {
-				return lastErr
-			}
+			return isRetryableError(err), fmt.Errorf("error sending request for %s: %w", url, err)
 		}
 
 		body, err := io.ReadAll(response.Body)
 		response.Body.Close()
 		if err != nil {
-			lastErr = fmt.Errorf("error reading response body: %w", err)
-			continue
+			return true, fmt.Errorf("error reading response body: %w", err)
 		}
 
 		// Check response status code and decide retry or not
 		if response.StatusCode >= 200 && response.StatusCode < 300 {
 			fmt.Printf("Response: %s\n", string(body))
-			return nil
-		} else {
-			lastErr = fmt.Errorf("server returned error status %d: %s", response.StatusCode, string(body))
-			// Think, that for 5xx errors, we should retry request
-			if response.StatusCode >= 500 && response.StatusCode < 600 {
-				fmt.Printf("Server error (5xx), will retry: %v\n", lastErr)
-				continue
-			} else {
-				// For other errors, don't retry
-				return lastErr
+			return false, nil
+		}
+		// Think, that for 5xx errors, we should retry request
+		err = fmt.Errorf("server returned error status %d: %s", response.StatusCode, string(body))
+		if response.StatusCode == http.StatusTooManyRequests || response.StatusCode == http.StatusServiceUnavailable {
+			if after, ok := parseRetryAfter(response.Header.Get("Retry-After"), time.Now()); ok {
+				return true, &retryAfterError{err: err, after: after}
 			}
+			return true, err
 		}
-	}
-
-	// Failed
-	return fmt.Errorf("failed to send metrics after 4 attempts: %w", lastErr)
+		return response.StatusCode >= 500 && response.StatusCode < 600, err
+	})
 }
 
 // collectGopsutilMetrics gathers system metrics using gopsutil.
@@ -254,25 +241,6 @@ func collectGopsutilMetrics() []agent.Metric {
 	return metrics
 }
 
-// worker processes metric batches from the jobs channel.
-func worker(client *http.Client, url string, key string, jobs <-chan []agent.Metric) {
-
-	for job := range jobs {
-		// Prepare the metrics payload
-		payload, hash, err := prepareMetricsPayload(job, key)
-		if err != nil {
-			log.Printf("Error preparing metrics payload: %v", err)
-			continue
-		}
-
-		// Send with retry logic
-		err = sendWithRetry(client, payload, hash, url, key)
-		if err != nil {
-			log.Printf("Error sending metrics: %v", err)
-		}
-	}
-}
-
 // main initializes and starts the metrics collection agent.
 func main() {
 	// Print build information
@@ -284,33 +252,36 @@ func main() {
 	if err != nil {
 		log.Fatal("Failed to parse configuration: ", err)
 	}
+	if agentConfig.PrintConfig {
+		if err := agentConfig.Dump(os.Stdout); err != nil {
+			log.Fatal("Failed to print configuration: ", err)
+		}
+		return
+	}
 
-	client := &http.Client{}
-
-	url := "http://" + agentConfig.Address + "/updates"
-	counter := &Counter{Value: 0}
-	jobs := make(chan []agent.Metric, 20)
-
-	for w := 1; w <= agentConfig.RateLimit; w++ {
-		go worker(client, url, agentConfig.Key, jobs)
+	transport, err := newTransport(agentConfig)
+	if err != nil {
+		log.Fatal("Failed to create transport: ", err)
 	}
-	go func() {
-		for {
-			jobs <- collectMetrics(counter)
-			time.Sleep(time.Duration(agentConfig.PollInterval) * time.Second)
-		}
-	}()
-	go func() {
-		for {
-			jobs <- collectGopsutilMetrics()
-			time.Sleep(time.Duration(agentConfig.PollInterval) * time.Second)
+	defer transport.Close()
+
+	sender := &sender{transport: transport, aggregator: agent.NewAggregator(agentConfig.AggregateStats)}
+	if agentConfig.SpoolDir != "" {
+		sender.spool, err = agent.NewSpool(
+			agentConfig.SpoolDir,
+			int64(agentConfig.SpoolMaxBytes),
+			time.Duration(agentConfig.SpoolMaxAge)*time.Second,
+		)
+		if err != nil {
+			log.Fatal("Failed to open spool: ", err)
 		}
-	}()
+	}
 
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	// Block until signal received
-	<-sigChan
-	log.Println("Shutting down...")
-	close(jobs)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
+	collectors := []collector{
+		collectMetrics,
+		collectGopsutilMetrics,
+	}
+	run(ctx, agentConfig, sender, collectors, shutdownTimeout)
 }
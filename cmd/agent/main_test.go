@@ -2,6 +2,7 @@ package main
 
 import (
 	"compress/gzip"
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	"io"
@@ -16,8 +17,7 @@ import (
 )
 
 func TestCollectMetrics(t *testing.T) {
-	counter := &Counter{Value: 0}
-	metrics := collectMetrics(counter)
+	metrics := collectMetrics()
 	require.NotEmpty(t, metrics)
 
 	foundPollCount := false
@@ -35,6 +35,13 @@ func TestCollectMetrics(t *testing.T) {
 	}
 
 	assert.True(t, foundPollCount, "PollCount metric should be present")
+
+	// Every poll reports a delta, not the running total
+	for _, m := range collectMetrics() {
+		if m.Name == "PollCount" {
+			assert.Equal(t, int64(1), m.Value)
+		}
+	}
 }
 
 func TestSendMetric(t *testing.T) {
@@ -63,14 +70,13 @@ func TestSendMetric(t *testing.T) {
 	}))
 	defer server.Close()
 
-	counter := &Counter{Value: 0}
-	metrics := collectMetrics(counter)
+	metrics := collectMetrics()
 
 	client := &http.Client{}
 
 	payload, hash, err := prepareMetricsPayload(metrics, key)
 	require.NoError(t, err)
-	err = sendWithRetry(client, payload, hash, server.URL+"/update", key)
+	err = sendWithRetry(context.Background(), &retrier{}, client, payload, hash, server.URL+"/update", key, nil)
 	require.NoError(t, err)
 
 	// We should receive exactly one request with all metrics
@@ -121,14 +127,13 @@ func TestSendMetricWithHash(t *testing.T) {
 	}))
 	defer server.Close()
 
-	counter := &Counter{Value: 0}
-	metrics := collectMetrics(counter)
+	metrics := collectMetrics()
 
 	client := &http.Client{}
 
 	payload, hash, err := prepareMetricsPayload(metrics, key)
 	require.NoError(t, err)
-	err = sendWithRetry(client, payload, hash, server.URL+"/update", key)
+	err = sendWithRetry(context.Background(), &retrier{}, client, payload, hash, server.URL+"/update", key, nil)
 	require.NoError(t, err)
 
 	// We should receive exactly one request with all metrics
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Schera-ole/metrics/internal/agent"
+)
+
+// shutdownTimeout bounds the time the agent spends sending the pending batches on shutdown.
+const shutdownTimeout = 10 * time.Second
+
+// collector gathers one poll of metrics.
+type collector func() []agent.Metric
+
+// run polls the collectors every poll interval and reports the aggregate every report
+// interval until ctx is done.
+//
+// On shutdown the collectors are stopped, a final collection is taken and reported, and the
+// workers send the queued batches. Sending is canceled after flushTimeout; the batches that
+// could not be sent by then are kept in the spool if it is enabled.
+func run(ctx context.Context, config *agent.AgentConfig, sender *sender, collectors []collector, flushTimeout time.Duration) {
+
+	aggregator := sender.aggregator
+	jobs := make(chan []agent.Metric, 20)
+
+	// sendCtx outlives ctx by flushTimeout, so in-flight and queued batches can still be sent
+	sendCtx, cancelSend := context.WithCancel(context.Background())
+	defer cancelSend()
+
+	var workers sync.WaitGroup
+	for w := 1; w <= config.RateLimit; w++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			worker(sendCtx, sender, jobs)
+		}()
+	}
+
+	var producers sync.WaitGroup
+	pollInterval := time.Duration(config.PollInterval) * time.Second
+	for _, collect := range collectors {
+		producers.Add(1)
+		go func() {
+			defer producers.Done()
+			ticker := time.NewTicker(pollInterval)
+			defer ticker.Stop()
+			for {
+				aggregator.Add(collect())
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+	}
+	producers.Add(1)
+	go func() {
+		defer producers.Done()
+		ticker := time.NewTicker(time.Duration(config.ReportInterval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			// Only the aggregate of the polls since the last report is sent
+			metrics := aggregator.Flush()
+			if len(metrics) == 0 {
+				continue
+			}
+			select {
+			case jobs <- metrics:
+			case <-ctx.Done():
+				// The workers are busy, report the metrics with the final collection
+				aggregator.Requeue(metrics)
+				return
+			}
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("Shutting down...")
+	timer := time.AfterFunc(flushTimeout, cancelSend)
+	defer timer.Stop()
+
+	// Nothing sends to jobs once the producers have stopped, so it can be closed
+	producers.Wait()
+	for _, collect := range collectors {
+		aggregator.Add(collect())
+	}
+	if metrics := aggregator.Flush(); len(metrics) > 0 {
+		jobs <- metrics
+	}
+	close(jobs)
+	workers.Wait()
+
+	if pending := aggregator.Flush(); len(pending) > 0 {
+		log.Printf("Dropped %d metrics that could not be sent before shutdown", len(pending))
+	}
+	log.Println("Agent stopped")
+}
+
+// worker processes metric batches from the jobs channel until it is closed.
+func worker(ctx context.Context, sender *sender, jobs <-chan []agent.Metric) {
+
+	for job := range jobs {
+		sender.deliver(ctx, job)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Schera-ole/metrics/internal/agent"
+	models "github.com/Schera-ole/metrics/internal/model"
+)
+
+// blockingTransport blocks every send until its context is canceled.
+type blockingTransport struct{}
+
+// Send implements Transport.
+func (b *blockingTransport) Send(ctx context.Context, metrics []agent.Metric) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// Close implements Transport.
+func (b *blockingTransport) Close() error {
+	return nil
+}
+
+// testCollectors returns a collector polling a counter delta and a gauge.
+func testCollectors() []collector {
+	return []collector{func() []agent.Metric {
+		return []agent.Metric{
+			{Name: "PollCount", Type: models.Counter, Value: int64(1)},
+			{Name: "Alloc", Type: models.Gauge, Value: 1.0},
+		}
+	}}
+}
+
+func TestRunFlushesOnShutdown(t *testing.T) {
+	config := &agent.AgentConfig{PollInterval: 60, ReportInterval: 60, RateLimit: 2}
+	transport := &failingTransport{}
+	sender := &sender{transport: transport, aggregator: agent.NewAggregator(false)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	run(ctx, config, sender, testCollectors(), time.Second)
+
+	// The poll taken at startup and the final collection are reported in one batch
+	require.Len(t, transport.sent, 1)
+	require.Len(t, transport.sent[0], 2)
+	assert.Equal(t, "PollCount", transport.sent[0][1].Name)
+	assert.Equal(t, int64(2), transport.sent[0][1].Value)
+}
+
+func TestRunBoundsFlush(t *testing.T) {
+	config := &agent.AgentConfig{PollInterval: 60, ReportInterval: 60, RateLimit: 1}
+	spool, err := agent.NewSpool(t.TempDir(), 0, 0)
+	require.NoError(t, err)
+	sender := &sender{transport: &blockingTransport{}, aggregator: agent.NewAggregator(false), spool: spool}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	run(ctx, config, sender, testCollectors(), 50*time.Millisecond)
+
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Equal(t, 1, spool.Len(), "the batch that could not be sent is kept in the spool")
+}
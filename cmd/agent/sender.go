@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/Schera-ole/metrics/internal/agent"
+)
+
+// sender delivers batches through a transport and keeps the batches that could not be sent.
+type sender struct {
+	// transport sends the batches to the server
+	transport Transport
+
+	// aggregator receives the counters of failed batches when the spool is disabled or fails
+	aggregator *agent.Aggregator
+
+	// spool queues failed batches on disk, nil if disabled
+	spool *agent.Spool
+}
+
+// deliver sends a batch.
+//
+// Without a spool, the counters of a batch that could not be sent are carried forward to
+// the next report. With a spool, the batch is queued on disk instead. While the spool is
+// not empty, new batches are queued behind the spooled ones, so the server receives them
+// in order and a replayed gauge never overwrites a newer value.
+//
+// Delivery is at least once: a batch that fails after the server stored it, for example when
+// the response times out, is sent again, and its counter deltas are then counted twice.
+func (s *sender) deliver(ctx context.Context, job []agent.Metric) {
+
+	if s.spool != nil && s.spool.Len() > 0 {
+		s.enqueue(job)
+		s.replay(ctx)
+		return
+	}
+	if err := s.transport.Send(ctx, job); err != nil {
+		log.Printf("Error sending metrics: %v", err)
+		s.enqueue(job)
+	}
+}
+
+// enqueue keeps a batch that could not be sent.
+func (s *sender) enqueue(job []agent.Metric) {
+
+	if s.spool != nil {
+		err := s.spool.Write(job)
+		if err == nil {
+			return
+		}
+		log.Printf("Error spooling metrics: %v", err)
+	}
+	s.aggregator.Requeue(job)
+}
+
+// replay sends the spooled batches in order.
+func (s *sender) replay(ctx context.Context) {
+
+	replayed, err := s.spool.Replay(func(metrics []agent.Metric) error {
+		return s.transport.Send(ctx, metrics)
+	})
+	if replayed > 0 {
+		log.Printf("Replayed %d spooled batches", replayed)
+	}
+	if err != nil {
+		log.Printf("Error replaying spooled metrics: %v", err)
+	}
+}
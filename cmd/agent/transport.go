@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Schera-ole/metrics/internal/agent"
+	"github.com/Schera-ole/metrics/internal/encryption"
+	"github.com/Schera-ole/metrics/internal/tlsconfig"
+)
+
+// Transport sends batches of collected metrics to the server.
+type Transport interface {
+	// Send delivers a batch of metrics, retrying transient failures
+	Send(ctx context.Context, metrics []agent.Metric) error
+
+	// Close releases the resources held by the transport
+	Close() error
+}
+
+// realIPHeader is the header in which the agent reports its own address to the server.
+const realIPHeader = "X-Real-IP"
+
+// outboundIP returns the local address used to connect to the server at address.
+//
+// Dialing UDP sends no packets, it only selects the outbound interface by the routing table.
+func outboundIP(address string) (string, error) {
+
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	host, _, err := net.SplitHostPort(conn.LocalAddr().String())
+	if err != nil {
+		return "", err
+	}
+	return host, nil
+}
+
+// retryAfterError is a retryable error for which the server asked to wait before retrying.
+type retryAfterError struct {
+	// err is the underlying error
+	err error
+
+	// after is how long the server asked to wait
+	after time.Duration
+}
+
+// Error implements the error interface.
+func (e *retryAfterError) Error() string {
+	return fmt.Sprintf("%v (retry after %v)", e.err, e.after)
+}
+
+// Unwrap returns the underlying error.
+func (e *retryAfterError) Unwrap() error {
+	return e.err
+}
+
+// parseRetryAfter parses a Retry-After value given in seconds or as an HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if d := at.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// retrier retries failed attempts with exponential backoff and jitter, guarded by a circuit breaker.
+//
+// Both transports use it, so they retry the same way.
+type retrier struct {
+	// backoff computes the delays between retries
+	backoff agent.Backoff
+
+	// maxRetries is the number of retries after the first failed attempt
+	maxRetries int
+
+	// breaker stops attempts while the server is failing, nil if disabled
+	breaker *agent.Breaker
+}
+
+// newRetrier creates the retrier configured for the agent.
+func newRetrier(config *agent.AgentConfig, target string) *retrier {
+
+	r := &retrier{
+		backoff: agent.Backoff{
+			Initial:    config.RetryInitialDelay,
+			Max:        config.RetryMaxDelay,
+			Multiplier: 2,
+			Jitter:     config.RetryJitter,
+		},
+		maxRetries: config.RetryMax,
+	}
+	if config.BreakerThreshold > 0 {
+		r.breaker = agent.NewBreaker(target, config.BreakerThreshold, config.BreakerCooldown)
+	}
+	return r
+}
+
+// do calls attempt until it succeeds, fails with an error that is not retryable, or the
+// retries are exhausted.
+//
+// attempt reports whether its error may be retried. While the circuit breaker is open no
+// attempt is made. A delay requested by the server with Retry-After is honoured; if it is
+// longer than the maximum backoff delay, the breaker is opened for that long instead of waiting.
+func (r *retrier) do(ctx context.Context, attempt func() (bool, error)) error {
+
+	var lastErr error
+	for i := 0; i <= r.maxRetries; i++ {
+		if i > 0 {
+			delay := r.backoff.Delay(i)
+			var retryAfter *retryAfterError
+			if errors.As(lastErr, &retryAfter) {
+				if r.breaker != nil && retryAfter.after > r.backoff.Max {
+					r.breaker.Trip(retryAfter.after)
+					return lastErr
+				}
+				delay = retryAfter.after
+			}
+			log.Printf("Retry attempt %d after %v delay", i, delay)
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("retry canceled: %w", lastErr)
+			case <-time.After(delay):
+			}
+		}
+
+		if r.breaker != nil {
+			if err := r.breaker.Allow(); err != nil {
+				if lastErr != nil {
+					return fmt.Errorf("%w: %w", err, lastErr)
+				}
+				return err
+			}
+		}
+		retryable, err := attempt()
+		if r.breaker != nil {
+			if err != nil && retryable {
+				r.breaker.Failure()
+			} else {
+				r.breaker.Success()
+			}
+		}
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		if !retryable {
+			return lastErr
+		}
+		log.Printf("Retryable error occurred: %v", err)
+	}
+
+	// Failed
+	return fmt.Errorf("failed to send metrics after %d attempts: %w", r.maxRetries+1, lastErr)
+}
+
+// newTransport creates the transport selected in the agent configuration.
+func newTransport(config *agent.AgentConfig) (Transport, error) {
+
+	var tlsConfig *tls.Config
+	if config.TLS {
+		var err error
+		tlsConfig, err = tlsconfig.NewClientConfig(config.TLSCA, config.TLSCert, config.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch config.Transport {
+	case agent.TransportHTTP:
+		t := &httpTransport{
+			client:  &http.Client{},
+			url:     "http://" + config.Address + "/updates",
+			key:     config.Key,
+			retrier: newRetrier(config, config.Address),
+			address: config.Address,
+		}
+		if tlsConfig != nil {
+			t.client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+			t.url = "https://" + config.Address + "/updates"
+		}
+		if config.CryptoKey != "" {
+			publicKey, err := encryption.LoadPublicKey(config.CryptoKey)
+			if err != nil {
+				return nil, fmt.Errorf("error loading crypto key: %w", err)
+			}
+			t.publicKey = publicKey
+		}
+		return t, nil
+	case agent.TransportGRPC:
+		return newGRPCTransport(config.GRPCAddress, config.Key, tlsConfig, newRetrier(config, config.GRPCAddress))
+	}
+	return nil, fmt.Errorf("unknown transport %s", config.Transport)
+}
+
+// httpTransport posts gzip compressed JSON batches to the /updates endpoint.
+type httpTransport struct {
+	// client is the HTTP client used to send requests
+	client *http.Client
+
+	// url is the batch update endpoint of the server
+	url string
+
+	// key signs the compressed payload, empty to disable signing
+	key string
+
+	// retrier retries failed requests
+	retrier *retrier
+
+	// publicKey encrypts the signed payload, nil to send it unencrypted
+	publicKey *rsa.PublicKey
+
+	// address is the host:port of the server
+	address string
+}
+
+// Send implements Transport.
+func (t *httpTransport) Send(ctx context.Context, metrics []agent.Metric) error {
+
+	payload, hash, err := prepareMetricsPayload(metrics, t.key)
+	if err != nil {
+		return fmt.Errorf("error preparing metrics payload: %w", err)
+	}
+	headers := http.Header{}
+	if t.publicKey != nil {
+		// The hash covers the compressed payload, which the server checks after decrypting
+		payload, err = encryption.Encrypt(t.publicKey, payload)
+		if err != nil {
+			return fmt.Errorf("error encrypting metrics payload: %w", err)
+		}
+		headers.Set(encryption.Header, encryption.Scheme)
+	}
+	if ip, err := outboundIP(t.address); err == nil {
+		headers.Set(realIPHeader, ip)
+	} else {
+		log.Printf("Error detecting outbound address: %v", err)
+	}
+	return sendWithRetry(ctx, t.retrier, t.client, payload, hash, t.url, t.key, headers)
+}
+
+// Close implements Transport.
+func (t *httpTransport) Close() error {
+
+	t.client.CloseIdleConnections()
+	return nil
+}
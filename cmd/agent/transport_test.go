@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/Schera-ole/metrics/internal/agent"
+	"github.com/Schera-ole/metrics/internal/config"
+	"github.com/Schera-ole/metrics/internal/grpcserver"
+	"github.com/Schera-ole/metrics/internal/handler"
+	models "github.com/Schera-ole/metrics/internal/model"
+	"github.com/Schera-ole/metrics/internal/repository"
+	"github.com/Schera-ole/metrics/internal/service"
+)
+
+// noopAuditLogger discards audit events.
+type noopAuditLogger struct{}
+
+// Log implements the AuditLogger interface.
+func (n *noopAuditLogger) Log(metrics []string, ipAddress string, identity string) {}
+
+// testRetrier returns a retrier with three retries, short delays and no circuit breaker.
+func testRetrier() *retrier {
+	return &retrier{
+		backoff:    agent.Backoff{Initial: time.Millisecond, Max: 10 * time.Millisecond, Multiplier: 2},
+		maxRetries: 3,
+	}
+}
+
+// startGRPCServer serves the gRPC API on a local port and returns its address and storage.
+func startGRPCServer(t *testing.T, key string) (string, *service.MetricsService) {
+	logger, _ := zap.NewDevelopment()
+	metricService := service.NewMetricsService(repository.NewMemStorage())
+	serverConfig := &config.ServerConfig{StoreInterval: 300, Key: key}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	grpcServer := grpcserver.NewServer(logger.Sugar(), config.NewReloadable(serverConfig), metricService, &noopAuditLogger{}, nil).Register()
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+	return listener.Addr().String(), metricService
+}
+
+func TestRetrier(t *testing.T) {
+	r := testRetrier()
+
+	calls := 0
+	err := r.do(context.Background(), func() (bool, error) {
+		calls++
+		if calls < 3 {
+			return true, assert.AnError
+		}
+		return false, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	err = r.do(context.Background(), func() (bool, error) {
+		calls++
+		return false, assert.AnError
+	})
+	assert.ErrorIs(t, err, assert.AnError)
+	assert.Equal(t, 1, calls, "non-retryable errors are not retried")
+
+	calls = 0
+	err = r.do(context.Background(), func() (bool, error) {
+		calls++
+		return true, assert.AnError
+	})
+	assert.ErrorIs(t, err, assert.AnError)
+	assert.Equal(t, r.maxRetries+1, calls)
+}
+
+func TestHTTPTransportRetries(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	transport, err := newTransport(&agent.AgentConfig{
+		Transport:         agent.TransportHTTP,
+		Address:           server.Listener.Addr().String(),
+		RetryMax:          3,
+		RetryInitialDelay: time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+
+	err = transport.Send(context.Background(), []agent.Metric{{Name: "Alloc", Type: models.Gauge, Value: 1.0}})
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), requests.Load())
+}
+
+func TestGRPCTransport(t *testing.T) {
+	address, metricService := startGRPCServer(t, "secret")
+
+	transport, err := newTransport(&agent.AgentConfig{
+		Transport:   agent.TransportGRPC,
+		GRPCAddress: address,
+		Key:         "secret",
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+
+	// More metrics than fit in one stream message
+	metrics := []agent.Metric{{Name: "TotalMemory", Type: models.Gauge, Value: uint64(1024)}}
+	for i := 0; i < 2*streamChunkSize; i++ {
+		metrics = append(metrics, agent.Metric{Name: "PollCount", Type: models.Counter, Value: int64(1)})
+	}
+	require.NoError(t, transport.Send(context.Background(), metrics))
+
+	value, err := metricService.GetMetricByName(context.Background(), "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2*streamChunkSize), value)
+	value, err = metricService.GetMetricByName(context.Background(), "TotalMemory")
+	require.NoError(t, err)
+	assert.Equal(t, 1024.0, value)
+}
+
+func TestGRPCTransportWrongKey(t *testing.T) {
+	address, metricService := startGRPCServer(t, "secret")
+
+	transport, err := newGRPCTransport(address, "other", nil, testRetrier())
+	require.NoError(t, err)
+	defer transport.Close()
+
+	err = transport.Send(context.Background(), []agent.Metric{{Name: "PollCount", Type: models.Counter, Value: int64(1)}})
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), "attempts", "rejected signatures are not retried")
+
+	_, err = metricService.GetMetricByName(context.Background(), "PollCount")
+	assert.Error(t, err)
+}
+
+func TestGRPCTransportUnavailable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := listener.Addr().String()
+	listener.Close()
+
+	transport, err := newGRPCTransport(address, "", nil, testRetrier())
+	require.NoError(t, err)
+	defer transport.Close()
+
+	err = transport.Send(context.Background(), []agent.Metric{{Name: "PollCount", Type: models.Counter, Value: int64(1)}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to send metrics after 4 attempts")
+}
+
+// failingTransport fails the first fail sends and records the batches it delivered.
+type failingTransport struct {
+	fail int
+	sent [][]agent.Metric
+}
+
+// Send implements Transport.
+func (f *failingTransport) Send(ctx context.Context, metrics []agent.Metric) error {
+	if f.fail > 0 {
+		f.fail--
+		return assert.AnError
+	}
+	f.sent = append(f.sent, metrics)
+	return nil
+}
+
+// Close implements Transport.
+func (f *failingTransport) Close() error {
+	return nil
+}
+
+func TestWorkerCarriesCountersForward(t *testing.T) {
+	transport := &failingTransport{fail: 1}
+	aggregator := agent.NewAggregator(false)
+
+	send := func() {
+		jobs := make(chan []agent.Metric, 1)
+		jobs <- aggregator.Flush()
+		close(jobs)
+		worker(context.Background(), &sender{transport: transport, aggregator: aggregator}, jobs)
+	}
+
+	aggregator.Add([]agent.Metric{{Name: "PollCount", Type: models.Counter, Value: int64(1)}})
+	aggregator.Add([]agent.Metric{{Name: "PollCount", Type: models.Counter, Value: int64(1)}})
+	send()
+	assert.Empty(t, transport.sent)
+
+	aggregator.Add([]agent.Metric{{Name: "PollCount", Type: models.Counter, Value: int64(1)}})
+	send()
+	require.Len(t, transport.sent, 1)
+	assert.Equal(t, []agent.Metric{{Name: "PollCount", Type: models.Counter, Value: int64(3)}}, transport.sent[0])
+}
+
+func TestSenderSpoolsFailedBatches(t *testing.T) {
+	spool, err := agent.NewSpool(t.TempDir(), 0, 0)
+	require.NoError(t, err)
+	transport := &failingTransport{fail: 2}
+	aggregator := agent.NewAggregator(false)
+	s := &sender{transport: transport, aggregator: aggregator, spool: spool}
+
+	first := []agent.Metric{{Name: "PollCount", Type: models.Counter, Value: int64(1)}}
+	second := []agent.Metric{{Name: "PollCount", Type: models.Counter, Value: int64(2)}}
+	third := []agent.Metric{{Name: "PollCount", Type: models.Counter, Value: int64(3)}}
+
+	// The first batch fails and is spooled, the second is queued behind it and its replay fails
+	s.deliver(context.Background(), first)
+	s.deliver(context.Background(), second)
+	assert.Equal(t, 2, spool.Len())
+	assert.Empty(t, transport.sent)
+	assert.Empty(t, aggregator.Flush(), "spooled counters are not carried forward")
+
+	// Once the server is back, the spooled batches are sent before the new one
+	s.deliver(context.Background(), third)
+	assert.Equal(t, [][]agent.Metric{first, second, third}, transport.sent)
+	assert.Equal(t, 0, spool.Len())
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	after, ok := parseRetryAfter("120", now)
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Minute, after)
+
+	after, ok = parseRetryAfter(now.Add(time.Minute).Format(http.TimeFormat), now)
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, after)
+
+	_, ok = parseRetryAfter("soon", now)
+	assert.False(t, ok)
+	_, ok = parseRetryAfter("", now)
+	assert.False(t, ok)
+}
+
+func TestHTTPTransportRetryAfter(t *testing.T) {
+	var requests atomic.Int32
+	retryAfter := "0"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.Header().Set("Retry-After", retryAfter)
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	r := testRetrier()
+	r.breaker = agent.NewBreaker("test", 5, time.Minute)
+	transport := &httpTransport{client: server.Client(), url: server.URL, retrier: r}
+	metrics := []agent.Metric{{Name: "Alloc", Type: models.Gauge, Value: 1.0}}
+
+	// A short Retry-After is waited for and the request retried
+	require.NoError(t, transport.Send(context.Background(), metrics))
+	assert.Equal(t, int32(2), requests.Load())
+
+	// A Retry-After longer than the maximum backoff opens the breaker instead
+	requests.Store(0)
+	retryAfter = "60"
+	err := transport.Send(context.Background(), metrics)
+	require.Error(t, err)
+	assert.Equal(t, agent.BreakerOpen, r.breaker.State())
+
+	err = transport.Send(context.Background(), metrics)
+	assert.ErrorIs(t, err, agent.ErrBreakerOpen)
+	assert.Equal(t, int32(1), requests.Load(), "no request is made while the breaker is open")
+}
+
+func TestGRPCTransportRetryAfter(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	serverConfig := &config.ServerConfig{StoreInterval: 300, RateLimit: 0.1, RateBurst: 1}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	grpcServer := grpcserver.NewServer(logger.Sugar(), config.NewReloadable(serverConfig), service.NewMetricsService(repository.NewMemStorage()), &noopAuditLogger{}, nil).Register()
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	r := testRetrier()
+	r.breaker = agent.NewBreaker("test", 5, time.Minute)
+	transport, err := newGRPCTransport(listener.Addr().String(), "", nil, r)
+	require.NoError(t, err)
+	defer transport.Close()
+	metrics := []agent.Metric{{Name: "Alloc", Type: models.Gauge, Value: 1.0}}
+	require.NoError(t, transport.Send(context.Background(), metrics))
+
+	// The throttled stream reports the delay set by the server in the trailer
+	requests, err := prepareStreamRequests(metrics, "")
+	require.NoError(t, err)
+	after, err := transport.stream(context.Background(), requests)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Equal(t, 10*time.Second, after)
+
+	// The delay is longer than the maximum backoff, so the breaker is opened instead of waiting
+	err = transport.Send(context.Background(), metrics)
+	require.Error(t, err)
+	assert.Equal(t, agent.BreakerOpen, r.breaker.State())
+}
+
+func TestRetrierStopsWhenBreakerOpens(t *testing.T) {
+	r := testRetrier()
+	r.breaker = agent.NewBreaker("test", 2, time.Minute)
+
+	calls := 0
+	err := r.do(context.Background(), func() (bool, error) {
+		calls++
+		return true, assert.AnError
+	})
+	assert.ErrorIs(t, err, agent.ErrBreakerOpen)
+	assert.ErrorIs(t, err, assert.AnError)
+	assert.Equal(t, 2, calls)
+}
+
+func TestHTTPTransportEncryption(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	logger, _ := zap.NewDevelopment()
+	metricService := service.NewMetricsService(repository.NewMemStorage())
+	serverConfig := &config.ServerConfig{StoreInterval: 300, Key: "secret"}
+	server := httptest.NewServer(handler.Router(logger.Sugar(), config.NewReloadable(serverConfig), metricService, &noopAuditLogger{}, nil, privateKey, nil))
+	defer server.Close()
+
+	transport := &httpTransport{
+		client:    server.Client(),
+		url:       server.URL + "/updates",
+		key:       "secret",
+		retrier:   testRetrier(),
+		publicKey: &privateKey.PublicKey,
+	}
+	metrics := []agent.Metric{
+		{Name: "Alloc", Type: models.Gauge, Value: 1.5},
+		{Name: "PollCount", Type: models.Counter, Value: int64(3)},
+	}
+	require.NoError(t, transport.Send(context.Background(), metrics))
+
+	value, err := metricService.GetMetricByName(context.Background(), "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, value)
+	value, err = metricService.GetMetricByName(context.Background(), "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), value)
+
+	// A payload encrypted for another key is rejected
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	transport.publicKey = &otherKey.PublicKey
+	err = transport.Send(context.Background(), metrics)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "400")
+
+	// So is an unencrypted payload
+	transport.publicKey = nil
+	err = transport.Send(context.Background(), []agent.Metric{{Name: "Alloc", Type: models.Gauge, Value: 2.5}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "400")
+	value, err = metricService.GetMetricByName(context.Background(), "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, value)
+}
+
+func TestHTTPTransportTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	require.NoError(t, os.WriteFile(caFile, caPEM, 0600))
+
+	transport, err := newTransport(&agent.AgentConfig{
+		Transport: agent.TransportHTTP,
+		Address:   server.Listener.Addr().String(),
+		TLS:       true,
+		TLSCA:     caFile,
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+	assert.Equal(t, server.URL+"/updates", transport.(*httpTransport).url)
+	require.NoError(t, transport.Send(context.Background(), []agent.Metric{{Name: "Alloc", Type: models.Gauge, Value: 1.0}}))
+
+	// The server certificate is not trusted without the CA
+	transport, err = newTransport(&agent.AgentConfig{
+		Transport: agent.TransportHTTP,
+		Address:   server.Listener.Addr().String(),
+		TLS:       true,
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+	assert.Error(t, transport.Send(context.Background(), []agent.Metric{{Name: "Alloc", Type: models.Gauge, Value: 1.0}}))
+}
+
+func TestTransportsSendRealIP(t *testing.T) {
+	var realIP atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		realIP.Store(r.Header.Get(realIPHeader))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	transport, err := newTransport(&agent.AgentConfig{
+		Transport: agent.TransportHTTP,
+		Address:   server.Listener.Addr().String(),
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+	require.NoError(t, transport.Send(context.Background(), []agent.Metric{{Name: "Alloc", Type: models.Gauge, Value: 1.0}}))
+	assert.Equal(t, "127.0.0.1", realIP.Load())
+
+	logger, _ := zap.NewDevelopment()
+	serverConfig := &config.ServerConfig{StoreInterval: 300, TrustedSubnet: "127.0.0.0/8"}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	grpcServer := grpcserver.NewServer(logger.Sugar(), config.NewReloadable(serverConfig), service.NewMetricsService(repository.NewMemStorage()), &noopAuditLogger{}, nil).Register()
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	transport, err = newGRPCTransport(listener.Addr().String(), "", nil, testRetrier())
+	require.NoError(t, err)
+	defer transport.Close()
+	require.NoError(t, transport.Send(context.Background(), []agent.Metric{{Name: "Alloc", Type: models.Gauge, Value: 1.0}}),
+		"the server accepts the address reported in the metadata")
+}
@@ -3,25 +3,45 @@ package main
 
 import (
 	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"flag"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sync"
+	"syscall"
 	"time"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 
+	"github.com/Schera-ole/metrics/internal/alerting"
 	"github.com/Schera-ole/metrics/internal/audit"
 	"github.com/Schera-ole/metrics/internal/config"
+	"github.com/Schera-ole/metrics/internal/encryption"
+	"github.com/Schera-ole/metrics/internal/grpcserver"
 	"github.com/Schera-ole/metrics/internal/handler"
+	"github.com/Schera-ole/metrics/internal/history"
+	middlewareinternal "github.com/Schera-ole/metrics/internal/middleware"
 	"github.com/Schera-ole/metrics/internal/migration"
 	models "github.com/Schera-ole/metrics/internal/model"
 	"github.com/Schera-ole/metrics/internal/repository"
 	"github.com/Schera-ole/metrics/internal/service"
+	"github.com/Schera-ole/metrics/internal/tlsconfig"
 )
 
+// shutdownTimeout bounds draining requests and flushing the state on shutdown.
+const shutdownTimeout = 30 * time.Second
+
 var (
 	buildVersion string = "N/A"
 	buildDate    string = "N/A"
@@ -39,38 +59,112 @@ func main() {
 	if err != nil {
 		log.Fatal("Failed to parse configuration: ", err)
 	}
+	if serverConfig.PrintConfig {
+		if err := serverConfig.Dump(os.Stdout); err != nil {
+			log.Fatal("Failed to print configuration: ", err)
+		}
+		return
+	}
 
-	logger, err := zap.NewDevelopment()
+	logConfig := zap.NewDevelopmentConfig()
+	level, err := zapcore.ParseLevel(serverConfig.LogLevel)
+	if err != nil {
+		log.Fatal("Failed to parse log level: ", err)
+	}
+	logConfig.Level.SetLevel(level)
+	logger, err := logConfig.Build()
 	if err != nil {
 		log.Fatal("Failed to initialize zap logger: ", err)
 	}
 	defer logger.Sync()
 	logSugar := logger.Sugar()
 
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
+
+	// background tracks the periodic tasks, which stop when ctx is done
+	var background sync.WaitGroup
+
+	// subscribers tracks the audit and alert subscribers, which stop when their channels are closed
+	var subscribers sync.WaitGroup
+
 	// Create repository
 	var storage repository.Repository
 	var metricsService *service.MetricsService
 	if serverConfig.DatabaseDSN == "" {
-		storage = repository.NewMemStorage()
+		var memStorage repository.WALRepository = repository.NewMemStorage()
+		if serverConfig.StorageShards > 0 {
+			memStorage = repository.NewShardedStorage(serverConfig.StorageShards)
+		}
+		storage = memStorage
 		metricsService = service.NewMetricsService(storage)
+		metricsService.SetSnapshotGenerations(serverConfig.SnapshotGenerations)
+		metricsService.SetSnapshotFormat(serverConfig.SnapshotFormat)
 
 		dir := filepath.Dir(serverConfig.FileStoragePath)
 		if err := os.MkdirAll(dir, 0755); err != nil {
 			logSugar.Errorf("error creating directory: %w", err)
 		}
-		if serverConfig.Restore {
+
+		// The WAL holds every acknowledged update, so it replaces the storage file on restore
+		replayed := false
+		if serverConfig.WALPath != "" {
+			replayed, err = memStorage.ReplayWAL(serverConfig.WALPath)
+			if err != nil {
+				logSugar.Fatalf("Error replaying WAL: %v", err)
+			}
+			if replayed {
+				logSugar.Infof("Metrics restored from WAL %s", serverConfig.WALPath)
+			}
+		}
+		if serverConfig.Restore && !replayed {
 			restoreCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 			defer cancel()
 			metricsService.RestoreMetrics(restoreCtx, serverConfig.FileStoragePath, logSugar)
 		}
+		if serverConfig.WALPath != "" {
+			err = memStorage.OpenWAL(serverConfig.WALPath, repository.WALOptions{
+				SyncInterval: serverConfig.WALSyncInterval,
+				SyncBatch:    serverConfig.WALSyncBatch,
+			})
+			if err != nil {
+				logSugar.Fatalf("Error opening WAL: %v", err)
+			}
+
+			compactTicker := time.NewTicker(serverConfig.WALCompactInterval)
+			defer compactTicker.Stop()
+
+			background.Add(1)
+			go func() {
+				defer background.Done()
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case <-compactTicker.C:
+					}
+					if err := memStorage.Compact(); err != nil {
+						logSugar.Errorf("Error compacting WAL: %v", err)
+					}
+				}
+			}()
+		}
 		if serverConfig.StoreInterval == 0 {
-			// This will be handled in the UpdateHandler
+			// This will be handled in the UpdateHandler, or by the WAL
 		} else {
 			ticker := time.NewTicker(time.Duration(serverConfig.StoreInterval) * time.Second)
 			defer ticker.Stop()
 
+			background.Add(1)
 			go func() {
-				for range ticker.C {
+				defer background.Done()
+				for {
+					select {
+					case <-ctx.Done():
+						// The final save is made on shutdown
+						return
+					case <-ticker.C:
+					}
 					backupCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 					if err := metricsService.SaveMetrics(backupCtx, serverConfig.FileStoragePath); err != nil {
 						logSugar.Errorf("Error saving metrics: %v", err)
@@ -93,32 +187,131 @@ func main() {
 			logSugar.Fatalf("Error when open db connection: %v", err)
 		}
 		metricsService = service.NewMetricsService(storage)
-		defer storage.Close()
 	}
-	// Create event channel
+	if serverConfig.HistorySize > 0 {
+		metricsService.SetHistory(history.NewStore(serverConfig.HistorySize))
+	}
+
+	// Create alerting engine
+	var alertEngine *alerting.Engine
+	var alertChan chan []alerting.Alert
+	if serverConfig.AlertRulesFile != "" {
+		rules, err := alerting.LoadRules(serverConfig.AlertRulesFile)
+		if err != nil {
+			logSugar.Fatalf("Error loading alerting rules: %v", err)
+		}
+		alertEngine = alerting.NewEngine(metricsService, rules)
+		if len(serverConfig.AlertWebhooks) > 0 {
+			alertChan = make(chan []alerting.Alert, 100)
+			var subs []chan<- []alerting.Alert
+			for _, url := range serverConfig.AlertWebhooks {
+				webhookChan := make(chan []alerting.Alert, 50)
+				subs = append(subs, webhookChan)
+				subscribers.Add(1)
+				go func() {
+					defer subscribers.Done()
+					alerting.NewWebhook(url, logSugar).Run(webhookChan)
+				}()
+			}
+			go audit.Broadcaster(alertChan, subs...)
+			alertEngine.SetNotifications(alertChan)
+		}
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			alertEngine.Run(ctx, time.Duration(serverConfig.AlertInterval)*time.Second, logSugar)
+		}()
+		logSugar.Infof("Loaded %d alerting rules from %s", len(rules), serverConfig.AlertRulesFile)
+	}
+
+	// Create event channel. The audit sinks can be replaced on reload, so the events are
+	// broadcast even if auditing is disabled.
 	var eventChan = make(chan models.AuditEvent, 100)
-	if serverConfig.AuditFile != "" || serverConfig.AuditURL != "" {
-		var subs []chan<- models.AuditEvent
-		if serverConfig.AuditFile != "" {
-			fileChan := make(chan models.AuditEvent, 50)
-			subs = append(subs, fileChan)
-			go audit.FileSubscriber(fileChan, *serverConfig)
+	auditSubscribers := audit.NewSubscribers(auditSinks(serverConfig, &subscribers)...)
+	go audit.BroadcastTo(eventChan, auditSubscribers)
+	auditLogger := audit.NewAuditLogger(eventChan)
+
+	// Load the key for decrypting agent payloads
+	var privateKey *rsa.PrivateKey
+	if serverConfig.CryptoKey != "" {
+		privateKey, err = encryption.LoadPrivateKey(serverConfig.CryptoKey)
+		if err != nil {
+			logSugar.Fatalf("Error loading crypto key: %v", err)
 		}
-		if serverConfig.AuditURL != "" {
-			urlChan := make(chan models.AuditEvent, 50)
-			subs = append(subs, urlChan)
-			go audit.URLSubscriber(urlChan, *serverConfig)
+	}
+
+	// Load the TLS configuration
+	var tlsConfig *tls.Config
+	if serverConfig.TLSCert != "" {
+		tlsConfig, err = tlsconfig.NewServerConfig(
+			serverConfig.TLSCert,
+			serverConfig.TLSKey,
+			serverConfig.TLSClientCA,
+			serverConfig.TLSClientNames,
+		)
+		if err != nil {
+			logSugar.Fatalf("Error loading TLS configuration: %v", err)
 		}
-		go audit.Broadcaster(eventChan, subs...)
 	}
 
-	// Create audit logger
-	var auditLogger audit.AuditLogger
-	if serverConfig.AuditFile != "" || serverConfig.AuditURL != "" {
-		auditLogger = audit.NewAuditLogger(eventChan)
-	} else {
-		// Create a no-op audit logger if auditing is disabled
-		auditLogger = &noopAuditLogger{}
+	// Reload the config file on SIGHUP
+	liveConfig := config.NewReloadable(serverConfig)
+	// The HTTP and the gRPC API share the limits, so clients cannot double them by using both
+	limits := middlewareinternal.NewLimits(liveConfig)
+	reload := &reloader{
+		config: liveConfig,
+		load: func() (*config.ServerConfig, error) {
+			flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+			flags.SetOutput(io.Discard)
+			return config.LoadServerConfig(flags, os.Args[1:], os.LookupEnv)
+		},
+		logLevel:         logConfig.Level,
+		auditSubscribers: auditSubscribers,
+		subscribers:      &subscribers,
+		alertEngine:      alertEngine,
+		logger:           logSugar,
+	}
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hangup:
+			}
+			logSugar.Info("Reloading configuration")
+			if err := reload.reload(); err != nil {
+				logSugar.Errorf("Error reloading configuration, keeping the current one: %v", err)
+			}
+		}
+	}()
+
+	// Start gRPC API
+	var grpcAPI *grpcserver.Server
+	var grpcServer *grpc.Server
+	if serverConfig.GRPCAddress != "" {
+		listener, err := net.Listen("tcp", serverConfig.GRPCAddress)
+		if err != nil {
+			logSugar.Fatalf("Error listening on gRPC address: %v", err)
+		}
+		var opts []grpc.ServerOption
+		if tlsConfig != nil {
+			opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		} else if privateKey != nil {
+			logSugar.Warn("The gRPC API rejects updates without TLS when a crypto key is set")
+		}
+		grpcAPI = grpcserver.NewServer(logSugar, liveConfig, metricsService, auditLogger, limits)
+		grpcServer = grpcAPI.Register(opts...)
+		go func() {
+			if err := grpcServer.Serve(listener); err != nil {
+				logSugar.Errorf("gRPC server stopped: %v", err)
+			}
+		}()
+		logSugar.Infow("Starting gRPC server", "address", serverConfig.GRPCAddress)
 	}
 
 	logSugar.Infow(
@@ -127,20 +320,92 @@ func main() {
 		"storeInterval", serverConfig.StoreInterval,
 		"fileStoragePath", serverConfig.FileStoragePath,
 		"databaseDSN", serverConfig.DatabaseDSN,
+		"tls", tlsConfig != nil,
+		"mutualTLS", serverConfig.TLSClientCA != "",
+		"wal", serverConfig.WALPath,
+		"storageShards", serverConfig.StorageShards,
 	)
 
-	logSugar.Fatal(
-		http.ListenAndServe(
-			serverConfig.Address,
-			handler.Router(logSugar, serverConfig, metricsService, auditLogger),
-		),
-	)
-}
+	server := &http.Server{
+		Addr:      serverConfig.Address,
+		Handler:   handler.Router(logSugar, liveConfig, metricsService, auditLogger, alertEngine, privateKey, limits),
+		TLSConfig: tlsConfig,
+	}
+	serverErr := make(chan error, 1)
+	go func() {
+		if tlsConfig != nil {
+			// The certificates are already loaded into the TLS configuration
+			serverErr <- server.ListenAndServeTLS("", "")
+			return
+		}
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case <-ctx.Done():
+		logSugar.Info("Shutting down server")
+	case err := <-serverErr:
+		logSugar.Errorf("HTTP server stopped: %v", err)
+	}
+	stop()
 
-// noopAuditLogger is a no-op implementation of AuditLogger for when auditing is disabled.
-type noopAuditLogger struct{}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
 
-// Log implements the AuditLogger interface but does nothing.
-func (n *noopAuditLogger) Log(metrics []string, ipAddress string) {
-	// No-op implementation
+	// Stop accepting requests and wait for the running ones
+	drainedRequests := true
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logSugar.Errorf("Error shutting down HTTP server: %v", err)
+		drainedRequests = false
+	}
+	if grpcServer != nil {
+		grpcAPI.Shutdown()
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-shutdownCtx.Done():
+			grpcServer.Stop()
+			drainedRequests = false
+		}
+	}
+	background.Wait()
+
+	// No more updates can arrive, save the final state
+	if metricsService.IsMemStorage() {
+		if err := metricsService.SaveMetrics(shutdownCtx, serverConfig.FileStoragePath); err != nil {
+			logSugar.Errorf("Error saving metrics: %v", err)
+		} else {
+			logSugar.Info("Metrics saved to file")
+		}
+	}
+
+	// Let the subscribers deliver the pending events. Requests still running after a timeout
+	// may log audit events, so the channels are only closed once every request has finished.
+	if alertChan != nil {
+		close(alertChan)
+	}
+	if drainedRequests {
+		close(eventChan)
+	} else {
+		logSugar.Warn("Requests still running, pending audit events may be lost")
+	}
+	drained := make(chan struct{})
+	go func() {
+		subscribers.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-shutdownCtx.Done():
+		logSugar.Warn("Timed out waiting for audit and alert subscribers")
+	}
+
+	if err := storage.Close(); err != nil {
+		logSugar.Errorf("Error closing storage: %v", err)
+	}
+	logSugar.Info("Server stopped")
 }
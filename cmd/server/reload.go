@@ -0,0 +1,114 @@
+package main
+
+import (
+	"sync"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/Schera-ole/metrics/internal/alerting"
+	"github.com/Schera-ole/metrics/internal/audit"
+	"github.com/Schera-ole/metrics/internal/config"
+	models "github.com/Schera-ole/metrics/internal/model"
+)
+
+// reloader applies a reloaded configuration to the running server.
+type reloader struct {
+	// config is the configuration loaded by the request handlers
+	config *config.Reloadable
+
+	// load loads the configuration from the config file, the environment and the flags
+	load func() (*config.ServerConfig, error)
+
+	// logLevel is the level of the server log
+	logLevel zap.AtomicLevel
+
+	// auditSubscribers are the audit sinks receiving the audit events
+	auditSubscribers *audit.Subscribers[models.AuditEvent]
+
+	// subscribers tracks the audit sink goroutines
+	subscribers *sync.WaitGroup
+
+	// alertEngine evaluates the alerting rules, nil if alerting is disabled
+	alertEngine *alerting.Engine
+
+	// logger reports the reloads
+	logger *zap.SugaredLogger
+}
+
+// reload loads the configuration again and applies the options that can be changed without a
+// restart. If the configuration or the alerting rules are invalid, nothing is changed.
+func (r *reloader) reload() error {
+
+	next, err := r.load()
+	if err != nil {
+		return err
+	}
+	current := r.config.Load()
+	reloaded := current.Reload(next)
+
+	var rules []alerting.Rule
+	if r.alertEngine == nil {
+		if reloaded.AlertRulesFile != "" {
+			r.logger.Warn("Alerting was disabled on startup, enabling it requires a restart")
+		}
+		reloaded.AlertRulesFile = current.AlertRulesFile
+	} else if reloaded.AlertRulesFile != "" {
+		rules, err = alerting.LoadRules(reloaded.AlertRulesFile)
+		if err != nil {
+			return err
+		}
+	}
+	level, err := zapcore.ParseLevel(reloaded.LogLevel)
+	if err != nil {
+		return err
+	}
+
+	if reloaded.AuditFile != current.AuditFile || reloaded.AuditURL != current.AuditURL {
+		// The previous sinks write their pending events and exit
+		r.auditSubscribers.Swap(auditSinks(reloaded, r.subscribers)...)
+	}
+	r.logLevel.SetLevel(level)
+	r.config.Store(reloaded)
+	if r.alertEngine != nil {
+		r.alertEngine.SetRules(rules)
+	}
+	r.logger.Infow(
+		"Configuration reloaded",
+		"logLevel", reloaded.LogLevel,
+		"auditFile", reloaded.AuditFile,
+		"auditURL", reloaded.AuditURL,
+		"rateLimit", reloaded.RateLimit,
+		"rateBurst", reloaded.RateBurst,
+		"trustedSubnet", reloaded.TrustedSubnet,
+		"alertRules", len(rules),
+	)
+	return nil
+}
+
+// auditSinks starts the audit sinks configured in serverConfig and returns their channels.
+//
+// Every sink is tracked by subscribers until its channel is closed.
+func auditSinks(serverConfig *config.ServerConfig, subscribers *sync.WaitGroup) []chan<- models.AuditEvent {
+
+	var subs []chan<- models.AuditEvent
+	if serverConfig.AuditFile != "" {
+		fileChan := make(chan models.AuditEvent, 50)
+		subs = append(subs, fileChan)
+		subscribers.Add(1)
+		go func() {
+			defer subscribers.Done()
+			audit.FileSubscriber(fileChan, *serverConfig)
+		}()
+	}
+	if serverConfig.AuditURL != "" {
+		urlChan := make(chan models.AuditEvent, 50)
+		subs = append(subs, urlChan)
+		subscribers.Add(1)
+		go func() {
+			defer subscribers.Done()
+			audit.URLSubscriber(urlChan, *serverConfig)
+		}()
+	}
+	return subs
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/Schera-ole/metrics/internal/alerting"
+	"github.com/Schera-ole/metrics/internal/audit"
+	"github.com/Schera-ole/metrics/internal/config"
+	models "github.com/Schera-ole/metrics/internal/model"
+	"github.com/Schera-ole/metrics/internal/repository"
+	"github.com/Schera-ole/metrics/internal/service"
+)
+
+// writeRules writes an alerting rules file with a single rule named name.
+func writeRules(t *testing.T, dir, name string) string {
+	path := filepath.Join(dir, name+".yaml")
+	rules := "rules:\n  - name: " + name + "\n    metric: HeapAlloc\n    op: \">\"\n    threshold: 1\n"
+	require.NoError(t, os.WriteFile(path, []byte(rules), 0600))
+	return path
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	initial := &config.ServerConfig{
+		Address:        "localhost:8080",
+		Key:            "old",
+		LogLevel:       "debug",
+		AuditFile:      filepath.Join(dir, "old.log"),
+		AlertRulesFile: writeRules(t, dir, "Old"),
+	}
+	next := &config.ServerConfig{
+		Address:        "localhost:9090",
+		Key:            "new",
+		LogLevel:       "warn",
+		AuditFile:      filepath.Join(dir, "new.log"),
+		AlertRulesFile: writeRules(t, dir, "New"),
+		RateLimit:      10,
+		TrustedSubnet:  "10.0.0.0/8",
+	}
+
+	var subscribers sync.WaitGroup
+	events := make(chan models.AuditEvent)
+	auditSubscribers := audit.NewSubscribers(auditSinks(initial, &subscribers)...)
+	go audit.BroadcastTo(events, auditSubscribers)
+
+	rules, err := alerting.LoadRules(initial.AlertRulesFile)
+	require.NoError(t, err)
+	logger, _ := zap.NewDevelopment()
+	r := &reloader{
+		config:           config.NewReloadable(initial),
+		load:             func() (*config.ServerConfig, error) { return next, nil },
+		logLevel:         zap.NewAtomicLevelAt(zapcore.DebugLevel),
+		auditSubscribers: auditSubscribers,
+		subscribers:      &subscribers,
+		alertEngine:      alerting.NewEngine(service.NewMetricsService(repository.NewMemStorage()), rules),
+		logger:           logger.Sugar(),
+	}
+
+	events <- models.AuditEvent{Metrics: []string{"before"}}
+	require.NoError(t, r.reload())
+	events <- models.AuditEvent{Metrics: []string{"after"}}
+	close(events)
+	subscribers.Wait()
+
+	current := r.config.Load()
+	assert.Equal(t, "new", current.Key)
+	assert.Equal(t, 10.0, current.RateLimit)
+	assert.Equal(t, "10.0.0.0/8", current.TrustedSubnet)
+	assert.Equal(t, "localhost:8080", current.Address, "options requiring a restart are kept")
+	assert.Equal(t, zapcore.WarnLevel, r.logLevel.Level())
+	require.Len(t, r.alertEngine.Rules(), 1)
+	assert.Equal(t, "New", r.alertEngine.Rules()[0].Name)
+
+	before, err := os.ReadFile(initial.AuditFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(before), "before")
+	assert.NotContains(t, string(before), "after")
+	after, err := os.ReadFile(next.AuditFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(after), "after")
+}
+
+func TestReloadKeepsConfigOnError(t *testing.T) {
+	initial := &config.ServerConfig{Key: "old", LogLevel: "info", AlertRulesFile: writeRules(t, t.TempDir(), "Old")}
+	rules, err := alerting.LoadRules(initial.AlertRulesFile)
+	require.NoError(t, err)
+	logger, _ := zap.NewDevelopment()
+	r := &reloader{
+		config:           config.NewReloadable(initial),
+		logLevel:         zap.NewAtomicLevelAt(zapcore.InfoLevel),
+		auditSubscribers: audit.NewSubscribers[models.AuditEvent](),
+		subscribers:      &sync.WaitGroup{},
+		alertEngine:      alerting.NewEngine(service.NewMetricsService(repository.NewMemStorage()), rules),
+		logger:           logger.Sugar(),
+	}
+
+	r.load = func() (*config.ServerConfig, error) { return nil, errors.New("invalid config file") }
+	assert.Error(t, r.reload())
+
+	r.load = func() (*config.ServerConfig, error) {
+		return &config.ServerConfig{Key: "new", LogLevel: "info", AlertRulesFile: "missing.yaml"}, nil
+	}
+	assert.Error(t, r.reload(), "invalid rules fail the whole reload")
+
+	assert.Same(t, initial, r.config.Load())
+	assert.Equal(t, "Old", r.alertEngine.Rules()[0].Name)
+}
@@ -1,14 +1,16 @@
 // Package metrics implements a server for collecting and storing various system metrics.
 //
-// The server supports two types of metrics:
+// The server supports three types of metrics:
 //   - Gauge: represents float64 values, typically used for measuring things
 //   - Counter: represents int64 values, typically used for counting events or requests
+//   - Histogram: represents bucketed observations, typically used for latency distributions
 //
 // The server can store metrics in memory or in a PostgreSQL database. It also supports
 // periodic saving of metrics to a file for persistence when using in-memory storage.
 //
 // Features:
 //   - REST API for updating and retrieving metrics
+//   - gRPC API with streaming of metric updates
 //   - Support for batch updates
 //   - Data compression using gzip
 //   - Data integrity validation using HMAC SHA256 hashing
@@ -16,6 +18,8 @@
 //   - Structured logging
 //   - Profiling support via pprof
 //   - Audit logging to file or HTTP endpoint
+//   - In-memory time-series history with range queries
+//   - Alerting rules with threshold and absence conditions
 //
 // The server includes an agent component that collects system metrics.
 //
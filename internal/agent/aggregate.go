@@ -0,0 +1,167 @@
+package agent
+
+import (
+	"sort"
+	"sync"
+
+	models "github.com/Schera-ole/metrics/internal/model"
+)
+
+// Suffixes of the gauges reported for the optional gauge statistics.
+const (
+	MinSuffix = "_min"
+	MaxSuffix = "_max"
+	AvgSuffix = "_avg"
+)
+
+// aggregate is the accumulated state of one series between two reports.
+type aggregate struct {
+	// metric holds the name, type and labels of the series and its last value
+	metric Metric
+
+	// delta is the sum of the counter deltas polled since the last report
+	delta int64
+
+	// min is the smallest gauge value polled since the last report
+	min float64
+
+	// max is the largest gauge value polled since the last report
+	max float64
+
+	// sum is the sum of the gauge values polled since the last report
+	sum float64
+
+	// count is the number of polls since the last report
+	count int
+}
+
+// Aggregator accumulates polled metrics between two reports.
+//
+// Gauges keep their last value and counters the sum of their polled deltas. If stats
+// are enabled, every gauge is also reported with its minimum, maximum and average over
+// the report interval, as gauges named with MinSuffix, MaxSuffix and AvgSuffix.
+type Aggregator struct {
+	// mu provides thread-safe access to the series map
+	mu sync.Mutex
+
+	// stats enables the min, max and avg gauges
+	stats bool
+
+	// series stores the aggregate of each series key
+	series map[string]*aggregate
+}
+
+// NewAggregator creates an empty Aggregator. If stats is true, gauge statistics are reported as well.
+func NewAggregator(stats bool) *Aggregator {
+
+	return &Aggregator{
+		stats:  stats,
+		series: make(map[string]*aggregate),
+	}
+}
+
+// Add accumulates the metrics of one poll.
+//
+// Gauges with a value that is not a number are skipped.
+func (a *Aggregator) Add(metrics []Metric) {
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, metric := range metrics {
+		key := models.SeriesKey(metric.Name, metric.Labels)
+		agg, exists := a.series[key]
+		if !exists || agg.metric.Type != metric.Type {
+			agg = &aggregate{metric: Metric{Name: metric.Name, Type: metric.Type, Labels: metric.Labels}}
+			a.series[key] = agg
+		}
+
+		switch metric.Type {
+		case models.Gauge:
+			value, ok := gaugeValue(metric.Value)
+			if !ok {
+				continue
+			}
+			if agg.count == 0 || value < agg.min {
+				agg.min = value
+			}
+			if agg.count == 0 || value > agg.max {
+				agg.max = value
+			}
+			agg.sum += value
+			agg.metric.Value = value
+		case models.Counter:
+			delta, ok := metric.Value.(int64)
+			if !ok {
+				continue
+			}
+			agg.delta += delta
+			agg.metric.Value = agg.delta
+		default:
+			agg.metric.Value = metric.Value
+		}
+		agg.count++
+	}
+}
+
+// Requeue carries the counters of a batch that could not be sent forward to the next report.
+//
+// Their deltas are added to the counters polled since, so no polled delta is lost. A delta
+// is reported twice if the server stored the failed batch anyway, since delivery is at least
+// once. Gauges are dropped, newer polls replace them anyway.
+func (a *Aggregator) Requeue(metrics []Metric) {
+
+	counters := make([]Metric, 0, len(metrics))
+	for _, metric := range metrics {
+		if metric.Type == models.Counter {
+			counters = append(counters, metric)
+		}
+	}
+	a.Add(counters)
+}
+
+// Flush returns the aggregated metrics ordered by series and resets the aggregator.
+func (a *Aggregator) Flush() []Metric {
+
+	a.mu.Lock()
+	series := a.series
+	a.series = make(map[string]*aggregate)
+	a.mu.Unlock()
+
+	keys := make([]string, 0, len(series))
+	for key, agg := range series {
+		if agg.count > 0 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	metrics := make([]Metric, 0, len(keys))
+	for _, key := range keys {
+		agg := series[key]
+		metrics = append(metrics, agg.metric)
+		if a.stats && agg.metric.Type == models.Gauge {
+			metrics = append(metrics,
+				Metric{Name: agg.metric.Name + MinSuffix, Type: models.Gauge, Value: agg.min, Labels: agg.metric.Labels},
+				Metric{Name: agg.metric.Name + MaxSuffix, Type: models.Gauge, Value: agg.max, Labels: agg.metric.Labels},
+				Metric{Name: agg.metric.Name + AvgSuffix, Type: models.Gauge, Value: agg.sum / float64(agg.count), Labels: agg.metric.Labels},
+			)
+		}
+	}
+	return metrics
+}
+
+// gaugeValue converts a polled gauge value to float64.
+func gaugeValue(value any) (float64, bool) {
+
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case uint64:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
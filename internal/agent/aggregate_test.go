@@ -0,0 +1,76 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	models "github.com/Schera-ole/metrics/internal/model"
+)
+
+func TestAggregator(t *testing.T) {
+	aggregator := NewAggregator(false)
+	aggregator.Add([]Metric{
+		{Name: "Alloc", Type: models.Gauge, Value: uint64(10)},
+		{Name: "PollCount", Type: models.Counter, Value: int64(1)},
+	})
+	aggregator.Add([]Metric{
+		{Name: "Alloc", Type: models.Gauge, Value: uint64(30)},
+		{Name: "PollCount", Type: models.Counter, Value: int64(1)},
+		{Name: "RandomValue", Type: models.Gauge, Value: 0.5},
+	})
+
+	assert.Equal(t, []Metric{
+		{Name: "Alloc", Type: models.Gauge, Value: 30.0},
+		{Name: "PollCount", Type: models.Counter, Value: int64(2)},
+		{Name: "RandomValue", Type: models.Gauge, Value: 0.5},
+	}, aggregator.Flush())
+
+	assert.Empty(t, aggregator.Flush(), "flush resets the aggregate")
+}
+
+func TestAggregatorStats(t *testing.T) {
+	aggregator := NewAggregator(true)
+	labels := map[string]string{"cpu": "0"}
+	for _, value := range []float64{20, 10, 60} {
+		aggregator.Add([]Metric{{Name: "CPUutilization", Type: models.Gauge, Value: value, Labels: labels}})
+	}
+	aggregator.Add([]Metric{{Name: "PollCount", Type: models.Counter, Value: int64(1)}})
+
+	assert.Equal(t, []Metric{
+		{Name: "CPUutilization", Type: models.Gauge, Value: 60.0, Labels: labels},
+		{Name: "CPUutilization_min", Type: models.Gauge, Value: 10.0, Labels: labels},
+		{Name: "CPUutilization_max", Type: models.Gauge, Value: 60.0, Labels: labels},
+		{Name: "CPUutilization_avg", Type: models.Gauge, Value: 30.0, Labels: labels},
+		{Name: "PollCount", Type: models.Counter, Value: int64(1)},
+	}, aggregator.Flush())
+}
+
+func TestAggregatorSkipsInvalidValues(t *testing.T) {
+	aggregator := NewAggregator(false)
+	aggregator.Add([]Metric{
+		{Name: "Alloc", Type: models.Gauge, Value: "not a number"},
+		{Name: "PollCount", Type: models.Counter, Value: 1.5},
+	})
+	assert.Empty(t, aggregator.Flush())
+}
+
+func TestAggregatorRequeue(t *testing.T) {
+	aggregator := NewAggregator(false)
+	aggregator.Add([]Metric{
+		{Name: "Alloc", Type: models.Gauge, Value: 1.0},
+		{Name: "PollCount", Type: models.Counter, Value: int64(3)},
+	})
+	failed := aggregator.Flush()
+
+	aggregator.Add([]Metric{
+		{Name: "Alloc", Type: models.Gauge, Value: 2.0},
+		{Name: "PollCount", Type: models.Counter, Value: int64(2)},
+	})
+	aggregator.Requeue(failed)
+
+	assert.Equal(t, []Metric{
+		{Name: "Alloc", Type: models.Gauge, Value: 2.0},
+		{Name: "PollCount", Type: models.Counter, Value: int64(5)},
+	}, aggregator.Flush())
+}
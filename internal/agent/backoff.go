@@ -0,0 +1,43 @@
+package agent
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff computes exponentially growing delays between retries.
+type Backoff struct {
+	// Initial is the delay before the first retry
+	Initial time.Duration
+
+	// Max caps the delay before jitter is applied
+	Max time.Duration
+
+	// Multiplier is the factor applied to the delay after every retry
+	Multiplier float64
+
+	// Jitter is the fraction by which every delay is randomly shortened or lengthened,
+	// so that agents failing at the same time do not retry in lockstep
+	Jitter float64
+}
+
+// Delay returns the delay before the given retry, starting at 1.
+func (b Backoff) Delay(retry int) time.Duration {
+
+	if retry < 1 {
+		retry = 1
+	}
+	multiplier := b.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	delay := float64(b.Initial) * math.Pow(multiplier, float64(retry-1))
+	if b.Max > 0 && delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+	if b.Jitter > 0 {
+		delay *= 1 - b.Jitter + 2*b.Jitter*rand.Float64()
+	}
+	return time.Duration(delay)
+}
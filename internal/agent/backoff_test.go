@@ -0,0 +1,23 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{Initial: time.Second, Max: 5 * time.Second, Multiplier: 2}
+	assert.Equal(t, time.Second, b.Delay(1))
+	assert.Equal(t, 2*time.Second, b.Delay(2))
+	assert.Equal(t, 4*time.Second, b.Delay(3))
+	assert.Equal(t, 5*time.Second, b.Delay(4), "delays are capped")
+
+	b.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		delay := b.Delay(2)
+		assert.GreaterOrEqual(t, delay, time.Second)
+		assert.LessOrEqual(t, delay, 3*time.Second)
+	}
+}
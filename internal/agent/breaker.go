@@ -0,0 +1,159 @@
+package agent
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrBreakerOpen is returned by Breaker.Allow while requests are not allowed.
+var ErrBreakerOpen = errors.New("circuit breaker is open")
+
+// Circuit breaker states.
+const (
+	// BreakerClosed lets every request through.
+	BreakerClosed = "closed"
+
+	// BreakerOpen rejects every request until the cooldown has passed.
+	BreakerOpen = "open"
+
+	// BreakerHalfOpen lets a single probe request through to test whether the server has recovered.
+	BreakerHalfOpen = "half-open"
+)
+
+// Breaker is a circuit breaker that stops requests to a failing server.
+//
+// It opens after Threshold consecutive failures and rejects requests for the cooldown.
+// After that a single probe is let through: if it succeeds the breaker closes, otherwise
+// it opens again. Every state change is logged.
+type Breaker struct {
+	// name identifies the breaker in logs
+	name string
+
+	// threshold is the number of consecutive failures that opens the breaker
+	threshold int
+
+	// cooldown is how long the breaker stays open before probing
+	cooldown time.Duration
+
+	// now returns the current time
+	now func() time.Time
+
+	// mu provides thread-safe access to the state
+	mu sync.Mutex
+
+	// state is one of closed, open or half-open
+	state string
+
+	// failures is the number of consecutive failures
+	failures int
+
+	// openUntil is when an open breaker lets the next probe through
+	openUntil time.Time
+
+	// probing is set while the half-open probe is in flight
+	probing bool
+}
+
+// NewBreaker creates a closed Breaker named name.
+func NewBreaker(name string, threshold int, cooldown time.Duration) *Breaker {
+
+	return &Breaker{
+		name:      name,
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+		state:     BreakerClosed,
+	}
+}
+
+// State returns the current state of the breaker.
+func (b *Breaker) State() string {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Allow reports whether a request may be made now.
+//
+// It returns ErrBreakerOpen while the breaker is open, and while the probe of a half-open
+// breaker is in flight. The caller must report the result with Success or Failure.
+func (b *Breaker) Allow() error {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if b.now().Before(b.openUntil) {
+			return ErrBreakerOpen
+		}
+		b.setState(BreakerHalfOpen, "cooldown elapsed, probing")
+		b.probing = true
+		return nil
+	case BreakerHalfOpen:
+		if b.probing {
+			return ErrBreakerOpen
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// Success records a request that reached the server.
+func (b *Breaker) Success() {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.probing = false
+	if b.state != BreakerClosed {
+		b.setState(BreakerClosed, "request succeeded")
+	}
+}
+
+// Failure records a request that failed because the server was unavailable.
+func (b *Breaker) Failure() {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.probing = false
+	switch {
+	case b.state == BreakerHalfOpen:
+		b.open(b.cooldown, "probe failed")
+	case b.state == BreakerClosed && b.failures >= b.threshold:
+		b.open(b.cooldown, "too many consecutive failures")
+	}
+}
+
+// Trip opens the breaker for at least d, for example when the server asks to retry later.
+func (b *Breaker) Trip(d time.Duration) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if b.state == BreakerOpen && b.openUntil.After(b.now().Add(d)) {
+		return
+	}
+	b.open(d, "server asked to retry later")
+}
+
+// open moves the breaker to the open state for d. The caller must hold mu.
+func (b *Breaker) open(d time.Duration, reason string) {
+
+	b.openUntil = b.now().Add(d)
+	b.setState(BreakerOpen, reason)
+}
+
+// setState changes the state and logs the transition. The caller must hold mu.
+func (b *Breaker) setState(state string, reason string) {
+
+	if b.state == BreakerOpen && state == BreakerOpen {
+		log.Printf("Circuit breaker %s: open until %s (%s)", b.name, b.openUntil.Format(time.RFC3339), reason)
+		return
+	}
+	log.Printf("Circuit breaker %s: %s -> %s (%s)", b.name, b.state, state, reason)
+	b.state = state
+}
@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testBreaker returns a breaker whose clock is controlled by the returned function.
+func testBreaker(threshold int, cooldown time.Duration) (*Breaker, func(time.Duration)) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := NewBreaker("test", threshold, cooldown)
+	b.now = func() time.Time { return now }
+	return b, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestBreaker(t *testing.T) {
+	b, advance := testBreaker(2, time.Minute)
+
+	require.NoError(t, b.Allow())
+	b.Failure()
+	assert.Equal(t, BreakerClosed, b.State())
+	require.NoError(t, b.Allow())
+	b.Failure()
+	assert.Equal(t, BreakerOpen, b.State())
+	assert.ErrorIs(t, b.Allow(), ErrBreakerOpen)
+
+	// After the cooldown a single probe is allowed
+	advance(time.Minute)
+	require.NoError(t, b.Allow())
+	assert.Equal(t, BreakerHalfOpen, b.State())
+	assert.ErrorIs(t, b.Allow(), ErrBreakerOpen)
+
+	// A failed probe opens the breaker again
+	b.Failure()
+	assert.Equal(t, BreakerOpen, b.State())
+	assert.ErrorIs(t, b.Allow(), ErrBreakerOpen)
+
+	// A successful probe closes it
+	advance(time.Minute)
+	require.NoError(t, b.Allow())
+	b.Success()
+	assert.Equal(t, BreakerClosed, b.State())
+	require.NoError(t, b.Allow())
+}
+
+func TestBreakerSuccessResetsFailures(t *testing.T) {
+	b, _ := testBreaker(2, time.Minute)
+	b.Failure()
+	b.Success()
+	b.Failure()
+	assert.Equal(t, BreakerClosed, b.State())
+}
+
+func TestBreakerTrip(t *testing.T) {
+	b, advance := testBreaker(5, time.Second)
+	b.Trip(time.Minute)
+	assert.Equal(t, BreakerOpen, b.State())
+
+	advance(30 * time.Second)
+	assert.ErrorIs(t, b.Allow(), ErrBreakerOpen)
+
+	// A shorter trip does not shorten the open period
+	b.Trip(time.Second)
+	advance(time.Second)
+	assert.ErrorIs(t, b.Allow(), ErrBreakerOpen)
+
+	advance(30 * time.Second)
+	assert.NoError(t, b.Allow())
+}
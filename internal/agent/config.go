@@ -3,16 +3,23 @@ package agent
 
 import (
 	"flag"
-	"fmt"
+	"io"
 	"os"
-	"strconv"
+	"time"
+
+	"github.com/Schera-ole/metrics/internal/options"
 )
 
 // AgentConfig holds the configuration settings for the metrics collection agent.
 type AgentConfig struct {
 	// ReportInterval is the interval in seconds between reports to the server.
+	// Metrics polled in between are aggregated and sent once per report.
 	ReportInterval int
 
+	// AggregateStats enables reporting the minimum, maximum and average of every gauge
+	// over the report interval.
+	AggregateStats bool
+
 	// PollInterval is the interval in seconds between metric collections.
 	PollInterval int
 
@@ -24,54 +31,189 @@ type AgentConfig struct {
 
 	// RateLimit is the maximum number of concurrent requests to the server.
 	RateLimit int
+
+	// Transport is the protocol used to send metrics, either "http" or "grpc".
+	Transport string
+
+	// GRPCAddress is the host:port combination of the server's gRPC API, used by the grpc transport.
+	GRPCAddress string
+
+	// SpoolDir is the directory where batches that could not be sent are queued until
+	// the server is reachable again. If empty, the spool is disabled.
+	SpoolDir string
+
+	// SpoolMaxBytes is the maximum total size in bytes of the spooled batches, 0 for no limit.
+	SpoolMaxBytes int
+
+	// SpoolMaxAge is the maximum age in seconds of a spooled batch, 0 for no limit.
+	SpoolMaxAge int
+
+	// RetryMax is the number of retries after the first failed attempt to send a batch.
+	RetryMax int
+
+	// RetryInitialDelay is the delay before the first retry, doubled after every retry.
+	RetryInitialDelay time.Duration
+
+	// RetryMaxDelay caps the delay between retries.
+	RetryMaxDelay time.Duration
+
+	// RetryJitter is the fraction by which retry delays are randomized.
+	RetryJitter float64
+
+	// BreakerThreshold is the number of consecutive failed attempts that opens the circuit breaker.
+	// If 0, the circuit breaker is disabled.
+	BreakerThreshold int
+
+	// BreakerCooldown is how long the circuit breaker stays open before probing the server.
+	BreakerCooldown time.Duration
+
+	// CryptoKey is the path to the PEM file with the server's RSA public key used to
+	// encrypt payloads of the http transport. If empty, payloads are not encrypted.
+	CryptoKey string
+
+	// TLS enables TLS for connections to the server. It is implied by the other TLS settings.
+	TLS bool
+
+	// TLSCA is the path to the PEM file with the CA that signs the server certificate.
+	// If empty, the system roots are used.
+	TLSCA string
+
+	// TLSCert is the path to the PEM file with the client certificate presented to
+	// servers requiring mutual TLS. Its common name identifies the agent.
+	TLSCert string
+
+	// TLSKey is the path to the PEM file with the private key of the client certificate.
+	TLSKey string
+
+	// PrintConfig is set when the effective configuration should be printed instead of
+	// starting the agent.
+	PrintConfig bool
 }
 
-// NewAgentConfig creates a new AgentConfig with default values and parses
-// command-line flags and environment variables.
+// Supported transports.
+const (
+	// TransportHTTP sends gzip compressed JSON batches to the /updates endpoint.
+	TransportHTTP = "http"
+
+	// TransportGRPC streams batches to the StreamMetrics RPC.
+	TransportGRPC = "grpc"
+)
+
+// NewAgentConfig creates a new AgentConfig with default values and loads the config file,
+// environment variables and command-line flags.
 func NewAgentConfig() (*AgentConfig, error) {
 
+	return LoadAgentConfig(flag.CommandLine, os.Args[1:], os.LookupEnv)
+}
+
+// LoadAgentConfig creates a new AgentConfig with default values, registers its flags in
+// flags and loads the options from args, the config file and the environment.
+//
+// Later sources override earlier ones: defaults < config file < environment < flags.
+func LoadAgentConfig(flags *flag.FlagSet, args []string, lookupEnv options.LookupEnv) (*AgentConfig, error) {
+
 	config := &AgentConfig{
-		// ReportInterval: 10,
-		PollInterval: 2,
-		Address:      "localhost:8080",
-		Key:          "",
-		RateLimit:    5,
+		ReportInterval:    10,
+		AggregateStats:    false,
+		PollInterval:      2,
+		Address:           "localhost:8080",
+		Key:               "",
+		RateLimit:         5,
+		Transport:         TransportHTTP,
+		GRPCAddress:       "localhost:3200",
+		SpoolDir:          "",
+		SpoolMaxBytes:     64 << 20,
+		SpoolMaxAge:       3600,
+		RetryMax:          3,
+		RetryInitialDelay: 1 * time.Second,
+		RetryMaxDelay:     5 * time.Second,
+		RetryJitter:       0.2,
+		BreakerThreshold:  5,
+		BreakerCooldown:   30 * time.Second,
+		CryptoKey:         "",
+		TLS:               false,
+		TLSCA:             "",
+		TLSCert:           "",
+		TLSKey:            "",
 	}
-
-	pollInterval := flag.Int("p", 2, "The frequency of polling metrics from the package")
-	address := flag.String("a", "localhost:8080", "Address for sending metrics")
-	key := flag.String("k", "", "Key for hash")
-	rateLimit := flag.Int("l", 5, "Rate limit")
-	flag.Parse()
-	envIntVars := map[string]*int{
-		"POLL_INTERVAL": pollInterval,
-		"RATE_LIMIT":    rateLimit,
+	set := config.options(flags)
+	if err := set.Load(args, lookupEnv); err != nil {
+		return nil, err
 	}
-
-	envStrVars := map[string]*string{
-		"ADDRESS": address,
-		"KEY":     key,
+	config.TLS = config.TLS || config.TLSCA != "" || config.TLSCert != ""
+	if err := config.Validate(); err != nil {
+		return nil, err
 	}
+	config.PrintConfig = set.PrintRequested()
+	return config, nil
+}
 
-	for envVar, flag := range envIntVars {
-		if envValue := os.Getenv(envVar); envValue != "" {
-			interval, err := strconv.Atoi(envValue)
-			if err != nil {
-				return nil, fmt.Errorf("invalid %s value: %s", envVar, envValue)
-			}
-			*flag = interval
-		}
-	}
+// options registers the configuration options of the agent in flags.
+//
+// The config file key of every option is its environment variable in lower case.
+func (c *AgentConfig) options(flags *flag.FlagSet) *options.Set {
+
+	set := options.NewSet(flags)
+	set.Int(&c.ReportInterval, "report_interval", "r", "The frequency of sending metrics to the server")
+	set.Bool(&c.AggregateStats, "aggregate_stats", "aggregate-stats", "Report min, max and avg of gauges over the report interval")
+	set.Int(&c.PollInterval, "poll_interval", "p", "The frequency of polling metrics from the package")
+	set.String(&c.Address, "address", "a", "Address for sending metrics")
+	set.Secret(&c.Key, "key", "k", "Key for hash")
+	set.Int(&c.RateLimit, "rate_limit", "l", "Rate limit")
+	set.String(&c.Transport, "transport", "transport", "Transport for sending metrics: http or grpc")
+	set.String(&c.GRPCAddress, "grpc_address", "grpc-address", "Address of the gRPC API for the grpc transport")
+	set.String(&c.SpoolDir, "spool_dir", "spool-dir", "Directory for batches that could not be sent, empty disables the spool")
+	set.Int(&c.SpoolMaxBytes, "spool_max_bytes", "spool-max-bytes", "Maximum size of the spool in bytes")
+	set.Int(&c.SpoolMaxAge, "spool_max_age", "spool-max-age", "Maximum age of a spooled batch in seconds")
+	set.Int(&c.RetryMax, "retry_max", "retry-max", "Number of retries of a failed send")
+	set.Duration(&c.RetryInitialDelay, "retry_initial_delay", "retry-initial-delay", "Delay before the first retry")
+	set.Duration(&c.RetryMaxDelay, "retry_max_delay", "retry-max-delay", "Maximum delay between retries")
+	set.Float64(&c.RetryJitter, "retry_jitter", "retry-jitter", "Fraction by which retry delays are randomized")
+	set.Int(&c.BreakerThreshold, "breaker_threshold", "breaker-threshold", "Consecutive failures that open the circuit breaker, 0 disables it")
+	set.Duration(&c.BreakerCooldown, "breaker_cooldown", "breaker-cooldown", "Time the circuit breaker stays open before probing")
+	set.String(&c.CryptoKey, "crypto_key", "crypto-key", "Path to the server's public key for encrypting payloads")
+	set.Bool(&c.TLS, "tls", "tls", "Connect to the server with TLS")
+	set.String(&c.TLSCA, "tls_ca", "tls-ca", "Path to the CA of the server certificate")
+	set.String(&c.TLSCert, "tls_cert", "tls-cert", "Path to the client certificate for mutual TLS")
+	set.String(&c.TLSKey, "tls_key", "tls-key", "Path to the client certificate key")
+	return set
+}
+
+// Validate checks the option values. Its errors name the config file key of the invalid option.
+func (c *AgentConfig) Validate() error {
 
-	for envVar, flag := range envStrVars {
-		if envValue := os.Getenv(envVar); envValue != "" {
-			*flag = envValue
-		}
+	if c.PollInterval <= 0 {
+		return options.Invalid("poll_interval", "must be positive, got %d", c.PollInterval)
 	}
-	config.Address = *address
-	config.PollInterval = *pollInterval
-	config.RateLimit = *rateLimit
-	config.Key = *key
+	if c.ReportInterval <= 0 {
+		return options.Invalid("report_interval", "must be positive, got %d", c.ReportInterval)
+	}
+	if c.RateLimit <= 0 {
+		return options.Invalid("rate_limit", "must be positive, got %d", c.RateLimit)
+	}
+	if c.RetryMax < 0 {
+		return options.Invalid("retry_max", "must not be negative, got %d", c.RetryMax)
+	}
+	if c.RetryJitter < 0 || c.RetryJitter > 1 {
+		return options.Invalid("retry_jitter", "must be between 0 and 1, got %v", c.RetryJitter)
+	}
+	if c.Transport != TransportHTTP && c.Transport != TransportGRPC {
+		return options.Invalid("transport", "must be %s or %s, got %q", TransportHTTP, TransportGRPC, c.Transport)
+	}
+	if c.CryptoKey != "" && c.Transport != TransportHTTP {
+		return options.Invalid("crypto_key", "is only supported by the %s transport", TransportHTTP)
+	}
+	if c.TLSCert == "" && c.TLSKey != "" {
+		return options.Invalid("tls_cert", "must be set together with tls_key")
+	}
+	if c.TLSCert != "" && c.TLSKey == "" {
+		return options.Invalid("tls_key", "must be set together with tls_cert")
+	}
+	return nil
+}
 
-	return config, nil
+// Dump writes the configuration as a JSON config file, with secrets hidden.
+func (c *AgentConfig) Dump(w io.Writer) error {
+
+	return c.options(flag.NewFlagSet("dump", flag.ContinueOnError)).Dump(w)
 }
@@ -0,0 +1,46 @@
+package agent
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// loadTestConfig loads an AgentConfig from args and env with a new flag set.
+func loadTestConfig(args []string, env map[string]string) (*AgentConfig, error) {
+	flags := flag.NewFlagSet("agent", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	return LoadAgentConfig(flags, args, func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	})
+}
+
+func TestLoadAgentConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("address: file:8080\npoll_interval: 1\nretry_max_delay: 10s\ntls_ca: ca.pem\n"), 0600))
+
+	config, err := loadTestConfig([]string{"-a", "flag:8080"}, map[string]string{"CONFIG": path, "POLL_INTERVAL": "3"})
+	require.NoError(t, err)
+	assert.Equal(t, "flag:8080", config.Address)
+	assert.Equal(t, 3, config.PollInterval)
+	assert.Equal(t, 10*time.Second, config.RetryMaxDelay)
+	assert.True(t, config.TLS, "a CA in the config file enables TLS")
+	assert.Equal(t, 10, config.ReportInterval, "options missing everywhere keep their defaults")
+}
+
+func TestLoadAgentConfigInvalid(t *testing.T) {
+	_, err := loadTestConfig([]string{"-transport", "udp"}, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "transport")
+
+	_, err = loadTestConfig(nil, map[string]string{"RATE_LIMIT": "0"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "rate_limit")
+}
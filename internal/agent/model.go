@@ -9,8 +9,11 @@ type Metric struct {
 	// Type is the type of the metric (either "counter" or "gauge")
 	Type string
 
-	// Value is the metric value (int64 for counters, float64 for gauges)
+	// Value is the metric value (int64 delta since the previous poll for counters, float64 for gauges)
 	Value any
+
+	// Labels are optional dimensions that, together with Name, identify a series
+	Labels map[string]string
 }
 
 var (
@@ -0,0 +1,292 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	models "github.com/Schera-ole/metrics/internal/model"
+)
+
+// segmentExt is the extension of spool segment files.
+const segmentExt = ".json"
+
+// segmentMetric is the encoding of a metric in a spool segment.
+type segmentMetric struct {
+	Name   string            `json:"name"`
+	Type   string            `json:"type"`
+	Delta  *int64            `json:"delta,omitempty"`
+	Value  *float64          `json:"value,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// segment is a spooled batch on disk.
+type segment struct {
+	seq     uint64
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// Spool is a disk-backed FIFO queue of batches that could not be sent.
+//
+// Every batch is written to its own segment file, named by an increasing sequence
+// number, and replayed in that order. Segments older than the maximum age are dropped,
+// and the oldest segments are dropped while the spool exceeds its maximum size.
+type Spool struct {
+	// dir is the directory holding the segment files
+	dir string
+
+	// maxBytes caps the total size of the segments, 0 for no limit
+	maxBytes int64
+
+	// maxAge caps the age of a segment, 0 for no limit
+	maxAge time.Duration
+
+	// mu provides thread-safe access to the segment files and nextSeq
+	mu sync.Mutex
+
+	// nextSeq is the sequence number of the next segment
+	nextSeq uint64
+
+	// replayMu ensures that a single replay runs at a time
+	replayMu sync.Mutex
+}
+
+// NewSpool opens the spool in dir, creating the directory if needed.
+//
+// Segments left by a previous run are kept and replayed first.
+func NewSpool(dir string, maxBytes int64, maxAge time.Duration) (*Spool, error) {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating spool directory: %w", err)
+	}
+	s := &Spool{dir: dir, maxBytes: maxBytes, maxAge: maxAge, nextSeq: 1}
+
+	// Remove segments whose write was interrupted
+	tmpFiles, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if err != nil {
+		return nil, err
+	}
+	for _, tmp := range tmpFiles {
+		os.Remove(tmp)
+	}
+
+	segments, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) > 0 {
+		s.nextSeq = segments[len(segments)-1].seq + 1
+	}
+	return s, nil
+}
+
+// segments returns the segments on disk ordered by sequence number.
+func (s *Spool) segments() ([]segment, error) {
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading spool directory: %w", err)
+	}
+	var segments []segment
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment{
+			seq:     seq,
+			path:    filepath.Join(s.dir, name),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].seq < segments[j].seq
+	})
+	return segments, nil
+}
+
+// Len returns the number of spooled batches.
+func (s *Spool) Len() int {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	segments, err := s.segments()
+	if err != nil {
+		return 0
+	}
+	return len(segments)
+}
+
+// Write appends a batch to the spool and applies the size and age limits.
+func (s *Spool) Write(metrics []Metric) error {
+
+	encoded := make([]segmentMetric, 0, len(metrics))
+	for _, metric := range metrics {
+		m := segmentMetric{Name: metric.Name, Type: metric.Type, Labels: metric.Labels}
+		switch metric.Type {
+		case models.Counter:
+			delta, ok := metric.Value.(int64)
+			if !ok {
+				continue
+			}
+			m.Delta = &delta
+		case models.Gauge:
+			value, ok := gaugeValue(metric.Value)
+			if !ok {
+				continue
+			}
+			m.Value = &value
+		default:
+			continue
+		}
+		encoded = append(encoded, m)
+	}
+	data, err := json.Marshal(encoded)
+	if err != nil {
+		return fmt.Errorf("error encoding spool segment: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d%s", s.nextSeq, segmentExt))
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error writing spool segment: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error writing spool segment: %w", err)
+	}
+	s.nextSeq++
+	return s.enforceLimits()
+}
+
+// enforceLimits drops the segments over the age limit and the oldest segments over the size limit.
+//
+// The caller must hold mu.
+func (s *Spool) enforceLimits() error {
+
+	segments, err := s.segments()
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, seg := range segments {
+		total += seg.size
+	}
+
+	now := time.Now()
+	dropped := 0
+	for _, seg := range segments {
+		expired := s.maxAge > 0 && now.Sub(seg.modTime) > s.maxAge
+		oversized := s.maxBytes > 0 && total > s.maxBytes
+		if !expired && !oversized {
+			break
+		}
+		if err := os.Remove(seg.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("error removing spool segment: %w", err)
+		}
+		total -= seg.size
+		dropped++
+	}
+	if dropped > 0 {
+		log.Printf("Spool: dropped %d segments over the size or age limit", dropped)
+	}
+	return nil
+}
+
+// Replay sends the spooled batches in order, removing every batch that was sent.
+//
+// It stops at the first batch send fails for and returns that error. If another replay
+// is already running, Replay returns immediately. Segments that cannot be decoded are dropped.
+func (s *Spool) Replay(send func([]Metric) error) (int, error) {
+
+	if !s.replayMu.TryLock() {
+		return 0, nil
+	}
+	defer s.replayMu.Unlock()
+
+	s.mu.Lock()
+	err := s.enforceLimits()
+	s.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	replayed := 0
+	for {
+		s.mu.Lock()
+		segments, err := s.segments()
+		s.mu.Unlock()
+		if err != nil {
+			return replayed, err
+		}
+		if len(segments) == 0 {
+			return replayed, nil
+		}
+
+		oldest := segments[0]
+		metrics, err := readSegment(oldest.path)
+		if err != nil {
+			log.Printf("Spool: dropping unreadable segment %s: %v", oldest.path, err)
+		} else if err := send(metrics); err != nil {
+			return replayed, err
+		} else {
+			replayed++
+		}
+
+		s.mu.Lock()
+		err = os.Remove(oldest.path)
+		s.mu.Unlock()
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return replayed, fmt.Errorf("error removing spool segment: %w", err)
+		}
+	}
+}
+
+// readSegment decodes a spool segment.
+func readSegment(path string) ([]Metric, error) {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var encoded []segmentMetric
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return nil, err
+	}
+	metrics := make([]Metric, 0, len(encoded))
+	for _, m := range encoded {
+		metric := Metric{Name: m.Name, Type: m.Type, Labels: m.Labels}
+		switch {
+		case m.Delta != nil:
+			metric.Value = *m.Delta
+		case m.Value != nil:
+			metric.Value = *m.Value
+		default:
+			continue
+		}
+		metrics = append(metrics, metric)
+	}
+	return metrics, nil
+}
@@ -0,0 +1,120 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	models "github.com/Schera-ole/metrics/internal/model"
+)
+
+// batch returns a batch with a gauge and a counter.
+func batch(gauge float64, delta int64) []Metric {
+	return []Metric{
+		{Name: "Alloc", Type: models.Gauge, Value: gauge},
+		{Name: "PollCount", Type: models.Counter, Value: delta, Labels: map[string]string{"host": "a"}},
+	}
+}
+
+func TestSpoolReplayInOrder(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := NewSpool(dir, 0, 0)
+	require.NoError(t, err)
+
+	require.NoError(t, spool.Write(batch(1, 1)))
+	require.NoError(t, spool.Write([]Metric{{Name: "TotalMemory", Type: models.Gauge, Value: uint64(1024)}}))
+	assert.Equal(t, 2, spool.Len())
+
+	// Segments survive a restart and new segments are appended after them
+	spool, err = NewSpool(dir, 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, spool.Write(batch(3, 3)))
+
+	var replayed [][]Metric
+	n, err := spool.Replay(func(metrics []Metric) error {
+		replayed = append(replayed, metrics)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, [][]Metric{
+		batch(1, 1),
+		{{Name: "TotalMemory", Type: models.Gauge, Value: 1024.0}},
+		batch(3, 3),
+	}, replayed)
+	assert.Equal(t, 0, spool.Len())
+}
+
+func TestSpoolReplayStopsOnFailure(t *testing.T) {
+	spool, err := NewSpool(t.TempDir(), 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, spool.Write(batch(1, 1)))
+	require.NoError(t, spool.Write(batch(2, 2)))
+
+	calls := 0
+	n, err := spool.Replay(func(metrics []Metric) error {
+		calls++
+		if calls == 2 {
+			return assert.AnError
+		}
+		return nil
+	})
+	assert.ErrorIs(t, err, assert.AnError)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 1, spool.Len(), "the failed batch stays in the spool")
+}
+
+func TestSpoolLimits(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := NewSpool(dir, 0, time.Minute)
+	require.NoError(t, err)
+	require.NoError(t, spool.Write(batch(1, 1)))
+
+	segments, err := spool.segments()
+	require.NoError(t, err)
+	require.Len(t, segments, 1)
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(segments[0].path, old, old))
+
+	require.NoError(t, spool.Write(batch(2, 2)))
+	assert.Equal(t, 1, spool.Len(), "expired segments are dropped")
+
+	size := segments[0].size
+	spool, err = NewSpool(dir, 2*size, 0)
+	require.NoError(t, err)
+	require.NoError(t, spool.Write(batch(3, 3)))
+	require.NoError(t, spool.Write(batch(4, 4)))
+
+	var replayed [][]Metric
+	_, err = spool.Replay(func(metrics []Metric) error {
+		replayed = append(replayed, metrics)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, [][]Metric{batch(3, 3), batch(4, 4)}, replayed, "the oldest segments are dropped over the size limit")
+}
+
+func TestSpoolDropsUnreadableSegments(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "00000000000000000001.json"), []byte("{"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "00000000000000000002.json.tmp"), []byte("[]"), 0644))
+
+	spool, err := NewSpool(dir, 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, spool.Write(batch(1, 1)))
+	_, err = os.Stat(filepath.Join(dir, "00000000000000000002.json.tmp"))
+	assert.True(t, os.IsNotExist(err), "interrupted writes are removed")
+
+	var replayed [][]Metric
+	n, err := spool.Replay(func(metrics []Metric) error {
+		replayed = append(replayed, metrics)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, [][]Metric{batch(1, 1)}, replayed)
+}
@@ -0,0 +1,292 @@
+// Package alerting provides a rules engine that raises alerts on stored metrics.
+//
+// Rules are loaded from a YAML or JSON file and evaluated periodically. Every
+// alert goes through the pending, firing and resolved states.
+package alerting
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Schera-ole/metrics/internal/config"
+	models "github.com/Schera-ole/metrics/internal/model"
+)
+
+// Alert states.
+const (
+	// StatePending means the condition holds but not yet for the rule's For duration.
+	StatePending = "pending"
+
+	// StateFiring means the condition has held for at least the rule's For duration.
+	StateFiring = "firing"
+
+	// StateResolved means a firing alert's condition no longer holds.
+	StateResolved = "resolved"
+)
+
+// Alert is the state of a rule for a single series.
+type Alert struct {
+	// Rule is the name of the rule that raised the alert
+	Rule string `json:"rule"`
+
+	// Metric is the name of the metric the rule is evaluated against
+	Metric string `json:"metric"`
+
+	// Labels are the labels of the series that raised the alert
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// State is one of pending, firing or resolved
+	State string `json:"state"`
+
+	// Value is the metric value, or the seconds since the last update for absence rules
+	Value float64 `json:"value"`
+
+	// ActiveAt is when the condition started to hold
+	ActiveAt time.Time `json:"active_at"`
+
+	// FiredAt is when the alert started firing
+	FiredAt time.Time `json:"fired_at,omitzero"`
+
+	// ResolvedAt is when the alert was resolved
+	ResolvedAt time.Time `json:"resolved_at,omitzero"`
+}
+
+// Key returns the identity of the alert, made of the rule name and the series.
+func (a Alert) Key() string {
+	return a.Rule + "/" + models.SeriesKey(a.Metric, a.Labels)
+}
+
+// Source provides the metrics the rules are evaluated against.
+//
+// It is implemented by service.MetricsService.
+type Source interface {
+	// ListMetricsByLabels retrieves all metrics whose labels contain every pair of matchers
+	ListMetricsByLabels(ctx context.Context, matchers map[string]string) ([]models.Metric, error)
+
+	// LastUpdated returns the last time any matching series of the metric was updated
+	LastUpdated(name string, matchers map[string]string) (time.Time, bool)
+}
+
+// Engine evaluates alerting rules and tracks the resulting alerts.
+type Engine struct {
+	// source provides the metrics
+	source Source
+
+	// started is the reference time for absence rules on metrics never updated
+	started time.Time
+
+	// mu provides thread-safe access to rules and active
+	mu sync.RWMutex
+
+	// rules are the rules being evaluated
+	rules []Rule
+
+	// active stores the pending and firing alerts by alert key
+	active map[string]*Alert
+
+	// notifications receives the alerts that changed state after every evaluation, nil if disabled
+	notifications chan<- []Alert
+}
+
+// NewEngine creates a new Engine that evaluates rules against source.
+func NewEngine(source Source, rules []Rule) *Engine {
+	return &Engine{
+		source:  source,
+		started: time.Now(),
+		rules:   rules,
+		active:  make(map[string]*Alert),
+	}
+}
+
+// SetNotifications makes Run send the alerts that started firing or were resolved to ch.
+//
+// Sends never block: if ch is full, the notification is dropped.
+func (e *Engine) SetNotifications(ch chan<- []Alert) {
+	e.notifications = ch
+}
+
+// Rules returns the rules being evaluated.
+func (e *Engine) Rules() []Rule {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return append([]Rule(nil), e.rules...)
+}
+
+// SetRules replaces the rules being evaluated, for example when the rules file is reloaded.
+//
+// Alerts of rules that were removed are resolved by the next evaluation.
+func (e *Engine) SetRules(rules []Rule) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rules = rules
+}
+
+// observation is a series for which a rule's condition holds.
+type observation struct {
+	rule   Rule
+	labels map[string]string
+	value  float64
+}
+
+// observe returns the series of a rule whose condition holds at now.
+func (e *Engine) observe(ctx context.Context, rule Rule, now time.Time) ([]observation, error) {
+	if rule.IsAbsence() {
+		last, ok := e.source.LastUpdated(rule.Metric, rule.Labels)
+		if !ok {
+			last = e.started
+		}
+		age := now.Sub(last)
+		if age < time.Duration(rule.Absent) {
+			return nil, nil
+		}
+		return []observation{{rule: rule, labels: rule.Labels, value: age.Seconds()}}, nil
+	}
+
+	metrics, err := e.source.ListMetricsByLabels(ctx, rule.Labels)
+	if err != nil {
+		return nil, err
+	}
+	var result []observation
+	for _, metric := range metrics {
+		if metric.Name != rule.Metric {
+			continue
+		}
+		if metric.Type != config.GaugeType && metric.Type != config.CounterType {
+			continue
+		}
+		var value float64
+		switch v := metric.Value.(type) {
+		case float64:
+			value = v
+		case int64:
+			value = float64(v)
+		default:
+			continue
+		}
+		if rule.compare(value) {
+			result = append(result, observation{rule: rule, labels: metric.Labels, value: value})
+		}
+	}
+	return result, nil
+}
+
+// Evaluate evaluates all rules at now and updates the alert states.
+//
+// It returns the alerts that started firing or were resolved during this evaluation.
+// Rules whose metrics could not be read keep their previous state.
+func (e *Engine) Evaluate(ctx context.Context, now time.Time) ([]Alert, error) {
+	rules := e.Rules()
+
+	current := make(map[string]observation)
+	failed := make(map[string]struct{})
+	var firstErr error
+	for _, rule := range rules {
+		observations, err := e.observe(ctx, rule, now)
+		if err != nil {
+			failed[rule.Name] = struct{}{}
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		for _, obs := range observations {
+			alert := Alert{Rule: rule.Name, Metric: rule.Metric, Labels: obs.labels}
+			current[alert.Key()] = obs
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var changed []Alert
+	for key, obs := range current {
+		alert, exists := e.active[key]
+		if !exists {
+			alert = &Alert{
+				Rule:     obs.rule.Name,
+				Metric:   obs.rule.Metric,
+				Labels:   obs.labels,
+				State:    StatePending,
+				ActiveAt: now,
+			}
+			e.active[key] = alert
+		}
+		alert.Value = obs.value
+		if alert.State == StatePending && now.Sub(alert.ActiveAt) >= time.Duration(obs.rule.For) {
+			alert.State = StateFiring
+			alert.FiredAt = now
+			changed = append(changed, *alert)
+		}
+	}
+	for key, alert := range e.active {
+		if _, holds := current[key]; holds {
+			continue
+		}
+		if _, skipped := failed[alert.Rule]; skipped {
+			continue
+		}
+		delete(e.active, key)
+		if alert.State == StateFiring {
+			alert.State = StateResolved
+			alert.ResolvedAt = now
+			changed = append(changed, *alert)
+		}
+	}
+	sortAlerts(changed)
+	return changed, firstErr
+}
+
+// ActiveAlerts returns the pending and firing alerts.
+func (e *Engine) ActiveAlerts() []Alert {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	alerts := make([]Alert, 0, len(e.active))
+	for _, alert := range e.active {
+		alerts = append(alerts, *alert)
+	}
+	sortAlerts(alerts)
+	return alerts
+}
+
+// Run evaluates the rules every interval until ctx is canceled.
+func (e *Engine) Run(ctx context.Context, interval time.Duration, logger *zap.SugaredLogger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			changed, err := e.Evaluate(ctx, now)
+			if err != nil {
+				logger.Errorf("error evaluating alerting rules: %v", err)
+			}
+			for _, alert := range changed {
+				logger.Infow("Alert state changed",
+					"rule", alert.Rule,
+					"series", models.SeriesKey(alert.Metric, alert.Labels),
+					"state", alert.State,
+					"value", alert.Value,
+				)
+			}
+			if len(changed) > 0 && e.notifications != nil {
+				select {
+				case e.notifications <- changed:
+					// Notification sent successfully
+				default:
+					logger.Warnf("dropped %d alert notifications, channel is full", len(changed))
+				}
+			}
+		}
+	}
+}
+
+// sortAlerts orders alerts by their key.
+func sortAlerts(alerts []Alert) {
+	sort.Slice(alerts, func(i, j int) bool {
+		return alerts[i].Key() < alerts[j].Key()
+	})
+}
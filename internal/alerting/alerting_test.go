@@ -0,0 +1,136 @@
+package alerting
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Schera-ole/metrics/internal/config"
+	models "github.com/Schera-ole/metrics/internal/model"
+)
+
+// fakeSource is an in-memory Source for tests.
+type fakeSource struct {
+	metrics []models.Metric
+	updated map[string]time.Time
+	err     error
+}
+
+func (f *fakeSource) ListMetricsByLabels(ctx context.Context, matchers map[string]string) ([]models.Metric, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	var result []models.Metric
+	for _, m := range f.metrics {
+		if models.MatchLabels(m.Labels, matchers) {
+			result = append(result, m)
+		}
+	}
+	return result, nil
+}
+
+func (f *fakeSource) LastUpdated(name string, matchers map[string]string) (time.Time, bool) {
+	at, ok := f.updated[name]
+	return at, ok
+}
+
+func TestEngine_ThresholdRule(t *testing.T) {
+	source := &fakeSource{metrics: []models.Metric{
+		{Name: "HeapAlloc", Type: config.GaugeType, Value: 2e9},
+	}}
+	rule := Rule{Name: "HighHeap", Metric: "HeapAlloc", Op: OpGreater, Threshold: 1e9, For: Duration(time.Minute)}
+	engine := NewEngine(source, []Rule{rule})
+	ctx := context.Background()
+	start := time.Now()
+
+	// The condition holds but not yet for a minute
+	changed, err := engine.Evaluate(ctx, start)
+	require.NoError(t, err)
+	assert.Empty(t, changed)
+	active := engine.ActiveAlerts()
+	require.Len(t, active, 1)
+	assert.Equal(t, StatePending, active[0].State)
+
+	// After a minute the alert fires
+	changed, err = engine.Evaluate(ctx, start.Add(time.Minute))
+	require.NoError(t, err)
+	require.Len(t, changed, 1)
+	assert.Equal(t, StateFiring, changed[0].State)
+	assert.Equal(t, 2e9, changed[0].Value)
+
+	// A failing source keeps the alert firing
+	source.err = errors.New("unavailable")
+	changed, err = engine.Evaluate(ctx, start.Add(2*time.Minute))
+	assert.Error(t, err)
+	assert.Empty(t, changed)
+	assert.Len(t, engine.ActiveAlerts(), 1)
+
+	// Once the value drops the alert is resolved
+	source.err = nil
+	source.metrics[0].Value = 1.0
+	changed, err = engine.Evaluate(ctx, start.Add(3*time.Minute))
+	require.NoError(t, err)
+	require.Len(t, changed, 1)
+	assert.Equal(t, StateResolved, changed[0].State)
+	assert.Empty(t, engine.ActiveAlerts())
+}
+
+func TestEngine_ThresholdRulePerSeries(t *testing.T) {
+	source := &fakeSource{metrics: []models.Metric{
+		{Name: "CPU", Type: config.GaugeType, Value: 95.0, Labels: map[string]string{"cpu": "0"}},
+		{Name: "CPU", Type: config.GaugeType, Value: 10.0, Labels: map[string]string{"cpu": "1"}},
+		{Name: "CPU", Type: config.GaugeType, Value: 99.0, Labels: map[string]string{"cpu": "2"}},
+	}}
+	engine := NewEngine(source, []Rule{{Name: "HighCPU", Metric: "CPU", Op: OpGreaterEqual, Threshold: 90}})
+
+	changed, err := engine.Evaluate(context.Background(), time.Now())
+	require.NoError(t, err)
+	require.Len(t, changed, 2)
+	assert.Equal(t, map[string]string{"cpu": "0"}, changed[0].Labels)
+	assert.Equal(t, map[string]string{"cpu": "2"}, changed[1].Labels)
+}
+
+func TestEngine_AbsenceRule(t *testing.T) {
+	start := time.Now()
+	source := &fakeSource{updated: map[string]time.Time{"PollCount": start}}
+	engine := NewEngine(source, []Rule{{Name: "NoPolls", Metric: "PollCount", Absent: Duration(30 * time.Second)}})
+	ctx := context.Background()
+
+	changed, err := engine.Evaluate(ctx, start.Add(10*time.Second))
+	require.NoError(t, err)
+	assert.Empty(t, changed)
+	assert.Empty(t, engine.ActiveAlerts())
+
+	changed, err = engine.Evaluate(ctx, start.Add(40*time.Second))
+	require.NoError(t, err)
+	require.Len(t, changed, 1)
+	assert.Equal(t, StateFiring, changed[0].State)
+	assert.Equal(t, 40.0, changed[0].Value)
+
+	source.updated["PollCount"] = start.Add(45 * time.Second)
+	changed, err = engine.Evaluate(ctx, start.Add(50*time.Second))
+	require.NoError(t, err)
+	require.Len(t, changed, 1)
+	assert.Equal(t, StateResolved, changed[0].State)
+}
+
+func TestEngine_PendingAlertIsDroppedSilently(t *testing.T) {
+	source := &fakeSource{metrics: []models.Metric{{Name: "PollCount", Type: config.CounterType, Value: int64(5)}}}
+	engine := NewEngine(source, []Rule{{Name: "Many", Metric: "PollCount", Op: OpGreater, Threshold: 1, For: Duration(time.Hour)}})
+	ctx := context.Background()
+	now := time.Now()
+
+	_, err := engine.Evaluate(ctx, now)
+	require.NoError(t, err)
+	require.Len(t, engine.ActiveAlerts(), 1)
+
+	source.metrics[0].Value = int64(0)
+	changed, err := engine.Evaluate(ctx, now.Add(time.Second))
+	require.NoError(t, err)
+	assert.Empty(t, changed)
+	assert.Empty(t, engine.ActiveAlerts())
+}
@@ -0,0 +1,169 @@
+package alerting
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Notification is the payload posted to a webhook for the alerts of one rule.
+type Notification struct {
+	// Rule is the name of the rule the alerts belong to
+	Rule string `json:"rule"`
+
+	// Status is firing if any alert in the group is firing, resolved otherwise
+	Status string `json:"status"`
+
+	// Alerts are the alerts that changed state
+	Alerts []Alert `json:"alerts"`
+}
+
+// Webhook delivers alert notifications to an HTTP endpoint.
+//
+// Alerts are grouped by rule, so a single evaluation produces at most one request per rule.
+// Failed requests are retried with exponential backoff, and an alert whose state has already
+// been delivered is not sent again. A resolution is only sent for an alert whose firing
+// notification was delivered.
+type Webhook struct {
+	// URL is the endpoint notifications are posted to
+	URL string
+
+	// Client is the HTTP client used to post notifications
+	Client *http.Client
+
+	// MaxRetries is the number of retries after the first failed attempt
+	MaxRetries int
+
+	// InitialBackoff is the delay before the first retry
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the delay between retries
+	MaxBackoff time.Duration
+
+	// logger reports delivery failures
+	logger *zap.SugaredLogger
+
+	// delivered stores the last delivered state for each alert key
+	delivered map[string]string
+}
+
+// NewWebhook creates a Webhook for url with the default retry settings.
+func NewWebhook(url string, logger *zap.SugaredLogger) *Webhook {
+	return &Webhook{
+		URL:            url,
+		Client:         &http.Client{Timeout: 10 * time.Second},
+		MaxRetries:     3,
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     10 * time.Second,
+		logger:         logger,
+		delivered:      make(map[string]string),
+	}
+}
+
+// Run delivers every batch of alerts received from events until the channel is closed.
+func (w *Webhook) Run(events <-chan []Alert) {
+	for alerts := range events {
+		if err := w.Deliver(alerts); err != nil {
+			w.logger.Errorf("Webhook %s: %v", w.URL, err)
+		}
+	}
+}
+
+// Deliver posts the alerts grouped by rule, skipping alerts whose state was already delivered
+// and resolved alerts whose firing was never delivered.
+//
+// It returns the last delivery error; the other groups are still attempted.
+func (w *Webhook) Deliver(alerts []Alert) error {
+	groups := make(map[string][]Alert)
+	for _, alert := range alerts {
+		delivered := w.delivered[alert.Key()]
+		if delivered == alert.State || (alert.State == StateResolved && delivered != StateFiring) {
+			continue
+		}
+		groups[alert.Rule] = append(groups[alert.Rule], alert)
+	}
+
+	rules := make([]string, 0, len(groups))
+	for rule := range groups {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+
+	var lastErr error
+	for _, rule := range rules {
+		notification := Notification{Rule: rule, Status: StateResolved, Alerts: groups[rule]}
+		for _, alert := range notification.Alerts {
+			if alert.State == StateFiring {
+				notification.Status = StateFiring
+				break
+			}
+		}
+		if err := w.sendWithRetry(notification); err != nil {
+			lastErr = fmt.Errorf("error delivering alerts for rule %s: %w", rule, err)
+			continue
+		}
+		for _, alert := range notification.Alerts {
+			if alert.State == StateResolved {
+				delete(w.delivered, alert.Key())
+				continue
+			}
+			w.delivered[alert.Key()] = alert.State
+		}
+	}
+	return lastErr
+}
+
+// sendWithRetry posts a notification, retrying network errors, 429 and 5xx responses.
+func (w *Webhook) sendWithRetry(notification Notification) error {
+	data, err := json.Marshal(notification)
+	if err != nil {
+		return fmt.Errorf("error marshalling notification: %w", err)
+	}
+
+	backoff := w.InitialBackoff
+	var lastErr error
+	for attempt := 0; attempt <= w.MaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > w.MaxBackoff {
+				backoff = w.MaxBackoff
+			}
+		}
+
+		retryable, err := w.send(data)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		if !retryable {
+			return lastErr
+		}
+	}
+	return fmt.Errorf("failed after %d attempts: %w", w.MaxRetries+1, lastErr)
+}
+
+// send performs a single POST and reports whether a failure may be retried.
+func (w *Webhook) send(data []byte) (bool, error) {
+	resp, err := w.Client.Post(w.URL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return true, fmt.Errorf("error sending request: %w", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	default:
+		return false, fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+}
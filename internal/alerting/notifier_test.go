@@ -0,0 +1,150 @@
+package alerting
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// receiver is an httptest webhook endpoint that records notifications.
+type receiver struct {
+	mu            sync.Mutex
+	failures      int
+	status        int
+	attempts      int
+	notifications []Notification
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.attempts++
+	if r.failures > 0 {
+		r.failures--
+		w.WriteHeader(r.status)
+		return
+	}
+	var notification Notification
+	if err := json.NewDecoder(req.Body).Decode(&notification); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.notifications = append(r.notifications, notification)
+	w.WriteHeader(http.StatusOK)
+}
+
+func newTestWebhook(t *testing.T, url string) *Webhook {
+	logger, _ := zap.NewDevelopment()
+	t.Cleanup(func() { logger.Sync() })
+	webhook := NewWebhook(url, logger.Sugar())
+	webhook.InitialBackoff = time.Millisecond
+	webhook.MaxBackoff = 2 * time.Millisecond
+	return webhook
+}
+
+func TestWebhook_GroupsByRuleAndDeduplicates(t *testing.T) {
+	recv := &receiver{}
+	server := httptest.NewServer(recv)
+	defer server.Close()
+	webhook := newTestWebhook(t, server.URL)
+
+	alerts := []Alert{
+		{Rule: "HighCPU", Metric: "CPU", Labels: map[string]string{"cpu": "0"}, State: StateFiring},
+		{Rule: "HighCPU", Metric: "CPU", Labels: map[string]string{"cpu": "1"}, State: StateFiring},
+		{Rule: "NoPolls", Metric: "PollCount", State: StateFiring},
+	}
+	require.NoError(t, webhook.Deliver(alerts))
+	require.Len(t, recv.notifications, 2)
+	assert.Equal(t, "HighCPU", recv.notifications[0].Rule)
+	assert.Equal(t, StateFiring, recv.notifications[0].Status)
+	assert.Len(t, recv.notifications[0].Alerts, 2)
+	assert.Equal(t, "NoPolls", recv.notifications[1].Rule)
+
+	// Already delivered states are not sent again
+	require.NoError(t, webhook.Deliver(alerts))
+	assert.Len(t, recv.notifications, 2)
+
+	// Resolutions are delivered, after which the alert may fire again
+	resolved := alerts[2]
+	resolved.State = StateResolved
+	require.NoError(t, webhook.Deliver([]Alert{resolved}))
+	require.Len(t, recv.notifications, 3)
+	assert.Equal(t, StateResolved, recv.notifications[2].Status)
+	require.NoError(t, webhook.Deliver([]Alert{alerts[2]}))
+	assert.Len(t, recv.notifications, 4)
+}
+
+func TestWebhook_RetriesWithBackoff(t *testing.T) {
+	recv := &receiver{failures: 2, status: http.StatusServiceUnavailable}
+	server := httptest.NewServer(recv)
+	defer server.Close()
+	webhook := newTestWebhook(t, server.URL)
+
+	require.NoError(t, webhook.Deliver([]Alert{{Rule: "HighHeap", Metric: "HeapAlloc", State: StateFiring}}))
+	assert.Equal(t, 3, recv.attempts)
+	assert.Len(t, recv.notifications, 1)
+}
+
+func TestWebhook_GivesUp(t *testing.T) {
+	recv := &receiver{failures: 10, status: http.StatusInternalServerError}
+	server := httptest.NewServer(recv)
+	defer server.Close()
+	webhook := newTestWebhook(t, server.URL)
+	alert := Alert{Rule: "HighHeap", Metric: "HeapAlloc", State: StateFiring}
+
+	assert.Error(t, webhook.Deliver([]Alert{alert}))
+	assert.Equal(t, webhook.MaxRetries+1, recv.attempts)
+
+	// Client errors are not retried
+	recv.failures, recv.status, recv.attempts = 1, http.StatusBadRequest, 0
+	assert.Error(t, webhook.Deliver([]Alert{alert}))
+	assert.Equal(t, 1, recv.attempts)
+
+	// The undelivered alert is sent on the next attempt
+	require.NoError(t, webhook.Deliver([]Alert{alert}))
+	assert.Len(t, recv.notifications, 1)
+}
+
+func TestWebhook_SkipsResolutionOfUndeliveredFiring(t *testing.T) {
+	recv := &receiver{failures: 1, status: http.StatusBadRequest}
+	server := httptest.NewServer(recv)
+	defer server.Close()
+	webhook := newTestWebhook(t, server.URL)
+	alert := Alert{Rule: "HighHeap", Metric: "HeapAlloc", State: StateFiring}
+
+	assert.Error(t, webhook.Deliver([]Alert{alert}))
+
+	// The receiver never learnt that the alert fired, so it is not told that it resolved
+	resolved := alert
+	resolved.State = StateResolved
+	require.NoError(t, webhook.Deliver([]Alert{resolved}))
+	assert.Equal(t, 1, recv.attempts)
+	assert.Empty(t, recv.notifications)
+
+	// An alert that fires again is delivered, and so is its resolution
+	require.NoError(t, webhook.Deliver([]Alert{alert}))
+	require.NoError(t, webhook.Deliver([]Alert{resolved}))
+	require.Len(t, recv.notifications, 2)
+	assert.Equal(t, StateFiring, recv.notifications[0].Status)
+	assert.Equal(t, StateResolved, recv.notifications[1].Status)
+}
+
+func TestWebhook_Run(t *testing.T) {
+	recv := &receiver{}
+	server := httptest.NewServer(recv)
+	defer server.Close()
+	webhook := newTestWebhook(t, server.URL)
+
+	events := make(chan []Alert, 1)
+	events <- []Alert{{Rule: "HighHeap", Metric: "HeapAlloc", State: StateFiring}}
+	close(events)
+	webhook.Run(events)
+	assert.Len(t, recv.notifications, 1)
+}
@@ -0,0 +1,178 @@
+package alerting
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Comparison operators supported by threshold rules.
+const (
+	OpGreater      = ">"
+	OpGreaterEqual = ">="
+	OpLess         = "<"
+	OpLessEqual    = "<="
+	OpEqual        = "=="
+	OpNotEqual     = "!="
+)
+
+// Duration is a time.Duration that is written as a string such as "30s" or "1m" in rule files.
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %w", err)
+	}
+	return d.parse(value)
+}
+
+// MarshalJSON writes the duration as a string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalYAML parses a duration string.
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	return d.parse(node.Value)
+}
+
+// parse sets the duration from a Go duration string.
+func (d *Duration) parse(value string) error {
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if parsed < 0 {
+		return fmt.Errorf("duration %q must not be negative", value)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Rule describes a condition on a metric that raises an alert.
+//
+// A threshold rule compares every series of the metric with Threshold using Op.
+// An absence rule (Absent is set) fires when no series of the metric has been
+// updated for the Absent duration. In both cases the condition must hold for the
+// For duration before the alert fires.
+type Rule struct {
+	// Name is the unique name of the rule
+	Name string `json:"name" yaml:"name"`
+
+	// Metric is the name of the metric the rule is evaluated against
+	Metric string `json:"metric" yaml:"metric"`
+
+	// Labels restrict the rule to series that have all of these labels
+	Labels map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+
+	// Op is the comparison operator of a threshold rule
+	Op string `json:"op,omitempty" yaml:"op,omitempty"`
+
+	// Threshold is the value the metric is compared with
+	Threshold float64 `json:"threshold,omitempty" yaml:"threshold,omitempty"`
+
+	// Absent is how long the metric may go without updates in an absence rule
+	Absent Duration `json:"absent,omitempty" yaml:"absent,omitempty"`
+
+	// For is how long the condition must hold before the alert fires
+	For Duration `json:"for,omitempty" yaml:"for,omitempty"`
+}
+
+// RuleSet is the content of a rules file.
+type RuleSet struct {
+	// Rules are the alerting rules
+	Rules []Rule `json:"rules" yaml:"rules"`
+}
+
+// IsAbsence reports whether the rule is an absence rule.
+func (r Rule) IsAbsence() bool {
+	return r.Absent > 0
+}
+
+// compare applies the rule's operator to value and the threshold.
+func (r Rule) compare(value float64) bool {
+	switch r.Op {
+	case OpGreater:
+		return value > r.Threshold
+	case OpGreaterEqual:
+		return value >= r.Threshold
+	case OpLess:
+		return value < r.Threshold
+	case OpLessEqual:
+		return value <= r.Threshold
+	case OpEqual:
+		return value == r.Threshold
+	case OpNotEqual:
+		return value != r.Threshold
+	}
+	return false
+}
+
+// Validate checks that the rule is complete.
+func (r Rule) Validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("rule name is required")
+	}
+	if r.Metric == "" {
+		return fmt.Errorf("rule %s: metric is required", r.Name)
+	}
+	if r.IsAbsence() {
+		if r.Op != "" {
+			return fmt.Errorf("rule %s: absence rules must not set op", r.Name)
+		}
+		return nil
+	}
+	switch r.Op {
+	case OpGreater, OpGreaterEqual, OpLess, OpLessEqual, OpEqual, OpNotEqual:
+		return nil
+	case "":
+		return fmt.Errorf("rule %s: either op or absent is required", r.Name)
+	}
+	return fmt.Errorf("rule %s: unknown op %q", r.Name, r.Op)
+}
+
+// ParseRules decodes a rule set in YAML or JSON format and validates it.
+//
+// The format is chosen by the file extension: .yaml and .yml are parsed as YAML,
+// everything else as JSON.
+func ParseRules(data []byte, filename string) ([]Rule, error) {
+	var set RuleSet
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &set); err != nil {
+			return nil, fmt.Errorf("error parsing rules: %w", err)
+		}
+	default:
+		if err := json.Unmarshal(data, &set); err != nil {
+			return nil, fmt.Errorf("error parsing rules: %w", err)
+		}
+	}
+
+	names := make(map[string]struct{}, len(set.Rules))
+	for _, rule := range set.Rules {
+		if err := rule.Validate(); err != nil {
+			return nil, err
+		}
+		if _, exists := names[rule.Name]; exists {
+			return nil, fmt.Errorf("duplicate rule name %s", rule.Name)
+		}
+		names[rule.Name] = struct{}{}
+	}
+	return set.Rules, nil
+}
+
+// LoadRules reads and parses a rules file.
+func LoadRules(filename string) ([]Rule, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading rules file: %w", err)
+	}
+	return ParseRules(data, filename)
+}
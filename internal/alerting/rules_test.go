@@ -0,0 +1,72 @@
+package alerting
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRules_YAML(t *testing.T) {
+	data := []byte(`
+rules:
+  - name: HighHeap
+    metric: HeapAlloc
+    op: ">"
+    threshold: 1e9
+    for: 1m
+  - name: NoPolls
+    metric: PollCount
+    labels:
+      host: a
+    absent: 30s
+`)
+	rules, err := ParseRules(data, "rules.yaml")
+	require.NoError(t, err)
+	require.Len(t, rules, 2)
+	assert.Equal(t, Rule{Name: "HighHeap", Metric: "HeapAlloc", Op: OpGreater, Threshold: 1e9, For: Duration(time.Minute)}, rules[0])
+	assert.True(t, rules[1].IsAbsence())
+	assert.Equal(t, Duration(30*time.Second), rules[1].Absent)
+	assert.Equal(t, map[string]string{"host": "a"}, rules[1].Labels)
+}
+
+func TestLoadRules_JSON(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "rules.json")
+	data := `{"rules":[{"name":"LowMemory","metric":"FreeMemory","op":"<","threshold":1024,"for":"30s"}]}`
+	require.NoError(t, os.WriteFile(filename, []byte(data), 0644))
+
+	rules, err := LoadRules(filename)
+	require.NoError(t, err)
+	require.Len(t, rules, 1)
+	assert.Equal(t, Duration(30*time.Second), rules[0].For)
+	assert.True(t, rules[0].compare(512))
+	assert.False(t, rules[0].compare(2048))
+
+	_, err = LoadRules(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
+
+func TestParseRules_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{name: "missing name", data: `{"rules":[{"metric":"A","op":">"}]}`},
+		{name: "missing metric", data: `{"rules":[{"name":"A","op":">"}]}`},
+		{name: "missing op", data: `{"rules":[{"name":"A","metric":"A"}]}`},
+		{name: "unknown op", data: `{"rules":[{"name":"A","metric":"A","op":"~"}]}`},
+		{name: "absence with op", data: `{"rules":[{"name":"A","metric":"A","op":">","absent":"1s"}]}`},
+		{name: "duplicate name", data: `{"rules":[{"name":"A","metric":"A","op":">"},{"name":"A","metric":"B","op":">"}]}`},
+		{name: "bad duration", data: `{"rules":[{"name":"A","metric":"A","op":">","for":"soon"}]}`},
+		{name: "malformed", data: `{"rules":`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseRules([]byte(tt.data), "rules.json")
+			assert.Error(t, err)
+		})
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/Schera-ole/metrics/internal/config"
@@ -19,8 +20,9 @@ import (
 
 // AuditLogger is an interface for logging audit events.
 type AuditLogger interface {
-	// Log sends an audit event with the specified metrics, IP address, and timestamp.
-	Log(metrics []string, ipAddress string)
+	// Log sends an audit event with the specified metrics, IP address, caller identity and timestamp.
+	// The identity is the common name of the client certificate, empty if the client has none.
+	Log(metrics []string, ipAddress string, identity string)
 }
 
 // auditLogger is a concrete implementation of AuditLogger that sends events to a channel.
@@ -35,12 +37,13 @@ func NewAuditLogger(eventChan chan models.AuditEvent) AuditLogger {
 	}
 }
 
-// Log sends an audit event with the specified metrics and IP address.
-func (a *auditLogger) Log(metrics []string, ipAddress string) {
+// Log sends an audit event with the specified metrics, IP address and caller identity.
+func (a *auditLogger) Log(metrics []string, ipAddress string, identity string) {
 	event := models.AuditEvent{
 		TS:        time.Now().Format(time.RFC3339),
 		Metrics:   metrics,
 		IPAddress: ipAddress,
+		Identity:  identity,
 	}
 
 	select {
@@ -56,21 +59,84 @@ type Subscriber struct {
 	ID int
 }
 
-// Broadcaster distributes audit events to multiple subscriber channels.
+// Subscribers is the set of subscriber channels a broadcaster sends to.
+//
+// The set can be replaced while the broadcaster is running, for example when the audit sinks
+// are reloaded. Every event is sent either to the whole old set or to the whole new one.
+type Subscribers[T any] struct {
+	// mu guards subs against sends to channels being closed
+	mu sync.RWMutex
+
+	// subs are the current subscriber channels
+	subs []chan<- T
+
+	// closed is set once the source is closed
+	closed bool
+}
+
+// NewSubscribers creates a set of subscriber channels.
+func NewSubscribers[T any](subs ...chan<- T) *Subscribers[T] {
+	return &Subscribers[T]{subs: subs}
+}
+
+// Swap replaces the subscriber channels and closes the previous ones, so their subscribers
+// can finish their work and exit. If the source is already closed, subs are closed at once.
+func (s *Subscribers[T]) Swap(subs ...chan<- T) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous := s.subs
+	if s.closed {
+		previous = subs
+	} else {
+		s.subs = subs
+	}
+	for _, subChan := range previous {
+		close(subChan)
+	}
+}
+
+// send sends evt to every subscriber channel without blocking.
+func (s *Subscribers[T]) send(evt T) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, subChan := range s.subs {
+		select {
+		case subChan <- evt:
+			// Event sent successfully
+		default:
+			// Channel is blocked, discard event to prevent goroutine leak
+			fmt.Printf("Broadcaster: dropped event for blocked subscriber channel\n")
+		}
+	}
+}
+
+// close closes the subscriber channels once the source is closed.
+func (s *Subscribers[T]) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for _, subChan := range s.subs {
+		close(subChan)
+	}
+	s.subs = nil
+}
+
+// Broadcaster distributes events to multiple subscriber channels.
 //
 // It receives events from a source channel and sends them to all provided subscriber channels
-// using select with default case to prevent blocking and goroutine leaks.
-func Broadcaster(source <-chan models.AuditEvent, subs ...chan<- models.AuditEvent) {
+// using select with default case to prevent blocking and goroutine leaks. It is used for audit
+// events and for alert notifications. When the source channel is closed, the subscriber channels
+// are closed too, so the subscribers can finish their work and exit.
+func Broadcaster[T any](source <-chan T, subs ...chan<- T) {
+	BroadcastTo(source, NewSubscribers(subs...))
+}
+
+// BroadcastTo is like Broadcaster, but sends to a set of subscribers that can be swapped
+// while it is running.
+func BroadcastTo[T any](source <-chan T, subs *Subscribers[T]) {
+	defer subs.close()
 	for evt := range source {
-		for _, subChan := range subs {
-			select {
-			case subChan <- evt:
-				// Event sent successfully
-			default:
-				// Channel is blocked, discard event to prevent goroutine leak
-				fmt.Printf("Broadcaster: dropped event for blocked subscriber channel\n")
-			}
-		}
+		subs.send(evt)
 	}
 }
 
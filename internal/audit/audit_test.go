@@ -305,3 +305,60 @@ func TestURLSubscriber_NetworkError(t *testing.T) {
 
 	// Just ensure the test completes without panicking
 }
+
+func TestBroadcaster_ClosesSubscribers(t *testing.T) {
+	source := make(chan models.AuditEvent, 1)
+	sub := make(chan models.AuditEvent, 1)
+	done := make(chan struct{})
+	go func() {
+		Broadcaster(source, sub)
+		close(done)
+	}()
+
+	event := models.AuditEvent{Metrics: []string{"testMetric"}}
+	source <- event
+	close(source)
+	<-done
+
+	// The pending event is still delivered before the channel reports closed
+	received, ok := <-sub
+	assert.True(t, ok)
+	assert.Equal(t, event, received)
+	_, ok = <-sub
+	assert.False(t, ok)
+}
+
+func TestSubscribers_Swap(t *testing.T) {
+	source := make(chan models.AuditEvent)
+	old := make(chan models.AuditEvent, 1)
+	subs := NewSubscribers[models.AuditEvent](old)
+	done := make(chan struct{})
+	go func() {
+		BroadcastTo(source, subs)
+		close(done)
+	}()
+
+	first := models.AuditEvent{Metrics: []string{"first"}}
+	source <- first
+	assert.Equal(t, first, <-old)
+
+	next := make(chan models.AuditEvent, 1)
+	subs.Swap(next)
+	_, ok := <-old
+	assert.False(t, ok, "the previous subscriber channels are closed")
+
+	second := models.AuditEvent{Metrics: []string{"second"}}
+	source <- second
+	assert.Equal(t, second, <-next)
+
+	close(source)
+	<-done
+	_, ok = <-next
+	assert.False(t, ok)
+
+	// Subscribers swapped in after the source is closed are closed at once
+	late := make(chan models.AuditEvent)
+	subs.Swap(late)
+	_, ok = <-late
+	assert.False(t, ok)
+}
@@ -1,12 +1,18 @@
 // Package config provides configuration management for the metrics server.
 //
-// It handles parsing of command-line flags and environment variables.
+// It handles parsing of a JSON or YAML config file, environment variables and command-line flags.
 package config
 
 import (
 	"flag"
+	"io"
+	"net/netip"
 	"os"
-	"strconv"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+
+	"github.com/Schera-ole/metrics/internal/options"
 )
 
 // ServerConfig holds the configuration settings for the metrics server.
@@ -14,6 +20,14 @@ type ServerConfig struct {
 	// Address is the host:port combination for the server to listen on.
 	Address string
 
+	// GRPCAddress is the host:port combination for the gRPC API to listen on.
+	// If empty, the gRPC API is disabled.
+	GRPCAddress string
+
+	// GRPCMaxStreamMetrics is the maximum number of metrics a single StreamMetrics call may send,
+	// since they are held in memory until the stream ends. If 0, the number is not limited.
+	GRPCMaxStreamMetrics int
+
 	// StoreInterval is the interval in seconds between saves to file storage.
 	// If 0, metrics are saved immediately after each update.
 	StoreInterval int
@@ -24,6 +38,17 @@ type ServerConfig struct {
 	// Restore indicates whether to restore metrics from file storage on startup.
 	Restore bool
 
+	// SnapshotGenerations is the number of previous snapshots kept next to FileStoragePath.
+	SnapshotGenerations int
+
+	// SnapshotFormat is the format of the snapshots: json, binary, or auto to choose the binary
+	// format for a FileStoragePath with the .bin extension.
+	SnapshotFormat string
+
+	// StorageShards is the number of lock shards of the memory storage. If 0, a single lock
+	// guards every series.
+	StorageShards int
+
 	// DatabaseDSN is the data source name for connecting to the PostgreSQL database.
 	// If empty, file-based storage is used instead.
 	DatabaseDSN string
@@ -36,73 +61,247 @@ type ServerConfig struct {
 
 	// AuditURL is the URL where audit logs are sent via HTTP POST.
 	AuditURL string
+
+	// HistorySize is the number of samples kept in memory per series for range queries.
+	// If 0, metric history is disabled.
+	HistorySize int
+
+	// AlertRulesFile is the path to the YAML or JSON file with alerting rules.
+	// If empty, alerting is disabled.
+	AlertRulesFile string
+
+	// AlertInterval is the interval in seconds between evaluations of the alerting rules.
+	AlertInterval int
+
+	// AlertWebhooks are the URLs that alert notifications are posted to.
+	AlertWebhooks []string
+
+	// RateLimit is the number of update requests per second allowed for every client. Reads and
+	// scrapes are not limited. Clients are identified only by the common name of their certificate
+	// with mutual TLS or else by IP address, so agents behind a proxy or a load balancer share one
+	// limit unless they use client certificates. If 0, updates are not rate limited.
+	RateLimit float64
+
+	// RateBurst is the number of update requests a client may make at once.
+	// If 0, it equals the rate limit.
+	RateBurst int
+
+	// MaxConcurrentWrites is the maximum number of update requests served at a time.
+	// If 0, the number is not limited.
+	MaxConcurrentWrites int
+
+	// CryptoKey is the path to the PEM file with the RSA private key used to decrypt
+	// agent payloads. If set, unencrypted updates are rejected, and the gRPC API only accepts
+	// updates over TLS; if empty, encrypted payloads are not accepted.
+	CryptoKey string
+
+	// TLSCert is the path to the PEM file with the server certificate.
+	// If empty, the server does not use TLS.
+	TLSCert string
+
+	// TLSKey is the path to the PEM file with the private key of the server certificate.
+	TLSKey string
+
+	// TLSClientCA is the path to the PEM file with the CA that signs agent certificates.
+	// If set, agents must authenticate with a client certificate (mutual TLS).
+	TLSClientCA string
+
+	// TLSClientNames are the certificate common names of the agents allowed to connect.
+	// If empty, every certificate signed by the client CA is accepted.
+	TLSClientNames []string
+
+	// TrustedSubnet is the subnet in CIDR notation that agents must report in the X-Real-IP header.
+	// If empty, updates are accepted from any address. It can be changed by a reload.
+	TrustedSubnet string
+
+	// LogLevel is the minimum level of the server log: debug, info, warn or error.
+	LogLevel string
+
+	// WALPath is the path to the write-ahead log of the memory storage, which makes every
+	// acknowledged update survive a restart. If empty, the WAL is disabled.
+	WALPath string
+
+	// WALSyncInterval is the longest time an update waits for the fsync of the WAL.
+	// Updates arriving meanwhile are synced together. If 0, every update is synced at once.
+	WALSyncInterval time.Duration
+
+	// WALSyncBatch is the number of pending updates that triggers an fsync of the WAL before
+	// WALSyncInterval elapses.
+	WALSyncBatch int
+
+	// WALCompactInterval is the interval between compactions of the WAL into a snapshot.
+	WALCompactInterval time.Duration
+
+	// PrintConfig is set when the effective configuration should be printed instead of
+	// starting the server.
+	PrintConfig bool
 }
 
-// NewServerConfig creates a new ServerConfig with default values and parses
-// command-line flags and environment variables.
+// NewServerConfig creates a new ServerConfig with default values and loads the config file,
+// environment variables and command-line flags.
 func NewServerConfig() (*ServerConfig, error) {
 
+	return LoadServerConfig(flag.CommandLine, os.Args[1:], os.LookupEnv)
+}
+
+// LoadServerConfig creates a new ServerConfig with default values, registers its flags in
+// flags and loads the options from args, the config file and the environment.
+//
+// Later sources override earlier ones: defaults < config file < environment < flags.
+func LoadServerConfig(flags *flag.FlagSet, args []string, lookupEnv options.LookupEnv) (*ServerConfig, error) {
+
 	config := &ServerConfig{
-		Address:         "localhost:8080",
-		StoreInterval:   300,
-		FileStoragePath: "./cmd/server/logs",
-		Restore:         false,
-		DatabaseDSN:     "",
-		Key:             "",
-		AuditFile:       "",
-		AuditURL:        "",
-	}
-
-	address := flag.String("a", config.Address, "address")
-	storeInterval := flag.Int("i", config.StoreInterval, "store in file interval")
-	fileStoragePath := flag.String("f", config.FileStoragePath, "path to store file")
-	restoreFlag := flag.Bool("r", config.Restore, "bool flag, describe restore metrics from file or not")
-	databaseDSN := flag.String("d", config.DatabaseDSN, "database dsn")
-	key := flag.String("k", "", "Key for hash")
-	auditFile := flag.String("audit-file", config.AuditFile, "file for audit log")
-	auditURL := flag.String("audit-url", config.AuditURL, "url for audit log")
-	flag.Parse()
-
-	envVars := map[string]*string{
-		"ADDRESS":           address,
-		"FILE_STORAGE_PATH": fileStoragePath,
-		"DATABASE_DSN":      databaseDSN,
-		"KEY":               key,
-	}
-
-	for envVar, flag := range envVars {
-		if envValue := os.Getenv(envVar); envValue != "" {
-			*flag = envValue
-		}
+		Address:              "localhost:8080",
+		GRPCAddress:          "",
+		GRPCMaxStreamMetrics: 100000,
+		StoreInterval:        300,
+		FileStoragePath:      "./cmd/server/logs",
+		Restore:              false,
+		SnapshotFormat:       "auto",
+		StorageShards:        0,
+		DatabaseDSN:          "",
+		Key:                  "",
+		AuditFile:            "",
+		AuditURL:             "",
+		HistorySize:          1000,
+		AlertRulesFile:       "",
+		AlertInterval:        10,
+		RateLimit:            0,
+		RateBurst:            0,
+		LogLevel:             "debug",
+		WALPath:              "",
+		WALSyncInterval:      10 * time.Millisecond,
+		WALSyncBatch:         64,
+		WALCompactInterval:   5 * time.Minute,
 	}
-
-	if envStoreInterval := os.Getenv("STORE_INTERVAL"); envStoreInterval != "" {
-		interval, err := strconv.Atoi(envStoreInterval)
-		if err != nil {
-			return nil, err
-		}
-		*storeInterval = interval
+	set := config.options(flags)
+	if err := set.Load(args, lookupEnv); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
 	}
+	config.PrintConfig = set.PrintRequested()
+	return config, nil
+}
+
+// options registers the configuration options of the server in flags.
+//
+// The config file key of every option is its environment variable in lower case.
+func (c *ServerConfig) options(flags *flag.FlagSet) *options.Set {
+
+	set := options.NewSet(flags)
+	set.String(&c.Address, "address", "a", "address")
+	set.String(&c.GRPCAddress, "grpc_address", "grpc-address", "address of the gRPC API, empty disables it")
+	set.Int(&c.GRPCMaxStreamMetrics, "grpc_max_stream_metrics", "grpc-max-stream-metrics", "metrics a single gRPC stream may send, 0 disables the limit")
+	set.Int(&c.StoreInterval, "store_interval", "i", "store in file interval")
+	set.String(&c.FileStoragePath, "file_storage_path", "f", "path to store file")
+	set.Bool(&c.Restore, "restore", "r", "bool flag, describe restore metrics from file or not")
+	set.Int(&c.SnapshotGenerations, "snapshot_generations", "snapshot-generations", "number of previous snapshots kept next to the storage file")
+	set.String(&c.SnapshotFormat, "snapshot_format", "snapshot-format", "format of the storage file: json, binary, or auto to use binary for the .bin extension")
+	set.Int(&c.StorageShards, "storage_shards", "storage-shards", "number of lock shards of the memory storage, 0 uses a single lock")
+	set.Secret(&c.DatabaseDSN, "database_dsn", "d", "database dsn")
+	set.Secret(&c.Key, "key", "k", "Key for hash")
+	set.String(&c.AuditFile, "audit_file", "audit-file", "file for audit log")
+	set.String(&c.AuditURL, "audit_url", "audit-url", "url for audit log")
+	set.Int(&c.HistorySize, "history_size", "history-size", "samples kept per series for range queries, 0 disables history")
+	set.String(&c.AlertRulesFile, "alert_rules", "alert-rules", "file with alerting rules")
+	set.Int(&c.AlertInterval, "alert_interval", "alert-interval", "alerting rules evaluation interval")
+	set.List(&c.AlertWebhooks, "alert_webhooks", "alert-webhooks", "comma-separated urls for alert notifications")
+	set.Float64(&c.RateLimit, "rate_limit", "rate-limit", "update requests per second allowed per client, 0 disables rate limiting")
+	set.Int(&c.RateBurst, "rate_burst", "rate-burst", "update requests a client may make at once")
+	set.Int(&c.MaxConcurrentWrites, "max_concurrent_writes", "max-concurrent-writes", "update requests served at a time, 0 disables the limit")
+	set.String(&c.CryptoKey, "crypto_key", "crypto-key", "path to the private key for decrypting agent payloads")
+	set.String(&c.TLSCert, "tls_cert", "tls-cert", "path to the server certificate, empty disables TLS")
+	set.String(&c.TLSKey, "tls_key", "tls-key", "path to the server certificate key")
+	set.String(&c.TLSClientCA, "tls_client_ca", "tls-client-ca", "path to the CA of agent certificates, enables mutual TLS")
+	set.List(&c.TLSClientNames, "tls_client_names", "tls-client-names", "comma-separated common names of the agent certificates allowed to connect")
+	set.String(&c.TrustedSubnet, "trusted_subnet", "t", "trusted subnet of agents in CIDR notation")
+	set.String(&c.LogLevel, "log_level", "log-level", "minimum log level: debug, info, warn or error")
+	set.String(&c.WALPath, "wal_path", "wal", "path to the write-ahead log of the memory storage, empty disables it")
+	set.Duration(&c.WALSyncInterval, "wal_sync_interval", "wal-sync-interval", "longest time an update waits for the fsync of the write-ahead log")
+	set.Int(&c.WALSyncBatch, "wal_sync_batch", "wal-sync-batch", "pending updates that trigger an fsync of the write-ahead log")
+	set.Duration(&c.WALCompactInterval, "wal_compact_interval", "wal-compact-interval", "interval between compactions of the write-ahead log")
+	return set
+}
 
-	if envRestoreFlag := os.Getenv("RESTORE"); envRestoreFlag != "" {
-		restore, err := strconv.ParseBool(envRestoreFlag)
-		if err != nil {
-			return nil, err
+// Validate checks the option values. Its errors name the config file key of the invalid option.
+func (c *ServerConfig) Validate() error {
+
+	if c.StoreInterval < 0 {
+		return options.Invalid("store_interval", "must not be negative, got %d", c.StoreInterval)
+	}
+	if c.SnapshotGenerations < 0 {
+		return options.Invalid("snapshot_generations", "must not be negative, got %d", c.SnapshotGenerations)
+	}
+	switch c.SnapshotFormat {
+	case "auto", "json", "binary":
+	default:
+		return options.Invalid("snapshot_format", "must be json, binary or auto, got %q", c.SnapshotFormat)
+	}
+	if c.GRPCMaxStreamMetrics < 0 {
+		return options.Invalid("grpc_max_stream_metrics", "must not be negative, got %d", c.GRPCMaxStreamMetrics)
+	}
+	if c.StorageShards < 0 {
+		return options.Invalid("storage_shards", "must not be negative, got %d", c.StorageShards)
+	}
+	if c.HistorySize < 0 {
+		return options.Invalid("history_size", "must not be negative, got %d", c.HistorySize)
+	}
+	if c.AlertRulesFile != "" && c.AlertInterval <= 0 {
+		return options.Invalid("alert_interval", "must be positive, got %d", c.AlertInterval)
+	}
+	if c.RateLimit < 0 {
+		return options.Invalid("rate_limit", "must not be negative, got %v", c.RateLimit)
+	}
+	if c.RateBurst < 0 {
+		return options.Invalid("rate_burst", "must not be negative, got %d", c.RateBurst)
+	}
+	if c.MaxConcurrentWrites < 0 {
+		return options.Invalid("max_concurrent_writes", "must not be negative, got %d", c.MaxConcurrentWrites)
+	}
+	if c.TLSCert == "" && c.TLSKey != "" {
+		return options.Invalid("tls_cert", "must be set together with tls_key")
+	}
+	if c.TLSCert != "" && c.TLSKey == "" {
+		return options.Invalid("tls_key", "must be set together with tls_cert")
+	}
+	if c.TLSClientCA != "" && c.TLSCert == "" {
+		return options.Invalid("tls_client_ca", "requires tls_cert")
+	}
+	if c.TrustedSubnet != "" {
+		if _, err := netip.ParsePrefix(c.TrustedSubnet); err != nil {
+			return options.Invalid("trusted_subnet", "%v", err)
 		}
-		*restoreFlag = restore
 	}
-	if *auditFile != "" {
-		config.AuditFile = *auditFile
+	if _, err := zapcore.ParseLevel(c.LogLevel); err != nil {
+		return options.Invalid("log_level", "%v", err)
+	}
+	if c.WALPath != "" && c.DatabaseDSN != "" {
+		return options.Invalid("wal_path", "is only supported by the memory storage")
+	}
+	if c.WALSyncInterval < 0 {
+		return options.Invalid("wal_sync_interval", "must not be negative, got %v", c.WALSyncInterval)
 	}
-	if *auditURL != "" {
-		config.AuditURL = *auditURL
+	if c.WALSyncBatch <= 0 {
+		return options.Invalid("wal_sync_batch", "must be positive, got %d", c.WALSyncBatch)
 	}
-	config.Address = *address
-	config.StoreInterval = *storeInterval
-	config.FileStoragePath = *fileStoragePath
-	config.Restore = *restoreFlag
-	config.DatabaseDSN = *databaseDSN
-	config.Key = *key
+	if c.WALPath != "" && c.WALCompactInterval <= 0 {
+		return options.Invalid("wal_compact_interval", "must be positive, got %v", c.WALCompactInterval)
+	}
+	return nil
+}
 
-	return config, nil
+// SavesOnUpdate reports whether the memory storage is saved to FileStoragePath after every
+// update. It is the case with a store interval of 0, unless the WAL already makes the updates
+// durable.
+func (c *ServerConfig) SavesOnUpdate() bool {
+
+	return c.StoreInterval == 0 && c.WALPath == ""
+}
+
+// Dump writes the configuration as a JSON config file, with secrets hidden.
+func (c *ServerConfig) Dump(w io.Writer) error {
+
+	return c.options(flag.NewFlagSet("dump", flag.ContinueOnError)).Dump(w)
 }
@@ -7,4 +7,7 @@ const (
 
 	// CounterType represents the type string for counter metrics.
 	CounterType = "counter"
+
+	// HistogramType represents the type string for histogram metrics.
+	HistogramType = "histogram"
 )
@@ -0,0 +1,75 @@
+package config
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Reloadable holds the current server configuration, which is replaced when the config file
+// is reloaded.
+//
+// Request handlers load it for every request, so they always see a complete configuration,
+// either the old one or the new one.
+type Reloadable struct {
+	// current is the configuration in use
+	current atomic.Pointer[ServerConfig]
+
+	// mu provides thread-safe access to callbacks
+	mu sync.Mutex
+
+	// callbacks are called with every new configuration
+	callbacks []func(*ServerConfig)
+}
+
+// NewReloadable creates a Reloadable holding config.
+func NewReloadable(config *ServerConfig) *Reloadable {
+
+	r := &Reloadable{}
+	r.current.Store(config)
+	return r
+}
+
+// Load returns the current configuration. It must not be modified.
+func (r *Reloadable) Load() *ServerConfig {
+
+	return r.current.Load()
+}
+
+// Store replaces the current configuration and calls the OnStore callbacks with it.
+func (r *Reloadable) Store(config *ServerConfig) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.current.Store(config)
+	for _, callback := range r.callbacks {
+		callback(config)
+	}
+}
+
+// OnStore registers a callback applying every new configuration to components that cannot
+// load it on their own, like a rate limiter.
+func (r *Reloadable) OnStore(callback func(*ServerConfig)) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.callbacks = append(r.callbacks, callback)
+}
+
+// Reload returns a copy of the configuration with the options that can be changed without a
+// restart taken from next: the key, the audit sinks, the log level, the rate limits, the trusted
+// subnet and the alerting rules file.
+//
+// Other options, like the listen addresses or the storage, keep their current values.
+func (c *ServerConfig) Reload(next *ServerConfig) *ServerConfig {
+
+	reloaded := *c
+	reloaded.Key = next.Key
+	reloaded.AuditFile = next.AuditFile
+	reloaded.AuditURL = next.AuditURL
+	reloaded.LogLevel = next.LogLevel
+	reloaded.RateLimit = next.RateLimit
+	reloaded.RateBurst = next.RateBurst
+	reloaded.TrustedSubnet = next.TrustedSubnet
+	reloaded.AlertRulesFile = next.AlertRulesFile
+	return &reloaded
+}
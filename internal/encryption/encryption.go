@@ -0,0 +1,160 @@
+// Package encryption provides hybrid RSA and AES encryption of agent payloads.
+//
+// A payload is encrypted with a random AES-256-GCM key, and the key itself is
+// encrypted with the server's RSA public key using OAEP with SHA-256. This way
+// payloads of any size can be encrypted with an RSA key pair.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+const (
+	// Scheme names the encryption in the Header of encrypted requests.
+	Scheme = "rsa-oaep-aes-256-gcm"
+
+	// Header marks a request body as encrypted with Scheme.
+	Header = "X-Content-Encryption"
+
+	// keySize is the size in bytes of the AES key.
+	keySize = 32
+)
+
+// ErrInvalidPayload is returned when an encrypted payload cannot be decrypted.
+var ErrInvalidPayload = errors.New("invalid encrypted payload")
+
+// Encrypt encrypts data for the owner of key.
+//
+// The result is the RSA-OAEP encrypted AES key, followed by the GCM nonce and the
+// AES-GCM sealed data.
+func Encrypt(key *rsa.PublicKey, data []byte) ([]byte, error) {
+
+	aesKey := make([]byte, keySize)
+	if _, err := rand.Read(aesKey); err != nil {
+		return nil, fmt.Errorf("error generating key: %w", err)
+	}
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key, aesKey, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error encrypting key: %w", err)
+	}
+	gcm, err := newGCM(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("error generating nonce: %w", err)
+	}
+
+	result := make([]byte, 0, len(encryptedKey)+len(nonce)+len(data)+gcm.Overhead())
+	result = append(result, encryptedKey...)
+	result = append(result, nonce...)
+	return gcm.Seal(result, nonce, data, nil), nil
+}
+
+// Decrypt decrypts data encrypted by Encrypt with the public part of key.
+func Decrypt(key *rsa.PrivateKey, data []byte) ([]byte, error) {
+
+	keyLen := key.Size()
+	if len(data) < keyLen {
+		return nil, ErrInvalidPayload
+	}
+	aesKey, err := rsa.DecryptOAEP(sha256.New(), nil, key, data[:keyLen], nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+	gcm, err := newGCM(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	rest := data[keyLen:]
+	if len(rest) < gcm.NonceSize() {
+		return nil, ErrInvalidPayload
+	}
+	plain, err := gcm.Open(nil, rest[:gcm.NonceSize()], rest[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+	return plain, nil
+}
+
+// newGCM creates an AES-GCM cipher for key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// LoadPublicKey reads an RSA public key from a PEM file in PKIX or PKCS #1 format.
+func LoadPublicKey(path string) (*rsa.PublicKey, error) {
+
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing public key: %w", err)
+		}
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("public key in %s is not an RSA key", path)
+		}
+		return rsaKey, nil
+	}
+	return nil, fmt.Errorf("unexpected PEM block %q in %s", block.Type, path)
+}
+
+// LoadPrivateKey reads an RSA private key from a PEM file in PKCS #8 or PKCS #1 format.
+func LoadPrivateKey(path string) (*rsa.PrivateKey, error) {
+
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing private key: %w", err)
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("private key in %s is not an RSA key", path)
+		}
+		return rsaKey, nil
+	}
+	return nil, fmt.Errorf("unexpected PEM block %q in %s", block.Type, path)
+}
+
+// readPEM reads the first PEM block of a file.
+func readPEM(path string) (*pem.Block, error) {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key file: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", path)
+	}
+	return block, nil
+}
@@ -0,0 +1,85 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	// Larger than a single RSA block
+	data := bytes.Repeat([]byte(`{"id":"Alloc","type":"gauge","value":1}`), 1000)
+	encrypted, err := Encrypt(&key.PublicKey, data)
+	require.NoError(t, err)
+	assert.NotContains(t, string(encrypted), "Alloc")
+
+	decrypted, err := Decrypt(key, encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, data, decrypted)
+
+	encrypted[len(encrypted)-1] ^= 0xff
+	_, err = Decrypt(key, encrypted)
+	assert.ErrorIs(t, err, ErrInvalidPayload)
+
+	_, err = Decrypt(key, []byte("short"))
+	assert.ErrorIs(t, err, ErrInvalidPayload)
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	encrypted, err = Encrypt(&other.PublicKey, data)
+	require.NoError(t, err)
+	_, err = Decrypt(key, encrypted)
+	assert.ErrorIs(t, err, ErrInvalidPayload)
+}
+
+func TestLoadKeys(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	dir := t.TempDir()
+
+	write := func(name, blockType string, der []byte) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+		return path
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	pkix, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+
+	for _, path := range []string{
+		write("pkcs1.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key)),
+		write("pkcs8.pem", "PRIVATE KEY", pkcs8),
+	} {
+		loaded, err := LoadPrivateKey(path)
+		require.NoError(t, err, path)
+		assert.True(t, key.Equal(loaded), path)
+	}
+	for _, path := range []string{
+		write("pkcs1.pub", "RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(&key.PublicKey)),
+		write("pkix.pub", "PUBLIC KEY", pkix),
+	} {
+		loaded, err := LoadPublicKey(path)
+		require.NoError(t, err, path)
+		assert.True(t, key.PublicKey.Equal(loaded), path)
+	}
+
+	_, err = LoadPublicKey(filepath.Join(dir, "pkcs8.pem"))
+	assert.Error(t, err)
+	_, err = LoadPrivateKey(filepath.Join(dir, "missing.pem"))
+	assert.Error(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "garbage.pem"), []byte("not a key"), 0600))
+	_, err = LoadPrivateKey(filepath.Join(dir, "garbage.pem"))
+	assert.Error(t, err)
+}
@@ -9,6 +9,9 @@ var (
 	ErrUnknownMetricType  = errors.New("unknown metric type")
 	ErrInvalidMetricValue = errors.New("invalid metric value")
 
+	// Histogram errors
+	ErrHistogramBoundsMismatch = errors.New("histogram bucket bounds mismatch")
+
 	// Database errors
 	ErrDatabaseConnection = errors.New("database connection failed")
 	ErrTransactionFailed  = errors.New("transaction failed")
@@ -16,4 +19,5 @@ var (
 
 	// Storage errors
 	ErrStorageUnavailable = errors.New("storage unavailable")
+	ErrHistoryDisabled    = errors.New("metric history is disabled")
 )
@@ -0,0 +1,124 @@
+package grpcserver
+
+import (
+	"fmt"
+
+	"github.com/Schera-ole/metrics/internal/config"
+	internalerrors "github.com/Schera-ole/metrics/internal/errors"
+	models "github.com/Schera-ole/metrics/internal/model"
+	"github.com/Schera-ole/metrics/pkg/metricspb"
+)
+
+// TypeToProto converts a metric type name to its protobuf enum value.
+func TypeToProto(typ string) metricspb.Metric_Type {
+	switch typ {
+	case config.GaugeType:
+		return metricspb.Metric_GAUGE
+	case config.CounterType:
+		return metricspb.Metric_COUNTER
+	case config.HistogramType:
+		return metricspb.Metric_HISTOGRAM
+	}
+	return metricspb.Metric_TYPE_UNSPECIFIED
+}
+
+// TypeFromProto converts a protobuf enum value to a metric type name.
+func TypeFromProto(typ metricspb.Metric_Type) (string, error) {
+	switch typ {
+	case metricspb.Metric_GAUGE:
+		return config.GaugeType, nil
+	case metricspb.Metric_COUNTER:
+		return config.CounterType, nil
+	case metricspb.Metric_HISTOGRAM:
+		return config.HistogramType, nil
+	}
+	return "", internalerrors.ErrUnknownMetricType
+}
+
+// HistogramToProto converts a histogram value to its protobuf message.
+func HistogramToProto(h models.HistogramValue) *metricspb.Histogram {
+	return &metricspb.Histogram{
+		Bounds: append([]float64(nil), h.Bounds...),
+		Counts: append([]uint64(nil), h.Counts...),
+		Sum:    h.Sum,
+		Count:  h.Count,
+	}
+}
+
+// HistogramFromProto converts a protobuf histogram message to a histogram value.
+func HistogramFromProto(h *metricspb.Histogram) models.HistogramValue {
+	return models.HistogramValue{
+		Bounds: append([]float64(nil), h.GetBounds()...),
+		Counts: append([]uint64(nil), h.GetCounts()...),
+		Sum:    h.GetSum(),
+		Count:  h.GetCount(),
+	}
+}
+
+// DTOToProto converts a metric DTO to its protobuf message.
+func DTOToProto(dto models.MetricsDTO) *metricspb.Metric {
+	metric := &metricspb.Metric{
+		Id:     dto.ID,
+		Type:   TypeToProto(dto.MType),
+		Labels: dto.Labels,
+	}
+	switch {
+	case dto.Delta != nil:
+		metric.Data = &metricspb.Metric_Delta{Delta: *dto.Delta}
+	case dto.Value != nil:
+		metric.Data = &metricspb.Metric_Value{Value: *dto.Value}
+	case dto.Histogram != nil:
+		metric.Data = &metricspb.Metric_Histogram{Histogram: HistogramToProto(*dto.Histogram)}
+	}
+	return metric
+}
+
+// MetricToProto converts a stored metric to its protobuf message.
+func MetricToProto(m models.Metric) *metricspb.Metric {
+	metric := &metricspb.Metric{
+		Id:     m.Name,
+		Type:   TypeToProto(m.Type),
+		Labels: m.Labels,
+	}
+	switch v := m.Value.(type) {
+	case int64:
+		metric.Data = &metricspb.Metric_Delta{Delta: v}
+	case float64:
+		metric.Data = &metricspb.Metric_Value{Value: v}
+	case models.HistogramValue:
+		metric.Data = &metricspb.Metric_Histogram{Histogram: HistogramToProto(v)}
+	}
+	return metric
+}
+
+// MetricFromProto converts a protobuf metric message to a metric ready to be stored.
+//
+// The value must match the metric type.
+func MetricFromProto(m *metricspb.Metric) (models.Metric, error) {
+	typ, err := TypeFromProto(m.GetType())
+	if err != nil {
+		return models.Metric{}, err
+	}
+	metric := models.Metric{Name: m.GetId(), Type: typ, Labels: m.GetLabels()}
+	if metric.Name == "" {
+		return models.Metric{}, fmt.Errorf("%w: metric id is required", internalerrors.ErrInvalidMetricValue)
+	}
+	switch data := m.GetData().(type) {
+	case *metricspb.Metric_Delta:
+		if typ == config.CounterType {
+			metric.Value = data.Delta
+		}
+	case *metricspb.Metric_Value:
+		if typ == config.GaugeType {
+			metric.Value = data.Value
+		}
+	case *metricspb.Metric_Histogram:
+		if typ == config.HistogramType {
+			metric.Value = HistogramFromProto(data.Histogram)
+		}
+	}
+	if metric.Value == nil {
+		return models.Metric{}, fmt.Errorf("%w: %s has no %s value", internalerrors.ErrInvalidMetricValue, metric.Name, typ)
+	}
+	return metric, nil
+}
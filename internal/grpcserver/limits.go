@@ -0,0 +1,96 @@
+package grpcserver
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	middlewareinternal "github.com/Schera-ole/metrics/internal/middleware"
+	"github.com/Schera-ole/metrics/pkg/metricspb"
+)
+
+// retryAfterKey is the trailer asking a throttled client how long to wait, like the Retry-After header.
+const retryAfterKey = "retry-after"
+
+// writeMethods are the RPCs storing metrics, limited by the rate and the concurrency limits
+// like the HTTP updates.
+var writeMethods = map[string]bool{
+	metricspb.Metrics_UpdateMetrics_FullMethodName: true,
+	metricspb.Metrics_StreamMetrics_FullMethodName: true,
+}
+
+// unaryLimits rejects unary write calls over the rate or the concurrency limit with ResourceExhausted.
+func (s *Server) unaryLimits(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+
+	release, wait, err := s.acquire(ctx, info.FullMethod)
+	if err != nil {
+		if trailerErr := grpc.SetTrailer(ctx, retryAfter(wait)); trailerErr != nil {
+			s.logger.Infof("couldn't set the retry-after trailer: %v", trailerErr)
+		}
+		return nil, err
+	}
+	defer release()
+	return handler(ctx, req)
+}
+
+// streamLimits rejects write streams over the rate or the concurrency limit with ResourceExhausted.
+//
+// A stream holds its concurrency slot until it ends.
+func (s *Server) streamLimits(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+
+	release, wait, err := s.acquire(ss.Context(), info.FullMethod)
+	if err != nil {
+		ss.SetTrailer(retryAfter(wait))
+		return err
+	}
+	defer release()
+	return handler(srv, ss)
+}
+
+// acquire takes a token from the bucket of the calling client and a concurrency slot if method
+// is a write method; other methods are not limited. On success, the caller must call release when the call is done.
+// Otherwise it returns how long the client should wait before retrying.
+func (s *Server) acquire(ctx context.Context, method string) (release func(), wait time.Duration, err error) {
+
+	if !writeMethods[method] {
+		return func() {}, 0, nil
+	}
+	allowed, wait := s.limits.Rate.Allow(clientID(ctx))
+	if !allowed {
+		return nil, wait, status.Error(codes.ResourceExhausted, "rate limit exceeded")
+	}
+	if !s.limits.Writes.Acquire() {
+		return nil, time.Second, status.Error(codes.ResourceExhausted, "too many concurrent writes")
+	}
+	return s.limits.Writes.Release, 0, nil
+}
+
+// clientID identifies the calling client for rate limiting, like middlewareinternal.ClientID
+// for HTTP requests.
+func clientID(ctx context.Context) string {
+
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	var remoteAddr string
+	if p.Addr != nil {
+		remoteAddr = p.Addr.String()
+	}
+	if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+		return middlewareinternal.PeerID(&info.State, remoteAddr)
+	}
+	return middlewareinternal.PeerID(nil, remoteAddr)
+}
+
+// retryAfter returns the trailer asking the client to retry after wait.
+func retryAfter(wait time.Duration) metadata.MD {
+
+	return metadata.Pairs(retryAfterKey, middlewareinternal.RetryAfter(wait))
+}
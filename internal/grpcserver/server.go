@@ -0,0 +1,348 @@
+// Package grpcserver implements the gRPC API of the metrics server defined in api/metrics.proto.
+//
+// It is backed by the same service.MetricsService as the HTTP handlers.
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/Schera-ole/metrics/internal/audit"
+	"github.com/Schera-ole/metrics/internal/config"
+	internalerrors "github.com/Schera-ole/metrics/internal/errors"
+	middlewareinternal "github.com/Schera-ole/metrics/internal/middleware"
+	models "github.com/Schera-ole/metrics/internal/model"
+	"github.com/Schera-ole/metrics/internal/service"
+	"github.com/Schera-ole/metrics/internal/tlsconfig"
+	"github.com/Schera-ole/metrics/pkg/metricspb"
+)
+
+const (
+	// watchBuffer is the number of pending updates buffered for each WatchMetrics stream.
+	watchBuffer = 100
+
+	// realIPKey is the metadata key carrying the address of the agent, like the X-Real-IP header.
+	realIPKey = "x-real-ip"
+)
+
+// Server implements metricspb.MetricsServer.
+type Server struct {
+	metricspb.UnimplementedMetricsServer
+
+	// logger reports request failures
+	logger *zap.SugaredLogger
+
+	// config is the server configuration, loaded for every request
+	config *config.Reloadable
+
+	// metricService stores and retrieves the metrics
+	metricService *service.MetricsService
+
+	// auditLogger records metric updates
+	auditLogger audit.AuditLogger
+
+	// limits are the rate and concurrency limits, shared with the HTTP API
+	limits *middlewareinternal.Limits
+
+	// done is closed by Shutdown to end the WatchMetrics streams
+	done chan struct{}
+
+	// shutdownOnce closes done once
+	shutdownOnce sync.Once
+}
+
+// NewServer creates a new Server backed by metricService.
+//
+// limits should be the ones of the HTTP API; if nil, the server creates its own from config.
+func NewServer(
+	logger *zap.SugaredLogger,
+	config *config.Reloadable,
+	metricService *service.MetricsService,
+	auditLogger audit.AuditLogger,
+	limits *middlewareinternal.Limits,
+) *Server {
+
+	if limits == nil {
+		limits = middlewareinternal.NewLimits(config)
+	}
+	s := &Server{
+		logger:        logger,
+		config:        config,
+		metricService: metricService,
+		auditLogger:   auditLogger,
+		limits:        limits,
+		done:          make(chan struct{}),
+	}
+	return s
+}
+
+// Register creates a gRPC server with the metrics service registered and the limits enforced.
+func (s *Server) Register(opts ...grpc.ServerOption) *grpc.Server {
+
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(s.unaryLimits),
+		grpc.ChainStreamInterceptor(s.streamLimits),
+	)
+	grpcServer := grpc.NewServer(opts...)
+	metricspb.RegisterMetricsServer(grpcServer, s)
+	return grpcServer
+}
+
+// Shutdown ends the WatchMetrics streams, which would otherwise keep grpc.Server.GracefulStop
+// waiting until their clients disconnect.
+func (s *Server) Shutdown() {
+
+	s.shutdownOnce.Do(func() { close(s.done) })
+}
+
+// UpdateMetrics stores a batch of metrics.
+func (s *Server) UpdateMetrics(ctx context.Context, req *metricspb.UpdateMetricsRequest) (*metricspb.UpdateMetricsResponse, error) {
+
+	if err := s.checkEncrypted(ctx); err != nil {
+		return nil, err
+	}
+	address, err := s.clientAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	metrics, err := s.decodeRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.store(ctx, metrics, address); err != nil {
+		return nil, err
+	}
+	return &metricspb.UpdateMetricsResponse{}, nil
+}
+
+// StreamMetrics receives batches of metrics until the client closes the stream and then
+// stores all of them at once.
+//
+// Nothing is stored if any batch is invalid, so a failed stream can be retried as a whole.
+// A stream sending more metrics than the configured maximum is rejected with InvalidArgument
+// as soon as it exceeds it, since the metrics are held in memory until the stream ends.
+func (s *Server) StreamMetrics(stream grpc.ClientStreamingServer[metricspb.UpdateMetricsRequest, metricspb.UpdateMetricsResponse]) error {
+
+	if err := s.checkEncrypted(stream.Context()); err != nil {
+		return err
+	}
+	address, err := s.clientAddress(stream.Context())
+	if err != nil {
+		return err
+	}
+	limit := s.config.Load().GRPCMaxStreamMetrics
+	var metrics []models.Metric
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if limit > 0 && len(metrics)+len(req.GetMetrics()) > limit {
+			return status.Errorf(codes.InvalidArgument, "stream exceeds the limit of %d metrics", limit)
+		}
+		batch, err := s.decodeRequest(req)
+		if err != nil {
+			return err
+		}
+		metrics = append(metrics, batch...)
+	}
+	if err := s.store(stream.Context(), metrics, address); err != nil {
+		return err
+	}
+	return stream.SendAndClose(&metricspb.UpdateMetricsResponse{})
+}
+
+// decodeRequest verifies the hash of a request and converts its metrics.
+func (s *Server) decodeRequest(req *metricspb.UpdateMetricsRequest) ([]models.Metric, error) {
+
+	if err := req.Verify(s.config.Load().Key); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	metrics := make([]models.Metric, 0, len(req.GetMetrics()))
+	for _, m := range req.GetMetrics() {
+		metric, err := MetricFromProto(m)
+		if err != nil {
+			return nil, toStatus(err)
+		}
+		metrics = append(metrics, metric)
+	}
+	return metrics, nil
+}
+
+// checkEncrypted rejects updates sent without TLS with FailedPrecondition when the server has
+// a private key, as the HTTP API rejects unencrypted bodies. The gRPC API has no payload
+// encryption of its own, so TLS is what keeps its updates private.
+func (s *Server) checkEncrypted(ctx context.Context) error {
+
+	if s.config.Load().CryptoKey == "" {
+		return nil
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if _, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			return nil
+		}
+	}
+	return status.Error(codes.FailedPrecondition, "updates must be sent over TLS when the server has a crypto key")
+}
+
+// clientAddress returns the address of the client recorded in the audit log.
+//
+// With a trusted subnet, it is the real IP sent in the x-real-ip metadata, and requests from
+// outside the subnet are rejected with PermissionDenied. The subnet is loaded for every request,
+// so it follows reloads of the configuration.
+func (s *Server) clientAddress(ctx context.Context) (string, error) {
+
+	trustedSubnet := s.config.Load().TrustedSubnet
+	if trustedSubnet == "" {
+		return peerAddress(ctx), nil
+	}
+	// An invalid subnet contains no address, so every update is rejected
+	subnet, _ := middlewareinternal.ParseSubnet(trustedSubnet)
+	var value string
+	if values := metadata.ValueFromIncomingContext(ctx, realIPKey); len(values) > 0 {
+		value = values[0]
+	}
+	addr, err := middlewareinternal.CheckRealIP(subnet, value)
+	if err != nil {
+		return "", status.Error(codes.PermissionDenied, err.Error())
+	}
+	return addr.String(), nil
+}
+
+// store saves the metrics and records the update of the client at address in the audit log.
+func (s *Server) store(ctx context.Context, metrics []models.Metric, address string) error {
+
+	if err := s.metricService.SetMetrics(ctx, metrics); err != nil {
+		s.logger.Info(err)
+		return toStatus(err)
+	}
+	config := s.config.Load()
+	if config.SavesOnUpdate() && s.metricService.IsMemStorage() {
+		if err := s.metricService.SaveMetrics(ctx, config.FileStoragePath); err != nil {
+			s.logger.Infof("couldn't save to file %s", err)
+		}
+	}
+	names := make([]string, 0, len(metrics))
+	for _, metric := range metrics {
+		names = append(names, metric.Name)
+	}
+	s.auditLogger.Log(names, address, peerIdentity(ctx))
+	return nil
+}
+
+// GetMetric returns the current value of a single series.
+func (s *Server) GetMetric(ctx context.Context, req *metricspb.GetMetricRequest) (*metricspb.GetMetricResponse, error) {
+
+	typ, err := TypeFromProto(req.GetType())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	metric, err := s.metricService.GetMetric(ctx, models.MetricsDTO{ID: req.GetId(), MType: typ, Labels: req.GetLabels()})
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &metricspb.GetMetricResponse{Metric: DTOToProto(metric)}, nil
+}
+
+// ListMetrics returns all series whose labels contain the requested labels.
+func (s *Server) ListMetrics(ctx context.Context, req *metricspb.ListMetricsRequest) (*metricspb.ListMetricsResponse, error) {
+
+	metrics, err := s.metricService.ListMetricsByLabels(ctx, req.GetLabels())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	resp := &metricspb.ListMetricsResponse{Metrics: make([]*metricspb.Metric, 0, len(metrics))}
+	for _, metric := range metrics {
+		resp.Metrics = append(resp.Metrics, MetricToProto(metric))
+	}
+	return resp, nil
+}
+
+// WatchMetrics streams the current values of the requested series every time they are updated.
+//
+// Updates are dropped for a stream that cannot keep up.
+func (s *Server) WatchMetrics(req *metricspb.WatchMetricsRequest, stream grpc.ServerStreamingServer[metricspb.WatchMetricsResponse]) error {
+
+	ids := make(map[string]struct{}, len(req.GetIds()))
+	for _, id := range req.GetIds() {
+		ids[id] = struct{}{}
+	}
+
+	updates, cancel := s.metricService.Watch(watchBuffer)
+	defer cancel()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-s.done:
+			return status.Error(codes.Unavailable, "server is shutting down")
+		case values := <-updates:
+			resp := &metricspb.WatchMetricsResponse{}
+			for _, value := range values {
+				if _, ok := ids[value.ID]; len(ids) > 0 && !ok {
+					continue
+				}
+				if !models.MatchLabels(value.Labels, req.GetLabels()) {
+					continue
+				}
+				resp.Metrics = append(resp.Metrics, DTOToProto(value))
+			}
+			if len(resp.Metrics) == 0 {
+				continue
+			}
+			if err := stream.Send(resp); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// toStatus converts a service error to a gRPC status error.
+func toStatus(err error) error {
+
+	switch {
+	case errors.Is(err, internalerrors.ErrMetricNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, internalerrors.ErrUnknownMetricType),
+		errors.Is(err, internalerrors.ErrInvalidMetricValue),
+		errors.Is(err, internalerrors.ErrHistogramBoundsMismatch):
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// peerIdentity returns the common name of the client certificate of the calling client,
+// or an empty string without mutual TLS.
+func peerIdentity(ctx context.Context) string {
+
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+		return tlsconfig.PeerCN(&info.State)
+	}
+	return ""
+}
+
+// peerAddress returns the address of the calling client.
+func peerAddress(ctx context.Context) string {
+
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return p.Addr.String()
+	}
+	return ""
+}
@@ -0,0 +1,402 @@
+package grpcserver
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/Schera-ole/metrics/internal/config"
+	"github.com/Schera-ole/metrics/internal/repository"
+	"github.com/Schera-ole/metrics/internal/service"
+	"github.com/Schera-ole/metrics/pkg/metricspb"
+)
+
+// mockAuditLogger records the metric names and addresses passed to Log.
+type mockAuditLogger struct {
+	metrics   [][]string
+	addresses []string
+}
+
+// Log implements the AuditLogger interface.
+func (m *mockAuditLogger) Log(metrics []string, ipAddress string, identity string) {
+	m.metrics = append(m.metrics, metrics)
+	m.addresses = append(m.addresses, ipAddress)
+}
+
+// testClient starts a server on an in-memory listener and returns a client connected to it.
+func testClient(t *testing.T) (metricspb.MetricsClient, *mockAuditLogger) {
+	return testClientWithKey(t, "")
+}
+
+// testClientWithKey is like testClient, with the server verifying request hashes with key.
+func testClientWithKey(t *testing.T, key string) (metricspb.MetricsClient, *mockAuditLogger) {
+	return testClientWithConfig(t, &config.ServerConfig{StoreInterval: 300, Key: key})
+}
+
+// testClientWithConfig is like testClient, with the server using testConfig.
+func testClientWithConfig(t *testing.T, testConfig *config.ServerConfig) (metricspb.MetricsClient, *mockAuditLogger) {
+	_, client, mockAudit := startServer(t, testConfig)
+	return client, mockAudit
+}
+
+// startServer is like testClientWithConfig, and also returns the server.
+func startServer(t *testing.T, testConfig *config.ServerConfig) (*Server, metricspb.MetricsClient, *mockAuditLogger) {
+	logger, _ := zap.NewDevelopment()
+	metricService := service.NewMetricsService(repository.NewMemStorage())
+	mockAudit := &mockAuditLogger{}
+
+	listener := bufconn.Listen(1024 * 1024)
+	server := NewServer(logger.Sugar(), config.NewReloadable(testConfig), metricService, mockAudit, nil)
+	grpcServer := server.Register()
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return server, metricspb.NewMetricsClient(conn), mockAudit
+}
+
+func TestUpdateAndGetMetric(t *testing.T) {
+	client, mockAudit := testClient(t)
+	ctx := context.Background()
+
+	_, err := client.UpdateMetrics(ctx, &metricspb.UpdateMetricsRequest{Metrics: []*metricspb.Metric{
+		{Id: "Alloc", Type: metricspb.Metric_GAUGE, Data: &metricspb.Metric_Value{Value: 1.5}},
+		{Id: "PollCount", Type: metricspb.Metric_COUNTER, Data: &metricspb.Metric_Delta{Delta: 2}},
+		{Id: "PollCount", Type: metricspb.Metric_COUNTER, Data: &metricspb.Metric_Delta{Delta: 3}},
+		{
+			Id:   "latency",
+			Type: metricspb.Metric_HISTOGRAM,
+			Data: &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+				Bounds: []float64{0.1, 1},
+				Counts: []uint64{1, 0, 1},
+				Sum:    2.05,
+				Count:  2,
+			}},
+			Labels: map[string]string{"host": "a"},
+		},
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"Alloc", "PollCount", "PollCount", "latency"}}, mockAudit.metrics)
+
+	resp, err := client.GetMetric(ctx, &metricspb.GetMetricRequest{Id: "Alloc", Type: metricspb.Metric_GAUGE})
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, resp.GetMetric().GetValue())
+
+	resp, err = client.GetMetric(ctx, &metricspb.GetMetricRequest{Id: "PollCount", Type: metricspb.Metric_COUNTER})
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), resp.GetMetric().GetDelta())
+
+	resp, err = client.GetMetric(ctx, &metricspb.GetMetricRequest{
+		Id:     "latency",
+		Type:   metricspb.Metric_HISTOGRAM,
+		Labels: map[string]string{"host": "a"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), resp.GetMetric().GetHistogram().GetCount())
+	assert.Equal(t, map[string]string{"host": "a"}, resp.GetMetric().GetLabels())
+}
+
+func TestUpdateMetricsErrors(t *testing.T) {
+	client, _ := testClient(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		metric *metricspb.Metric
+	}{
+		{
+			name:   "unspecified type",
+			metric: &metricspb.Metric{Id: "Alloc", Data: &metricspb.Metric_Value{Value: 1}},
+		},
+		{
+			name:   "value does not match type",
+			metric: &metricspb.Metric{Id: "Alloc", Type: metricspb.Metric_COUNTER, Data: &metricspb.Metric_Value{Value: 1}},
+		},
+		{
+			name:   "missing id",
+			metric: &metricspb.Metric{Type: metricspb.Metric_GAUGE, Data: &metricspb.Metric_Value{Value: 1}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := client.UpdateMetrics(ctx, &metricspb.UpdateMetricsRequest{Metrics: []*metricspb.Metric{tt.metric}})
+			assert.Equal(t, codes.InvalidArgument, status.Code(err))
+		})
+	}
+
+	_, err := client.GetMetric(ctx, &metricspb.GetMetricRequest{Id: "missing", Type: metricspb.Metric_GAUGE})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestStreamMetrics(t *testing.T) {
+	client, mockAudit := testClientWithKey(t, "secret")
+	ctx := context.Background()
+
+	stream, err := client.StreamMetrics(ctx)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		req := &metricspb.UpdateMetricsRequest{Metrics: []*metricspb.Metric{
+			{Id: "PollCount", Type: metricspb.Metric_COUNTER, Data: &metricspb.Metric_Delta{Delta: 1}},
+		}}
+		require.NoError(t, req.Sign("secret"))
+		require.NoError(t, stream.Send(req))
+	}
+	_, err = stream.CloseAndRecv()
+	require.NoError(t, err)
+	assert.Len(t, mockAudit.metrics, 1)
+
+	resp, err := client.GetMetric(ctx, &metricspb.GetMetricRequest{Id: "PollCount", Type: metricspb.Metric_COUNTER})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), resp.GetMetric().GetDelta())
+
+	// A batch signed with another key rejects the whole stream
+	stream, err = client.StreamMetrics(ctx)
+	require.NoError(t, err)
+	valid := &metricspb.UpdateMetricsRequest{Metrics: []*metricspb.Metric{
+		{Id: "PollCount", Type: metricspb.Metric_COUNTER, Data: &metricspb.Metric_Delta{Delta: 1}},
+	}}
+	require.NoError(t, valid.Sign("secret"))
+	invalid := &metricspb.UpdateMetricsRequest{Metrics: valid.Metrics}
+	require.NoError(t, invalid.Sign("other"))
+	require.NoError(t, stream.Send(valid))
+	stream.Send(invalid)
+	_, err = stream.CloseAndRecv()
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	resp, err = client.GetMetric(ctx, &metricspb.GetMetricRequest{Id: "PollCount", Type: metricspb.Metric_COUNTER})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), resp.GetMetric().GetDelta())
+}
+
+func TestStreamMetricsLimit(t *testing.T) {
+	client, mockAudit := testClientWithConfig(t, &config.ServerConfig{StoreInterval: 300, GRPCMaxStreamMetrics: 3})
+	ctx := context.Background()
+	req := &metricspb.UpdateMetricsRequest{Metrics: []*metricspb.Metric{
+		{Id: "PollCount", Type: metricspb.Metric_COUNTER, Data: &metricspb.Metric_Delta{Delta: 1}},
+		{Id: "PollCount", Type: metricspb.Metric_COUNTER, Data: &metricspb.Metric_Delta{Delta: 1}},
+	}}
+
+	// A stream over the limit is rejected and nothing is stored
+	stream, err := client.StreamMetrics(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(req))
+	stream.Send(req)
+	_, err = stream.CloseAndRecv()
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Empty(t, mockAudit.metrics)
+	_, err = client.GetMetric(ctx, &metricspb.GetMetricRequest{Id: "PollCount", Type: metricspb.Metric_COUNTER})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	// A stream up to the limit is stored
+	stream, err = client.StreamMetrics(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(req))
+	require.NoError(t, stream.Send(&metricspb.UpdateMetricsRequest{Metrics: req.Metrics[:1]}))
+	_, err = stream.CloseAndRecv()
+	require.NoError(t, err)
+	resp, err := client.GetMetric(ctx, &metricspb.GetMetricRequest{Id: "PollCount", Type: metricspb.Metric_COUNTER})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), resp.GetMetric().GetDelta())
+}
+
+func TestListMetrics(t *testing.T) {
+	client, _ := testClient(t)
+	ctx := context.Background()
+
+	_, err := client.UpdateMetrics(ctx, &metricspb.UpdateMetricsRequest{Metrics: []*metricspb.Metric{
+		{Id: "cpu", Type: metricspb.Metric_GAUGE, Data: &metricspb.Metric_Value{Value: 1}, Labels: map[string]string{"host": "a"}},
+		{Id: "cpu", Type: metricspb.Metric_GAUGE, Data: &metricspb.Metric_Value{Value: 2}, Labels: map[string]string{"host": "b"}},
+		{Id: "PollCount", Type: metricspb.Metric_COUNTER, Data: &metricspb.Metric_Delta{Delta: 1}},
+	}})
+	require.NoError(t, err)
+
+	resp, err := client.ListMetrics(ctx, &metricspb.ListMetricsRequest{})
+	require.NoError(t, err)
+	assert.Len(t, resp.GetMetrics(), 3)
+
+	resp, err = client.ListMetrics(ctx, &metricspb.ListMetricsRequest{Labels: map[string]string{"host": "b"}})
+	require.NoError(t, err)
+	require.Len(t, resp.GetMetrics(), 1)
+	assert.Equal(t, 2.0, resp.GetMetrics()[0].GetValue())
+}
+
+func TestWatchMetrics(t *testing.T) {
+	client, _ := testClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := client.WatchMetrics(ctx, &metricspb.WatchMetricsRequest{Ids: []string{"PollCount"}})
+	require.NoError(t, err)
+
+	// The subscription is registered asynchronously, keep updating until the first value arrives
+	received := make(chan *metricspb.WatchMetricsResponse, 1)
+	go func() {
+		resp, err := stream.Recv()
+		if err == nil {
+			received <- resp
+		}
+	}()
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		_, err := client.UpdateMetrics(ctx, &metricspb.UpdateMetricsRequest{Metrics: []*metricspb.Metric{
+			{Id: "Alloc", Type: metricspb.Metric_GAUGE, Data: &metricspb.Metric_Value{Value: 1}},
+			{Id: "PollCount", Type: metricspb.Metric_COUNTER, Data: &metricspb.Metric_Delta{Delta: 1}},
+		}})
+		require.NoError(t, err)
+
+		select {
+		case resp := <-received:
+			require.Len(t, resp.GetMetrics(), 1)
+			assert.Equal(t, "PollCount", resp.GetMetrics()[0].GetId())
+			assert.Positive(t, resp.GetMetrics()[0].GetDelta())
+			return
+		case <-ticker.C:
+		case <-ctx.Done():
+			t.Fatal("no update received")
+		}
+	}
+}
+
+func TestTrustedSubnet(t *testing.T) {
+	server, client, mockAudit := startServer(t, &config.ServerConfig{StoreInterval: 300, TrustedSubnet: "192.168.1.0/24"})
+	req := &metricspb.UpdateMetricsRequest{Metrics: []*metricspb.Metric{
+		{Id: "Alloc", Type: metricspb.Metric_GAUGE, Data: &metricspb.Metric_Value{Value: 1}},
+	}}
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), realIPKey, "192.168.1.5")
+	_, err := client.UpdateMetrics(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.168.1.5"}, mockAudit.addresses)
+
+	ctx = metadata.AppendToOutgoingContext(context.Background(), realIPKey, "10.0.0.1")
+	_, err = client.UpdateMetrics(ctx, req)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = client.UpdateMetrics(context.Background(), req)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	stream, err := client.StreamMetrics(context.Background())
+	require.NoError(t, err)
+	_, err = stream.CloseAndRecv()
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Len(t, mockAudit.addresses, 1)
+
+	// A reloaded subnet applies to the next call
+	server.config.Store(&config.ServerConfig{StoreInterval: 300, TrustedSubnet: "10.0.0.0/8"})
+	ctx = metadata.AppendToOutgoingContext(context.Background(), realIPKey, "10.0.0.1")
+	_, err = client.UpdateMetrics(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.168.1.5", "10.0.0.1"}, mockAudit.addresses)
+}
+
+func TestShutdownEndsWatch(t *testing.T) {
+	server, client, _ := startServer(t, &config.ServerConfig{StoreInterval: 300})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := client.WatchMetrics(ctx, &metricspb.WatchMetricsRequest{})
+	require.NoError(t, err)
+	server.Shutdown()
+	server.Shutdown()
+
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestRateLimit(t *testing.T) {
+	client, _ := testClientWithConfig(t, &config.ServerConfig{StoreInterval: 300, RateLimit: 0.5, RateBurst: 1})
+	ctx := context.Background()
+	req := &metricspb.UpdateMetricsRequest{Metrics: []*metricspb.Metric{
+		{Id: "Alloc", Type: metricspb.Metric_GAUGE, Data: &metricspb.Metric_Value{Value: 1}},
+	}}
+
+	_, err := client.UpdateMetrics(ctx, req)
+	require.NoError(t, err)
+
+	var trailer metadata.MD
+	_, err = client.UpdateMetrics(ctx, req, grpc.Trailer(&trailer))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Equal(t, []string{"2"}, trailer.Get(retryAfterKey))
+
+	// Streams take tokens from the same bucket
+	stream, err := client.StreamMetrics(ctx)
+	require.NoError(t, err)
+	_, err = stream.CloseAndRecv()
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Equal(t, []string{"2"}, stream.Trailer().Get(retryAfterKey))
+
+	// Reads are not limited
+	_, err = client.ListMetrics(ctx, &metricspb.ListMetricsRequest{})
+	assert.NoError(t, err)
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	client, _ := testClientWithConfig(t, &config.ServerConfig{StoreInterval: 300, MaxConcurrentWrites: 1})
+	ctx := context.Background()
+	req := &metricspb.UpdateMetricsRequest{Metrics: []*metricspb.Metric{
+		{Id: "Alloc", Type: metricspb.Metric_GAUGE, Data: &metricspb.Metric_Value{Value: 1}},
+	}}
+
+	// An open stream holds the only slot
+	stream, err := client.StreamMetrics(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(req))
+	require.Eventually(t, func() bool {
+		_, err := client.UpdateMetrics(ctx, req)
+		return status.Code(err) == codes.ResourceExhausted
+	}, 5*time.Second, 10*time.Millisecond)
+
+	var trailer metadata.MD
+	_, err = client.UpdateMetrics(ctx, req, grpc.Trailer(&trailer))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Equal(t, []string{"1"}, trailer.Get(retryAfterKey))
+
+	_, err = client.ListMetrics(ctx, &metricspb.ListMetricsRequest{})
+	assert.NoError(t, err, "reads are not limited by the concurrent writes")
+
+	_, err = stream.CloseAndRecv()
+	require.NoError(t, err)
+	_, err = client.UpdateMetrics(ctx, req)
+	assert.NoError(t, err, "the slot is released when the stream ends")
+}
+
+func TestCryptoKeyRequiresTLS(t *testing.T) {
+	client, mockAudit := testClientWithConfig(t, &config.ServerConfig{StoreInterval: 300, CryptoKey: "private.pem"})
+	ctx := context.Background()
+	req := &metricspb.UpdateMetricsRequest{Metrics: []*metricspb.Metric{
+		{Id: "Alloc", Type: metricspb.Metric_GAUGE, Data: &metricspb.Metric_Value{Value: 1}},
+	}}
+
+	_, err := client.UpdateMetrics(ctx, req)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	stream, err := client.StreamMetrics(ctx)
+	require.NoError(t, err)
+	stream.Send(req)
+	_, err = stream.CloseAndRecv()
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Empty(t, mockAudit.metrics)
+
+	_, err = client.GetMetric(ctx, &metricspb.GetMetricRequest{Id: "Alloc", Type: metricspb.Metric_GAUGE})
+	assert.Equal(t, codes.NotFound, status.Code(err), "nothing is stored, and reads are still served")
+}
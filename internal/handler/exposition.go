@@ -0,0 +1,261 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Schera-ole/metrics/internal/config"
+	models "github.com/Schera-ole/metrics/internal/model"
+)
+
+const (
+	// PrometheusContentType is the content type of the Prometheus text exposition format.
+	PrometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+	// OpenMetricsContentType is the content type of the OpenMetrics text format.
+	OpenMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// wantsOpenMetrics reports whether the Accept header asks for the OpenMetrics format.
+func wantsOpenMetrics(accept string) bool {
+
+	return strings.Contains(accept, "application/openmetrics-text")
+}
+
+// SanitizeMetricName converts a metric name into a valid Prometheus metric name.
+//
+// Every character outside [a-zA-Z0-9_:] is replaced with an underscore, and a
+// leading digit is prefixed with an underscore.
+func SanitizeMetricName(name string) string {
+
+	if name == "" {
+		return "_"
+	}
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == ':':
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteRune('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
+
+// formatFloat formats a float64 value the way Prometheus expects it.
+func formatFloat(value float64) string {
+
+	switch {
+	case math.IsNaN(value):
+		return "NaN"
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// formatValue formats a stored gauge or counter value as a sample value.
+func formatValue(value any) (string, bool) {
+
+	switch v := value.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case float64:
+		return formatFloat(v), true
+	}
+	return "", false
+}
+
+// writeHistogram renders the cumulative _bucket samples, the _sum and the _count of a histogram.
+// labels must be sanitized already.
+func writeHistogram(w io.Writer, name string, labels map[string]string, hist models.HistogramValue) error {
+
+	bucketLabels := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		bucketLabels[k] = v
+	}
+	var cumulative uint64
+	for i, count := range hist.Counts {
+		cumulative += count
+		bucketLabels["le"] = "+Inf"
+		if i < len(hist.Bounds) {
+			bucketLabels["le"] = formatFloat(hist.Bounds[i])
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(bucketLabels), cumulative); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%s_sum%s %s\n%s_count%s %d\n",
+		name, formatLabels(labels), formatFloat(hist.Sum),
+		name, formatLabels(labels), hist.Count)
+	return err
+}
+
+// sanitizeLabels returns labels with sanitized names. It reports false if two label names
+// sanitize to the same name, since one of the values would be lost.
+func sanitizeLabels(labels map[string]string) (map[string]string, bool) {
+
+	sanitized := make(map[string]string, len(labels))
+	for k, v := range labels {
+		name := strings.ReplaceAll(SanitizeMetricName(k), ":", "_")
+		if _, exists := sanitized[name]; exists {
+			return nil, false
+		}
+		sanitized[name] = v
+	}
+	return sanitized, true
+}
+
+// formatLabels renders a sanitized label set as {k1="v1",k2="v2"} with sorted label names.
+func formatLabels(labels map[string]string) string {
+
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, k := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteString(`="`)
+		b.WriteString(labelValueReplacer.Replace(labels[k]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// labelValueReplacer escapes label values as required by the exposition formats.
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// exposedSeries is a series prepared for the exposition.
+type exposedSeries struct {
+	// metric is the stored series
+	metric models.Metric
+
+	// family is the metric family name in the TYPE line
+	family string
+
+	// sample is the name of the sample of a gauge or counter
+	sample string
+
+	// labels are the sanitized labels
+	labels map[string]string
+
+	// formatted is the rendered label set
+	formatted string
+}
+
+// WriteExposition renders metrics in the Prometheus text exposition format, or
+// in the OpenMetrics text format if openMetrics is set.
+//
+// Metrics are sorted by their family name and labels so that the output is stable,
+// and all series of a metric share a single TYPE line.
+//
+// Metrics whose names sanitize to a family already used by another metric, or whose label
+// names collide once sanitized, cannot be rendered without mixing or losing samples. They are
+// skipped, and their names are returned so the caller can report them. Of colliding metrics,
+// the one whose name sorts first is kept.
+func WriteExposition(w io.Writer, metrics []models.Metric, openMetrics bool) ([]string, error) {
+
+	var skipped []string
+	series := make([]exposedSeries, 0, len(metrics))
+	for _, metric := range metrics {
+		name := SanitizeMetricName(metric.Name)
+		sample := name
+		switch metric.Type {
+		case config.CounterType:
+			if openMetrics {
+				// OpenMetrics requires the _total suffix on counter samples only
+				name = strings.TrimSuffix(name, "_total")
+				sample = name + "_total"
+			}
+		case config.GaugeType, config.HistogramType:
+		default:
+			continue
+		}
+		labels, ok := sanitizeLabels(metric.Labels)
+		if _, reserved := labels["le"]; ok && reserved && metric.Type == config.HistogramType {
+			// The le label holds the bucket bounds of a histogram
+			ok = false
+		}
+		if !ok {
+			skipped = append(skipped, metric.Name)
+			continue
+		}
+		series = append(series, exposedSeries{
+			metric:    metric,
+			family:    name,
+			sample:    sample,
+			labels:    labels,
+			formatted: formatLabels(labels),
+		})
+	}
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].family != series[j].family {
+			return series[i].family < series[j].family
+		}
+		if series[i].metric.Name != series[j].metric.Name {
+			return series[i].metric.Name < series[j].metric.Name
+		}
+		return series[i].formatted < series[j].formatted
+	})
+
+	// owners stores the name of the metric rendered in each family
+	owners := make(map[string]string)
+	for _, s := range series {
+		metric := s.metric
+		if owner, exists := owners[s.family]; exists && owner != metric.Name {
+			if len(skipped) == 0 || skipped[len(skipped)-1] != metric.Name {
+				skipped = append(skipped, metric.Name)
+			}
+			continue
+		}
+		hist, isHistogram := metric.Value.(models.HistogramValue)
+		value, ok := formatValue(metric.Value)
+		if !ok && !isHistogram {
+			continue
+		}
+		if _, exists := owners[s.family]; !exists {
+			owners[s.family] = metric.Name
+			if _, err := fmt.Fprintf(w, "# TYPE %s %s\n", s.family, metric.Type); err != nil {
+				return skipped, err
+			}
+		}
+		if isHistogram {
+			if err := writeHistogram(w, s.family, s.labels, hist); err != nil {
+				return skipped, err
+			}
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", s.sample, s.formatted, value); err != nil {
+			return skipped, err
+		}
+	}
+	if openMetrics {
+		if _, err := io.WriteString(w, "# EOF\n"); err != nil {
+			return skipped, err
+		}
+	}
+	return skipped, nil
+}
@@ -6,7 +6,9 @@ package handler
 
 import (
 	"bytes"
+	"crypto/rsa"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -18,41 +20,67 @@ import (
 	"github.com/go-chi/chi/v5/middleware"
 	"go.uber.org/zap"
 
+	"github.com/Schera-ole/metrics/internal/alerting"
 	"github.com/Schera-ole/metrics/internal/audit"
 	"github.com/Schera-ole/metrics/internal/config"
 	internalerrors "github.com/Schera-ole/metrics/internal/errors"
+	"github.com/Schera-ole/metrics/internal/history"
 	middlewareinternal "github.com/Schera-ole/metrics/internal/middleware"
 	models "github.com/Schera-ole/metrics/internal/model"
 	"github.com/Schera-ole/metrics/internal/service"
 )
 
+// maxQueryPoints limits the number of points a resampled range query may return per series.
+const maxQueryPoints = 11000
+
 // Router creates and configures the HTTP router with all metrics endpoints.
+//
+// The handlers load serverConfig for every request, so the key, the rate limits and the trusted
+// subnet can be changed while the server is running. The limits apply to the update endpoints only. alertEngine may be nil if alerting is disabled.
+// privateKey decrypts encrypted update requests, and may be nil if encryption is disabled.
+// limits are shared with the gRPC API; if nil, the router creates its own from serverConfig.
 func Router(
 	logger *zap.SugaredLogger,
-	config *config.ServerConfig,
+	serverConfig *config.Reloadable,
 	metricService *service.MetricsService,
 	auditLogger audit.AuditLogger,
+	alertEngine *alerting.Engine,
+	privateKey *rsa.PrivateKey,
+	limits *middlewareinternal.Limits,
 ) chi.Router {
 
+	if limits == nil {
+		limits = middlewareinternal.NewLimits(serverConfig)
+	}
+
 	router := chi.NewRouter()
 	router.Use(middlewareinternal.LoggingMiddleware(logger))
 	router.Use(middlewareinternal.GzipMiddleware)
 	router.Use(middleware.StripSlashes)
 	router.Use(middleware.Timeout(15 * time.Second))
-	router.Post("/update/{type}/{metric}/{value}", func(w http.ResponseWriter, r *http.Request) {
-		UpdateHandlerWithParams(w, r, logger, config, metricService, auditLogger)
-	})
-	router.Post("/update", func(w http.ResponseWriter, r *http.Request) {
-		UpdateHandler(w, r, logger, config, metricService, auditLogger)
-	})
-	router.Post("/updates", func(w http.ResponseWriter, r *http.Request) {
-		BatchUpdateHandler(w, r, logger, config, metricService, auditLogger)
+	router.Group(func(writes chi.Router) {
+		// Only updates are limited, so scrapes and reads keep working while agents are throttled
+		writes.Use(limits.Rate.Middleware)
+		writes.Use(middlewareinternal.TrustedSubnet(serverConfig))
+		writes.Use(limits.Writes.Middleware)
+		if privateKey != nil {
+			writes.Use(middlewareinternal.Decrypt(privateKey))
+		}
+		writes.Post("/update/{type}/{metric}/{value}", func(w http.ResponseWriter, r *http.Request) {
+			UpdateHandlerWithParams(w, r, logger, serverConfig.Load(), metricService, auditLogger)
+		})
+		writes.Post("/update", func(w http.ResponseWriter, r *http.Request) {
+			UpdateHandler(w, r, logger, serverConfig.Load(), metricService, auditLogger)
+		})
+		writes.Post("/updates", func(w http.ResponseWriter, r *http.Request) {
+			BatchUpdateHandler(w, r, logger, serverConfig.Load(), metricService, auditLogger)
+		})
 	})
 	router.Get("/value/{type}/{name}", func(w http.ResponseWriter, r *http.Request) {
 		GetHandler(w, r, metricService)
 	})
 	router.Post("/value", func(w http.ResponseWriter, r *http.Request) {
-		GetValue(w, r, metricService, logger, config)
+		GetValue(w, r, metricService, logger, serverConfig.Load())
 	})
 	router.Get("/ping", func(w http.ResponseWriter, r *http.Request) {
 		PingDatabaseHandler(w, r, metricService, logger)
@@ -60,6 +88,15 @@ func Router(
 	router.Get("/", func(w http.ResponseWriter, r *http.Request) {
 		GetListHandler(w, r, metricService)
 	})
+	router.Get("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		PrometheusHandler(w, r, metricService, logger)
+	})
+	router.Get("/api/v1/query_range", func(w http.ResponseWriter, r *http.Request) {
+		QueryRangeHandler(w, r, metricService, logger)
+	})
+	router.Get("/api/v1/alerts", func(w http.ResponseWriter, r *http.Request) {
+		AlertsHandler(w, r, alertEngine)
+	})
 	return router
 }
 
@@ -109,33 +146,29 @@ func BatchUpdateHandler(
 		http.Error(w, "Invalid JSON format: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	var preparedMetrics []models.Metric
-	var metricsName []string
+	preparedMetrics := make([]models.Metric, 0, len(metrics))
+	metricsName := make([]string, 0, len(metrics))
 	for _, d := range metrics {
-		if d.Value != nil {
-			preparedMetrics = append(preparedMetrics, models.Metric{
-				Name:  d.ID,
-				Type:  d.MType,
-				Value: *d.Value,
-			})
-		}
-		if d.Delta != nil {
-			preparedMetrics = append(preparedMetrics, models.Metric{
-				Name:  d.ID,
-				Type:  d.MType,
-				Value: *d.Delta,
-			})
+		metric, err := metricFromDTO(d)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
+		preparedMetrics = append(preparedMetrics, metric)
 		metricsName = append(metricsName, d.ID)
 	}
 	err = metricService.SetMetrics(r.Context(), preparedMetrics)
+	if errors.Is(err, internalerrors.ErrInvalidMetricValue) || errors.Is(err, internalerrors.ErrHistogramBoundsMismatch) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		logger.Info(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
-	if config.StoreInterval == 0 {
+	if config.SavesOnUpdate() {
 		// Only save to file if using MemStorage
 		if metricService.IsMemStorage() {
 			if err := metricService.SaveMetrics(r.Context(), config.FileStoragePath); err != nil {
@@ -143,7 +176,7 @@ func BatchUpdateHandler(
 			}
 		}
 	}
-	SendAuditEvent(metricsName, r.RemoteAddr, auditLogger, logger)
+	SendAuditEvent(metricsName, r, auditLogger, logger)
 }
 
 // PingDatabaseHandler checks the database connection health.
@@ -157,6 +190,33 @@ func PingDatabaseHandler(w http.ResponseWriter, r *http.Request, metricService *
 	w.WriteHeader(http.StatusOK)
 }
 
+// metricFromDTO converts an update DTO to a metric. The DTO must carry the value field of its
+// type and no other.
+func metricFromDTO(d models.MetricsDTO) (models.Metric, error) {
+
+	metric := models.Metric{Name: d.ID, Type: d.MType, Labels: d.Labels}
+	switch d.MType {
+	case models.Gauge:
+		if d.Value == nil || d.Delta != nil || d.Histogram != nil {
+			return models.Metric{}, fmt.Errorf("%w: gauge metric %s must have a value and nothing else", internalerrors.ErrInvalidMetricValue, d.ID)
+		}
+		metric.Value = *d.Value
+	case models.Counter:
+		if d.Delta == nil || d.Value != nil || d.Histogram != nil {
+			return models.Metric{}, fmt.Errorf("%w: counter metric %s must have a delta and nothing else", internalerrors.ErrInvalidMetricValue, d.ID)
+		}
+		metric.Value = *d.Delta
+	case models.Histogram:
+		if d.Histogram == nil || d.Value != nil || d.Delta != nil {
+			return models.Metric{}, fmt.Errorf("%w: histogram metric %s must have a histogram and nothing else", internalerrors.ErrInvalidMetricValue, d.ID)
+		}
+		metric.Value = *d.Histogram
+	default:
+		return models.Metric{}, fmt.Errorf("%w: %q of %s", internalerrors.ErrUnknownMetricType, d.MType, d.ID)
+	}
+	return metric, nil
+}
+
 // UpdateHandler processes a single metric update request.
 func UpdateHandler(
 	w http.ResponseWriter,
@@ -203,30 +263,19 @@ func UpdateHandler(
 		http.Error(w, "Invalid JSON format: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	switch metrics.MType {
-	case models.Gauge:
-		if metrics.Value == nil {
-			http.Error(w, "Gauge metrics must have a value", http.StatusBadRequest)
-			return
-		}
-		err = metricService.SetMetric(r.Context(), metrics.ID, *metrics.Value, metrics.MType)
-	case models.Counter:
-		if metrics.Delta == nil {
-			http.Error(w, "Counter metrics must have a delta", http.StatusBadRequest)
-			return
-		}
-		err = metricService.SetMetric(r.Context(), metrics.ID, *metrics.Delta, metrics.MType)
-	default:
-		http.Error(w, "Invalid metric type", http.StatusBadRequest)
+	metric, err := metricFromDTO(metrics)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	err = metricService.SetMetrics(r.Context(), []models.Metric{metric})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 
-	if config.StoreInterval == 0 {
+	if config.SavesOnUpdate() {
 		// Only save to file if using MemStorage
 		if metricService.IsMemStorage() {
 			if err := metricService.SaveMetrics(r.Context(), config.FileStoragePath); err != nil {
@@ -235,7 +284,7 @@ func UpdateHandler(
 		}
 	}
 	metricsList := []string{metrics.ID}
-	SendAuditEvent(metricsList, r.RemoteAddr, auditLogger, logger)
+	SendAuditEvent(metricsList, r, auditLogger, logger)
 }
 
 // UpdateHandlerWithParams processes a single metric update request using URL parameters.
@@ -284,7 +333,7 @@ func UpdateHandlerWithParams(
 	}
 	w.WriteHeader(http.StatusOK)
 
-	if config.StoreInterval == 0 {
+	if config.SavesOnUpdate() {
 		// Only save to file if using MemStorage
 		if metricService.IsMemStorage() {
 			if err := metricService.SaveMetrics(r.Context(), config.FileStoragePath); err != nil {
@@ -293,7 +342,7 @@ func UpdateHandlerWithParams(
 		}
 	}
 	metricsList := []string{metricName}
-	SendAuditEvent(metricsList, r.RemoteAddr, auditLogger, logger)
+	SendAuditEvent(metricsList, r, auditLogger, logger)
 }
 
 // GetValue retrieves a single metric value by its ID and type.
@@ -371,10 +420,27 @@ func GetValue(w http.ResponseWriter, r *http.Request, metricService *service.Met
 }
 
 // GetHandler retrieves a single metric value by its name using URL parameters.
+//
+// Query parameters select the labels of the series; without them the series without labels is returned.
 func GetHandler(w http.ResponseWriter, r *http.Request, metricService *service.MetricsService) {
 
 	metricName := chi.URLParam(r, "name")
-	metricValue, err := metricService.GetMetricByName(r.Context(), metricName)
+	labels := LabelsFromQuery(r)
+	var metricValue any
+	var err error
+	if len(labels) == 0 {
+		metricValue, err = metricService.GetMetricByName(r.Context(), metricName)
+	} else {
+		var dto models.MetricsDTO
+		dto, err = metricService.GetMetric(r.Context(), models.MetricsDTO{ID: metricName, Labels: labels})
+		if dto.Value != nil {
+			metricValue = *dto.Value
+		} else if dto.Delta != nil {
+			metricValue = *dto.Delta
+		} else if dto.Histogram != nil {
+			metricValue = *dto.Histogram
+		}
+	}
 	if err != nil {
 		http.Error(w, internalerrors.ErrMetricNotFound.Error(), http.StatusNotFound)
 		return
@@ -384,15 +450,131 @@ func GetHandler(w http.ResponseWriter, r *http.Request, metricService *service.M
 }
 
 // GetListHandler retrieves all metrics and returns them as a formatted list.
+//
+// Query parameters filter the list by label.
 func GetListHandler(w http.ResponseWriter, r *http.Request, metricService *service.MetricsService) {
 
 	var result string
-	metrics, _ := metricService.ListMetrics(r.Context())
+	metrics, _ := metricService.ListMetricsByLabels(r.Context(), LabelsFromQuery(r))
 
 	for _, v := range metrics {
-		result += fmt.Sprintf("%s: %s\n", v.Name, v.Value)
+		result += fmt.Sprintf("%s: %s\n", models.SeriesKey(v.Name, v.Labels), v.Value)
 	}
 	w.Header().Set("Content-Type", "text/html")
 	io.WriteString(w, result)
 	w.WriteHeader(http.StatusOK)
 }
+
+// PrometheusHandler renders all metrics in the Prometheus text exposition format.
+//
+// If the Accept header asks for application/openmetrics-text, the OpenMetrics format is used instead.
+// Query parameters filter the metrics by label.
+func PrometheusHandler(w http.ResponseWriter, r *http.Request, metricService *service.MetricsService, logger *zap.SugaredLogger) {
+
+	metrics, err := metricService.ListMetricsByLabels(r.Context(), LabelsFromQuery(r))
+	if err != nil {
+		logger.Errorf("error listing metrics: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	openMetrics := wantsOpenMetrics(r.Header.Get("Accept"))
+	var buf bytes.Buffer
+	skipped, err := WriteExposition(&buf, metrics, openMetrics)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(skipped) > 0 {
+		logger.Warnf("skipped metrics whose exposition names collide with other metrics: %v", skipped)
+	}
+	if openMetrics {
+		w.Header().Set("Content-Type", OpenMetricsContentType)
+	} else {
+		w.Header().Set("Content-Type", PrometheusContentType)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// QueryRangeHandler returns the history of a metric between two points in time.
+//
+// It accepts the name, from, to and step query parameters; any other parameter filters the series by label.
+// Times are RFC 3339 or Unix seconds, step is a duration such as 15s or a number of seconds.
+// If from and to are omitted, the last hour is returned; without step the raw samples are returned.
+func QueryRangeHandler(w http.ResponseWriter, r *http.Request, metricService *service.MetricsService, logger *zap.SugaredLogger) {
+
+	query := r.URL.Query()
+	name := query.Get("name")
+	if name == "" {
+		http.Error(w, "name parameter is required", http.StatusBadRequest)
+		return
+	}
+	to, err := ParseTimeParam(query.Get("to"), time.Now())
+	if err != nil {
+		http.Error(w, "invalid to parameter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, err := ParseTimeParam(query.Get("from"), to.Add(-time.Hour))
+	if err != nil {
+		http.Error(w, "invalid from parameter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	step, err := ParseStepParam(query.Get("step"))
+	if err != nil {
+		http.Error(w, "invalid step parameter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if from.After(to) {
+		http.Error(w, "from must not be after to", http.StatusBadRequest)
+		return
+	}
+	if step > 0 && to.Sub(from)/step > maxQueryPoints {
+		http.Error(w, "too many points requested, increase step", http.StatusBadRequest)
+		return
+	}
+
+	matchers := LabelsFromQuery(r)
+	for _, param := range []string{"name", "from", "to", "step"} {
+		delete(matchers, param)
+	}
+	series, err := metricService.QueryRange(r.Context(), name, matchers, from, to, step)
+	if err != nil {
+		if errors.Is(err, internalerrors.ErrHistoryDisabled) {
+			http.Error(w, err.Error(), http.StatusNotImplemented)
+			return
+		}
+		logger.Errorf("error querying history: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if series == nil {
+		series = []history.Series{}
+	}
+
+	responseData, err := json.Marshal(series)
+	if err != nil {
+		http.Error(w, "Failed to marshal response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseData)
+}
+
+// AlertsHandler returns the pending and firing alerts as JSON.
+func AlertsHandler(w http.ResponseWriter, r *http.Request, alertEngine *alerting.Engine) {
+
+	if alertEngine == nil {
+		http.Error(w, "alerting is disabled", http.StatusNotImplemented)
+		return
+	}
+	responseData, err := json.Marshal(alertEngine.ActiveAlerts())
+	if err != nil {
+		http.Error(w, "Failed to marshal response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseData)
+}
@@ -3,19 +3,26 @@ package handler
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"go.uber.org/zap"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/Schera-ole/metrics/internal/alerting"
 	"github.com/Schera-ole/metrics/internal/config"
+	"github.com/Schera-ole/metrics/internal/history"
 	models "github.com/Schera-ole/metrics/internal/model"
 	"github.com/Schera-ole/metrics/internal/repository"
 	"github.com/Schera-ole/metrics/internal/service"
@@ -70,6 +77,11 @@ func (m *MockedStorage) SetMetrics(ctx context.Context, metrics []models.Metric)
 	return nil
 }
 
+func (m *MockedStorage) UpdateMetrics(ctx context.Context, metrics []models.Metric) ([]repository.Update, error) {
+	// Stub implementation
+	return nil, nil
+}
+
 func (m *MockedStorage) GetMetric(ctx context.Context, metrics models.MetricsDTO) (models.MetricsDTO, error) {
 	// Stub implementation
 	return models.MetricsDTO{}, nil
@@ -109,20 +121,22 @@ type mockAuditLogger struct {
 type auditLogCall struct {
 	metrics   []string
 	ipAddress string
+	identity  string
 }
 
 // Log implements the AuditLogger interface.
-func (m *mockAuditLogger) Log(metrics []string, ipAddress string) {
+func (m *mockAuditLogger) Log(metrics []string, ipAddress string, identity string) {
 	m.logCalls = append(m.logCalls, auditLogCall{
 		metrics:   metrics,
 		ipAddress: ipAddress,
+		identity:  identity,
 	})
 }
 
 func TestUpdateHandler(t *testing.T) {
 	metricService, testConfig, logSugar := testSetup(t)
 	mockAudit := &mockAuditLogger{}
-	ts := httptest.NewServer(Router(logSugar, testConfig, metricService, mockAudit))
+	ts := httptest.NewServer(Router(logSugar, config.NewReloadable(testConfig), metricService, mockAudit, nil, nil, nil))
 	defer ts.Close()
 
 	tests := []struct {
@@ -197,7 +211,7 @@ func TestGetHandler(t *testing.T) {
 	err := metricService.SetMetric(context.Background(), "TestGauge", 42.5, models.Gauge)
 	require.NoError(t, err)
 
-	ts := httptest.NewServer(Router(logSugar, testConfig, metricService, mockAudit))
+	ts := httptest.NewServer(Router(logSugar, config.NewReloadable(testConfig), metricService, mockAudit, nil, nil, nil))
 	defer ts.Close()
 
 	r := testRequest(t, ts, http.MethodGet, "/value/gauge/TestGauge", nil)
@@ -215,7 +229,7 @@ func TestGetValueHandler(t *testing.T) {
 	err := metricService.SetMetric(context.Background(), "TestCounter", int64(10), models.Counter)
 	require.NoError(t, err)
 
-	ts := httptest.NewServer(Router(logSugar, testConfig, metricService, mockAudit))
+	ts := httptest.NewServer(Router(logSugar, config.NewReloadable(testConfig), metricService, mockAudit, nil, nil, nil))
 	defer ts.Close()
 
 	requestBody := `{"id":"TestCounter","type":"counter"}`
@@ -241,7 +255,7 @@ func TestGetListHandler(t *testing.T) {
 	_ = metricService.SetMetric(context.Background(), "M1", 1.0, models.Gauge)
 	_ = metricService.SetMetric(context.Background(), "M2", int64(2), models.Counter)
 
-	ts := httptest.NewServer(Router(logSugar, testConfig, metricService, mockAudit))
+	ts := httptest.NewServer(Router(logSugar, config.NewReloadable(testConfig), metricService, mockAudit, nil, nil, nil))
 	defer ts.Close()
 
 	r := testRequest(t, ts, http.MethodGet, "/", nil)
@@ -256,7 +270,7 @@ func TestGetListHandler(t *testing.T) {
 func TestPingHandler(t *testing.T) {
 	metricService, testConfig, logSugar := testSetup(t)
 	mockAudit := &mockAuditLogger{}
-	ts := httptest.NewServer(Router(logSugar, testConfig, metricService, mockAudit))
+	ts := httptest.NewServer(Router(logSugar, config.NewReloadable(testConfig), metricService, mockAudit, nil, nil, nil))
 	defer ts.Close()
 
 	r := testRequest(t, ts, http.MethodGet, "/ping", nil)
@@ -267,7 +281,7 @@ func TestPingHandler(t *testing.T) {
 func TestBatchUpdateHandler(t *testing.T) {
 	metricService, testConfig, logSugar := testSetup(t)
 	mockAudit := &mockAuditLogger{}
-	ts := httptest.NewServer(Router(logSugar, testConfig, metricService, mockAudit))
+	ts := httptest.NewServer(Router(logSugar, config.NewReloadable(testConfig), metricService, mockAudit, nil, nil, nil))
 	defer ts.Close()
 
 	// Prepare batch payload
@@ -291,12 +305,30 @@ func TestBatchUpdateHandler(t *testing.T) {
 	r2 := testRequest(t, ts, http.MethodPost, "/updates", bytes.NewReader([]byte(`[{"invalid": json`)))
 	defer r2.Body.Close()
 	assert.Equal(t, http.StatusBadRequest, r2.StatusCode)
+
+	// Value fields that do not match the type are rejected, and the batch is not applied
+	for _, batch := range []string{
+		`[{"id":"B2","type":"counter","delta":1},{"id":"x","type":"gauge","delta":1}]`,
+		`[{"id":"B2","type":"counter","delta":1},{"id":"x","type":"gauge","histogram":{"bounds":[1],"counts":[0,0],"sum":0,"count":0}}]`,
+		`[{"id":"B2","type":"counter","delta":1},{"id":"x","type":"counter","value":1}]`,
+		`[{"id":"B2","type":"counter","delta":1},{"id":"x","type":"histogram","value":1}]`,
+		`[{"id":"B2","type":"counter","delta":1},{"id":"x","type":"gauge","value":1,"delta":1}]`,
+		`[{"id":"B2","type":"counter","delta":1},{"id":"x","type":"summary","value":1}]`,
+		`[{"id":"B2","type":"counter","delta":1},{"id":"x","type":"histogram","histogram":{"bounds":[1],"counts":[1],"sum":0,"count":1}}]`,
+	} {
+		r3 := testRequest(t, ts, http.MethodPost, "/updates", bytes.NewBufferString(batch))
+		r3.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, r3.StatusCode, batch)
+	}
+	m2, err = metricService.GetMetricByName(context.Background(), "B2")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), m2)
 }
 
 func TestUpdateHandlerWithParams(t *testing.T) {
 	metricService, testConfig, logSugar := testSetup(t)
 	mockAudit := &mockAuditLogger{}
-	ts := httptest.NewServer(Router(logSugar, testConfig, metricService, mockAudit))
+	ts := httptest.NewServer(Router(logSugar, config.NewReloadable(testConfig), metricService, mockAudit, nil, nil, nil))
 	defer ts.Close()
 
 	tests := []struct {
@@ -363,3 +395,343 @@ func TestUpdateHandlerWithParams(t *testing.T) {
 		})
 	}
 }
+
+func TestPrometheusHandler(t *testing.T) {
+	metricService, testConfig, logSugar := testSetup(t)
+	mockAudit := &mockAuditLogger{}
+
+	_ = metricService.SetMetric(context.Background(), "HeapAlloc", 1.5, models.Gauge)
+	_ = metricService.SetMetric(context.Background(), "PollCount", int64(3), models.Counter)
+	_ = metricService.SetMetric(context.Background(), "1bad-name.x", 2.0, models.Gauge)
+
+	ts := httptest.NewServer(Router(logSugar, config.NewReloadable(testConfig), metricService, mockAudit, nil, nil, nil))
+	defer ts.Close()
+
+	r := testRequest(t, ts, http.MethodGet, "/metrics", nil)
+	defer r.Body.Close()
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+	assert.Equal(t, PrometheusContentType, r.Header.Get("Content-Type"))
+	bodyBytes, _ := io.ReadAll(r.Body)
+	assert.Equal(t, "# TYPE HeapAlloc gauge\nHeapAlloc 1.5\n"+
+		"# TYPE PollCount counter\nPollCount 3\n"+
+		"# TYPE _1bad_name_x gauge\n_1bad_name_x 2\n", string(bodyBytes))
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/metrics", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	r2, err := ts.Client().Do(req)
+	require.NoError(t, err)
+	defer r2.Body.Close()
+	assert.Equal(t, OpenMetricsContentType, r2.Header.Get("Content-Type"))
+	bodyBytes, _ = io.ReadAll(r2.Body)
+	bodyStr := string(bodyBytes)
+	assert.Contains(t, bodyStr, "# TYPE PollCount counter\nPollCount_total 3\n")
+	assert.True(t, strings.HasSuffix(bodyStr, "# EOF\n"))
+}
+
+func TestSanitizeMetricName(t *testing.T) {
+	assert.Equal(t, "HeapAlloc", SanitizeMetricName("HeapAlloc"))
+	assert.Equal(t, "cpu_usage_0", SanitizeMetricName("cpu.usage-0"))
+	assert.Equal(t, "_0abc", SanitizeMetricName("0abc"))
+	assert.Equal(t, "_", SanitizeMetricName(""))
+}
+
+func TestWriteExpositionNameCollisions(t *testing.T) {
+	metrics := []models.Metric{
+		{Name: "x_total", Type: models.Counter, Value: int64(3)},
+		{Name: "x", Type: models.Gauge, Value: 1.5},
+		{Name: "a.b", Type: models.Gauge, Value: 2.0},
+		{Name: "a-b", Type: models.Counter, Value: int64(4)},
+	}
+
+	var buf bytes.Buffer
+	skipped, err := WriteExposition(&buf, metrics, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.b"}, skipped)
+	assert.Equal(t, "# TYPE a_b counter\na_b 4\n"+
+		"# TYPE x gauge\nx 1.5\n"+
+		"# TYPE x_total counter\nx_total 3\n", buf.String())
+
+	// In OpenMetrics the counter x_total belongs to the family x, like the gauge x
+	buf.Reset()
+	skipped, err = WriteExposition(&buf, metrics, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.b", "x_total"}, skipped)
+	assert.Equal(t, "# TYPE a_b counter\na_b_total 4\n"+
+		"# TYPE x gauge\nx 1.5\n# EOF\n", buf.String())
+}
+
+func TestWriteExpositionLabelCollisions(t *testing.T) {
+	metrics := []models.Metric{
+		{Name: "CPU", Type: models.Gauge, Value: 1.0, Labels: map[string]string{"cpu.id": "0", "cpu-id": "1"}},
+		{Name: "CPU", Type: models.Gauge, Value: 2.0, Labels: map[string]string{"cpu.id": "2"}},
+		{Name: "Latency", Type: models.Histogram, Value: models.HistogramValue{
+			Bounds: []float64{1}, Counts: []uint64{1, 0}, Sum: 0.5, Count: 1,
+		}, Labels: map[string]string{"le": "1"}},
+	}
+
+	var buf bytes.Buffer
+	skipped, err := WriteExposition(&buf, metrics, false)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"CPU", "Latency"}, skipped)
+	assert.Equal(t, "# TYPE CPU gauge\nCPU{cpu_id=\"2\"} 2\n", buf.String())
+}
+
+func TestLabelsEndToEnd(t *testing.T) {
+	metricService, testConfig, logSugar := testSetup(t)
+	mockAudit := &mockAuditLogger{}
+	ts := httptest.NewServer(Router(logSugar, config.NewReloadable(testConfig), metricService, mockAudit, nil, nil, nil))
+	defer ts.Close()
+
+	batch := `[{"id":"CPU","type":"gauge","value":10,"labels":{"cpu":"0","host":"a"}},` +
+		`{"id":"CPU","type":"gauge","value":20,"labels":{"cpu":"1","host":"a"}},` +
+		`{"id":"CPU","type":"gauge","value":30,"labels":{"cpu":"0","host":"b"}}]`
+	r := testRequest(t, ts, http.MethodPost, "/updates", bytes.NewBufferString(batch))
+	r.Body.Close()
+	require.Equal(t, http.StatusOK, r.StatusCode)
+
+	r = testRequest(t, ts, http.MethodPost, "/update", bytes.NewBufferString(`{"id":"Hits","type":"counter","delta":4,"labels":{"host":"a"}}`))
+	r.Body.Close()
+	require.Equal(t, http.StatusOK, r.StatusCode)
+
+	// Exact series lookup through /value
+	r = testRequest(t, ts, http.MethodPost, "/value", bytes.NewBufferString(`{"id":"CPU","type":"gauge","labels":{"host":"a","cpu":"1"}}`))
+	defer r.Body.Close()
+	require.Equal(t, http.StatusOK, r.StatusCode)
+	var resp models.MetricsDTO
+	require.NoError(t, json.NewDecoder(r.Body).Decode(&resp))
+	assert.Equal(t, 20.0, *resp.Value)
+
+	r2 := testRequest(t, ts, http.MethodGet, "/value/gauge/CPU?cpu=0&host=b", nil)
+	defer r2.Body.Close()
+	require.Equal(t, http.StatusOK, r2.StatusCode)
+	bodyBytes, _ := io.ReadAll(r2.Body)
+	assert.Equal(t, "30", string(bodyBytes))
+
+	r3 := testRequest(t, ts, http.MethodGet, "/value/gauge/CPU?cpu=7", nil)
+	r3.Body.Close()
+	assert.Equal(t, http.StatusNotFound, r3.StatusCode)
+
+	// Listing filtered by label
+	r4 := testRequest(t, ts, http.MethodGet, "/metrics?host=a", nil)
+	defer r4.Body.Close()
+	bodyBytes, _ = io.ReadAll(r4.Body)
+	assert.Equal(t, "# TYPE CPU gauge\nCPU{cpu=\"0\",host=\"a\"} 10\nCPU{cpu=\"1\",host=\"a\"} 20\n"+
+		"# TYPE Hits counter\nHits{host=\"a\"} 4\n", string(bodyBytes))
+}
+
+func TestHistogramUpdates(t *testing.T) {
+	metricService, testConfig, logSugar := testSetup(t)
+	mockAudit := &mockAuditLogger{}
+	ts := httptest.NewServer(Router(logSugar, config.NewReloadable(testConfig), metricService, mockAudit, nil, nil, nil))
+	defer ts.Close()
+
+	batch := `[{"id":"latency","type":"histogram","histogram":{"bounds":[0.1,1],"counts":[1,2,0],"sum":1.2,"count":3}},` +
+		`{"id":"latency","type":"histogram","histogram":{"bounds":[0.1,1],"counts":[0,1,1],"sum":3.5,"count":2}}]`
+	r := testRequest(t, ts, http.MethodPost, "/updates", bytes.NewBufferString(batch))
+	r.Body.Close()
+	require.Equal(t, http.StatusOK, r.StatusCode)
+
+	r = testRequest(t, ts, http.MethodPost, "/value", bytes.NewBufferString(`{"id":"latency","type":"histogram"}`))
+	defer r.Body.Close()
+	require.Equal(t, http.StatusOK, r.StatusCode)
+	var resp models.MetricsDTO
+	require.NoError(t, json.NewDecoder(r.Body).Decode(&resp))
+	require.NotNil(t, resp.Histogram)
+	assert.Equal(t, []uint64{1, 3, 1}, resp.Histogram.Counts)
+	assert.Equal(t, uint64(5), resp.Histogram.Count)
+
+	r2 := testRequest(t, ts, http.MethodGet, "/metrics", nil)
+	defer r2.Body.Close()
+	bodyBytes, _ := io.ReadAll(r2.Body)
+	assert.Equal(t, "# TYPE latency histogram\n"+
+		"latency_bucket{le=\"0.1\"} 1\nlatency_bucket{le=\"1\"} 4\nlatency_bucket{le=\"+Inf\"} 5\n"+
+		"latency_sum 4.7\nlatency_count 5\n", string(bodyBytes))
+
+	// A single update without histogram data is rejected
+	r3 := testRequest(t, ts, http.MethodPost, "/update", bytes.NewBufferString(`{"id":"latency","type":"histogram"}`))
+	r3.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, r3.StatusCode)
+}
+
+func TestQueryRangeHandler(t *testing.T) {
+	metricService, testConfig, logSugar := testSetup(t)
+	mockAudit := &mockAuditLogger{}
+	ts := httptest.NewServer(Router(logSugar, config.NewReloadable(testConfig), metricService, mockAudit, nil, nil, nil))
+	defer ts.Close()
+
+	// History is disabled until a store is configured
+	r := testRequest(t, ts, http.MethodGet, "/api/v1/query_range?name=PollCount", nil)
+	r.Body.Close()
+	assert.Equal(t, http.StatusNotImplemented, r.StatusCode)
+
+	metricService.SetHistory(history.NewStore(10))
+	_ = metricService.SetMetric(context.Background(), "PollCount", int64(2), models.Counter)
+	_ = metricService.SetMetric(context.Background(), "PollCount", int64(3), models.Counter)
+
+	r = testRequest(t, ts, http.MethodGet, "/api/v1/query_range?name=PollCount", nil)
+	defer r.Body.Close()
+	require.Equal(t, http.StatusOK, r.StatusCode)
+	var series []history.Series
+	require.NoError(t, json.NewDecoder(r.Body).Decode(&series))
+	require.Len(t, series, 1)
+	require.Len(t, series[0].Samples, 2)
+	// Counters are recorded as their running total
+	assert.Equal(t, 2.0, series[0].Samples[0].Value)
+	assert.Equal(t, 5.0, series[0].Samples[1].Value)
+
+	badRequests := []string{
+		"/api/v1/query_range",
+		"/api/v1/query_range?name=PollCount&from=yesterday",
+		"/api/v1/query_range?name=PollCount&step=-1",
+		"/api/v1/query_range?name=PollCount&from=2000&to=1000",
+		"/api/v1/query_range?name=PollCount&from=0&to=100000&step=1ms",
+	}
+	for _, path := range badRequests {
+		r := testRequest(t, ts, http.MethodGet, path, nil)
+		r.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, r.StatusCode, path)
+	}
+}
+
+func TestAlertsHandler(t *testing.T) {
+	metricService, testConfig, logSugar := testSetup(t)
+	mockAudit := &mockAuditLogger{}
+
+	// Alerting is disabled without an engine
+	ts := httptest.NewServer(Router(logSugar, config.NewReloadable(testConfig), metricService, mockAudit, nil, nil, nil))
+	r := testRequest(t, ts, http.MethodGet, "/api/v1/alerts", nil)
+	r.Body.Close()
+	ts.Close()
+	assert.Equal(t, http.StatusNotImplemented, r.StatusCode)
+
+	_ = metricService.SetMetric(context.Background(), "HeapAlloc", 2e9, models.Gauge)
+	engine := alerting.NewEngine(metricService, []alerting.Rule{
+		{Name: "HighHeap", Metric: "HeapAlloc", Op: alerting.OpGreater, Threshold: 1e9},
+	})
+	_, err := engine.Evaluate(context.Background(), time.Now())
+	require.NoError(t, err)
+
+	ts = httptest.NewServer(Router(logSugar, config.NewReloadable(testConfig), metricService, mockAudit, engine, nil, nil))
+	defer ts.Close()
+	r = testRequest(t, ts, http.MethodGet, "/api/v1/alerts", nil)
+	defer r.Body.Close()
+	require.Equal(t, http.StatusOK, r.StatusCode)
+	var alerts []alerting.Alert
+	require.NoError(t, json.NewDecoder(r.Body).Decode(&alerts))
+	require.Len(t, alerts, 1)
+	assert.Equal(t, "HighHeap", alerts[0].Rule)
+	assert.Equal(t, alerting.StateFiring, alerts[0].State)
+}
+
+func TestRouterRateLimit(t *testing.T) {
+	metricService, testConfig, logSugar := testSetup(t)
+	testConfig.StoreInterval = 300
+	testConfig.RateLimit = 0.001
+	testConfig.RateBurst = 1
+	ts := httptest.NewServer(Router(logSugar, config.NewReloadable(testConfig), metricService, &mockAuditLogger{}, nil, nil, nil))
+	defer ts.Close()
+
+	resp := testRequest(t, ts, http.MethodPost, "/update/gauge/Alloc/1", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = testRequest(t, ts, http.MethodPost, "/update/gauge/Alloc/2", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+
+	// Scrapes and reads are not limited
+	for _, path := range []string{"/metrics", "/value/gauge/Alloc", "/"} {
+		resp = testRequest(t, ts, http.MethodGet, path, nil)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, path)
+	}
+}
+
+func TestAuditIdentity(t *testing.T) {
+	metricService, testConfig, logSugar := testSetup(t)
+	testConfig.StoreInterval = 300
+	mockAudit := &mockAuditLogger{}
+	router := Router(logSugar, config.NewReloadable(testConfig), metricService, mockAudit, nil, nil, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/update/gauge/Alloc/1", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "agent-1"}}},
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	require.Len(t, mockAudit.logCalls, 1)
+	assert.Equal(t, "10.0.0.1:1234", mockAudit.logCalls[0].ipAddress)
+	assert.Equal(t, "agent-1", mockAudit.logCalls[0].identity)
+}
+
+func TestRouterTrustedSubnet(t *testing.T) {
+	metricService, testConfig, logSugar := testSetup(t)
+	testConfig.StoreInterval = 300
+	testConfig.TrustedSubnet = "192.168.1.0/24"
+	mockAudit := &mockAuditLogger{}
+	router := Router(logSugar, config.NewReloadable(testConfig), metricService, mockAudit, nil, nil, nil)
+
+	request := func(method, path, realIP string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		if realIP != "" {
+			req.Header.Set("X-Real-IP", realIP)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, request(http.MethodPost, "/update/gauge/Alloc/1", "192.168.1.5"))
+	require.Len(t, mockAudit.logCalls, 1)
+	assert.Equal(t, "192.168.1.5", mockAudit.logCalls[0].ipAddress, "the validated real IP is audited")
+
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPost, "/update/gauge/Alloc/2", "192.168.2.5"))
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPost, "/update/gauge/Alloc/2", ""))
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPost, "/updates", "10.0.0.1"))
+	assert.Len(t, mockAudit.logCalls, 1)
+
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/value/gauge/Alloc", ""), "reads are not restricted")
+}
+
+func TestRouterReloadsConfig(t *testing.T) {
+	metricService, testConfig, logSugar := testSetup(t)
+	testConfig.StoreInterval = 300
+	testConfig.Key = "old"
+	liveConfig := config.NewReloadable(testConfig)
+	router := Router(logSugar, liveConfig, metricService, &mockAuditLogger{}, nil, nil, nil)
+
+	body := []byte(`[{"id":"Alloc","type":"gauge","value":1}]`)
+	request := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/updates", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("HashSHA256", hex.EncodeToString(CalculatedHash(body, key)))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	require.Equal(t, http.StatusOK, request("old").Code)
+
+	reloaded := *testConfig
+	reloaded.Key = "new"
+	liveConfig.Store(&reloaded)
+	assert.Equal(t, http.StatusBadRequest, request("old").Code, "the rotated key is used without a restart")
+	assert.Equal(t, http.StatusOK, request("new").Code)
+
+	limited := reloaded
+	limited.RateLimit = 0.001
+	limited.RateBurst = 1
+	liveConfig.Store(&limited)
+	assert.Equal(t, http.StatusOK, request("new").Code)
+	assert.Equal(t, http.StatusTooManyRequests, request("new").Code, "the reloaded rate limit applies")
+
+	restricted := reloaded
+	restricted.TrustedSubnet = "192.168.1.0/24"
+	liveConfig.Store(&restricted)
+	assert.Equal(t, http.StatusForbidden, request("new").Code, "the reloaded trusted subnet applies")
+}
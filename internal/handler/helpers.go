@@ -8,12 +8,17 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
+	"strconv"
 	"sync"
+	"time"
 
 	"go.uber.org/zap"
 
 	"github.com/Schera-ole/metrics/internal/audit"
+	middlewareinternal "github.com/Schera-ole/metrics/internal/middleware"
+	"github.com/Schera-ole/metrics/internal/tlsconfig"
 )
 
 // CalculatedHash calculates the HMAC SHA256 hash of the compressed body using the provided key.
@@ -130,7 +135,70 @@ func ReadRequestBody(r *http.Request) ([]byte, error) {
 	return body, nil
 }
 
-// SendAuditEvent sends an audit event using the AuditLogger interface.
-func SendAuditEvent(metrics []string, remoteAddr string, auditLogger audit.AuditLogger, logger *zap.SugaredLogger) {
-	auditLogger.Log(metrics, remoteAddr)
+// LabelsFromQuery builds a label set from the URL query parameters of a request.
+//
+// Only the first value of every parameter is used.
+func LabelsFromQuery(r *http.Request) map[string]string {
+
+	query := r.URL.Query()
+	if len(query) == 0 {
+		return nil
+	}
+	labels := make(map[string]string, len(query))
+	for name := range query {
+		labels[name] = query.Get(name)
+	}
+	return labels
+}
+
+// ParseTimeParam parses a time given as RFC 3339 or as Unix seconds.
+//
+// An empty value yields def.
+func ParseTimeParam(value string, def time.Time) (time.Time, error) {
+
+	if value == "" {
+		return def, nil
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		whole, frac := math.Modf(seconds)
+		return time.Unix(int64(whole), int64(frac*float64(time.Second))), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// ParseStepParam parses a step given as a Go duration or as a number of seconds.
+//
+// An empty value yields zero.
+func ParseStepParam(value string) (time.Duration, error) {
+
+	if value == "" {
+		return 0, nil
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		if seconds < 0 {
+			return 0, fmt.Errorf("step must not be negative")
+		}
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	step, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if step < 0 {
+		return 0, fmt.Errorf("step must not be negative")
+	}
+	return step, nil
+}
+
+// SendAuditEvent sends an audit event for a request using the AuditLogger interface.
+//
+// The address recorded is the real IP validated against the trusted subnet, or the remote
+// address of the connection without one. The caller is identified by the common name of its
+// client certificate when the server uses mutual TLS.
+func SendAuditEvent(metrics []string, r *http.Request, auditLogger audit.AuditLogger, logger *zap.SugaredLogger) {
+	address := middlewareinternal.RealIP(r.Context())
+	if address == "" {
+		address = r.RemoteAddr
+	}
+	auditLogger.Log(metrics, address, tlsconfig.PeerCN(r.TLS))
 }
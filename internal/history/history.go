@@ -0,0 +1,207 @@
+// Package history provides time-series history for the metrics server.
+//
+// It keeps a bounded ring buffer of timestamped samples per series in memory and
+// answers range queries over them.
+package history
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	models "github.com/Schera-ole/metrics/internal/model"
+)
+
+// DefaultLookback is how far back a range query looks for a sample when resampling with a step.
+const DefaultLookback = 5 * time.Minute
+
+// minRingSize is the number of samples a new series has room for before its buffer grows.
+const minRingSize = 8
+
+// Sample is a single timestamped value of a series.
+type Sample struct {
+	// Timestamp is the time the value was recorded
+	Timestamp time.Time `json:"ts"`
+
+	// Value is the value of the series at Timestamp
+	Value float64 `json:"value"`
+}
+
+// Series is the history of a single series.
+type Series struct {
+	// Name is the metric name
+	Name string `json:"name"`
+
+	// Type is the metric type
+	Type string `json:"type"`
+
+	// Labels are the labels of the series
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Samples are the samples of the series ordered by time
+	Samples []Sample `json:"samples"`
+}
+
+// ring is a bounded circular buffer of samples for one series.
+//
+// The buffer grows as samples arrive, up to capacity, so series that are rarely updated do not
+// take the memory of a full buffer.
+type ring struct {
+	name     string
+	typ      string
+	labels   map[string]string
+	samples  []Sample
+	capacity int
+	start    int
+}
+
+// push adds a sample, overwriting the oldest one when the buffer is full.
+//
+// Samples are kept ordered by time: concurrent writers may append out of order, so a sample
+// older than the newest ones is moved back to its place.
+func (r *ring) push(sample Sample) {
+	if n := len(r.samples); n < r.capacity {
+		if n == cap(r.samples) {
+			grown := make([]Sample, n, min(max(2*n, minRingSize), r.capacity))
+			copy(grown, r.samples)
+			r.samples = grown
+		}
+		r.samples = append(r.samples, sample)
+	} else {
+		r.samples[r.start] = sample
+		r.start = (r.start + 1) % len(r.samples)
+	}
+	for i := len(r.samples) - 1; i > 0 && r.at(i-1).Timestamp.After(sample.Timestamp); i-- {
+		r.set(i, r.at(i-1))
+		r.set(i-1, sample)
+	}
+}
+
+// at returns the i-th oldest sample.
+func (r *ring) at(i int) Sample {
+	return r.samples[(r.start+i)%len(r.samples)]
+}
+
+// set replaces the i-th oldest sample.
+func (r *ring) set(i int, sample Sample) {
+	r.samples[(r.start+i)%len(r.samples)] = sample
+}
+
+// Store keeps the recent history of every series in memory.
+type Store struct {
+	// mu provides thread-safe access to the series map
+	mu sync.RWMutex
+
+	// capacity is the maximum number of samples kept per series
+	capacity int
+
+	// series stores the ring buffer for each series key
+	series map[string]*ring
+}
+
+// NewStore creates a history store that keeps up to capacity samples per series.
+func NewStore(capacity int) *Store {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &Store{
+		capacity: capacity,
+		series:   make(map[string]*ring),
+	}
+}
+
+// Append records a sample for the series identified by name and labels.
+func (s *Store) Append(name string, labels map[string]string, typ string, ts time.Time, value float64) {
+	key := models.SeriesKey(name, labels)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, exists := s.series[key]
+	if !exists || r.typ != typ {
+		var copied map[string]string
+		if len(labels) > 0 {
+			copied = make(map[string]string, len(labels))
+			for k, v := range labels {
+				copied[k] = v
+			}
+		}
+		r = &ring{name: name, typ: typ, labels: copied, capacity: s.capacity}
+		s.series[key] = r
+	}
+	r.push(Sample{Timestamp: ts, Value: value})
+}
+
+// Delete removes the history of every series of the metric.
+func (s *Store) Delete(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, r := range s.series {
+		if r.name == name {
+			delete(s.series, key)
+		}
+	}
+}
+
+// Query returns the samples between from and to of every series of the metric
+// whose labels contain all matchers.
+//
+// If step is zero, the raw samples are returned. Otherwise the series is resampled
+// at from, from+step, ... up to to, using the latest sample no older than DefaultLookback.
+func (s *Store) Query(name string, matchers map[string]string, from, to time.Time, step time.Duration) []Series {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var result []Series
+	for _, r := range s.series {
+		if r.name != name || !models.MatchLabels(r.labels, matchers) {
+			continue
+		}
+		var samples []Sample
+		if step > 0 {
+			samples = r.resample(from, to, step)
+		} else {
+			samples = r.between(from, to)
+		}
+		if len(samples) == 0 {
+			continue
+		}
+		result = append(result, Series{Name: r.name, Type: r.typ, Labels: r.labels, Samples: samples})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return models.SeriesKey(result[i].Name, result[i].Labels) < models.SeriesKey(result[j].Name, result[j].Labels)
+	})
+	return result
+}
+
+// between returns the raw samples in the closed interval [from, to].
+func (r *ring) between(from, to time.Time) []Sample {
+	var samples []Sample
+	for i := 0; i < len(r.samples); i++ {
+		sample := r.at(i)
+		if sample.Timestamp.Before(from) || sample.Timestamp.After(to) {
+			continue
+		}
+		samples = append(samples, sample)
+	}
+	return samples
+}
+
+// resample evaluates the series at every step between from and to.
+func (r *ring) resample(from, to time.Time, step time.Duration) []Sample {
+	var samples []Sample
+	i := 0
+	var last *Sample
+	for ts := from; !ts.After(to); ts = ts.Add(step) {
+		for ; i < len(r.samples); i++ {
+			sample := r.at(i)
+			if sample.Timestamp.After(ts) {
+				break
+			}
+			last = &sample
+		}
+		if last != nil && ts.Sub(last.Timestamp) <= DefaultLookback {
+			samples = append(samples, Sample{Timestamp: ts, Value: last.Value})
+		}
+	}
+	return samples
+}
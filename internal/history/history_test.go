@@ -0,0 +1,118 @@
+package history
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore_AppendAndQuery(t *testing.T) {
+	store := NewStore(10)
+	base := time.Unix(1000, 0)
+
+	for i := 0; i < 5; i++ {
+		store.Append("HeapAlloc", nil, "gauge", base.Add(time.Duration(i)*10*time.Second), float64(i))
+	}
+
+	series := store.Query("HeapAlloc", nil, base.Add(10*time.Second), base.Add(30*time.Second), 0)
+	require.Len(t, series, 1)
+	assert.Equal(t, "HeapAlloc", series[0].Name)
+	assert.Equal(t, "gauge", series[0].Type)
+	assert.Equal(t, []Sample{
+		{Timestamp: base.Add(10 * time.Second), Value: 1},
+		{Timestamp: base.Add(20 * time.Second), Value: 2},
+		{Timestamp: base.Add(30 * time.Second), Value: 3},
+	}, series[0].Samples)
+
+	// Unknown metrics return nothing
+	assert.Empty(t, store.Query("Missing", nil, base, base.Add(time.Minute), 0))
+}
+
+func TestStore_RingBufferIsBounded(t *testing.T) {
+	store := NewStore(3)
+	base := time.Unix(1000, 0)
+
+	for i := 0; i < 5; i++ {
+		store.Append("PollCount", nil, "counter", base.Add(time.Duration(i)*time.Second), float64(i))
+	}
+
+	series := store.Query("PollCount", nil, base, base.Add(time.Minute), 0)
+	require.Len(t, series, 1)
+	require.Len(t, series[0].Samples, 3)
+	assert.Equal(t, 2.0, series[0].Samples[0].Value)
+	assert.Equal(t, 4.0, series[0].Samples[2].Value)
+}
+
+func TestStore_RingBufferGrowsLazily(t *testing.T) {
+	store := NewStore(100)
+	base := time.Unix(1000, 0)
+
+	store.Append("Alloc", nil, "gauge", base, 0)
+	r := store.series["Alloc"]
+	assert.Equal(t, minRingSize, cap(r.samples), "a new series does not take a full buffer")
+
+	for i := 1; i < 250; i++ {
+		store.Append("Alloc", nil, "gauge", base.Add(time.Duration(i)*time.Second), float64(i))
+	}
+	assert.Equal(t, 100, cap(r.samples), "the buffer grows up to the capacity")
+
+	series := store.Query("Alloc", nil, base, base.Add(time.Hour), 0)
+	require.Len(t, series, 1)
+	require.Len(t, series[0].Samples, 100)
+	assert.Equal(t, 150.0, series[0].Samples[0].Value)
+	assert.Equal(t, 249.0, series[0].Samples[99].Value)
+}
+
+func TestStore_AppendOutOfOrder(t *testing.T) {
+	store := NewStore(3)
+	base := time.Unix(1000, 0)
+
+	for _, i := range []int{1, 3, 2, 5, 4} {
+		store.Append("Alloc", nil, "gauge", base.Add(time.Duration(i)*time.Second), float64(i))
+	}
+
+	series := store.Query("Alloc", nil, base, base.Add(time.Minute), 0)
+	require.Len(t, series, 1)
+	assert.Equal(t, []Sample{
+		{Timestamp: base.Add(3 * time.Second), Value: 3},
+		{Timestamp: base.Add(4 * time.Second), Value: 4},
+		{Timestamp: base.Add(5 * time.Second), Value: 5},
+	}, series[0].Samples)
+}
+
+func TestStore_QueryWithStep(t *testing.T) {
+	store := NewStore(10)
+	base := time.Unix(1000, 0)
+	store.Append("HeapAlloc", nil, "gauge", base, 1)
+	store.Append("HeapAlloc", nil, "gauge", base.Add(25*time.Second), 2)
+
+	series := store.Query("HeapAlloc", nil, base.Add(-10*time.Second), base.Add(30*time.Second), 10*time.Second)
+	require.Len(t, series, 1)
+	assert.Equal(t, []Sample{
+		{Timestamp: base, Value: 1},
+		{Timestamp: base.Add(10 * time.Second), Value: 1},
+		{Timestamp: base.Add(20 * time.Second), Value: 1},
+		{Timestamp: base.Add(30 * time.Second), Value: 2},
+	}, series[0].Samples)
+
+	// Samples older than the lookback window are not carried forward
+	series = store.Query("HeapAlloc", nil, base.Add(time.Hour), base.Add(time.Hour), time.Second)
+	assert.Empty(t, series)
+}
+
+func TestStore_LabelsAndDelete(t *testing.T) {
+	store := NewStore(10)
+	base := time.Unix(1000, 0)
+	store.Append("CPU", map[string]string{"cpu": "0"}, "gauge", base, 1)
+	store.Append("CPU", map[string]string{"cpu": "1"}, "gauge", base, 2)
+
+	assert.Len(t, store.Query("CPU", nil, base, base, 0), 2)
+	series := store.Query("CPU", map[string]string{"cpu": "1"}, base, base, 0)
+	require.Len(t, series, 1)
+	assert.Equal(t, 2.0, series[0].Samples[0].Value)
+
+	store.Delete("CPU")
+	assert.Empty(t, store.Query("CPU", nil, base, base, 0))
+}
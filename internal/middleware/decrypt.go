@@ -0,0 +1,47 @@
+package middlewareinternal
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"io"
+	"net/http"
+
+	"github.com/Schera-ole/metrics/internal/encryption"
+)
+
+// Decrypt creates a middleware that decrypts request bodies encrypted by the agent.
+//
+// Requests marked with the encryption header are decrypted with key before the handlers
+// decompress and verify them; a body that cannot be decrypted is rejected with 400 Bad Request.
+// Unmarked requests are rejected too, since a server with a key only accepts encrypted updates.
+func Decrypt(key *rsa.PrivateKey) func(http.Handler) http.Handler {
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			scheme := r.Header.Get(encryption.Header)
+			if scheme == "" {
+				http.Error(w, "request body must be encrypted", http.StatusBadRequest)
+				return
+			}
+			if scheme != encryption.Scheme {
+				http.Error(w, "unsupported encryption "+scheme, http.StatusBadRequest)
+				return
+			}
+			body, err := io.ReadAll(r.Body)
+			r.Body.Close()
+			if err != nil {
+				http.Error(w, "failed to read body", http.StatusBadRequest)
+				return
+			}
+			plain, err := encryption.Decrypt(key, body)
+			if err != nil {
+				http.Error(w, "failed to decrypt body", http.StatusBadRequest)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(plain))
+			r.ContentLength = int64(len(plain))
+			r.Header.Del(encryption.Header)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package middlewareinternal
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Schera-ole/metrics/internal/encryption"
+)
+
+func TestDecrypt(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	var received []byte
+	handler := Decrypt(key)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	request := func(body []byte, scheme string) int {
+		req := httptest.NewRequest(http.MethodPost, "/updates", bytes.NewReader(body))
+		if scheme != "" {
+			req.Header.Set(encryption.Header, scheme)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	encrypted, err := encryption.Encrypt(&key.PublicKey, []byte("payload"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, request(encrypted, encryption.Scheme))
+	assert.Equal(t, "payload", string(received))
+
+	received = nil
+	assert.Equal(t, http.StatusBadRequest, request([]byte("plain"), ""), "unencrypted requests are rejected")
+	assert.Nil(t, received)
+
+	assert.Equal(t, http.StatusBadRequest, request([]byte("plain"), encryption.Scheme))
+	assert.Equal(t, http.StatusBadRequest, request(encrypted, "rot13"))
+}
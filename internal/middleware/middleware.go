@@ -1,7 +1,8 @@
 // Package middlewareinternal provides HTTP middleware for the metrics server.
 //
-// It includes middleware for logging HTTP requests and responses, and for
-// compressing response bodies using gzip compression.
+// It includes middleware for logging HTTP requests and responses, for
+// compressing response bodies using gzip compression, and for limiting the
+// request rate and concurrency.
 package middlewareinternal
 
 import (
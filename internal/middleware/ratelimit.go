@@ -0,0 +1,262 @@
+package middlewareinternal
+
+import (
+	"crypto/tls"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Schera-ole/metrics/internal/config"
+	"github.com/Schera-ole/metrics/internal/tlsconfig"
+)
+
+// pruneInterval is how often buckets of idle clients are removed.
+const pruneInterval = time.Minute
+
+// bucket is the token bucket of a single client.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter limits the request rate of every client with a token bucket.
+//
+// Every client may make burst requests at once, and then rate requests per second.
+// A rate of 0 disables the limit.
+type RateLimiter struct {
+	// rate is the number of tokens added to a bucket per second
+	rate float64
+
+	// burst is the capacity of a bucket
+	burst float64
+
+	// now returns the current time
+	now func() time.Time
+
+	// mu provides thread-safe access to the limits and the buckets
+	mu sync.Mutex
+
+	// buckets stores the bucket of each client
+	buckets map[string]*bucket
+
+	// lastPrune is when idle buckets were last removed
+	lastPrune time.Time
+}
+
+// NewRateLimiter creates a RateLimiter allowing rate requests per second with bursts of burst
+// requests per client. A burst lower than 1 is raised to the rate.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+
+	return &RateLimiter{
+		rate:    rate,
+		burst:   bucketSize(rate, burst),
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// SetLimit changes the rate and the burst of every client, for example when the configuration
+// is reloaded. Buckets keep their tokens, capped to the new burst.
+func (l *RateLimiter) SetLimit(rate float64, burst int) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = rate
+	l.burst = bucketSize(rate, burst)
+}
+
+// bucketSize returns the capacity of a bucket: burst, or the rate rounded up if burst is lower than 1.
+func bucketSize(rate float64, burst int) float64 {
+
+	b := float64(burst)
+	if b < 1 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+	return b
+}
+
+// Allow takes a token from the client's bucket.
+//
+// If the bucket is empty, it reports false and how long until a token is available.
+func (l *RateLimiter) Allow(client string) (bool, time.Duration) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return true, 0
+	}
+	now := l.now()
+	l.prune(now)
+
+	b, exists := l.buckets[client]
+	if !exists {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// prune removes the buckets that have refilled completely. The caller must hold mu.
+func (l *RateLimiter) prune(now time.Time) {
+
+	if now.Sub(l.lastPrune) < pruneInterval {
+		return
+	}
+	l.lastPrune = now
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for client, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// Middleware rejects requests of clients over their rate with 429 Too Many Requests.
+func (l *RateLimiter) Middleware(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed, wait := l.Allow(ClientID(r))
+		if !allowed {
+			tooManyRequests(w, wait)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ClientID identifies the client of a request for rate limiting.
+//
+// Only identities the client cannot choose freely are used: the common name of its verified
+// certificate with mutual TLS, or else the IP address the request comes from. Headers like
+// X-Real-IP are ignored, since a client could get a fresh bucket by changing them.
+func ClientID(r *http.Request) string {
+
+	return PeerID(r.TLS, r.RemoteAddr)
+}
+
+// PeerID identifies a client by the common name of its verified certificate, or by the IP
+// address of remoteAddr without mutual TLS. The gRPC API uses it to share the buckets of
+// RateLimiter with the HTTP API.
+func PeerID(state *tls.ConnectionState, remoteAddr string) string {
+
+	if cn := tlsconfig.PeerCN(state); cn != "" {
+		return "cert:" + cn
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return "ip:" + host
+}
+
+// ConcurrencyLimiter limits the number of requests served at a time.
+type ConcurrencyLimiter struct {
+	// slots holds a value for every request being served
+	slots chan struct{}
+}
+
+// NewConcurrencyLimiter creates a ConcurrencyLimiter serving at most limit requests at a time.
+// A limit of 0 or less disables it.
+func NewConcurrencyLimiter(limit int) *ConcurrencyLimiter {
+
+	if limit <= 0 {
+		return &ConcurrencyLimiter{}
+	}
+	return &ConcurrencyLimiter{slots: make(chan struct{}, limit)}
+}
+
+// Acquire takes a slot without waiting. It reports false if all slots are taken, otherwise
+// the caller must call Release when done.
+func (l *ConcurrencyLimiter) Acquire() bool {
+
+	if l.slots == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Release frees a slot taken by Acquire.
+func (l *ConcurrencyLimiter) Release() {
+
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// Middleware rejects requests over the limit immediately with 429 Too Many Requests instead
+// of queueing them, so a burst of writes cannot pile up on the storage.
+func (l *ConcurrencyLimiter) Middleware(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !l.Acquire() {
+			tooManyRequests(w, time.Second)
+			return
+		}
+		defer l.Release()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ConcurrencyLimit creates a middleware that serves at most limit requests at a time.
+func ConcurrencyLimit(limit int) func(http.Handler) http.Handler {
+
+	return NewConcurrencyLimiter(limit).Middleware
+}
+
+// Limits are the request limits of the server, shared by the HTTP and the gRPC API so a
+// client cannot double its rate by using both.
+type Limits struct {
+	// Rate limits the update rate of every client
+	Rate *RateLimiter
+
+	// Writes limits the number of updates served at a time
+	Writes *ConcurrencyLimiter
+}
+
+// NewLimits creates the limits of serverConfig. The rate limit follows reloads of the
+// configuration, while the concurrency limit is fixed at startup.
+func NewLimits(serverConfig *config.Reloadable) *Limits {
+
+	initial := serverConfig.Load()
+	limits := &Limits{
+		Rate:   NewRateLimiter(initial.RateLimit, initial.RateBurst),
+		Writes: NewConcurrencyLimiter(initial.MaxConcurrentWrites),
+	}
+	serverConfig.OnStore(func(c *config.ServerConfig) {
+		limits.Rate.SetLimit(c.RateLimit, c.RateBurst)
+	})
+	return limits
+}
+
+// tooManyRequests writes a 429 response asking the client to retry after wait, rounded up to seconds.
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+
+	w.Header().Set("Retry-After", RetryAfter(wait))
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+}
+
+// RetryAfter formats wait as the value of a Retry-After header: whole seconds, rounded up
+// and at least 1.
+func RetryAfter(wait time.Duration) string {
+
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.Itoa(seconds)
+}
@@ -0,0 +1,154 @@
+package middlewareinternal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := NewRateLimiter(2, 3)
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		allowed, _ := limiter.Allow("a")
+		assert.True(t, allowed, "request %d is within the burst", i)
+	}
+	allowed, wait := limiter.Allow("a")
+	assert.False(t, allowed)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	// Other clients have their own bucket
+	allowed, _ = limiter.Allow("b")
+	assert.True(t, allowed)
+
+	// Tokens are refilled at the rate
+	now = now.Add(500 * time.Millisecond)
+	allowed, _ = limiter.Allow("a")
+	assert.True(t, allowed)
+	allowed, _ = limiter.Allow("a")
+	assert.False(t, allowed)
+}
+
+func TestRateLimiterPrunesIdleClients(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := NewRateLimiter(1, 0)
+	limiter.now = func() time.Time { return now }
+
+	limiter.Allow("a")
+	now = now.Add(2 * pruneInterval)
+	limiter.Allow("b")
+	assert.Len(t, limiter.buckets, 1)
+}
+
+func TestRateLimiterMiddleware(t *testing.T) {
+	limiter := NewRateLimiter(0.5, 1)
+	handler := limiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	request := func(remoteAddr string, peerCN string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/updates", nil)
+		req.RemoteAddr = remoteAddr
+		if peerCN != "" {
+			req.TLS = &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: peerCN}}},
+			}
+		}
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusOK, request("10.0.0.1:1000", "", nil).Code)
+	rec := request("10.0.0.1:2000", "", nil)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code, "clients are identified by IP regardless of port")
+	assert.Equal(t, "2", rec.Header().Get("Retry-After"))
+
+	for _, headers := range []map[string]string{
+		{"X-API-Key": "agent-1"},
+		{"X-Real-IP": "10.0.0.9"},
+		{"X-Forwarded-For": "10.0.0.9"},
+	} {
+		assert.Equal(t, http.StatusTooManyRequests, request("10.0.0.1:1000", "", headers).Code,
+			"headers chosen by the client do not get a new bucket: %v", headers)
+	}
+
+	assert.Equal(t, http.StatusOK, request("10.0.0.2:1000", "", nil).Code)
+	assert.Equal(t, http.StatusOK, request("10.0.0.1:1000", "agent-1", nil).Code, "clients with a certificate are limited by its name")
+	assert.Equal(t, http.StatusTooManyRequests, request("10.0.0.3:1000", "agent-1", nil).Code)
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	handler := ConcurrencyLimit(2)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	var wg sync.WaitGroup
+	codes := make([]int, 2)
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/updates", nil))
+			codes[i] = rec.Code
+		}()
+	}
+	<-started
+	<-started
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/updates", nil))
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+
+	close(release)
+	wg.Wait()
+	assert.Equal(t, []int{http.StatusOK, http.StatusOK}, codes)
+
+	rec = httptest.NewRecorder()
+	go func() { <-started }()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/updates", nil))
+	require.Equal(t, http.StatusOK, rec.Code, "slots are released when requests finish")
+}
+
+func TestRateLimiterSetLimit(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := NewRateLimiter(0, 0)
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < 5; i++ {
+		allowed, _ := limiter.Allow("a")
+		assert.True(t, allowed, "a rate of 0 disables the limit")
+	}
+
+	limiter.SetLimit(1, 2)
+	for i := 0; i < 2; i++ {
+		allowed, _ := limiter.Allow("a")
+		assert.True(t, allowed, "request %d is within the new burst", i)
+	}
+	allowed, wait := limiter.Allow("a")
+	assert.False(t, allowed)
+	assert.Equal(t, time.Second, wait)
+
+	limiter.SetLimit(0, 0)
+	allowed, _ = limiter.Allow("a")
+	assert.True(t, allowed)
+}
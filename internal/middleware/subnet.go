@@ -0,0 +1,83 @@
+package middlewareinternal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+
+	"github.com/Schera-ole/metrics/internal/config"
+)
+
+// RealIPHeader is the header carrying the address of the agent behind proxies and load balancers.
+const RealIPHeader = "X-Real-IP"
+
+// ErrUntrustedIP is returned when the real IP of a client is missing or outside the trusted subnet.
+var ErrUntrustedIP = errors.New("client IP is not in the trusted subnet")
+
+// realIPKey is the context key of the validated real IP.
+type realIPKey struct{}
+
+// ParseSubnet parses a trusted subnet in CIDR notation.
+func ParseSubnet(cidr string) (netip.Prefix, error) {
+
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid trusted subnet %q: %w", cidr, err)
+	}
+	return prefix.Masked(), nil
+}
+
+// CheckRealIP parses the real IP reported by a client and checks that it is in the subnet.
+func CheckRealIP(subnet netip.Prefix, value string) (netip.Addr, error) {
+
+	if value == "" {
+		return netip.Addr{}, fmt.Errorf("%w: missing %s", ErrUntrustedIP, RealIPHeader)
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("%w: invalid address %q", ErrUntrustedIP, value)
+	}
+	addr = addr.Unmap()
+	if !subnet.Contains(addr) {
+		return netip.Addr{}, fmt.Errorf("%w: %s", ErrUntrustedIP, addr)
+	}
+	return addr, nil
+}
+
+// TrustedSubnet creates a middleware that rejects requests with 403 Forbidden unless their
+// X-Real-IP header is an address inside the trusted subnet of serverConfig. Without a trusted
+// subnet, every request is accepted.
+//
+// The subnet is loaded for every request, so it can be changed while the server is running.
+// The validated address is stored in the request context, see RealIP.
+func TrustedSubnet(serverConfig *config.Reloadable) func(http.Handler) http.Handler {
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			trustedSubnet := serverConfig.Load().TrustedSubnet
+			if trustedSubnet == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			// An invalid subnet contains no address, so every request is rejected
+			subnet, _ := ParseSubnet(trustedSubnet)
+			addr, err := CheckRealIP(subnet, r.Header.Get(RealIPHeader))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			ctx := context.WithValue(r.Context(), realIPKey{}, addr.String())
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// RealIP returns the real IP validated by TrustedSubnet, or an empty string if the
+// request was not checked.
+func RealIP(ctx context.Context) string {
+
+	ip, _ := ctx.Value(realIPKey{}).(string)
+	return ip
+}
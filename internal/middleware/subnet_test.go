@@ -0,0 +1,59 @@
+package middlewareinternal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Schera-ole/metrics/internal/config"
+)
+
+func TestTrustedSubnet(t *testing.T) {
+	serverConfig := config.NewReloadable(&config.ServerConfig{TrustedSubnet: "192.168.1.0/24"})
+
+	var realIP string
+	handler := TrustedSubnet(serverConfig)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		realIP = RealIP(r.Context())
+		w.WriteHeader(http.StatusOK)
+	}))
+	request := func(value string) int {
+		req := httptest.NewRequest(http.MethodPost, "/updates", nil)
+		if value != "" {
+			req.Header.Set(RealIPHeader, value)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, request("192.168.1.20"))
+	assert.Equal(t, "192.168.1.20", realIP)
+	assert.Equal(t, http.StatusOK, request("::ffff:192.168.1.21"), "IPv4-mapped addresses are unmapped")
+	assert.Equal(t, "192.168.1.21", realIP)
+
+	assert.Equal(t, http.StatusForbidden, request("192.168.2.1"))
+	assert.Equal(t, http.StatusForbidden, request(""))
+	assert.Equal(t, http.StatusForbidden, request("not-an-ip"))
+
+	// A reloaded subnet applies to the next request
+	serverConfig.Store(&config.ServerConfig{TrustedSubnet: "192.168.2.0/24"})
+	assert.Equal(t, http.StatusForbidden, request("192.168.1.20"))
+	assert.Equal(t, http.StatusOK, request("192.168.2.1"))
+
+	serverConfig.Store(&config.ServerConfig{})
+	realIP = "unset"
+	assert.Equal(t, http.StatusOK, request(""), "without a trusted subnet every request is accepted")
+	assert.Empty(t, realIP)
+}
+
+func TestParseSubnet(t *testing.T) {
+	subnet, err := ParseSubnet("10.1.2.3/8")
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.0/8", subnet.String())
+
+	_, err = ParseSubnet("10.0.0.0")
+	assert.Error(t, err)
+}
@@ -0,0 +1,140 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	internalerrors "github.com/Schera-ole/metrics/internal/errors"
+)
+
+// HistogramValue represents the state of a histogram metric.
+//
+// Counts holds the number of observations per bucket (not cumulative). The bucket
+// i covers values up to Bounds[i], and the last bucket covers values above the last
+// bound, so Counts has one element more than Bounds.
+type HistogramValue struct {
+	// Bounds are the upper bounds of the buckets in increasing order
+	Bounds []float64 `json:"bounds"`
+
+	// Counts are the number of observations in each bucket
+	Counts []uint64 `json:"counts"`
+
+	// Sum is the sum of all observed values
+	Sum float64 `json:"sum"`
+
+	// Count is the total number of observations
+	Count uint64 `json:"count"`
+}
+
+// NewHistogram creates an empty histogram with the given bucket bounds.
+func NewHistogram(bounds ...float64) HistogramValue {
+	return HistogramValue{
+		Bounds: append([]float64(nil), bounds...),
+		Counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+// Observe records a single value in the histogram.
+func (h *HistogramValue) Observe(value float64) {
+	i := 0
+	for i < len(h.Bounds) && value > h.Bounds[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Sum += value
+	h.Count++
+}
+
+// Validate checks that the histogram is consistent.
+func (h HistogramValue) Validate() error {
+	if len(h.Counts) != len(h.Bounds)+1 {
+		return fmt.Errorf("%w: histogram has %d bounds and %d counts", internalerrors.ErrInvalidMetricValue, len(h.Bounds), len(h.Counts))
+	}
+	for i, bound := range h.Bounds {
+		if math.IsNaN(bound) || math.IsInf(bound, 0) {
+			return fmt.Errorf("%w: histogram bound %v is not finite", internalerrors.ErrInvalidMetricValue, bound)
+		}
+		if i > 0 && bound <= h.Bounds[i-1] {
+			return fmt.Errorf("%w: histogram bounds must be increasing", internalerrors.ErrInvalidMetricValue)
+		}
+	}
+	var total uint64
+	for _, c := range h.Counts {
+		total += c
+	}
+	if total != h.Count {
+		return fmt.Errorf("%w: histogram count %d does not match bucket counts %d", internalerrors.ErrInvalidMetricValue, h.Count, total)
+	}
+	return nil
+}
+
+// Merge returns the histogram that results from adding the observations of other to h.
+//
+// Both histograms must have the same bucket bounds.
+func (h HistogramValue) Merge(other HistogramValue) (HistogramValue, error) {
+	if len(h.Bounds) != len(other.Bounds) {
+		return HistogramValue{}, internalerrors.ErrHistogramBoundsMismatch
+	}
+	for i := range h.Bounds {
+		if h.Bounds[i] != other.Bounds[i] {
+			return HistogramValue{}, internalerrors.ErrHistogramBoundsMismatch
+		}
+	}
+	result := HistogramValue{
+		Bounds: append([]float64(nil), h.Bounds...),
+		Counts: make([]uint64, len(h.Counts)),
+		Sum:    h.Sum + other.Sum,
+		Count:  h.Count + other.Count,
+	}
+	for i := range h.Counts {
+		result.Counts[i] = h.Counts[i] + other.Counts[i]
+	}
+	return result, nil
+}
+
+// Clone returns a deep copy of the histogram.
+func (h HistogramValue) Clone() HistogramValue {
+	return HistogramValue{
+		Bounds: append([]float64(nil), h.Bounds...),
+		Counts: append([]uint64(nil), h.Counts...),
+		Sum:    h.Sum,
+		Count:  h.Count,
+	}
+}
+
+// String returns the JSON representation of the histogram.
+func (h HistogramValue) String() string {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return fmt.Sprintf("histogram(count=%d, sum=%v)", h.Count, h.Sum)
+	}
+	return string(data)
+}
+
+// ParseHistogram converts a decoded value into a HistogramValue.
+//
+// It accepts a HistogramValue, a pointer to one, or the generic map produced by
+// decoding JSON into an any value, such as a file snapshot entry.
+func ParseHistogram(value any) (HistogramValue, error) {
+	switch v := value.(type) {
+	case HistogramValue:
+		return v, nil
+	case *HistogramValue:
+		if v == nil {
+			return HistogramValue{}, internalerrors.ErrInvalidMetricValue
+		}
+		return *v, nil
+	case map[string]any:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return HistogramValue{}, fmt.Errorf("%w: %v", internalerrors.ErrInvalidMetricValue, err)
+		}
+		var h HistogramValue
+		if err := json.Unmarshal(data, &h); err != nil {
+			return HistogramValue{}, fmt.Errorf("%w: %v", internalerrors.ErrInvalidMetricValue, err)
+		}
+		return h, nil
+	}
+	return HistogramValue{}, fmt.Errorf("%w: unexpected histogram value %T", internalerrors.ErrInvalidMetricValue, value)
+}
@@ -1,9 +1,16 @@
 // Package models defines the data structures used throughout the metrics system.
 package models
 
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
 const (
-	Counter = "counter"
-	Gauge   = "gauge"
+	Counter   = "counter"
+	Gauge     = "gauge"
+	Histogram = "histogram"
 )
 
 // MetricsDTO represents a metric data transfer object for API requests and responses.
@@ -11,7 +18,7 @@ type MetricsDTO struct {
 	// ID is the unique identifier for the metric
 	ID string `json:"id"`
 
-	// MType is the type of the metric (either "counter" or "gauge")
+	// MType is the type of the metric ("counter", "gauge" or "histogram")
 	MType string `json:"type"`
 
 	// Delta is the increment value for counter metrics (omitted for gauge metrics)
@@ -19,6 +26,12 @@ type MetricsDTO struct {
 
 	// Value is the value for gauge metrics (omitted for counter metrics)
 	Value *float64 `json:"value,omitempty"`
+
+	// Histogram is the bucket data for histogram metrics (omitted for other metrics)
+	Histogram *HistogramValue `json:"histogram,omitempty"`
+
+	// Labels are optional dimensions that, together with ID, identify a series
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 // Metric represents a single metric with its name, type, and value.
@@ -26,11 +39,53 @@ type Metric struct {
 	// Name is the unique identifier for the metric
 	Name string
 
-	// Type is the type of the metric (either "counter" or "gauge")
+	// Type is the type of the metric ("counter", "gauge" or "histogram")
 	Type string
 
-	// Value is the metric value (int64 for counters, float64 for gauges)
+	// Value is the metric value (int64 for counters, float64 for gauges, HistogramValue for histograms)
 	Value any
+
+	// Labels are optional dimensions that, together with Name, identify a series
+	Labels map[string]string `json:",omitempty"`
+}
+
+// SeriesKey returns the canonical identity of a series.
+//
+// A series without labels is identified by its name alone, otherwise the key has
+// the form name{k1="v1",k2="v2"} with labels sorted by name.
+func SeriesKey(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(labels[k]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// MatchLabels reports whether labels contain every name/value pair of matchers.
+func MatchLabels(labels map[string]string, matchers map[string]string) bool {
+	for k, v := range matchers {
+		if lv, ok := labels[k]; !ok || lv != v {
+			return false
+		}
+	}
+	return true
 }
 
 // AuditEvent represents an audit log entry for metric operations.
@@ -43,4 +98,7 @@ type AuditEvent struct {
 
 	// IPAddress is the IP address of the client that initiated the operation
 	IPAddress string `json:"ip_address"`
+
+	// Identity is the common name of the client certificate, empty without mutual TLS
+	Identity string `json:"identity,omitempty"`
 }
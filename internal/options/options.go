@@ -0,0 +1,284 @@
+// Package options loads configuration options from defaults, a config file, environment
+// variables and command-line flags.
+//
+// Every option has a key used in the config file, an environment variable named after the
+// key in upper case, and a flag. Later sources override earlier ones:
+// defaults < config file < environment < flags.
+package options
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigEnv is the environment variable naming the config file, like the -c and -config flags.
+const ConfigEnv = "CONFIG"
+
+// LookupEnv returns the value of an environment variable and whether it is set, like os.LookupEnv.
+type LookupEnv func(key string) (string, bool)
+
+// value is an option value that can be set from a string and dumped in config file form.
+type value interface {
+	flag.Value
+
+	// dump returns the value as it is written in a config file
+	dump() any
+}
+
+// option is a single configuration option.
+type option struct {
+	// key is the name of the option in the config file
+	key string
+
+	// env is the environment variable of the option
+	env string
+
+	// flag is the command-line flag of the option
+	flag string
+
+	// value sets and reads the configuration field
+	value value
+
+	// secret hides the value when the configuration is dumped
+	secret bool
+}
+
+// Set is the set of options of a configuration.
+type Set struct {
+	// flags is the flag set the options are registered in
+	flags *flag.FlagSet
+
+	// options are the registered options in order of registration
+	options []*option
+
+	// byKey indexes the options by key
+	byKey map[string]*option
+
+	// configFile is the path given with -c or -config
+	configFile string
+
+	// print is set by -print-config
+	print bool
+}
+
+// NewSet creates a Set registering its flags in flags, including the -c and -config flags
+// naming the config file and the -print-config flag.
+func NewSet(flags *flag.FlagSet) *Set {
+
+	s := &Set{flags: flags, byKey: make(map[string]*option)}
+	flags.StringVar(&s.configFile, "c", "", "path to the JSON or YAML config file")
+	flags.StringVar(&s.configFile, "config", "", "path to the JSON or YAML config file")
+	flags.BoolVar(&s.print, "print-config", false, "print the effective configuration and exit")
+	return s
+}
+
+// add registers an option. An empty flag name registers no flag.
+func (s *Set) add(key, flagName, usage string, v value) *option {
+
+	opt := &option{key: key, env: strings.ToUpper(key), flag: flagName, value: v}
+	s.options = append(s.options, opt)
+	s.byKey[key] = opt
+	if flagName != "" {
+		s.flags.Var(v, flagName, usage)
+	}
+	return opt
+}
+
+// String registers a string option.
+func (s *Set) String(p *string, key, flagName, usage string) {
+	s.add(key, flagName, usage, (*stringValue)(p))
+}
+
+// Secret registers a string option whose value is hidden when the configuration is dumped.
+func (s *Set) Secret(p *string, key, flagName, usage string) {
+	s.add(key, flagName, usage, (*stringValue)(p)).secret = true
+}
+
+// Int registers an integer option.
+func (s *Set) Int(p *int, key, flagName, usage string) {
+	s.add(key, flagName, usage, (*intValue)(p))
+}
+
+// Float64 registers a floating point option.
+func (s *Set) Float64(p *float64, key, flagName, usage string) {
+	s.add(key, flagName, usage, (*float64Value)(p))
+}
+
+// Bool registers a boolean option.
+func (s *Set) Bool(p *bool, key, flagName, usage string) {
+	s.add(key, flagName, usage, (*boolValue)(p))
+}
+
+// Duration registers a duration option, written like "1s" or "5m".
+func (s *Set) Duration(p *time.Duration, key, flagName, usage string) {
+	s.add(key, flagName, usage, (*durationValue)(p))
+}
+
+// List registers a string list option, written comma-separated in flags and environment
+// variables and as a list in the config file.
+func (s *Set) List(p *[]string, key, flagName, usage string) {
+	s.add(key, flagName, usage, (*listValue)(p))
+}
+
+// Load parses the command-line arguments, then applies the config file and the environment
+// to the options that were not set with flags.
+//
+// Errors name the offending key, environment variable or flag.
+func (s *Set) Load(args []string, lookupEnv LookupEnv) error {
+
+	if err := s.flags.Parse(args); err != nil {
+		return err
+	}
+	setByFlag := make(map[string]bool)
+	s.flags.Visit(func(f *flag.Flag) {
+		setByFlag[f.Name] = true
+	})
+
+	configFile := s.configFile
+	if configFile == "" {
+		configFile, _ = lookupEnv(ConfigEnv)
+	}
+	if configFile != "" {
+		if err := s.loadFile(configFile, setByFlag); err != nil {
+			return err
+		}
+	}
+
+	for _, opt := range s.options {
+		if setByFlag[opt.flag] {
+			continue
+		}
+		if envValue, ok := lookupEnv(opt.env); ok && envValue != "" {
+			if err := opt.value.Set(envValue); err != nil {
+				return fmt.Errorf("invalid %s value %q: %w", opt.env, envValue, err)
+			}
+		}
+	}
+	return nil
+}
+
+// loadFile sets the options that were not set with flags from a JSON or YAML config file,
+// chosen by the file extension.
+func (s *Set) loadFile(path string, setByFlag map[string]bool) error {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %w", err)
+	}
+	values := make(map[string]any)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	default:
+		err = json.Unmarshal(data, &values)
+	}
+	if err != nil {
+		return fmt.Errorf("error parsing config file %s: %w", path, err)
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		opt, ok := s.byKey[key]
+		if !ok {
+			return fmt.Errorf("config file %s: unknown key %q", path, key)
+		}
+		if setByFlag[opt.flag] {
+			continue
+		}
+		text, err := fileValue(values[key])
+		if err != nil {
+			return fmt.Errorf("config file %s: invalid %s value: %w", path, key, err)
+		}
+		if err := opt.value.Set(text); err != nil {
+			return fmt.Errorf("config file %s: invalid %s value %q: %w", path, key, text, err)
+		}
+	}
+	return nil
+}
+
+// fileValue converts a value decoded from a config file to the string form parsed by the options.
+func fileValue(v any) (string, error) {
+
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []any:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			text, err := fileValue(item)
+			if err != nil {
+				return "", err
+			}
+			if strings.Contains(text, ",") {
+				return "", fmt.Errorf("list item %q must not contain a comma", text)
+			}
+			items = append(items, text)
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", v)
+}
+
+// PrintRequested reports whether -print-config was given.
+func (s *Set) PrintRequested() bool {
+	return s.print
+}
+
+// Dump writes the options as a JSON config file. Secret values are replaced by a placeholder.
+func (s *Set) Dump(w io.Writer) error {
+
+	var buf strings.Builder
+	buf.WriteString("{\n")
+	for i, opt := range s.options {
+		var v any = opt.value.dump()
+		if opt.secret && opt.value.String() != "" {
+			v = "<hidden>"
+		}
+		var data bytes.Buffer
+		encoder := json.NewEncoder(&data)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(v); err != nil {
+			return fmt.Errorf("error encoding %s: %w", opt.key, err)
+		}
+		fmt.Fprintf(&buf, "  %q: %s", opt.key, bytes.TrimSpace(data.Bytes()))
+		if i < len(s.options)-1 {
+			buf.WriteString(",")
+		}
+		buf.WriteString("\n")
+	}
+	buf.WriteString("}\n")
+	_, err := io.WriteString(w, buf.String())
+	return err
+}
+
+// ErrInvalid is wrapped by the errors of Invalid.
+var ErrInvalid = errors.New("invalid configuration")
+
+// Invalid returns an error for an option value that failed validation.
+func Invalid(key string, format string, args ...any) error {
+	return fmt.Errorf("%w: %s: %s", ErrInvalid, key, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,147 @@
+package options
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testConfig is a configuration with one option of every kind.
+type testConfig struct {
+	Address  string
+	Interval int
+	Restore  bool
+	Rate     float64
+	Delay    time.Duration
+	Webhooks []string
+	Key      string
+}
+
+// newTestSet registers the options of config in a new flag set.
+func newTestSet(config *testConfig) *Set {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	set := NewSet(flags)
+	set.String(&config.Address, "address", "a", "address")
+	set.Int(&config.Interval, "store_interval", "i", "interval")
+	set.Bool(&config.Restore, "restore", "r", "restore")
+	set.Float64(&config.Rate, "rate_limit", "rate-limit", "rate")
+	set.Duration(&config.Delay, "retry_delay", "retry-delay", "delay")
+	set.List(&config.Webhooks, "alert_webhooks", "alert-webhooks", "webhooks")
+	set.Secret(&config.Key, "key", "k", "key")
+	return set
+}
+
+// writeFile writes a config file to a temporary directory.
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+// env returns a LookupEnv reading from values.
+func env(values map[string]string) LookupEnv {
+	return func(key string) (string, bool) {
+		value, ok := values[key]
+		return value, ok
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeFile(t, "config.json", `{
+		"address": "file:1",
+		"store_interval": 5,
+		"restore": true,
+		"rate_limit": 2.5,
+		"retry_delay": "3s",
+		"alert_webhooks": ["http://a", "http://b"]
+	}`)
+
+	config := &testConfig{Address: "default", Interval: 300}
+	set := newTestSet(config)
+	err := set.Load(
+		[]string{"-c", path, "-i", "7"},
+		env(map[string]string{"ADDRESS": "env:1", "STORE_INTERVAL": "6"}),
+	)
+	require.NoError(t, err)
+
+	assert.Equal(t, "env:1", config.Address, "the environment overrides the file")
+	assert.Equal(t, 7, config.Interval, "flags override the environment")
+	assert.True(t, config.Restore)
+	assert.Equal(t, 2.5, config.Rate)
+	assert.Equal(t, 3*time.Second, config.Delay)
+	assert.Equal(t, []string{"http://a", "http://b"}, config.Webhooks)
+	assert.False(t, set.PrintRequested())
+}
+
+func TestLoadYAML(t *testing.T) {
+	path := writeFile(t, "config.yaml", "address: ':9090'\nstore_interval: 0\nrestore: true\nalert_webhooks:\n  - http://a\n")
+
+	config := &testConfig{Interval: 300}
+	err := newTestSet(config).Load(nil, env(map[string]string{ConfigEnv: path}))
+	require.NoError(t, err)
+	assert.Equal(t, ":9090", config.Address)
+	assert.Equal(t, 0, config.Interval)
+	assert.True(t, config.Restore)
+	assert.Equal(t, []string{"http://a"}, config.Webhooks)
+}
+
+func TestLoadErrorsNameTheKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		args    []string
+		wantErr string
+	}{
+		{name: "unknown key", file: `{"adress": "x"}`, wantErr: `unknown key "adress"`},
+		{name: "invalid file value", file: `{"store_interval": "soon"}`, wantErr: "invalid store_interval value"},
+		{name: "invalid duration", file: `{"retry_delay": 5}`, wantErr: "invalid retry_delay value"},
+		{name: "invalid env value", env: map[string]string{"RESTORE": "maybe"}, wantErr: "invalid RESTORE value"},
+		{name: "invalid flag value", args: []string{"-i", "x"}, wantErr: "-i"},
+		{name: "malformed file", file: `{"address":`, wantErr: "error parsing config file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"-config", writeFile(t, "config.json", tt.file)}, args...)
+			}
+			err := newTestSet(&testConfig{}).Load(args, env(tt.env))
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestDump(t *testing.T) {
+	config := &testConfig{
+		Address:  "localhost:8080",
+		Interval: 10,
+		Delay:    time.Second,
+		Webhooks: []string{"http://a?x=1&y=2"},
+		Key:      "secret",
+	}
+	set := newTestSet(config)
+	require.NoError(t, set.Load([]string{"-print-config"}, env(nil)))
+	assert.True(t, set.PrintRequested())
+
+	var buf bytes.Buffer
+	require.NoError(t, set.Dump(&buf))
+	assert.Contains(t, buf.String(), `"key": "<hidden>"`)
+	assert.NotContains(t, buf.String(), "secret")
+
+	// The dump can be loaded back, except for the secrets
+	path := writeFile(t, "dump.json", buf.String())
+	loaded := &testConfig{}
+	require.NoError(t, newTestSet(loaded).Load([]string{"-c", path}, env(nil)))
+	loaded.Key = config.Key
+	assert.Equal(t, config, loaded)
+}
@@ -0,0 +1,169 @@
+package options
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stringValue is a string option.
+type stringValue string
+
+// Set implements flag.Value.
+func (v *stringValue) Set(s string) error {
+	*v = stringValue(s)
+	return nil
+}
+
+// String implements flag.Value.
+func (v *stringValue) String() string {
+	if v == nil {
+		return ""
+	}
+	return string(*v)
+}
+
+// dump implements value.
+func (v *stringValue) dump() any {
+	return string(*v)
+}
+
+// intValue is an integer option.
+type intValue int
+
+// Set implements flag.Value.
+func (v *intValue) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	*v = intValue(n)
+	return nil
+}
+
+// String implements flag.Value.
+func (v *intValue) String() string {
+	if v == nil {
+		return "0"
+	}
+	return strconv.Itoa(int(*v))
+}
+
+// dump implements value.
+func (v *intValue) dump() any {
+	return int(*v)
+}
+
+// float64Value is a floating point option.
+type float64Value float64
+
+// Set implements flag.Value.
+func (v *float64Value) Set(s string) error {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return err
+	}
+	*v = float64Value(f)
+	return nil
+}
+
+// String implements flag.Value.
+func (v *float64Value) String() string {
+	if v == nil {
+		return "0"
+	}
+	return strconv.FormatFloat(float64(*v), 'g', -1, 64)
+}
+
+// dump implements value.
+func (v *float64Value) dump() any {
+	return float64(*v)
+}
+
+// boolValue is a boolean option.
+type boolValue bool
+
+// Set implements flag.Value.
+func (v *boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	*v = boolValue(b)
+	return nil
+}
+
+// String implements flag.Value.
+func (v *boolValue) String() string {
+	if v == nil {
+		return "false"
+	}
+	return strconv.FormatBool(bool(*v))
+}
+
+// IsBoolFlag lets the flag be given without a value.
+func (v *boolValue) IsBoolFlag() bool {
+	return true
+}
+
+// dump implements value.
+func (v *boolValue) dump() any {
+	return bool(*v)
+}
+
+// durationValue is a duration option.
+type durationValue time.Duration
+
+// Set implements flag.Value.
+func (v *durationValue) Set(s string) error {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*v = durationValue(d)
+	return nil
+}
+
+// String implements flag.Value.
+func (v *durationValue) String() string {
+	if v == nil {
+		return "0s"
+	}
+	return time.Duration(*v).String()
+}
+
+// dump implements value.
+func (v *durationValue) dump() any {
+	return time.Duration(*v).String()
+}
+
+// listValue is a comma-separated string list option.
+type listValue []string
+
+// Set implements flag.Value.
+func (v *listValue) Set(s string) error {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	*v = items
+	return nil
+}
+
+// String implements flag.Value.
+func (v *listValue) String() string {
+	if v == nil {
+		return ""
+	}
+	return strings.Join(*v, ",")
+}
+
+// dump implements value.
+func (v *listValue) dump() any {
+	if *v == nil {
+		return []string{}
+	}
+	return []string(*v)
+}
@@ -3,7 +3,10 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"sort"
+	"time"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
 
@@ -32,133 +35,331 @@ func (storage *DBStorage) Close() error {
 	return storage.db.Close()
 }
 
-// checkMetricExists checks if a metric exists and is not soft deleted
-func (storage *DBStorage) checkMetricExists(ctx context.Context, tx *sql.Tx, name string) (bool, error) {
-	var exists bool
-	query := "SELECT EXISTS(SELECT 1 FROM metrics WHERE name = $1 AND deleted_at IS NULL)"
-	err := tx.QueryRowContext(ctx, query, name).Scan(&exists)
+// encodeLabels serializes labels into the JSONB representation stored in the labels column
+func encodeLabels(labels map[string]string) (string, error) {
+	if len(labels) == 0 {
+		return "{}", nil
+	}
+	data, err := json.Marshal(labels)
 	if err != nil {
-		return false, fmt.Errorf("error checking if metric exists: %w", err)
+		return "", fmt.Errorf("error encoding labels: %w", err)
+	}
+	return string(data), nil
+}
+
+// decodeLabels parses the labels column, returning nil for a series without labels
+func decodeLabels(data []byte) (map[string]string, error) {
+	var labels map[string]string
+	if err := json.Unmarshal(data, &labels); err != nil {
+		return nil, fmt.Errorf("error decoding labels: %w", err)
 	}
-	return exists, nil
+	if len(labels) == 0 {
+		return nil, nil
+	}
+	return labels, nil
 }
 
-// insertMetric inserts a new metric record
-func (storage *DBStorage) insertMetric(tx *sql.Tx, name string, typ string, value any) error {
-	query := "INSERT INTO metrics (name, type, value, created_at, updated_at, deleted_at) VALUES ($1, $2, $3, NOW(), NOW(), NULL)"
-	_, err := tx.Exec(query, name, typ, value)
+// encodeHistogram validates a histogram value and serializes it for the histogram column
+func encodeHistogram(value any) (models.HistogramValue, []byte, error) {
+	hist, err := models.ParseHistogram(value)
 	if err != nil {
-		return fmt.Errorf("error saving metric: %w", err)
+		return models.HistogramValue{}, nil, err
 	}
-	return nil
+	if err := hist.Validate(); err != nil {
+		return models.HistogramValue{}, nil, err
+	}
+	data, err := json.Marshal(hist)
+	if err != nil {
+		return models.HistogramValue{}, nil, fmt.Errorf("error encoding histogram: %w", err)
+	}
+	return hist, data, nil
 }
 
-// updateMetric updates an existing metric based on its type
-func (storage *DBStorage) updateMetric(ctx context.Context, tx *sql.Tx, name string, value any, typ string) error {
-	switch typ {
-	case config.CounterType:
-		// For counters, increment the existing value
-		query := "UPDATE metrics SET value = value + $1, updated_at = NOW() where name = $2 AND deleted_at IS NULL"
-		_, err := tx.ExecContext(ctx, query, value, name)
-		if err != nil {
-			return fmt.Errorf("error saving metric: %w", err)
-		}
+// decodeValue converts the value, delta and histogram columns of a row into a metric value
+func decodeValue(metricType string, value sql.NullFloat64, delta sql.NullInt64, histogram []byte) (any, error) {
+	switch metricType {
 	case config.GaugeType:
-		// For gauges, replace the existing value
-		query := "UPDATE metrics SET value = $1, updated_at = NOW() where name = $2 AND deleted_at IS NULL"
-		_, err := tx.ExecContext(ctx, query, value, name)
-		if err != nil {
-			return fmt.Errorf("error saving metric: %w", err)
+		return value.Float64, nil
+	case config.CounterType:
+		return delta.Int64, nil
+	case config.HistogramType:
+		var hist models.HistogramValue
+		if err := json.Unmarshal(histogram, &hist); err != nil {
+			return nil, fmt.Errorf("error decoding histogram: %w", err)
 		}
+		return hist, nil
 	default:
-		return fmt.Errorf("unknown metric type: %s", typ)
+		return nil, internalerrors.ErrUnknownMetricType
 	}
-	return nil
 }
 
-// SetMetrics saves multiple metrics in a single transaction.
+// seriesUpdate is the combined change of a series in a batch
+type seriesUpdate struct {
+	// name is the metric name
+	name string
+
+	// labels is the JSONB representation of the series labels
+	labels string
+
+	// typ is the metric type, which selects the field below that is used
+	typ string
+
+	// value is the value of a gauge
+	value float64
+
+	// delta is the increment of a counter
+	delta int64
+
+	// histogram holds the observations of a histogram
+	histogram models.HistogramValue
+}
+
+// aggregateMetrics combines the updates of every series in metrics, since a single upsert
+// cannot change a row twice.
 //
-// For each metric, it checks if it exists and either creates a new record or updates the existing one.
-func (storage *DBStorage) SetMetrics(ctx context.Context, metrics []models.Metric) error {
-	// Start a transaction to ensure atomicity of batch operations
-	tx, err := storage.db.Begin()
-	if err != nil {
-		return fmt.Errorf("can't starting transaction: %w", err)
-	}
-	// Prepare statement to check if a metric already exists (not soft deleted)
-	stmtExist, err := tx.PrepareContext(ctx, "SELECT EXISTS(SELECT 1 FROM metrics WHERE name = $1 AND deleted_at IS NULL)")
-	if err != nil {
-		return fmt.Errorf("error checking if metric exists: %w", err)
-	}
-	defer stmtExist.Close()
+// Counters are summed, the last gauge value wins and histograms are merged. A series whose type
+// changes within the batch starts over. The result is ordered by series, so concurrent batches
+// lock their rows in the same order.
+func aggregateMetrics(metrics []models.Metric) ([]*seriesUpdate, error) {
+	bySeries := make(map[string]*seriesUpdate, len(metrics))
 	for _, metric := range metrics {
-		var exists bool
-		err = stmtExist.QueryRowContext(ctx, metric.Name).Scan(&exists)
+		labels, err := encodeLabels(metric.Labels)
 		if err != nil {
-			return fmt.Errorf("error checking if metric exists: %w", err)
+			return nil, err
 		}
-		if !exists {
-			// Insert new metric record
-			err = storage.insertMetric(tx, metric.Name, metric.Type, metric.Value)
-			if err != nil {
-				return err
+		key := models.SeriesKey(metric.Name, metric.Labels)
+		update, exists := bySeries[key]
+		if exists && update.typ != metric.Type {
+			exists = false
+		}
+		switch metric.Type {
+		case config.CounterType:
+			delta, ok := metric.Value.(int64)
+			if !ok {
+				return nil, fmt.Errorf("unexpected counter value %T of %s", metric.Value, metric.Name)
+			}
+			if exists {
+				update.delta += delta
+				continue
 			}
-		} else {
-			// Update existing metric based on its type
-			err = storage.updateMetric(ctx, tx, metric.Name, metric.Value, metric.Type)
+			update = &seriesUpdate{delta: delta}
+		case config.GaugeType:
+			value, ok := metric.Value.(float64)
+			if !ok {
+				return nil, fmt.Errorf("unexpected gauge value %T of %s", metric.Value, metric.Name)
+			}
+			if exists {
+				update.value = value
+				continue
+			}
+			update = &seriesUpdate{value: value}
+		case config.HistogramType:
+			hist, _, err := encodeHistogram(metric.Value)
 			if err != nil {
-				return err
+				return nil, err
 			}
+			if exists {
+				if update.histogram, err = update.histogram.Merge(hist); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			update = &seriesUpdate{histogram: hist.Clone()}
+		default:
+			return nil, fmt.Errorf("unknown metric type: %s", metric.Type)
 		}
+		update.name, update.labels, update.typ = metric.Name, labels, metric.Type
+		bySeries[key] = update
 	}
-	// Commit the transaction to persist all changes
-	err = tx.Commit()
-	if err != nil {
-		return fmt.Errorf("error committing transaction: %w", err)
+
+	updates := make([]*seriesUpdate, 0, len(bySeries))
+	for _, update := range bySeries {
+		updates = append(updates, update)
 	}
-	return nil
+	sort.Slice(updates, func(i, j int) bool {
+		if updates[i].name != updates[j].name {
+			return updates[i].name < updates[j].name
+		}
+		return updates[i].labels < updates[j].labels
+	})
+	return updates, nil
 }
 
-// SetMetric saves a single metric.
+// mergeStoredHistograms locks the rows of the histograms in updates and merges the stored
+// observations into them.
 //
-// It checks if the metric exists and either creates a new record or updates the existing one.
-func (storage *DBStorage) SetMetric(ctx context.Context, name string, value any, typ string) error {
-	tx, err := storage.db.Begin()
-	if err != nil {
-		return fmt.Errorf("can't start transaction: %w", err)
-	}
-	defer func() {
-		if err != nil {
-			tx.Rollback()
+// Missing rows are first inserted as soft-deleted placeholders, so a concurrent batch creating
+// the same series waits for this transaction instead of overwriting its observations.
+func (storage *DBStorage) mergeStoredHistograms(ctx context.Context, tx *sql.Tx, updates []*seriesUpdate) error {
+	var histograms []*seriesUpdate
+	var names, labels []string
+	for _, update := range updates {
+		if update.typ == config.HistogramType {
+			histograms = append(histograms, update)
+			names = append(names, update.name)
+			labels = append(labels, update.labels)
 		}
-	}()
+	}
+	if len(histograms) == 0 {
+		return nil
+	}
 
-	exists, err := storage.checkMetricExists(ctx, tx, name)
-	if err != nil {
-		return err
+	query := `INSERT INTO metrics (name, labels, type, created_at, updated_at, deleted_at)
+		SELECT u.name, u.labels::jsonb, $3, NOW(), NOW(), NOW() FROM unnest($1::text[], $2::text[]) AS u(name, labels)
+		ON CONFLICT (name, labels) DO NOTHING`
+	if _, err := tx.ExecContext(ctx, query, names, labels, config.HistogramType); err != nil {
+		return fmt.Errorf("error locking histograms: %w", err)
 	}
 
-	if !exists {
-		// Insert new metric record
-		err = storage.insertMetric(tx, name, typ, value)
-		if err != nil {
-			return err
+	query = `SELECT u.i, m.type, m.histogram, m.deleted_at IS NULL
+		FROM metrics m JOIN unnest($1::text[], $2::text[]) WITH ORDINALITY AS u(name, labels, i)
+		ON m.name = u.name AND m.labels = u.labels::jsonb
+		ORDER BY u.i FOR UPDATE OF m`
+	rows, err := tx.QueryContext(ctx, query, names, labels)
+	if err != nil {
+		return fmt.Errorf("error retrieving histograms: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var i int
+		var metricType string
+		var stored []byte
+		var live bool
+		if err := rows.Scan(&i, &metricType, &stored, &live); err != nil {
+			return fmt.Errorf("error scanning histogram: %w", err)
 		}
-	} else {
-		// Update existing metric based on its type
-		err = storage.updateMetric(ctx, tx, name, value, typ)
-		if err != nil {
+		// Soft-deleted series and series of another type start over
+		if !live || metricType != config.HistogramType || stored == nil {
+			continue
+		}
+		var existing models.HistogramValue
+		if err := json.Unmarshal(stored, &existing); err != nil {
+			return fmt.Errorf("error decoding histogram: %w", err)
+		}
+		update := histograms[i-1]
+		if update.histogram, err = existing.Merge(update.histogram); err != nil {
 			return err
 		}
 	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating over histograms: %w", err)
+	}
+	return nil
+}
+
+// upsertMetrics writes updates with a single multi-row upsert.
+//
+// Counters are added to the stored delta and the other types replace the stored value. A
+// soft-deleted row of the series is revived with the new value, and a row of another type is
+// replaced. If report is set, the rows as written are returned.
+func (storage *DBStorage) upsertMetrics(ctx context.Context, tx *sql.Tx, updates []*seriesUpdate, report bool) ([]models.Metric, error) {
+	names := make([]string, len(updates))
+	labels := make([]string, len(updates))
+	types := make([]string, len(updates))
+	values := make([]*float64, len(updates))
+	deltas := make([]*int64, len(updates))
+	histograms := make([]*string, len(updates))
+	for i, update := range updates {
+		names[i], labels[i], types[i] = update.name, update.labels, update.typ
+		switch update.typ {
+		case config.GaugeType:
+			values[i] = &update.value
+		case config.CounterType:
+			deltas[i] = &update.delta
+		case config.HistogramType:
+			data, err := json.Marshal(update.histogram)
+			if err != nil {
+				return nil, fmt.Errorf("error encoding histogram: %w", err)
+			}
+			histogram := string(data)
+			histograms[i] = &histogram
+		}
+	}
 
-	// Commit the transaction to persist changes
-	err = tx.Commit()
+	query := `INSERT INTO metrics (name, labels, type, value, delta, histogram, created_at, updated_at, deleted_at)
+		SELECT u.name, u.labels::jsonb, u.type, u.value, u.delta, u.histogram::jsonb, NOW(), NOW(), NULL
+		FROM unnest($1::text[], $2::text[], $3::text[], $4::float8[], $5::int8[], $6::text[])
+			AS u(name, labels, type, value, delta, histogram)
+		ON CONFLICT (name, labels) DO UPDATE SET
+			type = EXCLUDED.type,
+			value = EXCLUDED.value,
+			delta = CASE
+				WHEN metrics.deleted_at IS NULL AND metrics.type = EXCLUDED.type THEN metrics.delta + EXCLUDED.delta
+				ELSE EXCLUDED.delta
+			END,
+			histogram = EXCLUDED.histogram,
+			created_at = CASE WHEN metrics.deleted_at IS NULL THEN metrics.created_at ELSE NOW() END,
+			updated_at = NOW(),
+			deleted_at = NULL`
+	if !report {
+		if _, err := tx.ExecContext(ctx, query, names, labels, types, values, deltas, histograms); err != nil {
+			return nil, fmt.Errorf("error saving metrics: %w", err)
+		}
+		return nil, nil
+	}
+	query += " RETURNING name, labels, type, value, delta, histogram"
+	rows, err := tx.QueryContext(ctx, query, names, labels, types, values, deltas, histograms)
 	if err != nil {
-		return fmt.Errorf("error committing transaction: %w", err)
+		return nil, fmt.Errorf("error saving metrics: %w", err)
 	}
+	defer rows.Close()
+	return scanMetrics(rows)
+}
 
-	return nil
+// SetMetrics saves multiple metrics in a single transaction.
+//
+// The updates of every series are combined and written with one upsert, which also re-creates
+// soft-deleted series. Histograms take two more statements to merge the stored observations.
+func (storage *DBStorage) SetMetrics(ctx context.Context, metrics []models.Metric) error {
+	_, err := storage.setMetrics(ctx, metrics, false)
+	return err
+}
+
+// UpdateMetrics saves multiple metrics like SetMetrics and returns the value of every updated
+// series as written by the upsert, without another round trip.
+func (storage *DBStorage) UpdateMetrics(ctx context.Context, metrics []models.Metric) ([]Update, error) {
+	return storage.setMetrics(ctx, metrics, true)
+}
+
+// setMetrics saves a batch, and if report is set returns the values of the updated series.
+func (storage *DBStorage) setMetrics(ctx context.Context, metrics []models.Metric, report bool) ([]Update, error) {
+	updates, err := aggregateMetrics(metrics)
+	if err != nil || len(updates) == 0 {
+		return nil, err
+	}
+
+	// Start a transaction to ensure atomicity of batch operations
+	tx, err := storage.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("can't starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := storage.mergeStoredHistograms(ctx, tx, updates); err != nil {
+		return nil, err
+	}
+	written, err := storage.upsertMetrics(ctx, tx, updates, report)
+	if err != nil {
+		return nil, err
+	}
+	// The rows stay locked until the commit, so a later write of a series gets a later time
+	now := time.Now()
+	var updated []Update
+	for _, metric := range written {
+		updated = append(updated, Update{Metric: metric, At: now})
+	}
+	// Commit the transaction to persist all changes
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error committing transaction: %w", err)
+	}
+	return updated, nil
+}
+
+// SetMetric saves a single metric.
+//
+// It is a batch of one series without labels, see SetMetrics.
+func (storage *DBStorage) SetMetric(ctx context.Context, name string, value any, typ string) error {
+	return storage.SetMetrics(ctx, []models.Metric{{Name: name, Type: typ, Value: value}})
 }
 
 // GetMetric retrieves a single metric by its DTO.
@@ -166,10 +367,16 @@ func (storage *DBStorage) SetMetric(ctx context.Context, name string, value any,
 // It returns a MetricsDTO with the current value of the requested metric.
 func (storage *DBStorage) GetMetric(ctx context.Context, metrics models.MetricsDTO) (models.MetricsDTO, error) {
 	var metricType string
-	var value float64
+	var value sql.NullFloat64
+	var delta sql.NullInt64
+	var histogram []byte
 
-	query := "SELECT type, value FROM metrics WHERE name = $1 AND deleted_at IS NULL"
-	err := storage.db.QueryRowContext(ctx, query, metrics.ID).Scan(&metricType, &value)
+	labels, err := encodeLabels(metrics.Labels)
+	if err != nil {
+		return models.MetricsDTO{}, err
+	}
+	query := "SELECT type, value, delta, histogram FROM metrics WHERE name = $1 AND labels = $2::jsonb AND deleted_at IS NULL"
+	err = storage.db.QueryRowContext(ctx, query, metrics.ID, labels).Scan(&metricType, &value, &delta, &histogram)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return models.MetricsDTO{}, internalerrors.ErrMetricNotFound
@@ -178,51 +385,50 @@ func (storage *DBStorage) GetMetric(ctx context.Context, metrics models.MetricsD
 	}
 
 	responseMetrics := models.MetricsDTO{
-		ID:    metrics.ID,
-		MType: metrics.MType,
+		ID:     metrics.ID,
+		MType:  metrics.MType,
+		Labels: metrics.Labels,
 	}
 
-	switch metricType {
-	case config.GaugeType:
-		responseMetrics.Value = &value
-	case config.CounterType:
-		intValue := int64(value)
-		responseMetrics.Delta = &intValue
-	default:
-		return models.MetricsDTO{}, internalerrors.ErrUnknownMetricType
+	metricValue, err := decodeValue(metricType, value, delta, histogram)
+	if err != nil {
+		return models.MetricsDTO{}, err
+	}
+	switch v := metricValue.(type) {
+	case float64:
+		responseMetrics.Value = &v
+	case int64:
+		responseMetrics.Delta = &v
+	case models.HistogramValue:
+		responseMetrics.Histogram = &v
 	}
 	return responseMetrics, nil
 }
 
 // GetMetricByName retrieves a single metric by its name.
 //
-// It returns the raw value of the requested metric (float64 for gauges, int64 for counters).
+// It returns the raw value of the requested metric (float64 for gauges, int64 for counters,
+// HistogramValue for histograms). Only the series without labels is considered.
 func (storage *DBStorage) GetMetricByName(ctx context.Context, name string) (any, error) {
 	var metricType string
-	var value float64
+	var value sql.NullFloat64
+	var delta sql.NullInt64
+	var histogram []byte
 
-	query := "SELECT type, value FROM metrics WHERE name = $1 AND deleted_at IS NULL"
-	err := storage.db.QueryRowContext(ctx, query, name).Scan(&metricType, &value)
+	query := "SELECT type, value, delta, histogram FROM metrics WHERE name = $1 AND labels = '{}'::jsonb AND deleted_at IS NULL"
+	err := storage.db.QueryRowContext(ctx, query, name).Scan(&metricType, &value, &delta, &histogram)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, internalerrors.ErrMetricNotFound
 		}
 		return nil, fmt.Errorf("error retrieving metric: %w", err)
 	}
-	switch metricType {
-	case config.GaugeType:
-		return value, nil
-	case config.CounterType:
-		intValue := int64(value)
-		return intValue, nil
-	default:
-		return nil, internalerrors.ErrUnknownMetricType
-	}
+	return decodeValue(metricType, value, delta, histogram)
 }
 
 // DeleteMetric removes a metric by its name using soft deletion.
 //
-// It sets the deleted_at timestamp for the metric, marking it as deleted without actually removing it from the database.
+// It sets the deleted_at timestamp for every series of the metric, marking it as deleted without actually removing it from the database.
 func (storage *DBStorage) DeleteMetric(ctx context.Context, name string) error {
 	// Soft delete: set deleted_at timestamp
 	query := "UPDATE metrics SET deleted_at = NOW() WHERE name = $1 AND deleted_at IS NULL"
@@ -235,41 +441,50 @@ func (storage *DBStorage) DeleteMetric(ctx context.Context, name string) error {
 
 // ListMetrics retrieves all metrics that are not soft deleted.
 //
-// It returns a slice of Metric structs containing all gauge and counter values.
+// It returns a slice of Metric structs containing all gauge, counter, and histogram values.
 func (storage *DBStorage) ListMetrics(ctx context.Context) ([]models.Metric, error) {
-	var formattedMetrics []models.Metric
-	query := "SELECT name, type, value FROM metrics WHERE deleted_at IS NULL"
+	query := "SELECT name, labels, type, value, delta, histogram FROM metrics WHERE deleted_at IS NULL"
 	rows, err := storage.db.QueryContext(ctx, query)
 	if err != nil {
 		return nil, fmt.Errorf("error retrieving metrics: %w", err)
 	}
 	defer rows.Close()
+	return scanMetrics(rows)
+}
 
+// scanMetrics reads the metrics of rows with the name, labels, type, value, delta and histogram columns
+func scanMetrics(rows *sql.Rows) ([]models.Metric, error) {
+	var formattedMetrics []models.Metric
 	for rows.Next() {
 		var name, metricType string
-		var value float64
+		var rawLabels, histogram []byte
+		var value sql.NullFloat64
+		var delta sql.NullInt64
 
-		err = rows.Scan(&name, &metricType, &value)
+		err := rows.Scan(&name, &rawLabels, &metricType, &value, &delta, &histogram)
 		if err != nil {
 			return nil, fmt.Errorf("error scanning metric: %w", err)
 		}
+		labels, err := decodeLabels(rawLabels)
+		if err != nil {
+			return nil, err
+		}
 
-		var metricValue any
-		if metricType == config.CounterType {
-			metricValue = int64(value)
-		} else {
-			metricValue = value
+		metricValue, err := decodeValue(metricType, value, delta, histogram)
+		if err != nil {
+			return nil, err
 		}
 		metric := models.Metric{
-			Name:  name,
-			Type:  metricType,
-			Value: metricValue,
+			Name:   name,
+			Type:   metricType,
+			Value:  metricValue,
+			Labels: labels,
 		}
 
 		formattedMetrics = append(formattedMetrics, metric)
 	}
 
-	if err = rows.Err(); err != nil {
+	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("error iterating over metrics: %w", err)
 	}
 
@@ -0,0 +1,324 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+	_ "github.com/golang-migrate/migrate/v4/source/file"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/Schera-ole/metrics/internal/config"
+	internalerrors "github.com/Schera-ole/metrics/internal/errors"
+	"github.com/Schera-ole/metrics/internal/migration"
+	models "github.com/Schera-ole/metrics/internal/model"
+)
+
+func TestAggregateMetrics(t *testing.T) {
+	first := models.NewHistogram(0.1, 1)
+	first.Observe(0.5)
+	second := models.NewHistogram(0.1, 1)
+	second.Observe(5)
+
+	updates, err := aggregateMetrics([]models.Metric{
+		{Name: "PollCount", Type: config.CounterType, Value: int64(1 << 60)},
+		{Name: "Alloc", Type: config.GaugeType, Value: 1.5},
+		{Name: "PollCount", Type: config.CounterType, Value: int64(3)},
+		{Name: "Alloc", Type: config.GaugeType, Value: 2.5},
+		{Name: "requests", Type: config.CounterType, Value: int64(2), Labels: map[string]string{"host": "a"}},
+		{Name: "latency", Type: config.HistogramType, Value: first},
+		{Name: "latency", Type: config.HistogramType, Value: second},
+		{Name: "Changed", Type: config.CounterType, Value: int64(7)},
+		{Name: "Changed", Type: config.GaugeType, Value: 0.5},
+	})
+	require.NoError(t, err)
+
+	merged, err := first.Merge(second)
+	require.NoError(t, err)
+	assert.Equal(t, []*seriesUpdate{
+		{name: "Alloc", labels: "{}", typ: config.GaugeType, value: 2.5},
+		{name: "Changed", labels: "{}", typ: config.GaugeType, value: 0.5},
+		{name: "PollCount", labels: "{}", typ: config.CounterType, delta: 1<<60 + 3},
+		{name: "latency", labels: "{}", typ: config.HistogramType, histogram: merged},
+		{name: "requests", labels: `{"host":"a"}`, typ: config.CounterType, delta: 2},
+	}, updates, "every series is written once, in series order")
+}
+
+func TestAggregateMetricsErrors(t *testing.T) {
+	tests := []models.Metric{
+		{Name: "PollCount", Type: config.CounterType, Value: 1.5},
+		{Name: "Alloc", Type: config.GaugeType, Value: int64(1)},
+		{Name: "latency", Type: config.HistogramType, Value: models.HistogramValue{Bounds: []float64{1}, Counts: []uint64{1}}},
+		{Name: "unknown", Type: "summary", Value: 1.0},
+	}
+	for _, metric := range tests {
+		_, err := aggregateMetrics([]models.Metric{metric})
+		assert.Error(t, err, metric.Name)
+	}
+
+	_, err := aggregateMetrics([]models.Metric{
+		{Name: "latency", Type: config.HistogramType, Value: models.NewHistogram(1)},
+		{Name: "latency", Type: config.HistogramType, Value: models.NewHistogram(2)},
+	})
+	assert.Error(t, err, "histograms with different bounds are not merged")
+}
+
+// testDSN returns the database of the integration tests from DATABASE_DSN, and skips the test
+// if it is not set. The tables of previous runs are dropped, so the database must be disposable.
+func testDSN(t *testing.T) string {
+	dsn := os.Getenv("DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("DATABASE_DSN is not set")
+	}
+	db, err := sql.Open("pgx", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+	_, err = db.Exec("DROP TABLE IF EXISTS metrics, schema_migrations")
+	require.NoError(t, err)
+	return dsn
+}
+
+// testDBStorage returns a DBStorage on an empty database migrated like the server does.
+func testDBStorage(t *testing.T) *DBStorage {
+	dsn := testDSN(t)
+	// RunMigrations reads the migrations relative to the working directory of the server
+	t.Chdir("../..")
+	require.NoError(t, migration.RunMigrations(context.Background(), dsn, zap.NewNop().Sugar()))
+
+	storage, err := NewDBStorage(dsn)
+	require.NoError(t, err)
+	t.Cleanup(func() { storage.Close() })
+	return storage
+}
+
+func TestDBStorage_SetMetrics(t *testing.T) {
+	storage := testDBStorage(t)
+	ctx := context.Background()
+	hist := models.NewHistogram(1)
+	hist.Observe(0.5)
+
+	// Repeated series of a batch are combined into one row of the upsert
+	require.NoError(t, storage.SetMetrics(ctx, []models.Metric{
+		{Name: "PollCount", Type: config.CounterType, Value: int64(2)},
+		{Name: "Alloc", Type: config.GaugeType, Value: 1.5},
+		{Name: "PollCount", Type: config.CounterType, Value: int64(3)},
+		{Name: "requests", Type: config.CounterType, Value: int64(1), Labels: map[string]string{"host": "a"}},
+		{Name: "requests", Type: config.CounterType, Value: int64(4), Labels: map[string]string{"host": "b"}},
+		{Name: "latency", Type: config.HistogramType, Value: hist},
+	}))
+	require.NoError(t, storage.SetMetrics(ctx, []models.Metric{
+		{Name: "PollCount", Type: config.CounterType, Value: int64(10)},
+		{Name: "Alloc", Type: config.GaugeType, Value: 2.5},
+		{Name: "requests", Type: config.CounterType, Value: int64(1), Labels: map[string]string{"host": "a"}},
+		{Name: "latency", Type: config.HistogramType, Value: hist},
+	}))
+
+	metrics, err := storage.ListMetrics(ctx)
+	require.NoError(t, err)
+	merged, err := hist.Merge(hist)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []models.Metric{
+		{Name: "PollCount", Type: config.CounterType, Value: int64(15)},
+		{Name: "Alloc", Type: config.GaugeType, Value: 2.5},
+		{Name: "requests", Type: config.CounterType, Value: int64(2), Labels: map[string]string{"host": "a"}},
+		{Name: "requests", Type: config.CounterType, Value: int64(4), Labels: map[string]string{"host": "b"}},
+		{Name: "latency", Type: config.HistogramType, Value: merged},
+	}, metrics)
+
+	value, err := storage.GetMetricByName(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(15), value)
+	dto, err := storage.GetMetric(ctx, models.MetricsDTO{ID: "requests", MType: config.CounterType, Labels: map[string]string{"host": "b"}})
+	require.NoError(t, err)
+	require.NotNil(t, dto.Delta)
+	assert.Equal(t, int64(4), *dto.Delta)
+}
+
+func TestDBStorage_CounterRevivalAndTypeChange(t *testing.T) {
+	storage := testDBStorage(t)
+	ctx := context.Background()
+
+	// A revived counter starts over instead of adding to the delta of the deleted row
+	require.NoError(t, storage.SetMetric(ctx, "PollCount", int64(5), config.CounterType))
+	require.NoError(t, storage.DeleteMetric(ctx, "PollCount"))
+	_, err := storage.GetMetricByName(ctx, "PollCount")
+	assert.ErrorIs(t, err, internalerrors.ErrMetricNotFound)
+	require.NoError(t, storage.SetMetric(ctx, "PollCount", int64(3), config.CounterType))
+	value, err := storage.GetMetricByName(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), value)
+
+	// A series changing to a counter starts from the new delta, not from the NULL delta of a gauge
+	require.NoError(t, storage.SetMetric(ctx, "Changed", int64(4), config.CounterType))
+	require.NoError(t, storage.SetMetric(ctx, "Changed", 1.5, config.GaugeType))
+	require.NoError(t, storage.SetMetric(ctx, "Changed", int64(7), config.CounterType))
+	value, err = storage.GetMetricByName(ctx, "Changed")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), value)
+	require.NoError(t, storage.SetMetric(ctx, "Changed", int64(1), config.CounterType))
+	value, err = storage.GetMetricByName(ctx, "Changed")
+	require.NoError(t, err)
+	assert.Equal(t, int64(8), value)
+
+	// A revived histogram does not merge the observations of the deleted row
+	hist := models.NewHistogram(1)
+	hist.Observe(0.5)
+	require.NoError(t, storage.SetMetric(ctx, "latency", hist, config.HistogramType))
+	require.NoError(t, storage.DeleteMetric(ctx, "latency"))
+	require.NoError(t, storage.SetMetric(ctx, "latency", hist, config.HistogramType))
+	value, err = storage.GetMetricByName(ctx, "latency")
+	require.NoError(t, err)
+	assert.Equal(t, hist, value)
+}
+
+func TestDBStorage_UpdateMetricsReturnsWrittenValues(t *testing.T) {
+	storage := testDBStorage(t)
+	ctx := context.Background()
+	hist := models.NewHistogram(1)
+	hist.Observe(2)
+	require.NoError(t, storage.SetMetrics(ctx, []models.Metric{
+		{Name: "PollCount", Type: config.CounterType, Value: int64(5)},
+		{Name: "latency", Type: config.HistogramType, Value: hist},
+	}))
+
+	updated, err := storage.UpdateMetrics(ctx, []models.Metric{
+		{Name: "PollCount", Type: config.CounterType, Value: int64(3)},
+		{Name: "Alloc", Type: config.GaugeType, Value: 1.5, Labels: map[string]string{"host": "a"}},
+		{Name: "latency", Type: config.HistogramType, Value: hist},
+	})
+	require.NoError(t, err)
+	require.Len(t, updated, 3)
+	metrics := make([]models.Metric, 0, len(updated))
+	for _, update := range updated {
+		assert.False(t, update.At.IsZero())
+		metrics = append(metrics, update.Metric)
+	}
+	merged, err := hist.Merge(hist)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []models.Metric{
+		{Name: "PollCount", Type: config.CounterType, Value: int64(8)},
+		{Name: "Alloc", Type: config.GaugeType, Value: 1.5, Labels: map[string]string{"host": "a"}},
+		{Name: "latency", Type: config.HistogramType, Value: merged},
+	}, metrics, "the upsert returns the stored totals, not the deltas of the batch")
+
+	updated, err = storage.UpdateMetrics(ctx, nil)
+	require.NoError(t, err)
+	assert.Empty(t, updated)
+}
+
+func TestDBStorage_ConcurrentHistogramsOfNewSeries(t *testing.T) {
+	storage := testDBStorage(t)
+	ctx := context.Background()
+	hist := models.NewHistogram(1)
+	hist.Observe(0.5)
+
+	// Every writer finds the series missing, so the placeholder rows and FOR UPDATE must keep
+	// the writers from overwriting each other's observations
+	const writers = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- storage.SetMetrics(ctx, []models.Metric{
+				{Name: "latency", Type: config.HistogramType, Value: hist},
+				{Name: "fresh", Type: config.HistogramType, Value: hist, Labels: map[string]string{"host": "a"}},
+				{Name: "PollCount", Type: config.CounterType, Value: int64(1)},
+			})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	metrics, err := storage.ListMetrics(ctx)
+	require.NoError(t, err)
+	require.Len(t, metrics, 3)
+	for _, metric := range metrics {
+		switch metric.Type {
+		case config.HistogramType:
+			assert.Equal(t, uint64(writers), metric.Value.(models.HistogramValue).Count, metric.Name)
+		case config.CounterType:
+			assert.Equal(t, int64(writers), metric.Value, metric.Name)
+		}
+	}
+}
+
+func TestDBStorage_FailedBatchLeavesNoPlaceholders(t *testing.T) {
+	storage := testDBStorage(t)
+	ctx := context.Background()
+	require.NoError(t, storage.SetMetric(ctx, "latency", models.NewHistogram(1), config.HistogramType))
+
+	// The bounds of latency don't match the stored ones after the placeholder of fresh is inserted
+	err := storage.SetMetrics(ctx, []models.Metric{
+		{Name: "fresh", Type: config.HistogramType, Value: models.NewHistogram(1)},
+		{Name: "latency", Type: config.HistogramType, Value: models.NewHistogram(2)},
+		{Name: "PollCount", Type: config.CounterType, Value: int64(1)},
+	})
+	require.Error(t, err)
+
+	var rows int
+	require.NoError(t, storage.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM metrics").Scan(&rows))
+	assert.Equal(t, 1, rows, "the placeholder and the counter are rolled back")
+	value, err := storage.GetMetricByName(ctx, "latency")
+	require.NoError(t, err)
+	assert.Equal(t, models.NewHistogram(1), value)
+}
+
+func TestMigrations(t *testing.T) {
+	dsn := testDSN(t)
+	db, err := sql.Open("pgx", dsn)
+	require.NoError(t, err)
+	driver, err := postgres.WithInstance(db, &postgres.Config{})
+	require.NoError(t, err)
+	m, err := migrate.NewWithDatabaseInstance("file://../../migrations", "postgres", driver)
+	require.NoError(t, err)
+	defer m.Close()
+	ctx := context.Background()
+
+	// Rows written before labels, histograms and deltas existed
+	require.NoError(t, m.Migrate(2))
+	_, err = db.Exec("INSERT INTO metrics (name, type, value) VALUES ('PollCount', 'counter', 42), ('Alloc', 'gauge', 1.5)")
+	require.NoError(t, err)
+
+	require.NoError(t, m.Migrate(5))
+	storage := &DBStorage{db: db}
+	metrics, err := storage.ListMetrics(ctx)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []models.Metric{
+		{Name: "PollCount", Type: config.CounterType, Value: int64(42)},
+		{Name: "Alloc", Type: config.GaugeType, Value: 1.5},
+	}, metrics, "000005 moves counters to the delta column")
+
+	require.NoError(t, storage.SetMetrics(ctx, []models.Metric{
+		{Name: "PollCount", Type: config.CounterType, Value: int64(8)},
+		{Name: "PollCount", Type: config.CounterType, Value: int64(1), Labels: map[string]string{"host": "a"}},
+		{Name: "latency", Type: config.HistogramType, Value: models.NewHistogram(1)},
+	}))
+
+	// Going down drops the series the old schemas cannot hold and moves counters back
+	require.NoError(t, m.Migrate(2))
+	var value float64
+	require.NoError(t, db.QueryRowContext(ctx, "SELECT value FROM metrics WHERE name = 'PollCount'").Scan(&value))
+	assert.Equal(t, 50.0, value)
+	var rows int
+	require.NoError(t, db.QueryRowContext(ctx, "SELECT COUNT(*) FROM metrics").Scan(&rows))
+	assert.Equal(t, 2, rows)
+
+	require.NoError(t, m.Up())
+	metrics, err = storage.ListMetrics(ctx)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []models.Metric{
+		{Name: "PollCount", Type: config.CounterType, Value: int64(50)},
+		{Name: "Alloc", Type: config.GaugeType, Value: 1.5},
+	}, metrics)
+}
@@ -2,11 +2,17 @@ package repository
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
 	"sync"
+	"time"
 
 	"github.com/Schera-ole/metrics/internal/config"
 	internalerrors "github.com/Schera-ole/metrics/internal/errors"
 	models "github.com/Schera-ole/metrics/internal/model"
+	"github.com/Schera-ole/metrics/internal/snapshot"
 )
 
 // MemStorage implements the Repository interface using in-memory storage.
@@ -14,25 +20,42 @@ type MemStorage struct {
 	// mu provides thread-safe access to the storage maps
 	mu sync.RWMutex
 
-	// gauges stores gauge metrics as name -> value pairs
+	// gauges stores gauge metrics as series key -> value pairs
 	gauges map[string]float64
 
-	// counters stores counter metrics as name -> value pairs
+	// counters stores counter metrics as series key -> value pairs
 	counters map[string]int64
 
-	// types stores the metric type for each metric name
+	// histograms stores histogram metrics as series key -> value pairs
+	histograms map[string]models.HistogramValue
+
+	// types stores the metric type for each series key
 	types map[string]string
+
+	// series stores the metric name and labels for each series key
+	series map[string]seriesID
+
+	// wal logs every change for replay after a restart, nil if disabled
+	wal *wal
+}
+
+// seriesID holds the name and labels that make up a series key.
+type seriesID struct {
+	name   string
+	labels map[string]string
 }
 
 // NewMemStorage creates a new in-memory storage instance.
 //
-// It initializes empty maps for gauges, counters, and metric types.
+// It initializes empty maps for gauges, counters, histograms, and metric types.
 func NewMemStorage() *MemStorage {
 
 	return &MemStorage{
-		gauges:   make(map[string]float64),
-		counters: make(map[string]int64),
-		types:    make(map[string]string),
+		gauges:     make(map[string]float64),
+		counters:   make(map[string]int64),
+		histograms: make(map[string]models.HistogramValue),
+		types:      make(map[string]string),
+		series:     make(map[string]seriesID),
 	}
 }
 
@@ -40,71 +63,217 @@ func NewMemStorage() *MemStorage {
 //
 // For counters, it adds the value to the existing counter (or creates a new one).
 // For gauges, it replaces the existing value (or creates a new one).
+// For histograms, it merges the observations into the existing histogram (or creates a new one).
 func (ms *MemStorage) SetMetric(ctx context.Context, name string, value any, typ string) error {
 
-	ms.mu.Lock()
-	defer ms.mu.Unlock()
+	return ms.SetMetrics(ctx, []models.Metric{{Name: name, Type: typ, Value: value}})
+}
+
+// update applies a change under the write lock. With a WAL, the record of the change returned
+// by apply is logged, and update waits until it is durable.
+//
+// apply returns the record of the changes it made even if it fails halfway, since they are
+// visible in memory.
+func (ms *MemStorage) update(apply func() (walRecord, error)) error {
+
+	w, seq, err := func() (*wal, uint64, error) {
+		ms.mu.Lock()
+		defer ms.mu.Unlock()
+		rec, err := apply()
+		w := ms.wal
+		if w == nil || rec.empty() {
+			return nil, 0, err
+		}
+		seq, walErr := w.append(rec)
+		if err == nil {
+			err = walErr
+		}
+		return w, seq, err
+	}()
+
+	// Wait outside the lock, so concurrent updates are synced in the same batch
+	return wait(w, seq, err)
+}
+
+// setMetric stores a single series value. The caller must hold the write lock.
+//
+// A series that changes its type starts over from the new value.
+func (ms *MemStorage) setMetric(name string, labels map[string]string, value any, typ string) error {
+
+	key := models.SeriesKey(name, labels)
+	var hist models.HistogramValue
+	switch typ {
+	case config.CounterType, config.GaugeType:
+	case config.HistogramType:
+		var err error
+		if hist, err = models.ParseHistogram(value); err != nil {
+			return err
+		}
+		if err := hist.Validate(); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+
+	if previous, exists := ms.types[key]; exists && previous != typ {
+		delete(ms.gauges, key)
+		delete(ms.counters, key)
+		delete(ms.histograms, key)
+	}
 	switch typ {
 	case config.CounterType:
-		val := value.(int64)
-		_, exists := ms.counters[name]
-		if exists {
-			ms.counters[name] += val
+		ms.counters[key] += value.(int64)
+	case config.GaugeType:
+		ms.gauges[key] = value.(float64)
+	case config.HistogramType:
+		if existing, exists := ms.histograms[key]; exists {
+			merged, err := existing.Merge(hist)
+			if err != nil {
+				return err
+			}
+			ms.histograms[key] = merged
 		} else {
-			ms.counters[name] = val
+			ms.histograms[key] = hist.Clone()
 		}
-		ms.types[name] = typ
-	case config.GaugeType:
-		val := value.(float64)
-		ms.gauges[name] = val
-		ms.types[name] = typ
+	}
+	ms.types[key] = typ
+	if _, exists := ms.series[key]; !exists {
+		ms.series[key] = seriesID{name: name, labels: copyLabels(labels)}
 	}
 	return nil
 }
 
+// checkMetrics checks that every metric of a batch can be applied, so a batch that fails
+// changes nothing. stored returns the bounds of the stored histogram of a series key, and false
+// if the series is not a histogram.
+//
+// Metrics of unknown types are ignored, as setMetric ignores them.
+func checkMetrics(metrics []models.Metric, stored func(key string) ([]float64, bool)) error {
+
+	// histogramBounds are the bounds of the series changed by the batch
+	type histogramBounds struct {
+		histogram bool
+		bounds    []float64
+	}
+	changed := make(map[string]histogramBounds)
+
+	for _, metric := range metrics {
+		key := models.SeriesKey(metric.Name, metric.Labels)
+		switch metric.Type {
+		case config.CounterType:
+			if _, ok := metric.Value.(int64); !ok {
+				return fmt.Errorf("%w: unexpected counter value %T of %s", internalerrors.ErrInvalidMetricValue, metric.Value, metric.Name)
+			}
+		case config.GaugeType:
+			if _, ok := metric.Value.(float64); !ok {
+				return fmt.Errorf("%w: unexpected gauge value %T of %s", internalerrors.ErrInvalidMetricValue, metric.Value, metric.Name)
+			}
+		case config.HistogramType:
+			hist, err := models.ParseHistogram(metric.Value)
+			if err != nil {
+				return err
+			}
+			if err := hist.Validate(); err != nil {
+				return err
+			}
+			previous, exists := changed[key]
+			if !exists {
+				previous.bounds, previous.histogram = stored(key)
+			}
+			if previous.histogram && !slices.Equal(previous.bounds, hist.Bounds) {
+				return fmt.Errorf("%w: %s", internalerrors.ErrHistogramBoundsMismatch, metric.Name)
+			}
+			changed[key] = histogramBounds{histogram: true, bounds: hist.Bounds}
+			continue
+		default:
+			continue
+		}
+		changed[key] = histogramBounds{}
+	}
+	return nil
+}
+
+// copyLabels returns a copy of labels, or nil if there are none.
+func copyLabels(labels map[string]string) map[string]string {
+
+	if len(labels) == 0 {
+		return nil
+	}
+	result := make(map[string]string, len(labels))
+	for k, v := range labels {
+		result[k] = v
+	}
+	return result
+}
+
 // DeleteMetric removes a metric from memory storage.
 //
-// It deletes the metric from all maps (gauges, counters, and types).
+// It deletes every series of the metric from all maps (gauges, counters, histograms, types, and series).
 func (ms *MemStorage) DeleteMetric(ctx context.Context, name string) error {
 
-	ms.mu.Lock()
-	defer ms.mu.Unlock()
-	delete(ms.gauges, name)
-	delete(ms.counters, name)
-	delete(ms.types, name)
-	return nil
+	return ms.update(func() (walRecord, error) {
+		ms.deleteMetric(name)
+		return walRecord{Delete: name}, nil
+	})
+}
+
+// deleteMetric deletes every series of a metric. The caller must hold the write lock.
+func (ms *MemStorage) deleteMetric(name string) {
+
+	for key, id := range ms.series {
+		if id.name != name {
+			continue
+		}
+		delete(ms.gauges, key)
+		delete(ms.counters, key)
+		delete(ms.histograms, key)
+		delete(ms.types, key)
+		delete(ms.series, key)
+	}
 }
 
 // ListMetrics returns all metrics stored in memory.
 //
-// It creates a slice of Metric structs containing all gauge and counter values.
+// It creates a slice of Metric structs containing all gauge, counter, and histogram values.
 func (ms *MemStorage) ListMetrics(ctx context.Context) ([]models.Metric, error) {
 
 	ms.mu.RLock()
 	defer ms.mu.RUnlock()
 	var result []models.Metric
-
-	for name, typ := range ms.types {
-		var value any
-
-		switch typ {
-		case config.GaugeType:
-			value = ms.gauges[name]
-		case config.CounterType:
-			value = ms.counters[name]
-		default:
-			continue
+	for key := range ms.types {
+		if metric, ok := ms.metric(key); ok {
+			result = append(result, metric)
 		}
-
-		result = append(result, struct {
-			Name  string
-			Type  string
-			Value any
-		}{Name: name, Type: typ, Value: value})
 	}
 	return result, nil
 }
 
+// metric returns a copy of the series stored under key. It reports false if there is none.
+// The caller must hold the lock.
+func (ms *MemStorage) metric(key string) (models.Metric, bool) {
+
+	var value any
+	typ := ms.types[key]
+	switch typ {
+	case config.GaugeType:
+		value = ms.gauges[key]
+	case config.CounterType:
+		value = ms.counters[key]
+	case config.HistogramType:
+		value = ms.histograms[key].Clone()
+	default:
+		return models.Metric{}, false
+	}
+	id := ms.series[key]
+	return models.Metric{
+		Name:   id.name,
+		Type:   typ,
+		Value:  value,
+		Labels: copyLabels(id.labels),
+	}, true
+}
+
 // GetMetric retrieves a single metric by its DTO.
 //
 // It returns a MetricsDTO with the current value of the requested metric.
@@ -112,26 +281,33 @@ func (ms *MemStorage) GetMetric(ctx context.Context, metrics models.MetricsDTO)
 
 	ms.mu.RLock()
 	defer ms.mu.RUnlock()
-	metricType, exists := ms.types[metrics.ID]
+	key := models.SeriesKey(metrics.ID, metrics.Labels)
+	metricType, exists := ms.types[key]
 	if !exists {
 		return models.MetricsDTO{}, internalerrors.ErrMetricNotFound
 	}
 
 	// Create a new metrics struct for the response
 	responseMetrics := models.MetricsDTO{
-		ID:    metrics.ID,
-		MType: metricType,
+		ID:     metrics.ID,
+		MType:  metricType,
+		Labels: copyLabels(metrics.Labels),
 	}
 
 	switch metricType {
 	case config.GaugeType:
-		if val, exists := ms.gauges[metrics.ID]; exists {
+		if val, exists := ms.gauges[key]; exists {
 			responseMetrics.Value = &val
 		}
 	case config.CounterType:
-		if val, exists := ms.counters[metrics.ID]; exists {
+		if val, exists := ms.counters[key]; exists {
 			responseMetrics.Delta = &val
 		}
+	case config.HistogramType:
+		if val, exists := ms.histograms[key]; exists {
+			hist := val.Clone()
+			responseMetrics.Histogram = &hist
+		}
 	default:
 		return models.MetricsDTO{}, internalerrors.ErrUnknownMetricType
 	}
@@ -140,7 +316,8 @@ func (ms *MemStorage) GetMetric(ctx context.Context, metrics models.MetricsDTO)
 
 // GetMetricByName retrieves a single metric by its name.
 //
-// It returns the raw value of the requested metric (float64 for gauges, int64 for counters).
+// It returns the raw value of the requested metric (float64 for gauges, int64 for counters,
+// HistogramValue for histograms). Only the series without labels is considered.
 func (ms *MemStorage) GetMetricByName(ctx context.Context, name string) (any, error) {
 
 	ms.mu.RLock()
@@ -154,15 +331,25 @@ func (ms *MemStorage) GetMetricByName(ctx context.Context, name string) (any, er
 		return ms.gauges[name], nil
 	case config.CounterType:
 		return ms.counters[name], nil
+	case config.HistogramType:
+		return ms.histograms[name].Clone(), nil
 	default:
 		return nil, internalerrors.ErrUnknownMetricType
 	}
 }
 
 // Close releases any resources held by the memory storage.
+//
+// With a WAL, it syncs the pending updates and closes the log. Later updates fail.
 func (ms *MemStorage) Close() error {
 
-	return nil
+	ms.mu.RLock()
+	w := ms.wal
+	ms.mu.RUnlock()
+	if w == nil {
+		return nil
+	}
+	return w.close()
 }
 
 // Ping checks the health of the memory storage.
@@ -174,26 +361,175 @@ func (ms *MemStorage) Ping(ctx context.Context) error {
 
 // SetMetrics stores multiple metrics in memory.
 //
-// It processes a slice of Metric structs, setting each one according to its type.
+// It processes a slice of Metric structs, setting each one according to its type. The batch is
+// checked first, so a batch that fails changes nothing.
 func (ms *MemStorage) SetMetrics(ctx context.Context, metrics []models.Metric) error {
+
+	_, err := ms.setMetrics(metrics, false)
+	return err
+}
+
+// UpdateMetrics stores multiple metrics like SetMetrics and returns the value of every updated
+// series right after the batch, read under the same lock.
+func (ms *MemStorage) UpdateMetrics(ctx context.Context, metrics []models.Metric) ([]Update, error) {
+
+	return ms.setMetrics(metrics, true)
+}
+
+// setMetrics applies a batch, and if report is set returns the values of the updated series.
+func (ms *MemStorage) setMetrics(metrics []models.Metric, report bool) ([]Update, error) {
+
+	var updated []Update
+	err := ms.update(func() (walRecord, error) {
+		var rec walRecord
+		err := checkMetrics(metrics, func(key string) ([]float64, bool) {
+			hist, exists := ms.histograms[key]
+			return hist.Bounds, exists
+		})
+		if err != nil {
+			return rec, err
+		}
+		for _, metric := range metrics {
+			if err := ms.setMetric(metric.Name, metric.Labels, metric.Value, metric.Type); err != nil {
+				return rec, err
+			}
+			rec.Set = appliedEntries(rec.Set, metric.Name, metric.Labels, metric.Value, metric.Type)
+		}
+		if report {
+			updated = ms.current(metrics)
+		}
+		return rec, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// current returns the value of every series of metrics, once per series. The caller must hold
+// the lock.
+func (ms *MemStorage) current(metrics []models.Metric) []Update {
+
+	now := time.Now()
+	seen := make(map[string]struct{}, len(metrics))
+	result := make([]Update, 0, len(metrics))
+	for _, metric := range metrics {
+		key := models.SeriesKey(metric.Name, metric.Labels)
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		if stored, ok := ms.metric(key); ok {
+			result = append(result, Update{Metric: stored, At: now})
+		}
+	}
+	return result
+}
+
+// ReplayWAL restores the state logged in the WAL at path. It reports false if there is no log.
+//
+// It must be called before OpenWAL. A record torn by a crash ends the replay.
+func (ms *MemStorage) ReplayWAL(path string) (bool, error) {
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error opening WAL: %w", err)
+	}
+	defer file.Close()
+
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
-	for _, metric := range metrics {
-		switch metric.Type {
-		case config.CounterType:
-			val := metric.Value.(int64)
-			_, exists := ms.counters[metric.Name]
-			if exists {
-				ms.counters[metric.Name] += val
-			} else {
-				ms.counters[metric.Name] = val
+	err = readRecords(file, func(rec walRecord) error {
+		if rec.Snapshot {
+			ms.reset()
+		}
+		if rec.Delete != "" {
+			ms.deleteMetric(rec.Delete)
+		}
+		for _, entry := range rec.Set {
+			if err := ms.setMetric(entry.Name, entry.Labels, entry.MetricValue(), entry.Type); err != nil {
+				return fmt.Errorf("error replaying WAL: %w", err)
 			}
-			ms.types[metric.Name] = metric.Type
-		case config.GaugeType:
-			val := metric.Value.(float64)
-			ms.gauges[metric.Name] = val
-			ms.types[metric.Name] = metric.Type
 		}
+		return nil
+	})
+	return true, err
+}
+
+// OpenWAL starts logging every change to the WAL at path.
+//
+// The log is replaced by a snapshot of the current state, so ReplayWAL must be called first
+// to keep a previous log.
+func (ms *MemStorage) OpenWAL(path string, options WALOptions) error {
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	w, err := createWAL(path, ms.state(), options)
+	if err != nil {
+		return err
 	}
+	ms.wal = w
 	return nil
 }
+
+// Compact replaces the WAL with a snapshot of the current state followed by the changes made
+// while the snapshot was written, so the log does not grow without bound.
+func (ms *MemStorage) Compact() error {
+
+	ms.mu.RLock()
+	w := ms.wal
+	ms.mu.RUnlock()
+	if w == nil {
+		return nil
+	}
+	return w.compact(func() ([]snapshot.Entry, int64, error) {
+		// The read lock blocks updates, so the state matches the size of the log
+		ms.mu.RLock()
+		defer ms.mu.RUnlock()
+		offset, err := w.mark()
+		return ms.state(), offset, err
+	})
+}
+
+// appliedEntries appends the WAL entry of an applied metric to entries.
+//
+// Metrics of unknown types are ignored by setMetric, so they are not logged either.
+func appliedEntries(entries []snapshot.Entry, name string, labels map[string]string, value any, typ string) []snapshot.Entry {
+
+	entry, err := snapshot.NewEntry(name, labels, value, typ)
+	if err != nil {
+		return entries
+	}
+	return append(entries, entry)
+}
+
+// state returns the current value of every series as WAL entries. The caller must hold the lock.
+func (ms *MemStorage) state() []snapshot.Entry {
+
+	entries := make([]snapshot.Entry, 0, len(ms.types))
+	for key, typ := range ms.types {
+		id := ms.series[key]
+		switch typ {
+		case config.GaugeType:
+			entries = appliedEntries(entries, id.name, id.labels, ms.gauges[key], typ)
+		case config.CounterType:
+			entries = appliedEntries(entries, id.name, id.labels, ms.counters[key], typ)
+		case config.HistogramType:
+			entries = appliedEntries(entries, id.name, id.labels, ms.histograms[key], typ)
+		}
+	}
+	return entries
+}
+
+// reset removes every series. The caller must hold the write lock.
+func (ms *MemStorage) reset() {
+
+	ms.gauges = make(map[string]float64)
+	ms.counters = make(map[string]int64)
+	ms.histograms = make(map[string]models.HistogramValue)
+	ms.types = make(map[string]string)
+	ms.series = make(map[string]seriesID)
+}
@@ -2,9 +2,12 @@ package repository
 
 import (
 	"context"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/Schera-ole/metrics/internal/config"
+	internalerrors "github.com/Schera-ole/metrics/internal/errors"
 	models "github.com/Schera-ole/metrics/internal/model"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -190,3 +193,100 @@ func TestMemStorage_SetMetrics(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, int64(42), val)
 }
+
+func TestMemStorage_Labels(t *testing.T) {
+	storage := NewMemStorage()
+	ctx := context.Background()
+
+	// Series with the same name but different labels are stored separately
+	metrics := []models.Metric{
+		{Name: "CPUutilization", Type: config.GaugeType, Value: 10.0, Labels: map[string]string{"cpu": "0"}},
+		{Name: "CPUutilization", Type: config.GaugeType, Value: 20.0, Labels: map[string]string{"cpu": "1"}},
+		{Name: "Requests", Type: config.CounterType, Value: int64(1), Labels: map[string]string{"host": "a"}},
+		{Name: "Requests", Type: config.CounterType, Value: int64(2), Labels: map[string]string{"host": "a"}},
+	}
+	err := storage.SetMetrics(ctx, metrics)
+	require.NoError(t, err)
+
+	result, err := storage.GetMetric(ctx, models.MetricsDTO{ID: "CPUutilization", Labels: map[string]string{"cpu": "1"}})
+	require.NoError(t, err)
+	assert.Equal(t, 20.0, *result.Value)
+	assert.Equal(t, map[string]string{"cpu": "1"}, result.Labels)
+
+	result, err = storage.GetMetric(ctx, models.MetricsDTO{ID: "Requests", Labels: map[string]string{"host": "a"}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), *result.Delta)
+
+	// The series without labels does not exist
+	_, err = storage.GetMetricByName(ctx, "CPUutilization")
+	assert.Error(t, err)
+
+	list, err := storage.ListMetrics(ctx)
+	require.NoError(t, err)
+	assert.Len(t, list, 3)
+
+	// Deleting by name removes every series of the metric
+	err = storage.DeleteMetric(ctx, "CPUutilization")
+	require.NoError(t, err)
+	list, err = storage.ListMetrics(ctx)
+	require.NoError(t, err)
+	assert.Len(t, list, 1)
+}
+
+func TestMemStorage_Histogram(t *testing.T) {
+	storage := NewMemStorage()
+	ctx := context.Background()
+
+	first := models.NewHistogram(0.1, 1)
+	first.Observe(0.05)
+	first.Observe(0.5)
+	second := models.NewHistogram(0.1, 1)
+	second.Observe(5)
+
+	err := storage.SetMetrics(ctx, []models.Metric{
+		{Name: "latency", Type: config.HistogramType, Value: first},
+		{Name: "latency", Type: config.HistogramType, Value: second},
+	})
+	require.NoError(t, err)
+
+	val, err := storage.GetMetricByName(ctx, "latency")
+	require.NoError(t, err)
+	hist := val.(models.HistogramValue)
+	assert.Equal(t, []uint64{1, 1, 1}, hist.Counts)
+	assert.Equal(t, uint64(3), hist.Count)
+	assert.InDelta(t, 5.55, hist.Sum, 1e-9)
+
+	// Merging a histogram with different bounds fails
+	err = storage.SetMetric(ctx, "latency", models.NewHistogram(0.5), config.HistogramType)
+	assert.Error(t, err)
+
+	// Inconsistent histograms are rejected
+	err = storage.SetMetric(ctx, "broken", models.HistogramValue{Bounds: []float64{1}, Counts: []uint64{1}}, config.HistogramType)
+	assert.Error(t, err)
+}
+
+func TestMemStorage_FailedUpdateReleasesLock(t *testing.T) {
+	ctx := context.Background()
+	for name, storage := range map[string]*MemStorage{
+		"memory": NewMemStorage(),
+		"wal":    openWALStorage(t, filepath.Join(t.TempDir(), "metrics.wal"), WALOptions{}),
+	} {
+		err := storage.SetMetrics(ctx, []models.Metric{{Name: "x", Type: config.GaugeType, Value: int64(1)}})
+		assert.ErrorIs(t, err, internalerrors.ErrInvalidMetricValue, "a gauge carrying a counter value is rejected")
+		assert.Panics(t, func() {
+			_ = storage.update(func() (walRecord, error) { panic("update failed") })
+		})
+
+		done := make(chan error, 1)
+		go func() {
+			done <- storage.SetMetric(ctx, "x", 1.5, config.GaugeType)
+		}()
+		select {
+		case err := <-done:
+			assert.NoError(t, err, name)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: the update after a failed one deadlocked", name)
+		}
+		require.NoError(t, storage.Close())
+	}
+}
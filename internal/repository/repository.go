@@ -3,6 +3,7 @@ package repository
 
 import (
 	"context"
+	"time"
 
 	models "github.com/Schera-ole/metrics/internal/model"
 )
@@ -15,6 +16,10 @@ type Repository interface {
 	// SetMetrics stores multiple metrics in a batch operation
 	SetMetrics(ctx context.Context, metrics []models.Metric) error
 
+	// UpdateMetrics stores multiple metrics like SetMetrics and returns the value of every
+	// updated series right after the batch, once per series
+	UpdateMetrics(ctx context.Context, metrics []models.Metric) ([]Update, error)
+
 	// GetMetric retrieves a single metric by its DTO
 	GetMetric(ctx context.Context, metrics models.MetricsDTO) (models.MetricsDTO, error)
 
@@ -33,3 +38,27 @@ type Repository interface {
 	// Close releases any resources held by the repository
 	Close() error
 }
+
+// Update is the value of a series right after a write.
+type Update struct {
+	// Metric is the series and its value
+	Metric models.Metric
+
+	// At is when the value was written. It is taken while the series is locked, so the updates
+	// of a series are ordered by it.
+	At time.Time
+}
+
+// WALRepository is an in-memory Repository whose changes can be logged to a write-ahead log.
+type WALRepository interface {
+	Repository
+
+	// ReplayWAL restores the state logged in the WAL at path
+	ReplayWAL(path string) (bool, error)
+
+	// OpenWAL starts logging every change to the WAL at path
+	OpenWAL(path string, options WALOptions) error
+
+	// Compact replaces the WAL with a snapshot of the current state
+	Compact() error
+}
@@ -0,0 +1,516 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"os"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Schera-ole/metrics/internal/config"
+	internalerrors "github.com/Schera-ole/metrics/internal/errors"
+	models "github.com/Schera-ole/metrics/internal/model"
+	"github.com/Schera-ole/metrics/internal/snapshot"
+)
+
+// ShardedStorage implements the Repository interface using in-memory storage split into
+// shards, each guarded by its own lock.
+//
+// Every series of a metric lives in the shard picked by the hash of the metric name, so updates
+// of different metrics rarely wait for each other.
+type ShardedStorage struct {
+	// seed is the seed of the shard hash
+	seed maphash.Seed
+
+	// shards hold the series
+	shards []shard
+
+	// wal logs every change for replay after a restart, nil if disabled
+	wal atomic.Pointer[wal]
+}
+
+// shard holds the series of the metrics whose names hash to it.
+type shard struct {
+	// mu provides thread-safe access to the entries map
+	mu sync.RWMutex
+
+	// entries stores the series as series key -> entry pairs
+	entries map[string]*entry
+}
+
+// entry is a series and its value. Only the value field of typ is used.
+type entry struct {
+	// name is the metric name
+	name string
+
+	// labels are the series labels
+	labels map[string]string
+
+	// typ is the metric type
+	typ string
+
+	// gauge is the value of a gauge
+	gauge float64
+
+	// counter is the value of a counter
+	counter int64
+
+	// histogram is the value of a histogram
+	histogram models.HistogramValue
+}
+
+// value returns a copy of the value of the entry.
+func (e *entry) value() any {
+
+	switch e.typ {
+	case config.GaugeType:
+		return e.gauge
+	case config.CounterType:
+		return e.counter
+	default:
+		return e.histogram.Clone()
+	}
+}
+
+// metric returns a copy of the series of the entry.
+func (e *entry) metric() models.Metric {
+
+	return models.Metric{
+		Name:   e.name,
+		Type:   e.typ,
+		Value:  e.value(),
+		Labels: copyLabels(e.labels),
+	}
+}
+
+// NewShardedStorage creates a new in-memory storage instance with the given number of shards.
+//
+// If shards is not positive, four shards per CPU are used.
+func NewShardedStorage(shards int) *ShardedStorage {
+
+	if shards <= 0 {
+		shards = 4 * runtime.GOMAXPROCS(0)
+	}
+	ss := &ShardedStorage{
+		seed:   maphash.MakeSeed(),
+		shards: make([]shard, shards),
+	}
+	for i := range ss.shards {
+		ss.shards[i].entries = make(map[string]*entry)
+	}
+	return ss
+}
+
+// shardFor returns the shard holding the series of the metric name.
+func (ss *ShardedStorage) shardFor(name string) int {
+
+	return int(maphash.String(ss.seed, name) % uint64(len(ss.shards)))
+}
+
+// SetMetric stores a single metric value in memory.
+//
+// For counters, it adds the value to the existing counter (or creates a new one).
+// For gauges, it replaces the existing value (or creates a new one).
+// For histograms, it merges the observations into the existing histogram (or creates a new one).
+func (ss *ShardedStorage) SetMetric(ctx context.Context, name string, value any, typ string) error {
+
+	return ss.SetMetrics(ctx, []models.Metric{{Name: name, Type: typ, Value: value}})
+}
+
+// SetMetrics stores multiple metrics in memory.
+//
+// The shards of the batch are locked together, in index order, and the whole batch is checked
+// before anything is applied, so a batch that fails changes nothing, as with MemStorage. With
+// a WAL, the batch is logged as one record and SetMetrics returns once it is durable.
+func (ss *ShardedStorage) SetMetrics(ctx context.Context, metrics []models.Metric) error {
+
+	_, err := ss.setMetrics(metrics, false)
+	return err
+}
+
+// UpdateMetrics stores multiple metrics like SetMetrics and returns the value of every updated
+// series right after the batch, read under the same locks.
+func (ss *ShardedStorage) UpdateMetrics(ctx context.Context, metrics []models.Metric) ([]Update, error) {
+
+	return ss.setMetrics(metrics, true)
+}
+
+// setMetrics applies a batch, and if report is set returns the values of the updated series.
+func (ss *ShardedStorage) setMetrics(metrics []models.Metric, report bool) ([]Update, error) {
+
+	// The shard of every series key, and the shards to lock in index order
+	keyShards := make(map[string]int, len(metrics))
+	var shards []int
+	for _, metric := range metrics {
+		i := ss.shardFor(metric.Name)
+		keyShards[models.SeriesKey(metric.Name, metric.Labels)] = i
+		if !slices.Contains(shards, i) {
+			shards = append(shards, i)
+		}
+	}
+	slices.Sort(shards)
+
+	var updated []Update
+	w, seq, err := func() (*wal, uint64, error) {
+		for _, i := range shards {
+			ss.shards[i].mu.Lock()
+			defer ss.shards[i].mu.Unlock()
+		}
+		var rec walRecord
+		err := checkMetrics(metrics, func(key string) ([]float64, bool) {
+			e, exists := ss.shards[keyShards[key]].entries[key]
+			if !exists || e.typ != config.HistogramType {
+				return nil, false
+			}
+			return e.histogram.Bounds, true
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		w := ss.wal.Load()
+		for _, metric := range metrics {
+			sh := &ss.shards[ss.shardFor(metric.Name)]
+			if err = sh.set(metric.Name, metric.Labels, metric.Value, metric.Type); err != nil {
+				break
+			}
+			if w != nil {
+				rec.Set = appliedEntries(rec.Set, metric.Name, metric.Labels, metric.Value, metric.Type)
+			}
+		}
+		if err == nil && report {
+			updated = ss.current(metrics)
+		}
+		if w == nil || rec.empty() {
+			return nil, 0, err
+		}
+		seq, walErr := w.append(rec)
+		if err == nil {
+			err = walErr
+		}
+		return w, seq, err
+	}()
+
+	// Wait outside the locks, so concurrent updates are synced in the same batch
+	if err := wait(w, seq, err); err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// current returns the value of every series of metrics, once per series. The caller must hold
+// the locks of their shards.
+func (ss *ShardedStorage) current(metrics []models.Metric) []Update {
+
+	now := time.Now()
+	seen := make(map[string]struct{}, len(metrics))
+	updated := make([]Update, 0, len(metrics))
+	for _, metric := range metrics {
+		key := models.SeriesKey(metric.Name, metric.Labels)
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		if e, exists := ss.shards[ss.shardFor(metric.Name)].entries[key]; exists {
+			updated = append(updated, Update{Metric: e.metric(), At: now})
+		}
+	}
+	return updated
+}
+
+// apply applies a change to a shard under its write lock. With a WAL, the record of the change
+// returned by change is logged, and apply returns the log and the sequence number to wait for.
+//
+// change returns the record of the changes it made even if it fails halfway, since they are
+// visible in memory.
+func (ss *ShardedStorage) apply(sh *shard, change func() (walRecord, error)) (*wal, uint64, error) {
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	rec, err := change()
+	w := ss.wal.Load()
+	if w == nil || rec.empty() {
+		return nil, 0, err
+	}
+	seq, walErr := w.append(rec)
+	if err == nil {
+		err = walErr
+	}
+	return w, seq, err
+}
+
+// wait waits outside the shard lock until the record seq of w is durable, so concurrent
+// updates are synced in the same batch. It returns err, or else the error of the log.
+func wait(w *wal, seq uint64, err error) error {
+
+	var walErr error
+	if seq > 0 {
+		walErr = w.wait(seq)
+	}
+	if err != nil {
+		return err
+	}
+	return walErr
+}
+
+// set stores a single series value. The caller must hold the write lock.
+//
+// A series that changes its type starts over from the new value.
+func (sh *shard) set(name string, labels map[string]string, value any, typ string) error {
+
+	key := models.SeriesKey(name, labels)
+	e, exists := sh.entries[key]
+	if exists && e.typ != typ {
+		exists = false
+	}
+	switch typ {
+	case config.CounterType:
+		val := value.(int64)
+		if exists {
+			e.counter += val
+			return nil
+		}
+		e = &entry{counter: val}
+	case config.GaugeType:
+		val := value.(float64)
+		if exists {
+			e.gauge = val
+			return nil
+		}
+		e = &entry{gauge: val}
+	case config.HistogramType:
+		val, err := models.ParseHistogram(value)
+		if err != nil {
+			return err
+		}
+		if err := val.Validate(); err != nil {
+			return err
+		}
+		if exists {
+			merged, err := e.histogram.Merge(val)
+			if err != nil {
+				return err
+			}
+			e.histogram = merged
+			return nil
+		}
+		e = &entry{histogram: val.Clone()}
+	default:
+		return nil
+	}
+	e.name, e.labels, e.typ = name, copyLabels(labels), typ
+	sh.entries[key] = e
+	return nil
+}
+
+// deleteMetric deletes every series of a metric. The caller must hold the write lock.
+func (sh *shard) deleteMetric(name string) {
+
+	for key, e := range sh.entries {
+		if e.name == name {
+			delete(sh.entries, key)
+		}
+	}
+}
+
+// DeleteMetric removes every series of a metric from memory storage.
+func (ss *ShardedStorage) DeleteMetric(ctx context.Context, name string) error {
+
+	sh := &ss.shards[ss.shardFor(name)]
+	w, seq, err := ss.apply(sh, func() (walRecord, error) {
+		sh.deleteMetric(name)
+		return walRecord{Delete: name}, nil
+	})
+	return wait(w, seq, err)
+}
+
+// ListMetrics returns all metrics stored in memory.
+//
+// The shards are read one after another, so the result is not a consistent snapshot across
+// shards.
+func (ss *ShardedStorage) ListMetrics(ctx context.Context) ([]models.Metric, error) {
+
+	var result []models.Metric
+	for i := range ss.shards {
+		sh := &ss.shards[i]
+		sh.mu.RLock()
+		for _, e := range sh.entries {
+			result = append(result, e.metric())
+		}
+		sh.mu.RUnlock()
+	}
+	return result, nil
+}
+
+// GetMetric retrieves a single metric by its DTO.
+//
+// It returns a MetricsDTO with the current value of the requested metric.
+func (ss *ShardedStorage) GetMetric(ctx context.Context, metrics models.MetricsDTO) (models.MetricsDTO, error) {
+
+	sh := &ss.shards[ss.shardFor(metrics.ID)]
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	e, exists := sh.entries[models.SeriesKey(metrics.ID, metrics.Labels)]
+	if !exists {
+		return models.MetricsDTO{}, internalerrors.ErrMetricNotFound
+	}
+
+	responseMetrics := models.MetricsDTO{
+		ID:     metrics.ID,
+		MType:  e.typ,
+		Labels: copyLabels(metrics.Labels),
+	}
+	switch e.typ {
+	case config.GaugeType:
+		val := e.gauge
+		responseMetrics.Value = &val
+	case config.CounterType:
+		val := e.counter
+		responseMetrics.Delta = &val
+	case config.HistogramType:
+		hist := e.histogram.Clone()
+		responseMetrics.Histogram = &hist
+	default:
+		return models.MetricsDTO{}, internalerrors.ErrUnknownMetricType
+	}
+	return responseMetrics, nil
+}
+
+// GetMetricByName retrieves a single metric by its name.
+//
+// It returns the raw value of the requested metric (float64 for gauges, int64 for counters,
+// HistogramValue for histograms). Only the series without labels is considered.
+func (ss *ShardedStorage) GetMetricByName(ctx context.Context, name string) (any, error) {
+
+	sh := &ss.shards[ss.shardFor(name)]
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	e, exists := sh.entries[name]
+	if !exists {
+		return nil, internalerrors.ErrMetricNotFound
+	}
+	return e.value(), nil
+}
+
+// Close releases any resources held by the memory storage.
+//
+// With a WAL, it syncs the pending updates and closes the log. Later updates fail.
+func (ss *ShardedStorage) Close() error {
+
+	w := ss.wal.Load()
+	if w == nil {
+		return nil
+	}
+	return w.close()
+}
+
+// Ping checks the health of the memory storage.
+//
+// For ShardedStorage, this always returns nil since there are no external dependencies.
+func (ss *ShardedStorage) Ping(ctx context.Context) error {
+	return nil
+}
+
+// lock write locks every shard.
+func (ss *ShardedStorage) lock() {
+
+	for i := range ss.shards {
+		ss.shards[i].mu.Lock()
+	}
+}
+
+// unlock write unlocks every shard.
+func (ss *ShardedStorage) unlock() {
+
+	for i := range ss.shards {
+		ss.shards[i].mu.Unlock()
+	}
+}
+
+// ReplayWAL restores the state logged in the WAL at path. It reports false if there is no log.
+//
+// It must be called before OpenWAL. A record torn by a crash ends the replay.
+func (ss *ShardedStorage) ReplayWAL(path string) (bool, error) {
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error opening WAL: %w", err)
+	}
+	defer file.Close()
+
+	ss.lock()
+	defer ss.unlock()
+	err = readRecords(file, func(rec walRecord) error {
+		if rec.Snapshot {
+			for i := range ss.shards {
+				ss.shards[i].entries = make(map[string]*entry)
+			}
+		}
+		if rec.Delete != "" {
+			ss.shards[ss.shardFor(rec.Delete)].deleteMetric(rec.Delete)
+		}
+		for _, e := range rec.Set {
+			sh := &ss.shards[ss.shardFor(e.Name)]
+			if err := sh.set(e.Name, e.Labels, e.MetricValue(), e.Type); err != nil {
+				return fmt.Errorf("error replaying WAL: %w", err)
+			}
+		}
+		return nil
+	})
+	return true, err
+}
+
+// OpenWAL starts logging every change to the WAL at path.
+//
+// The log is replaced by a snapshot of the current state, so ReplayWAL must be called first
+// to keep a previous log.
+func (ss *ShardedStorage) OpenWAL(path string, options WALOptions) error {
+
+	ss.lock()
+	defer ss.unlock()
+	w, err := createWAL(path, ss.state(), options)
+	if err != nil {
+		return err
+	}
+	ss.wal.Store(w)
+	return nil
+}
+
+// Compact replaces the WAL with a snapshot of the current state followed by the changes made
+// while the snapshot was written, so the log does not grow without bound.
+func (ss *ShardedStorage) Compact() error {
+
+	w := ss.wal.Load()
+	if w == nil {
+		return nil
+	}
+	return w.compact(func() ([]snapshot.Entry, int64, error) {
+		// Locking every shard blocks updates, so the state matches the size of the log
+		for i := range ss.shards {
+			ss.shards[i].mu.RLock()
+			defer ss.shards[i].mu.RUnlock()
+		}
+		offset, err := w.mark()
+		return ss.state(), offset, err
+	})
+}
+
+// state returns the current value of every series as WAL entries. The caller must hold the
+// lock of every shard.
+func (ss *ShardedStorage) state() []snapshot.Entry {
+
+	var entries []snapshot.Entry
+	for i := range ss.shards {
+		for _, e := range ss.shards[i].entries {
+			entries = appliedEntries(entries, e.name, e.labels, e.value(), e.typ)
+		}
+	}
+	return entries
+}
@@ -0,0 +1,349 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Schera-ole/metrics/internal/config"
+	internalerrors "github.com/Schera-ole/metrics/internal/errors"
+	models "github.com/Schera-ole/metrics/internal/model"
+)
+
+func TestShardedStorage(t *testing.T) {
+	ctx := context.Background()
+	storage := NewShardedStorage(4)
+	assert.Len(t, storage.shards, 4)
+	assert.NotEmpty(t, NewShardedStorage(0).shards)
+
+	hist := models.NewHistogram(0.1, 1)
+	hist.Observe(0.5)
+	err := storage.SetMetrics(ctx, []models.Metric{
+		{Name: "Alloc", Type: config.GaugeType, Value: 1.5},
+		{Name: "Alloc", Type: config.GaugeType, Value: 2.5},
+		{Name: "PollCount", Type: config.CounterType, Value: int64(5)},
+		{Name: "PollCount", Type: config.CounterType, Value: int64(3)},
+		{Name: "requests", Type: config.CounterType, Value: int64(1), Labels: map[string]string{"host": "a"}},
+		{Name: "requests", Type: config.CounterType, Value: int64(2), Labels: map[string]string{"host": "b"}},
+		{Name: "latency", Type: config.HistogramType, Value: hist},
+		{Name: "latency", Type: config.HistogramType, Value: hist},
+	})
+	require.NoError(t, err)
+
+	val, err := storage.GetMetricByName(ctx, "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, 2.5, val)
+	val, err = storage.GetMetricByName(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(8), val)
+	val, err = storage.GetMetricByName(ctx, "latency")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), val.(models.HistogramValue).Count)
+
+	result, err := storage.GetMetric(ctx, models.MetricsDTO{ID: "requests", Labels: map[string]string{"host": "b"}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), *result.Delta)
+	_, err = storage.GetMetricByName(ctx, "requests")
+	assert.ErrorIs(t, err, internalerrors.ErrMetricNotFound, "the series without labels does not exist")
+
+	// A series that changes its type starts over
+	require.NoError(t, storage.SetMetric(ctx, "Alloc", int64(1), config.CounterType))
+	val, err = storage.GetMetricByName(ctx, "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), val)
+
+	err = storage.SetMetric(ctx, "latency", models.NewHistogram(0.5), config.HistogramType)
+	assert.Error(t, err, "merging a histogram with different bounds fails")
+
+	list, err := storage.ListMetrics(ctx)
+	require.NoError(t, err)
+	assert.Len(t, list, 5)
+	require.NoError(t, storage.DeleteMetric(ctx, "requests"))
+	list, err = storage.ListMetrics(ctx)
+	require.NoError(t, err)
+	assert.Len(t, list, 3, "deleting by name removes every series of the metric")
+
+	assert.NoError(t, storage.Ping(ctx))
+	assert.NoError(t, storage.Close())
+}
+
+func TestShardedStorage_ConcurrentUpdates(t *testing.T) {
+	ctx := context.Background()
+	storage := NewShardedStorage(8)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				assert.NoError(t, storage.SetMetrics(ctx, []models.Metric{
+					{Name: "PollCount", Type: config.CounterType, Value: int64(1)},
+					{Name: fmt.Sprintf("counter_%d", j%10), Type: config.CounterType, Value: int64(1)},
+				}))
+			}
+		}()
+	}
+	wg.Wait()
+
+	val, err := storage.GetMetricByName(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1600), val)
+	val, err = storage.GetMetricByName(ctx, "counter_3")
+	require.NoError(t, err)
+	assert.Equal(t, int64(160), val)
+}
+
+func TestShardedStorage_WAL(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.wal")
+	options := WALOptions{SyncInterval: time.Millisecond, SyncBatch: 10}
+
+	storage := NewShardedStorage(4)
+	replayed, err := storage.ReplayWAL(path)
+	require.NoError(t, err)
+	assert.False(t, replayed)
+	require.NoError(t, storage.OpenWAL(path, options))
+	for i := 0; i < 20; i++ {
+		require.NoError(t, storage.SetMetrics(ctx, []models.Metric{
+			{Name: fmt.Sprintf("gauge_%d", i), Type: config.GaugeType, Value: float64(i)},
+			{Name: "PollCount", Type: config.CounterType, Value: int64(1 << 60)},
+		}))
+	}
+	require.NoError(t, storage.Compact())
+	require.NoError(t, storage.SetMetric(ctx, "PollCount", int64(1), config.CounterType))
+	require.NoError(t, storage.DeleteMetric(ctx, "gauge_0"))
+	want, err := storage.ListMetrics(ctx)
+	require.NoError(t, err)
+	require.NoError(t, storage.Close())
+
+	// The log is read by either storage
+	restored := NewMemStorage()
+	replayed, err = restored.ReplayWAL(path)
+	require.NoError(t, err)
+	assert.True(t, replayed)
+	assert.ElementsMatch(t, want, sortedMetrics(t, restored))
+
+	sharded := NewShardedStorage(2)
+	_, err = sharded.ReplayWAL(path)
+	require.NoError(t, err)
+	got, err := sharded.ListMetrics(ctx)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, want, got)
+}
+
+func TestStorages_SetMetricsIsAtomic(t *testing.T) {
+	// Counters spread over many shards, so a batch failing in one shard also covers the others
+	counters := func() []models.Metric {
+		var batch []models.Metric
+		for i := 0; i < 32; i++ {
+			batch = append(batch, models.Metric{Name: fmt.Sprintf("counter_%d", i), Type: config.CounterType, Value: int64(1)})
+		}
+		return batch
+	}
+	failing := func(latency string) [][]models.Metric {
+		return [][]models.Metric{
+			{{Name: latency, Type: config.HistogramType, Value: models.NewHistogram(0.5)}},
+			{
+				{Name: "fresh", Type: config.HistogramType, Value: models.NewHistogram(1)},
+				{Name: "fresh", Type: config.HistogramType, Value: models.NewHistogram(2)},
+			},
+			{{Name: "broken", Type: config.HistogramType, Value: models.HistogramValue{Bounds: []float64{1}, Counts: []uint64{1}}}},
+			{{Name: "Alloc", Type: config.GaugeType, Value: models.NewHistogram(1)}},
+		}
+	}
+
+	for name, newStorage := range benchmarkStorages() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			storage := newStorage()
+			latency := "latency"
+			if ss, ok := storage.(*ShardedStorage); ok {
+				// The stored histogram must not be in the first shard, so other shards come before it
+				for i := 0; ss.shardFor(latency) == 0; i++ {
+					latency = fmt.Sprintf("latency_%d", i)
+				}
+			}
+			require.NoError(t, storage.SetMetric(ctx, latency, models.NewHistogram(0.1, 1), config.HistogramType))
+
+			for i, invalid := range failing(latency) {
+				// The invalid metrics come both after and before the valid ones
+				for _, batch := range [][]models.Metric{append(counters(), invalid...), append(invalid, counters()...)} {
+					assert.Error(t, storage.SetMetrics(ctx, batch), "batch %d", i)
+					metrics, err := storage.ListMetrics(ctx)
+					require.NoError(t, err)
+					assert.Len(t, metrics, 1, "batch %d is not applied partially", i)
+				}
+			}
+		})
+	}
+}
+
+func TestStorages_TypeChange(t *testing.T) {
+	histogram := func(observations ...float64) models.HistogramValue {
+		hist := models.NewHistogram(1, 10)
+		for _, value := range observations {
+			hist.Observe(value)
+		}
+		return hist
+	}
+	tests := []struct {
+		name    string
+		updates []models.Metric
+		want    any
+	}{
+		{
+			name: "counter to gauge and back",
+			updates: []models.Metric{
+				{Name: "x", Type: config.CounterType, Value: int64(5)},
+				{Name: "x", Type: config.GaugeType, Value: 1.5},
+				{Name: "x", Type: config.CounterType, Value: int64(2)},
+			},
+			want: int64(2),
+		},
+		{
+			name: "gauge to counter and back",
+			updates: []models.Metric{
+				{Name: "x", Type: config.GaugeType, Value: 1.5},
+				{Name: "x", Type: config.CounterType, Value: int64(2)},
+				{Name: "x", Type: config.GaugeType, Value: 2.5},
+			},
+			want: 2.5,
+		},
+		{
+			name: "histogram to counter and back",
+			updates: []models.Metric{
+				{Name: "x", Type: config.HistogramType, Value: histogram(0.5, 5)},
+				{Name: "x", Type: config.CounterType, Value: int64(2)},
+				{Name: "x", Type: config.HistogramType, Value: histogram(20)},
+			},
+			want: histogram(20),
+		},
+		{
+			name: "histogram bounds change with the type",
+			updates: []models.Metric{
+				{Name: "x", Type: config.HistogramType, Value: models.NewHistogram(1)},
+				{Name: "x", Type: config.GaugeType, Value: 1.0},
+				{Name: "x", Type: config.HistogramType, Value: models.NewHistogram(2)},
+			},
+			want: models.NewHistogram(2),
+		},
+	}
+	for storageName, newStorage := range benchmarkStorages() {
+		for _, tt := range tests {
+			t.Run(storageName+"/"+tt.name, func(t *testing.T) {
+				ctx := context.Background()
+
+				// Every update in its own call, and all of them in one batch
+				storage := newStorage()
+				for _, update := range tt.updates {
+					require.NoError(t, storage.SetMetrics(ctx, []models.Metric{update}))
+				}
+				val, err := storage.GetMetricByName(ctx, "x")
+				require.NoError(t, err)
+				assert.Equal(t, tt.want, val)
+
+				storage = newStorage()
+				require.NoError(t, storage.SetMetrics(ctx, tt.updates))
+				val, err = storage.GetMetricByName(ctx, "x")
+				require.NoError(t, err)
+				assert.Equal(t, tt.want, val)
+
+				list, err := storage.ListMetrics(ctx)
+				require.NoError(t, err)
+				assert.Len(t, list, 1)
+			})
+		}
+	}
+}
+
+// benchmarkStorages returns the in-memory storages compared by the benchmarks.
+func benchmarkStorages() map[string]func() Repository {
+	return map[string]func() Repository{
+		"mem":     func() Repository { return NewMemStorage() },
+		"sharded": func() Repository { return NewShardedStorage(0) },
+	}
+}
+
+// benchmarkBatch returns a batch of updates like the one an agent sends, for n metrics of agent.
+func benchmarkBatch(agent int, n int) []models.Metric {
+	batch := make([]models.Metric, 0, n)
+	labels := map[string]string{"host": fmt.Sprintf("agent-%d", agent)}
+	for i := 0; i < n; i++ {
+		if i%2 == 0 {
+			batch = append(batch, models.Metric{Name: fmt.Sprintf("gauge_%d", i), Type: config.GaugeType, Value: float64(i), Labels: labels})
+		} else {
+			batch = append(batch, models.Metric{Name: fmt.Sprintf("counter_%d", i), Type: config.CounterType, Value: int64(i), Labels: labels})
+		}
+	}
+	return batch
+}
+
+func BenchmarkStorage_SetMetricsParallel(b *testing.B) {
+	for name, newStorage := range benchmarkStorages() {
+		b.Run(name, func(b *testing.B) {
+			ctx := context.Background()
+			storage := newStorage()
+			var agents atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				batch := benchmarkBatch(int(agents.Add(1)), 30)
+				for pb.Next() {
+					if err := storage.SetMetrics(ctx, batch); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkStorage_SetMetricParallel(b *testing.B) {
+	for name, newStorage := range benchmarkStorages() {
+		b.Run(name, func(b *testing.B) {
+			ctx := context.Background()
+			storage := newStorage()
+			var agents atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				metric := fmt.Sprintf("counter_%d", agents.Add(1))
+				for pb.Next() {
+					if err := storage.SetMetric(ctx, metric, int64(1), config.CounterType); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkStorage_MixedParallel(b *testing.B) {
+	for name, newStorage := range benchmarkStorages() {
+		b.Run(name, func(b *testing.B) {
+			ctx := context.Background()
+			storage := newStorage()
+			require.NoError(b, storage.SetMetrics(ctx, benchmarkBatch(0, 30)))
+			var agents atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				agent := int(agents.Add(1))
+				batch := benchmarkBatch(agent, 30)
+				query := models.MetricsDTO{ID: "gauge_0", Labels: map[string]string{"host": "agent-0"}}
+				for i := 0; pb.Next(); i++ {
+					// Nine reads for every update
+					if i%10 == 0 {
+						if err := storage.SetMetrics(ctx, batch); err != nil {
+							b.Error(err)
+						}
+					} else if _, err := storage.GetMetric(ctx, query); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,439 @@
+package repository
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Schera-ole/metrics/internal/snapshot"
+)
+
+const (
+	// walHeaderSize is the size of the frame header of a WAL record: the payload length and its CRC-32.
+	walHeaderSize = 8
+
+	// maxWALRecordSize bounds the payload length read from a frame header, which is garbage in a
+	// record torn by a crash.
+	maxWALRecordSize = 1 << 30
+)
+
+// ErrWALClosed is returned for updates made after the write-ahead log was closed.
+var ErrWALClosed = errors.New("write-ahead log is closed")
+
+// WALOptions configures the group commit of a write-ahead log.
+type WALOptions struct {
+	// SyncInterval is the longest time an update waits for the fsync of its batch.
+	// If 0, every update is synced at once.
+	SyncInterval time.Duration
+
+	// SyncBatch is the number of pending updates that triggers an fsync before SyncInterval elapses.
+	SyncBatch int
+}
+
+// walRecord is a change of the storage.
+type walRecord struct {
+	// Snapshot marks a record holding the whole state, which replaces the state before it
+	Snapshot bool `json:"snapshot,omitempty"`
+
+	// Set are the applied metric updates
+	Set []snapshot.Entry `json:"set,omitempty"`
+
+	// Delete is the name of a deleted metric
+	Delete string `json:"delete,omitempty"`
+}
+
+// empty reports whether the record changes nothing.
+func (r walRecord) empty() bool {
+
+	return !r.Snapshot && len(r.Set) == 0 && r.Delete == ""
+}
+
+// encodeRecord encodes a record as a frame: the payload length, the CRC-32 of the payload and
+// the JSON payload.
+func encodeRecord(rec walRecord) ([]byte, error) {
+
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding WAL record: %w", err)
+	}
+	frame := make([]byte, walHeaderSize, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	return append(frame, payload...), nil
+}
+
+// readRecords calls apply for every record in r.
+//
+// Reading stops without an error at a truncated or corrupted record, which is what a crash in
+// the middle of a write leaves at the end of the log.
+func readRecords(r io.Reader, apply func(walRecord) error) error {
+
+	reader := bufio.NewReader(r)
+	header := make([]byte, walHeaderSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+			return fmt.Errorf("error reading WAL: %w", err)
+		}
+		length := binary.BigEndian.Uint32(header[0:4])
+		if length > maxWALRecordSize {
+			return nil
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+			return fmt.Errorf("error reading WAL: %w", err)
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+			return nil
+		}
+		var rec walRecord
+		if err := json.Unmarshal(payload, &rec); err != nil {
+			return nil
+		}
+		if err := apply(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// wal is an append-only log of storage changes with group commit.
+//
+// Appended records are buffered and written to the file with a single fsync per batch; updates
+// wait for the fsync of their batch before they are acknowledged.
+type wal struct {
+	// path is the path of the log file
+	path string
+
+	// options configures the group commit
+	options WALOptions
+
+	// compactMu serializes compactions
+	compactMu sync.Mutex
+
+	// syncMu serializes fsyncs and the replacement of the file by a compaction
+	syncMu sync.Mutex
+
+	// mu provides thread-safe access to the fields below
+	mu sync.Mutex
+
+	// synced is signaled when a batch is synced or the log fails or is closed
+	synced *sync.Cond
+
+	// file is the log file
+	file *os.File
+
+	// buf buffers the records appended since the last write to file
+	buf *bufio.Writer
+
+	// size is the size of the log, including the buffered records
+	size int64
+
+	// appended is the sequence number of the last appended record
+	appended uint64
+
+	// durable is the sequence number of the last synced record
+	durable uint64
+
+	// err is the first write or sync error, after which no record is accepted
+	err error
+
+	// kick asks the sync loop to sync before the interval elapses
+	kick chan struct{}
+
+	// done stops the sync loop
+	done chan struct{}
+
+	// stopped is closed when the sync loop returns
+	stopped chan struct{}
+
+	// closeOnce closes the log once
+	closeOnce sync.Once
+}
+
+// createWAL writes a new log at path that starts with a snapshot record of state, replacing
+// an existing log atomically, and starts its sync loop.
+func createWAL(path string, state []snapshot.Entry, options WALOptions) (*wal, error) {
+
+	if options.SyncBatch < 1 {
+		options.SyncBatch = 1
+	}
+	file, size, err := writeSnapshot(path, state)
+	if err != nil {
+		return nil, err
+	}
+	if err := commitFile(file, path); err != nil {
+		file.Close()
+		return nil, err
+	}
+	w := &wal{
+		path:    path,
+		options: options,
+		file:    file,
+		buf:     bufio.NewWriter(file),
+		size:    size,
+		kick:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	w.synced = sync.NewCond(&w.mu)
+	go w.syncLoop()
+	return w, nil
+}
+
+// writeSnapshot creates a temporary file next to path holding a snapshot record of state and
+// syncs it. It returns the file and its size.
+func writeSnapshot(path string, state []snapshot.Entry) (*os.File, int64, error) {
+
+	frame, err := encodeRecord(walRecord{Snapshot: true, Set: state})
+	if err != nil {
+		return nil, 0, err
+	}
+	file, err := os.OpenFile(path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error creating WAL: %w", err)
+	}
+	if _, err := file.Write(frame); err != nil {
+		file.Close()
+		return nil, 0, fmt.Errorf("error writing WAL: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return nil, 0, fmt.Errorf("error syncing WAL: %w", err)
+	}
+	return file, int64(len(frame)), nil
+}
+
+// commitFile syncs file and renames it to path, replacing the previous log atomically.
+func commitFile(file *os.File, path string) error {
+
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("error syncing WAL: %w", err)
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		return fmt.Errorf("error replacing WAL: %w", err)
+	}
+	// Sync the directory, so the rename survives a crash
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return fmt.Errorf("error syncing WAL directory: %w", err)
+	}
+	defer dir.Close()
+	if err := dir.Sync(); err != nil {
+		return fmt.Errorf("error syncing WAL directory: %w", err)
+	}
+	return nil
+}
+
+// append buffers a record and returns its sequence number, which is passed to wait.
+//
+// Records are written in the order of the calls, so the caller must hold the storage lock
+// under which the change was applied.
+func (w *wal) append(rec walRecord) (uint64, error) {
+
+	frame, err := encodeRecord(rec)
+	if err != nil {
+		return 0, err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	if _, err := w.buf.Write(frame); err != nil {
+		w.fail(fmt.Errorf("error writing WAL: %w", err))
+		return 0, w.err
+	}
+	w.size += int64(len(frame))
+	w.appended++
+	if w.options.SyncInterval <= 0 || w.appended-w.durable >= uint64(w.options.SyncBatch) {
+		select {
+		case w.kick <- struct{}{}:
+		default:
+			// A sync is already requested
+		}
+	}
+	return w.appended, nil
+}
+
+// wait blocks until the record with sequence number seq is synced to disk.
+func (w *wal) wait(seq uint64) error {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.durable < seq && w.err == nil {
+		w.synced.Wait()
+	}
+	if w.durable >= seq {
+		return nil
+	}
+	return w.err
+}
+
+// fail records the first error of the log and wakes up the waiting updates. The caller must hold mu.
+func (w *wal) fail(err error) {
+
+	if w.err == nil {
+		w.err = err
+	}
+	w.synced.Broadcast()
+}
+
+// syncLoop syncs the appended records every sync interval, or earlier when asked to.
+func (w *wal) syncLoop() {
+
+	defer close(w.stopped)
+	var tick <-chan time.Time
+	if w.options.SyncInterval > 0 {
+		ticker := time.NewTicker(w.options.SyncInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-tick:
+		case <-w.kick:
+		}
+		w.sync()
+	}
+}
+
+// sync writes the buffered records to the file and syncs it. Records appended meanwhile are
+// synced by the next call.
+func (w *wal) sync() {
+
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+
+	w.mu.Lock()
+	if w.err != nil || w.durable == w.appended {
+		w.mu.Unlock()
+		return
+	}
+	if err := w.buf.Flush(); err != nil {
+		w.fail(fmt.Errorf("error writing WAL: %w", err))
+		w.mu.Unlock()
+		return
+	}
+	target := w.appended
+	file := w.file
+	w.mu.Unlock()
+
+	// New records are buffered while the file is synced
+	err := file.Sync()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err != nil {
+		w.fail(fmt.Errorf("error syncing WAL: %w", err))
+		return
+	}
+	w.durable = target
+	w.synced.Broadcast()
+}
+
+// mark writes the buffered records to the file and returns its size. The caller must hold the
+// storage lock, so the size matches the state of the storage.
+func (w *wal) mark() (int64, error) {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	if err := w.buf.Flush(); err != nil {
+		w.fail(fmt.Errorf("error writing WAL: %w", err))
+		return 0, w.err
+	}
+	return w.size, nil
+}
+
+// compact replaces the log with a snapshot record followed by the records appended after the
+// snapshot was taken.
+//
+// snapshot returns the state of the storage and the size of the log from mark, both taken
+// under the storage lock. The snapshot is written while updates continue, and they are only
+// blocked while the records appended meanwhile are copied.
+func (w *wal) compact(snapshot func() ([]snapshot.Entry, int64, error)) error {
+
+	w.compactMu.Lock()
+	defer w.compactMu.Unlock()
+
+	state, offset, err := snapshot()
+	if err != nil {
+		return err
+	}
+	file, size, err := writeSnapshot(w.path, state)
+	if err != nil {
+		return err
+	}
+
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		file.Close()
+		return w.err
+	}
+	if err := w.buf.Flush(); err != nil {
+		file.Close()
+		w.fail(fmt.Errorf("error writing WAL: %w", err))
+		return w.err
+	}
+	tail, err := io.Copy(file, io.NewSectionReader(w.file, offset, w.size-offset))
+	if err == nil {
+		err = commitFile(file, w.path)
+	}
+	if err != nil {
+		// The previous log is still complete and in place
+		file.Close()
+		os.Remove(file.Name())
+		return fmt.Errorf("error compacting WAL: %w", err)
+	}
+
+	w.file.Close()
+	w.file = file
+	w.buf.Reset(file)
+	w.size = size + tail
+	// The copied records were synced together with the snapshot
+	w.durable = w.appended
+	w.synced.Broadcast()
+	return nil
+}
+
+// close syncs the pending records and closes the log.
+func (w *wal) close() error {
+
+	err := ErrWALClosed
+	w.closeOnce.Do(func() {
+		close(w.done)
+		<-w.stopped
+		w.sync()
+
+		w.syncMu.Lock()
+		defer w.syncMu.Unlock()
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		err = w.err
+		if closeErr := w.file.Close(); err == nil {
+			err = closeErr
+		}
+		w.fail(ErrWALClosed)
+	})
+	return err
+}
@@ -0,0 +1,173 @@
+package repository
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Schera-ole/metrics/internal/config"
+	models "github.com/Schera-ole/metrics/internal/model"
+)
+
+// openWALStorage creates a MemStorage that replays and then logs to the WAL at path.
+func openWALStorage(t *testing.T, path string, options WALOptions) *MemStorage {
+	storage := NewMemStorage()
+	_, err := storage.ReplayWAL(path)
+	require.NoError(t, err)
+	require.NoError(t, storage.OpenWAL(path, options))
+	return storage
+}
+
+// sortedMetrics returns the metrics of storage ordered by series key.
+func sortedMetrics(t *testing.T, storage *MemStorage) []models.Metric {
+	metrics, err := storage.ListMetrics(context.Background())
+	require.NoError(t, err)
+	sort.Slice(metrics, func(i, j int) bool {
+		return models.SeriesKey(metrics[i].Name, metrics[i].Labels) < models.SeriesKey(metrics[j].Name, metrics[j].Labels)
+	})
+	return metrics
+}
+
+func TestWAL_Replay(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.wal")
+	hist := models.NewHistogram(0.1, 1)
+	hist.Observe(0.5)
+
+	storage := openWALStorage(t, path, WALOptions{SyncInterval: time.Millisecond, SyncBatch: 10})
+	require.NoError(t, storage.SetMetric(ctx, "Alloc", 1.5, config.GaugeType))
+	require.NoError(t, storage.SetMetric(ctx, "Alloc", 2.5, config.GaugeType))
+	require.NoError(t, storage.SetMetrics(ctx, []models.Metric{
+		{Name: "PollCount", Type: config.CounterType, Value: int64(1 << 60)},
+		{Name: "PollCount", Type: config.CounterType, Value: int64(3)},
+		{Name: "requests", Type: config.CounterType, Value: int64(2), Labels: map[string]string{"host": "a"}},
+		{Name: "latency", Type: config.HistogramType, Value: hist},
+		{Name: "latency", Type: config.HistogramType, Value: hist},
+		{Name: "Deleted", Type: config.GaugeType, Value: 1.0},
+	}))
+	require.NoError(t, storage.DeleteMetric(ctx, "Deleted"))
+	want := sortedMetrics(t, storage)
+	require.NoError(t, storage.Close())
+
+	err := storage.SetMetric(ctx, "Alloc", 3.5, config.GaugeType)
+	assert.ErrorIs(t, err, ErrWALClosed, "updates after close are not durable")
+
+	restored := NewMemStorage()
+	replayed, err := restored.ReplayWAL(path)
+	require.NoError(t, err)
+	assert.True(t, replayed)
+	assert.Equal(t, want, sortedMetrics(t, restored))
+	val, err := restored.GetMetricByName(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1<<60+3), val, "counters are replayed without losing precision")
+
+	replayed, err = NewMemStorage().ReplayWAL(filepath.Join(t.TempDir(), "missing.wal"))
+	require.NoError(t, err)
+	assert.False(t, replayed)
+}
+
+func TestWAL_Compact(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.wal")
+
+	storage := openWALStorage(t, path, WALOptions{SyncInterval: time.Millisecond, SyncBatch: 10})
+	for i := 0; i < 100; i++ {
+		require.NoError(t, storage.SetMetric(ctx, "PollCount", int64(1), config.CounterType))
+	}
+	before, err := os.Stat(path)
+	require.NoError(t, err)
+
+	// Updates made during the compaction are kept
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, storage.SetMetric(ctx, "PollCount", int64(1), config.CounterType))
+		}()
+	}
+	require.NoError(t, storage.Compact())
+	wg.Wait()
+	require.NoError(t, storage.SetMetric(ctx, "PollCount", int64(1), config.CounterType))
+
+	after, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Less(t, after.Size(), before.Size())
+	require.NoError(t, storage.Close())
+
+	restored := openWALStorage(t, path, WALOptions{})
+	defer restored.Close()
+	val, err := restored.GetMetricByName(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(111), val)
+}
+
+func TestWAL_TornRecord(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.wal")
+
+	storage := openWALStorage(t, path, WALOptions{})
+	require.NoError(t, storage.SetMetric(ctx, "PollCount", int64(1), config.CounterType))
+	require.NoError(t, storage.SetMetric(ctx, "PollCount", int64(1), config.CounterType))
+	require.NoError(t, storage.Close())
+
+	// Cut the last record in half, as a crash in the middle of a write would
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(path, info.Size()-5))
+
+	restored := openWALStorage(t, path, WALOptions{})
+	val, err := restored.GetMetricByName(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), val)
+
+	// The torn record is dropped when the log is reopened
+	require.NoError(t, restored.SetMetric(ctx, "PollCount", int64(5), config.CounterType))
+	require.NoError(t, restored.Close())
+	restored = openWALStorage(t, path, WALOptions{})
+	defer restored.Close()
+	val, err = restored.GetMetricByName(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), val)
+}
+
+func TestWAL_GroupCommit(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.wal")
+
+	// The interval is never reached, so only full batches are synced
+	storage := openWALStorage(t, path, WALOptions{SyncInterval: time.Hour, SyncBatch: 4})
+	defer storage.Close()
+
+	done := make(chan struct{}, 4)
+	for i := 0; i < 3; i++ {
+		go func() {
+			assert.NoError(t, storage.SetMetric(ctx, "PollCount", int64(1), config.CounterType))
+			done <- struct{}{}
+		}()
+	}
+	select {
+	case <-done:
+		t.Fatal("an update was acknowledged before its batch was synced")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	go func() {
+		assert.NoError(t, storage.SetMetric(ctx, "PollCount", int64(1), config.CounterType))
+		done <- struct{}{}
+	}()
+	for i := 0; i < 4; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the full batch was not synced")
+		}
+	}
+}
@@ -3,15 +3,20 @@ package service
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"sync"
+	"time"
 
 	"go.uber.org/zap"
 
 	"github.com/Schera-ole/metrics/internal/config"
+	internalerrors "github.com/Schera-ole/metrics/internal/errors"
+	"github.com/Schera-ole/metrics/internal/history"
 	models "github.com/Schera-ole/metrics/internal/model"
 	"github.com/Schera-ole/metrics/internal/repository"
+	"github.com/Schera-ole/metrics/internal/snapshot"
 )
 
 // MetricsService provides methods for managing metrics.
@@ -20,24 +25,243 @@ import (
 type MetricsService struct {
 	// repository is the underlying data storage implementation
 	repository repository.Repository
+
+	// history records timestamped samples of every update, nil if disabled
+	history *history.Store
+
+	// updatesMu provides thread-safe access to the updates map
+	updatesMu sync.RWMutex
+
+	// updates stores the time of the last update for each series key
+	updates map[string]seriesUpdate
+
+	// watchersMu provides thread-safe access to the watchers set
+	watchersMu sync.RWMutex
+
+	// watchers stores the channels that receive the current values of updated series
+	watchers map[chan []models.MetricsDTO]struct{}
+
+	// saveMu serializes SaveMetrics from listing the metrics to writing the snapshot
+	saveMu sync.Mutex
+
+	// snapshotGenerations is the number of previous snapshots kept by SaveMetrics
+	snapshotGenerations int
+
+	// snapshotFormat is the format of the snapshots saved by SaveMetrics
+	snapshotFormat string
+}
+
+// seriesUpdate records when a series was last updated.
+type seriesUpdate struct {
+	name   string
+	labels map[string]string
+	at     time.Time
 }
 
 // NewMetricsService creates a new MetricsService with the specified repository.
 func NewMetricsService(repo repository.Repository) *MetricsService {
 
-	return &MetricsService{repository: repo}
+	return &MetricsService{
+		repository: repo,
+		updates:    make(map[string]seriesUpdate),
+		watchers:   make(map[chan []models.MetricsDTO]struct{}),
+	}
+}
+
+// SetSnapshotGenerations sets the number of previous snapshots kept by SaveMetrics.
+func (ms *MetricsService) SetSnapshotGenerations(generations int) {
+
+	ms.snapshotGenerations = generations
+}
+
+// SetSnapshotFormat sets the format of the snapshots saved by SaveMetrics, one of the
+// snapshot.Format constants. RestoreMetrics reads snapshots in any format.
+func (ms *MetricsService) SetSnapshotFormat(format string) {
+
+	ms.snapshotFormat = format
+}
+
+// SetHistory enables recording of time-series history in the given store.
+func (ms *MetricsService) SetHistory(store *history.Store) {
+
+	ms.history = store
 }
 
 // SetMetric sets a single metric value, delegating to the repository implementation.
 func (ms *MetricsService) SetMetric(ctx context.Context, name string, value any, typ string) error {
 
-	return ms.repository.SetMetric(ctx, name, value, typ)
+	return ms.SetMetrics(ctx, []models.Metric{{Name: name, Type: typ, Value: value}})
 }
 
 // SetMetrics sets multiple metrics in a batch operation, delegating to the repository implementation.
+//
+// When history is enabled or someone watches updates, the repository also returns the values of
+// the updated series as of this write, which are recorded and published.
 func (ms *MetricsService) SetMetrics(ctx context.Context, metrics []models.Metric) error {
 
-	return ms.repository.SetMetrics(ctx, metrics)
+	if !ms.reportsValues() {
+		if err := ms.repository.SetMetrics(ctx, metrics); err != nil {
+			return err
+		}
+		ms.recordUpdates(metrics)
+		return nil
+	}
+	updated, err := ms.repository.UpdateMetrics(ctx, metrics)
+	if err != nil {
+		return err
+	}
+	ms.recordUpdates(metrics)
+	ms.publish(ms.currentValues(updated))
+	return nil
+}
+
+// reportsValues reports whether the values of updated series are needed, for the history or
+// the watchers.
+func (ms *MetricsService) reportsValues() bool {
+
+	if ms.history != nil {
+		return true
+	}
+	ms.watchersMu.RLock()
+	defer ms.watchersMu.RUnlock()
+	return len(ms.watchers) > 0
+}
+
+// recordUpdates stores the current time as the last update time of every updated series.
+func (ms *MetricsService) recordUpdates(metrics []models.Metric) {
+
+	now := time.Now()
+	ms.updatesMu.Lock()
+	defer ms.updatesMu.Unlock()
+	for _, metric := range metrics {
+		key := models.SeriesKey(metric.Name, metric.Labels)
+		if update, exists := ms.updates[key]; exists {
+			update.at = now
+			ms.updates[key] = update
+			continue
+		}
+		ms.updates[key] = seriesUpdate{name: metric.Name, labels: metric.Labels, at: now}
+	}
+}
+
+// LastUpdated returns the latest time any series of the metric whose labels contain all
+// matchers was updated through this service. It reports false if no such update happened.
+func (ms *MetricsService) LastUpdated(name string, matchers map[string]string) (time.Time, bool) {
+
+	ms.updatesMu.RLock()
+	defer ms.updatesMu.RUnlock()
+	var latest time.Time
+	found := false
+	for _, update := range ms.updates {
+		if update.name != name || !models.MatchLabels(update.labels, matchers) {
+			continue
+		}
+		if !found || update.at.After(latest) {
+			latest = update.at
+			found = true
+		}
+	}
+	return latest, found
+}
+
+// currentValues converts the values of the updated series returned by the repository and
+// records them in the history at the time they were written.
+//
+// Counters are therefore recorded and published as their running total.
+func (ms *MetricsService) currentValues(updated []repository.Update) []models.MetricsDTO {
+
+	values := make([]models.MetricsDTO, 0, len(updated))
+	for _, update := range updated {
+		current, ok := toDTO(update.Metric)
+		if !ok {
+			continue
+		}
+		values = append(values, current)
+		ms.recordHistory(current, update.At)
+	}
+	return values
+}
+
+// toDTO converts a stored metric to a MetricsDTO. It reports false for a value of an unknown type.
+func toDTO(metric models.Metric) (models.MetricsDTO, bool) {
+
+	dto := models.MetricsDTO{ID: metric.Name, MType: metric.Type, Labels: metric.Labels}
+	switch value := metric.Value.(type) {
+	case float64:
+		dto.Value = &value
+	case int64:
+		dto.Delta = &value
+	case models.HistogramValue:
+		dto.Histogram = &value
+	default:
+		return models.MetricsDTO{}, false
+	}
+	return dto, true
+}
+
+// recordHistory appends the value of a gauge or counter series written at to the history.
+func (ms *MetricsService) recordHistory(current models.MetricsDTO, at time.Time) {
+
+	if ms.history == nil {
+		return
+	}
+	switch {
+	case current.MType == config.GaugeType && current.Value != nil:
+		ms.history.Append(current.ID, current.Labels, current.MType, at, *current.Value)
+	case current.MType == config.CounterType && current.Delta != nil:
+		ms.history.Append(current.ID, current.Labels, current.MType, at, float64(*current.Delta))
+	}
+}
+
+// Watch subscribes to metric updates.
+//
+// Every successful update sends the current values of the updated series to the returned
+// channel. Sends never block: if the channel is full, the values are dropped for this
+// subscriber. The returned function cancels the subscription and closes the channel.
+func (ms *MetricsService) Watch(buffer int) (<-chan []models.MetricsDTO, func()) {
+
+	ch := make(chan []models.MetricsDTO, buffer)
+	ms.watchersMu.Lock()
+	ms.watchers[ch] = struct{}{}
+	ms.watchersMu.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			ms.watchersMu.Lock()
+			delete(ms.watchers, ch)
+			close(ch)
+			ms.watchersMu.Unlock()
+		})
+	}
+	return ch, cancel
+}
+
+// publish sends updated values to every watcher.
+func (ms *MetricsService) publish(values []models.MetricsDTO) {
+
+	if len(values) == 0 {
+		return
+	}
+	ms.watchersMu.RLock()
+	defer ms.watchersMu.RUnlock()
+	for ch := range ms.watchers {
+		select {
+		case ch <- values:
+			// Update sent successfully
+		default:
+			// Slow watcher, drop the update
+		}
+	}
+}
+
+// QueryRange returns the history of every series of the metric whose labels contain all matchers.
+func (ms *MetricsService) QueryRange(ctx context.Context, name string, matchers map[string]string, from, to time.Time, step time.Duration) ([]history.Series, error) {
+
+	if ms.history == nil {
+		return nil, internalerrors.ErrHistoryDisabled
+	}
+	return ms.history.Query(name, matchers, from, to, step), nil
 }
 
 // GetMetric retrieves a single metric by its DTO, delegating to the repository implementation.
@@ -55,7 +279,20 @@ func (ms *MetricsService) GetMetricByName(ctx context.Context, name string) (any
 // DeleteMetric removes a metric by its name, delegating to the repository implementation.
 func (ms *MetricsService) DeleteMetric(ctx context.Context, name string) error {
 
-	return ms.repository.DeleteMetric(ctx, name)
+	if err := ms.repository.DeleteMetric(ctx, name); err != nil {
+		return err
+	}
+	ms.updatesMu.Lock()
+	for key, update := range ms.updates {
+		if update.name == name {
+			delete(ms.updates, key)
+		}
+	}
+	ms.updatesMu.Unlock()
+	if ms.history != nil {
+		ms.history.Delete(name)
+	}
+	return nil
 }
 
 // ListMetrics retrieves all metrics, delegating to the repository implementation.
@@ -64,65 +301,77 @@ func (ms *MetricsService) ListMetrics(ctx context.Context) ([]models.Metric, err
 	return ms.repository.ListMetrics(ctx)
 }
 
+// ListMetricsByLabels retrieves all metrics whose labels contain every pair of matchers.
+//
+// An empty set of matchers returns all metrics.
+func (ms *MetricsService) ListMetricsByLabels(ctx context.Context, matchers map[string]string) ([]models.Metric, error) {
+
+	metrics, err := ms.repository.ListMetrics(ctx)
+	if err != nil || len(matchers) == 0 {
+		return metrics, err
+	}
+	var result []models.Metric
+	for _, metric := range metrics {
+		if models.MatchLabels(metric.Labels, matchers) {
+			result = append(result, metric)
+		}
+	}
+	return result, nil
+}
+
 // Ping checks the repository connection, delegating to the repository implementation.
 func (ms *MetricsService) Ping(ctx context.Context) error {
 
 	return ms.repository.Ping(ctx)
 }
 
-// IsMemStorage checks if the underlying repository is a MemStorage implementation.
+// IsMemStorage checks if the underlying repository is an in-memory implementation, MemStorage
+// or ShardedStorage.
 func (ms *MetricsService) IsMemStorage() bool {
 
-	_, isMemStorage := ms.repository.(*repository.MemStorage)
-	return isMemStorage
+	switch ms.repository.(type) {
+	case *repository.MemStorage, *repository.ShardedStorage:
+		return true
+	}
+	return false
 }
 
-// SaveMetrics saves all metrics to a file in JSON format.
+// SaveMetrics saves all metrics to a snapshot file in the format set by SetSnapshotFormat,
+// keeping the previous snapshots as set by SetSnapshotGenerations.
+//
+// The file is replaced atomically, so a crash while saving leaves the previous snapshot intact.
 func (ms *MetricsService) SaveMetrics(ctx context.Context, fname string) error {
 
-	file, err := os.Create(fname)
+	codec, err := snapshot.CodecFor(ms.snapshotFormat, fname)
 	if err != nil {
-		return fmt.Errorf("error creating file: %w", err)
+		return err
 	}
-	defer file.Close()
-
-	encoder := json.NewEncoder(file)
-	metrics, _ := ms.repository.ListMetrics(ctx)
-
-	return encoder.Encode(metrics)
+	// Listing under the lock keeps an older listing from replacing a newer snapshot
+	ms.saveMu.Lock()
+	defer ms.saveMu.Unlock()
+	metrics, err := ms.repository.ListMetrics(ctx)
+	if err != nil {
+		return fmt.Errorf("error listing metrics: %w", err)
+	}
+	return snapshot.Save(fname, metrics, codec, ms.snapshotGenerations)
 }
 
-// RestoreMetrics restores metrics from a file.
+// RestoreMetrics restores metrics from a snapshot file.
 //
-// It reads metrics from the specified file and stores them in the repository.
+// It reads metrics from the specified file and stores them in the repository. If the file is
+// unreadable, the newest readable previous snapshot is restored instead.
 func (ms *MetricsService) RestoreMetrics(ctx context.Context, fname string, logger *zap.SugaredLogger) error {
 
-	if _, err := os.Stat(fname); os.IsNotExist(err) {
+	metrics, restoredFrom, err := snapshot.Load(fname, ms.snapshotGenerations)
+	if errors.Is(err, os.ErrNotExist) {
 		logger.Infof("storage file not exists %s", fname)
 		return nil
 	}
-
-	file, err := os.Open(fname)
-	if err != nil {
-		return fmt.Errorf("error while opening file to restore: %w", err)
-	}
-	defer file.Close()
-
-	decoder := json.NewDecoder(file)
-	metrics := []models.Metric{}
-	err = decoder.Decode(&metrics)
 	if err != nil {
-		return fmt.Errorf("error while marshalling file store: %w", err)
+		return fmt.Errorf("error while restoring metrics: %w", err)
 	}
-
-	for _, metric := range metrics {
-		value := metric.Value
-		if metric.Type == config.CounterType {
-			if floatValue, ok := metric.Value.(float64); ok {
-				value = int64(floatValue)
-			}
-		}
-		ms.repository.SetMetric(ctx, metric.Name, value, metric.Type)
+	if restoredFrom != fname {
+		logger.Warnf("storage file %s is unreadable, restored the previous snapshot %s", fname, restoredFrom)
 	}
-	return nil
+	return ms.repository.SetMetrics(ctx, metrics)
 }
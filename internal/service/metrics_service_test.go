@@ -2,12 +2,18 @@ package service
 
 import (
 	"context"
+	"fmt"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/Schera-ole/metrics/internal/config"
+	"github.com/Schera-ole/metrics/internal/history"
 	models "github.com/Schera-ole/metrics/internal/model"
 	"github.com/Schera-ole/metrics/internal/repository"
+	"github.com/Schera-ole/metrics/internal/snapshot"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
@@ -165,6 +171,9 @@ func TestMetricsService_IsMemStorage(t *testing.T) {
 	memStorage := repository.NewMemStorage()
 	service := NewMetricsService(memStorage)
 	assert.True(t, service.IsMemStorage())
+
+	service = NewMetricsService(repository.NewShardedStorage(4))
+	assert.True(t, service.IsMemStorage())
 }
 
 func TestMetricsService_SaveMetrics(t *testing.T) {
@@ -225,3 +234,241 @@ func TestMetricsService_RestoreMetrics(t *testing.T) {
 	// Clean up
 	os.Remove(filename2)
 }
+
+func TestMetricsService_SaveRestoreHistogram(t *testing.T) {
+	ctx := context.Background()
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync()
+
+	service := NewMetricsService(repository.NewMemStorage())
+	hist := models.NewHistogram(1, 10)
+	hist.Observe(3)
+	err := service.SetMetrics(ctx, []models.Metric{{Name: "latency", Type: config.HistogramType, Value: hist}})
+	require.NoError(t, err)
+
+	filename := t.TempDir() + "/metrics.json"
+	require.NoError(t, service.SaveMetrics(ctx, filename))
+
+	restored := NewMetricsService(repository.NewMemStorage())
+	require.NoError(t, restored.RestoreMetrics(ctx, filename, logger.Sugar()))
+	value, err := restored.GetMetricByName(ctx, "latency")
+	require.NoError(t, err)
+	assert.Equal(t, hist, value)
+}
+
+func TestMetricsService_SaveRestoreBinary(t *testing.T) {
+	ctx := context.Background()
+	logger, _ := zap.NewDevelopment()
+	defer logger.Sync()
+
+	service := NewMetricsService(repository.NewMemStorage())
+	service.SetSnapshotFormat(snapshot.FormatBinary)
+	require.NoError(t, service.SetMetric(ctx, "PollCount", int64(1<<53+1), config.CounterType))
+	filename := filepath.Join(t.TempDir(), "metrics.json")
+	require.NoError(t, service.SaveMetrics(ctx, filename))
+
+	// The format is detected when restoring, whatever the extension
+	restored := NewMetricsService(repository.NewMemStorage())
+	require.NoError(t, restored.RestoreMetrics(ctx, filename, logger.Sugar()))
+	value, err := restored.GetMetricByName(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1<<53+1), value)
+}
+
+// benchmarkService returns a service holding n gauges and n counters.
+func benchmarkService(b *testing.B, n int) *MetricsService {
+	service := NewMetricsService(repository.NewMemStorage())
+	metrics := make([]models.Metric, 0, 2*n)
+	for i := 0; i < n; i++ {
+		labels := map[string]string{"host": fmt.Sprintf("host-%d", i%100)}
+		metrics = append(metrics,
+			models.Metric{Name: fmt.Sprintf("gauge_%d", i), Type: config.GaugeType, Value: float64(i) / 3, Labels: labels},
+			models.Metric{Name: fmt.Sprintf("counter_%d", i), Type: config.CounterType, Value: int64(i) << 40, Labels: labels},
+		)
+	}
+	require.NoError(b, service.SetMetrics(context.Background(), metrics))
+	return service
+}
+
+func BenchmarkSaveMetrics(b *testing.B) {
+	for _, format := range []string{snapshot.FormatJSON, snapshot.FormatBinary} {
+		b.Run(format, func(b *testing.B) {
+			ctx := context.Background()
+			service := benchmarkService(b, 10000)
+			service.SetSnapshotFormat(format)
+			filename := filepath.Join(b.TempDir(), "metrics")
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				require.NoError(b, service.SaveMetrics(ctx, filename))
+			}
+		})
+	}
+}
+
+func BenchmarkRestoreMetrics(b *testing.B) {
+	for _, format := range []string{snapshot.FormatJSON, snapshot.FormatBinary} {
+		b.Run(format, func(b *testing.B) {
+			ctx := context.Background()
+			service := benchmarkService(b, 10000)
+			service.SetSnapshotFormat(format)
+			filename := filepath.Join(b.TempDir(), "metrics")
+			require.NoError(b, service.SaveMetrics(ctx, filename))
+			info, err := os.Stat(filename)
+			require.NoError(b, err)
+			b.SetBytes(info.Size())
+			logger := zap.NewNop().Sugar()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				restored := NewMetricsService(repository.NewMemStorage())
+				require.NoError(b, restored.RestoreMetrics(ctx, filename, logger))
+			}
+		})
+	}
+}
+
+func TestMetricsService_LastUpdated(t *testing.T) {
+	service := NewMetricsService(repository.NewMemStorage())
+	ctx := context.Background()
+
+	_, ok := service.LastUpdated("PollCount", nil)
+	assert.False(t, ok)
+
+	before := time.Now()
+	err := service.SetMetrics(ctx, []models.Metric{
+		{Name: "PollCount", Type: config.CounterType, Value: int64(1), Labels: map[string]string{"host": "a"}},
+	})
+	require.NoError(t, err)
+
+	at, ok := service.LastUpdated("PollCount", map[string]string{"host": "a"})
+	require.True(t, ok)
+	assert.False(t, at.Before(before))
+
+	_, ok = service.LastUpdated("PollCount", map[string]string{"host": "b"})
+	assert.False(t, ok)
+
+	require.NoError(t, service.DeleteMetric(ctx, "PollCount"))
+	_, ok = service.LastUpdated("PollCount", nil)
+	assert.False(t, ok)
+}
+
+func TestMetricsService_Watch(t *testing.T) {
+	service := NewMetricsService(repository.NewMemStorage())
+	ctx := context.Background()
+
+	updates, cancel := service.Watch(1)
+	require.NoError(t, service.SetMetrics(ctx, []models.Metric{
+		{Name: "PollCount", Type: config.CounterType, Value: int64(2)},
+		{Name: "PollCount", Type: config.CounterType, Value: int64(3)},
+	}))
+
+	values := <-updates
+	require.Len(t, values, 1)
+	assert.Equal(t, "PollCount", values[0].ID)
+	assert.Equal(t, int64(5), *values[0].Delta)
+
+	// The buffer is full, further updates are dropped instead of blocking
+	require.NoError(t, service.SetMetric(ctx, "Alloc", 1.0, config.GaugeType))
+	require.NoError(t, service.SetMetric(ctx, "Alloc", 2.0, config.GaugeType))
+	assert.Len(t, updates, 1)
+
+	cancel()
+	cancel()
+	<-updates
+	_, open := <-updates
+	assert.False(t, open)
+}
+
+// readCountingRepository counts the reads of single series.
+type readCountingRepository struct {
+	repository.Repository
+	reads int
+}
+
+// GetMetric implements the Repository interface.
+func (r *readCountingRepository) GetMetric(ctx context.Context, metrics models.MetricsDTO) (models.MetricsDTO, error) {
+	r.reads++
+	return r.Repository.GetMetric(ctx, metrics)
+}
+
+func TestMetricsService_RecordsValuesOfWrite(t *testing.T) {
+	for name, repo := range map[string]repository.Repository{
+		"mem":     repository.NewMemStorage(),
+		"sharded": repository.NewShardedStorage(4),
+	} {
+		t.Run(name, func(t *testing.T) {
+			counting := &readCountingRepository{Repository: repo}
+			service := NewMetricsService(counting)
+			service.SetHistory(history.NewStore(10))
+			ctx := context.Background()
+			updates, cancel := service.Watch(10)
+			defer cancel()
+
+			require.NoError(t, service.SetMetrics(ctx, []models.Metric{
+				{Name: "PollCount", Type: config.CounterType, Value: int64(2)},
+				{Name: "Alloc", Type: config.GaugeType, Value: 1.5},
+				{Name: "PollCount", Type: config.CounterType, Value: int64(3)},
+			}))
+			require.NoError(t, service.SetMetric(ctx, "PollCount", int64(1), config.CounterType))
+			assert.Zero(t, counting.reads, "the values are returned by the write")
+
+			values := <-updates
+			require.Len(t, values, 2)
+			totals := map[string]float64{}
+			for _, value := range values {
+				if value.Delta != nil {
+					totals[value.ID] = float64(*value.Delta)
+				} else {
+					totals[value.ID] = *value.Value
+				}
+			}
+			assert.Equal(t, map[string]float64{"PollCount": 5, "Alloc": 1.5}, totals)
+			values = <-updates
+			require.Len(t, values, 1)
+			assert.Equal(t, int64(6), *values[0].Delta)
+
+			series, err := service.QueryRange(ctx, "PollCount", nil, time.Now().Add(-time.Minute), time.Now().Add(time.Minute), 0)
+			require.NoError(t, err)
+			require.Len(t, series, 1)
+			require.Len(t, series[0].Samples, 2)
+			assert.Equal(t, 5.0, series[0].Samples[0].Value)
+			assert.Equal(t, 6.0, series[0].Samples[1].Value)
+		})
+	}
+}
+
+func TestMetricsService_ConcurrentWritesKeepHistoryOrdered(t *testing.T) {
+	for name, repo := range map[string]repository.Repository{
+		"mem":     repository.NewMemStorage(),
+		"sharded": repository.NewShardedStorage(4),
+	} {
+		t.Run(name, func(t *testing.T) {
+			service := NewMetricsService(repo)
+			service.SetHistory(history.NewStore(10000))
+			ctx := context.Background()
+
+			var wg sync.WaitGroup
+			for w := 0; w < 8; w++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < 200; i++ {
+						assert.NoError(t, service.SetMetric(ctx, "Alloc", float64(w*1000+i), config.GaugeType))
+					}
+				}()
+			}
+			wg.Wait()
+
+			series, err := service.QueryRange(ctx, "Alloc", nil, time.Now().Add(-time.Minute), time.Now().Add(time.Minute), 0)
+			require.NoError(t, err)
+			require.Len(t, series, 1)
+			samples := series[0].Samples
+			require.Len(t, samples, 1600)
+			for i := 1; i < len(samples); i++ {
+				require.False(t, samples[i].Timestamp.Before(samples[i-1].Timestamp), "samples are ordered by time")
+			}
+			current, err := service.GetMetricByName(ctx, "Alloc")
+			require.NoError(t, err)
+			assert.Equal(t, current, samples[len(samples)-1].Value, "the newest sample is the stored value")
+		})
+	}
+}
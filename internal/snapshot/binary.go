@@ -0,0 +1,293 @@
+package snapshot
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/Schera-ole/metrics/internal/config"
+	models "github.com/Schera-ole/metrics/internal/model"
+)
+
+// binaryMagic starts every binary snapshot.
+var binaryMagic = []byte("MSNP")
+
+// Binary value kinds.
+const (
+	kindGauge     byte = 1
+	kindCounter   byte = 2
+	kindHistogram byte = 3
+)
+
+// ErrChecksum is returned for binary snapshots whose checksum does not match their content.
+var ErrChecksum = errors.New("snapshot checksum mismatch")
+
+// crcTable is the CRC-32C table of the binary snapshot checksum.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// binaryCodec writes snapshots in a compact varint format.
+//
+// The layout is the magic "MSNP", the format version byte, the timestamp in Unix nanoseconds,
+// the number of series and every series, followed by the CRC-32C of everything before it.
+// A series is its kind byte, name, labels sorted by key and value. Strings and lengths are
+// uvarint prefixed, counters are zigzag varints and floating point numbers are 8 bytes.
+type binaryCodec struct{}
+
+// Name returns "binary".
+func (binaryCodec) Name() string {
+
+	return FormatBinary
+}
+
+// Encode writes metrics as a binary snapshot taken at now.
+func (binaryCodec) Encode(w io.Writer, metrics []models.Metric, now time.Time) error {
+
+	buf := make([]byte, 0, 64*len(metrics)+32)
+	buf = append(buf, binaryMagic...)
+	buf = append(buf, Version)
+	buf = binary.AppendVarint(buf, now.UnixNano())
+	buf = binary.AppendUvarint(buf, uint64(len(metrics)))
+	for _, metric := range metrics {
+		var err error
+		buf, err = appendMetric(buf, metric)
+		if err != nil {
+			return fmt.Errorf("error encoding snapshot: %w", err)
+		}
+	}
+	buf = binary.BigEndian.AppendUint32(buf, crc32.Checksum(buf, crcTable))
+	_, err := w.Write(buf)
+	return err
+}
+
+// appendMetric appends a series to buf.
+func appendMetric(buf []byte, metric models.Metric) ([]byte, error) {
+
+	entry, err := NewEntry(metric.Name, metric.Labels, metric.Value, metric.Type)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case entry.Value != nil:
+		buf = append(buf, kindGauge)
+	case entry.Delta != nil:
+		buf = append(buf, kindCounter)
+	default:
+		buf = append(buf, kindHistogram)
+	}
+	buf = appendString(buf, entry.Name)
+	keys := make([]string, 0, len(entry.Labels))
+	for key := range entry.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	buf = binary.AppendUvarint(buf, uint64(len(keys)))
+	for _, key := range keys {
+		buf = appendString(buf, key)
+		buf = appendString(buf, entry.Labels[key])
+	}
+
+	switch {
+	case entry.Value != nil:
+		buf = appendFloat(buf, *entry.Value)
+	case entry.Delta != nil:
+		buf = binary.AppendVarint(buf, *entry.Delta)
+	default:
+		hist := entry.Histogram
+		buf = binary.AppendUvarint(buf, uint64(len(hist.Bounds)))
+		for _, bound := range hist.Bounds {
+			buf = appendFloat(buf, bound)
+		}
+		buf = binary.AppendUvarint(buf, uint64(len(hist.Counts)))
+		for _, count := range hist.Counts {
+			buf = binary.AppendUvarint(buf, count)
+		}
+		buf = appendFloat(buf, hist.Sum)
+		buf = binary.AppendUvarint(buf, hist.Count)
+	}
+	return buf, nil
+}
+
+// appendString appends a length-prefixed string to buf.
+func appendString(buf []byte, s string) []byte {
+
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// appendFloat appends the 8 bytes of a floating point number to buf.
+func appendFloat(buf []byte, f float64) []byte {
+
+	return binary.LittleEndian.AppendUint64(buf, math.Float64bits(f))
+}
+
+// Decode reads the metrics of a binary snapshot.
+func (binaryCodec) Decode(r io.Reader) ([]models.Metric, error) {
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading snapshot: %w", err)
+	}
+	return decodeBinary(data)
+}
+
+// decodeBinary reads the metrics of the binary snapshot data.
+func decodeBinary(data []byte) ([]models.Metric, error) {
+
+	if len(data) < len(binaryMagic)+1+4 || string(data[:len(binaryMagic)]) != string(binaryMagic) {
+		return nil, fmt.Errorf("error decoding snapshot: %w", io.ErrUnexpectedEOF)
+	}
+	body, sum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.Checksum(body, crcTable) != sum {
+		return nil, ErrChecksum
+	}
+	if version := body[len(binaryMagic)]; version < 1 || version > Version {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+
+	d := &decoder{data: body[len(binaryMagic)+1:]}
+	d.varint() // The timestamp is informational
+	n := d.length()
+	metrics := make([]models.Metric, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		metrics = append(metrics, d.metric())
+	}
+	if d.err == nil && len(d.data) > 0 {
+		d.err = errors.New("unexpected data after the last series")
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("error decoding snapshot: %w", d.err)
+	}
+	return metrics, nil
+}
+
+// decoder reads the fields of a binary snapshot. The first error stops reading, and later
+// reads return zero values.
+type decoder struct {
+	// data is the unread data
+	data []byte
+
+	// err is the first error
+	err error
+}
+
+// metric reads a series.
+func (d *decoder) metric() models.Metric {
+
+	kind := d.byte()
+	metric := models.Metric{Name: d.string()}
+	if n := d.length(); n > 0 {
+		metric.Labels = make(map[string]string, n)
+		for i := 0; i < n && d.err == nil; i++ {
+			key := d.string()
+			metric.Labels[key] = d.string()
+		}
+	}
+	switch kind {
+	case kindGauge:
+		metric.Type = config.GaugeType
+		metric.Value = d.float()
+	case kindCounter:
+		metric.Type = config.CounterType
+		metric.Value = d.varint()
+	case kindHistogram:
+		var hist models.HistogramValue
+		hist.Bounds = make([]float64, d.length())
+		for i := range hist.Bounds {
+			hist.Bounds[i] = d.float()
+		}
+		hist.Counts = make([]uint64, d.length())
+		for i := range hist.Counts {
+			hist.Counts[i] = d.uvarint()
+		}
+		hist.Sum = d.float()
+		hist.Count = d.uvarint()
+		metric.Type = config.HistogramType
+		metric.Value = hist
+	default:
+		d.fail(fmt.Errorf("unknown value kind %d", kind))
+	}
+	return metric
+}
+
+// fail records the first error.
+func (d *decoder) fail(err error) {
+
+	if d.err == nil {
+		d.err = err
+	}
+	d.data = nil
+}
+
+// byte reads a single byte.
+func (d *decoder) byte() byte {
+
+	if len(d.data) < 1 {
+		d.fail(io.ErrUnexpectedEOF)
+		return 0
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b
+}
+
+// uvarint reads an unsigned varint.
+func (d *decoder) uvarint() uint64 {
+
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.fail(io.ErrUnexpectedEOF)
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+// varint reads a zigzag encoded varint.
+func (d *decoder) varint() int64 {
+
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.fail(io.ErrUnexpectedEOF)
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+// length reads a length, which cannot exceed the unread data since every element takes at
+// least one byte.
+func (d *decoder) length() int {
+
+	v := d.uvarint()
+	if v > uint64(len(d.data)) {
+		d.fail(io.ErrUnexpectedEOF)
+		return 0
+	}
+	return int(v)
+}
+
+// string reads a length-prefixed string.
+func (d *decoder) string() string {
+
+	n := d.length()
+	s := string(d.data[:n])
+	d.data = d.data[n:]
+	return s
+}
+
+// float reads an 8 byte floating point number.
+func (d *decoder) float() float64 {
+
+	if len(d.data) < 8 {
+		d.fail(io.ErrUnexpectedEOF)
+		return 0
+	}
+	f := math.Float64frombits(binary.LittleEndian.Uint64(d.data))
+	d.data = d.data[8:]
+	return f
+}
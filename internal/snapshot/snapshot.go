@@ -0,0 +1,375 @@
+// Package snapshot reads and writes the snapshot files of the memory storage.
+//
+// A snapshot is a versioned envelope holding the typed value of every series, encoded as JSON
+// or in a compact binary format. Snapshots are written to a temporary file that replaces the
+// previous snapshot atomically, and a number of previous generations are kept next to it.
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Schera-ole/metrics/internal/config"
+	models "github.com/Schera-ole/metrics/internal/model"
+)
+
+// Version is the format version of the snapshots written by this package.
+const Version = 1
+
+// Snapshot formats.
+const (
+	// FormatAuto selects the binary format for files with the .bin extension and JSON otherwise.
+	FormatAuto = "auto"
+
+	// FormatJSON is the JSON envelope.
+	FormatJSON = "json"
+
+	// FormatBinary is the binary format with a checksum.
+	FormatBinary = "binary"
+)
+
+// Codec encodes and decodes snapshots in a format.
+type Codec interface {
+	// Name returns the name of the format
+	Name() string
+
+	// Encode writes metrics as a snapshot taken at now
+	Encode(w io.Writer, metrics []models.Metric, now time.Time) error
+
+	// Decode reads the metrics of a snapshot
+	Decode(r io.Reader) ([]models.Metric, error)
+}
+
+var (
+	// JSON is the codec of the JSON format.
+	JSON Codec = jsonCodec{}
+
+	// Binary is the codec of the binary format.
+	Binary Codec = binaryCodec{}
+)
+
+// CodecFor returns the codec of format for the snapshot at path.
+func CodecFor(format string, path string) (Codec, error) {
+
+	switch format {
+	case FormatAuto, "":
+		if filepath.Ext(path) == ".bin" {
+			return Binary, nil
+		}
+		return JSON, nil
+	case FormatJSON:
+		return JSON, nil
+	case FormatBinary:
+		return Binary, nil
+	}
+	return nil, fmt.Errorf("unknown snapshot format %q", format)
+}
+
+// ErrUnsupportedVersion is returned for snapshots written by a newer format version.
+var ErrUnsupportedVersion = errors.New("unsupported snapshot version")
+
+// Snapshot is the envelope of a snapshot file.
+type Snapshot struct {
+	// Version is the format version
+	Version int `json:"version"`
+
+	// Timestamp is when the snapshot was taken
+	Timestamp time.Time `json:"timestamp"`
+
+	// Metrics are the values of every series
+	Metrics []Entry `json:"metrics"`
+}
+
+// Entry is the typed value of a series. Exactly one of Delta, Value and Histogram is set,
+// depending on Type.
+type Entry struct {
+	// Name is the metric name
+	Name string `json:"name"`
+
+	// Type is the metric type
+	Type string `json:"type"`
+
+	// Labels are the series labels
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Delta is the value of a counter
+	Delta *int64 `json:"delta,omitempty"`
+
+	// Value is the value of a gauge
+	Value *float64 `json:"value,omitempty"`
+
+	// Histogram is the value of a histogram
+	Histogram *models.HistogramValue `json:"histogram,omitempty"`
+}
+
+// NewEntry converts a metric value to an Entry.
+func NewEntry(name string, labels map[string]string, value any, typ string) (Entry, error) {
+
+	entry := Entry{Name: name, Type: typ, Labels: labels}
+	switch typ {
+	case config.CounterType:
+		delta, ok := value.(int64)
+		if !ok {
+			return Entry{}, fmt.Errorf("unexpected counter value %T of %s", value, name)
+		}
+		entry.Delta = &delta
+	case config.GaugeType:
+		val, ok := value.(float64)
+		if !ok {
+			return Entry{}, fmt.Errorf("unexpected gauge value %T of %s", value, name)
+		}
+		entry.Value = &val
+	case config.HistogramType:
+		hist, err := models.ParseHistogram(value)
+		if err != nil {
+			return Entry{}, err
+		}
+		hist = hist.Clone()
+		entry.Histogram = &hist
+	default:
+		return Entry{}, fmt.Errorf("unknown type %q of %s", typ, name)
+	}
+	return entry, nil
+}
+
+// MetricValue returns the value of the entry, or nil if it has none.
+func (e Entry) MetricValue() any {
+
+	switch {
+	case e.Delta != nil:
+		return *e.Delta
+	case e.Value != nil:
+		return *e.Value
+	case e.Histogram != nil:
+		return *e.Histogram
+	}
+	return nil
+}
+
+// Metric converts the entry to a metric.
+func (e Entry) Metric() models.Metric {
+
+	return models.Metric{Name: e.Name, Type: e.Type, Value: e.MetricValue(), Labels: e.Labels}
+}
+
+// jsonCodec writes snapshots as a JSON Snapshot.
+type jsonCodec struct{}
+
+// Name returns "json".
+func (jsonCodec) Name() string {
+
+	return FormatJSON
+}
+
+// Encode writes metrics as a JSON snapshot taken at now.
+func (jsonCodec) Encode(w io.Writer, metrics []models.Metric, now time.Time) error {
+
+	snap := Snapshot{Version: Version, Timestamp: now.UTC(), Metrics: make([]Entry, 0, len(metrics))}
+	for _, metric := range metrics {
+		entry, err := NewEntry(metric.Name, metric.Labels, metric.Value, metric.Type)
+		if err != nil {
+			return fmt.Errorf("error encoding snapshot: %w", err)
+		}
+		snap.Metrics = append(snap.Metrics, entry)
+	}
+	return json.NewEncoder(w).Encode(snap)
+}
+
+// Decode reads the metrics of a JSON snapshot.
+//
+// It also reads the files written before snapshots were versioned, a JSON array of metrics
+// whose counters were stored as floating point numbers.
+func (jsonCodec) Decode(r io.Reader) ([]models.Metric, error) {
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading snapshot: %w", err)
+	}
+	return decodeJSON(data)
+}
+
+// Decode reads the metrics of a snapshot in any format.
+func Decode(r io.Reader) ([]models.Metric, error) {
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading snapshot: %w", err)
+	}
+	if bytes.HasPrefix(data, binaryMagic) {
+		return decodeBinary(data)
+	}
+	return decodeJSON(data)
+}
+
+// decodeJSON reads the metrics of the JSON snapshot data.
+func decodeJSON(data []byte) ([]models.Metric, error) {
+
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		return decodeLegacy(trimmed)
+	}
+
+	var snap Snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("error decoding snapshot: %w", err)
+	}
+	if snap.Version < 1 || snap.Version > Version {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, snap.Version)
+	}
+	metrics := make([]models.Metric, 0, len(snap.Metrics))
+	for _, entry := range snap.Metrics {
+		metrics = append(metrics, entry.Metric())
+	}
+	return metrics, nil
+}
+
+// decodeLegacy reads a JSON array of metrics.
+func decodeLegacy(data []byte) ([]models.Metric, error) {
+
+	var metrics []models.Metric
+	if err := json.Unmarshal(data, &metrics); err != nil {
+		return nil, fmt.Errorf("error decoding snapshot: %w", err)
+	}
+	for i, metric := range metrics {
+		if metric.Type == config.CounterType {
+			if floatValue, ok := metric.Value.(float64); ok {
+				metrics[i].Value = int64(floatValue)
+			}
+		}
+	}
+	return metrics, nil
+}
+
+// Save writes metrics as a snapshot encoded by codec to path, keeping generations previous
+// snapshots as path.1 (the newest) to path.N.
+//
+// The snapshot is written to a temporary file in the same directory, synced and renamed to
+// path, so a crash leaves either the previous snapshot or the new one. Save must not be called
+// concurrently for the same path.
+func Save(path string, metrics []models.Metric, codec Codec, generations int) error {
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("error creating snapshot: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriter(tmp)
+	err = codec.Encode(writer, metrics, time.Now())
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error writing snapshot: %w", err)
+	}
+
+	if err := rotate(path, generations); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("error replacing snapshot: %w", err)
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// rotate shifts the previous generations of the snapshot at path by one, dropping the oldest.
+//
+// The current snapshot is linked as the newest generation, so path exists until the new
+// snapshot replaces it.
+func rotate(path string, generations int) error {
+
+	if generations <= 0 {
+		return nil
+	}
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	for i := generations - 1; i >= 1; i-- {
+		err := os.Rename(Generation(path, i), Generation(path, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("error rotating snapshots: %w", err)
+		}
+	}
+	newest := Generation(path, 1)
+	if err := os.Remove(newest); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error rotating snapshots: %w", err)
+	}
+	if err := os.Link(path, newest); err != nil {
+		// Without hard links, path is missing until the new snapshot is renamed
+		if err := os.Rename(path, newest); err != nil {
+			return fmt.Errorf("error rotating snapshots: %w", err)
+		}
+	}
+	return nil
+}
+
+// Generation returns the path of the n-th previous generation of the snapshot at path.
+func Generation(path string, n int) string {
+
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// Load reads the snapshot at path in any format. If it is missing or unreadable, the previous
+// generations are tried from the newest. It returns the metrics and the path they were read from.
+//
+// If no generation exists, the error wraps os.ErrNotExist.
+func Load(path string, generations int) ([]models.Metric, string, error) {
+
+	var loadErr error
+	for i := 0; i <= generations; i++ {
+		candidate := path
+		if i > 0 {
+			candidate = Generation(path, i)
+		}
+		metrics, err := loadFile(candidate)
+		if err == nil {
+			return metrics, candidate, nil
+		}
+		// Report the first unreadable snapshot rather than a missing one
+		if loadErr == nil || errors.Is(loadErr, os.ErrNotExist) {
+			loadErr = err
+		}
+	}
+	return nil, "", loadErr
+}
+
+// loadFile reads the snapshot file at path.
+func loadFile(path string) ([]models.Metric, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	metrics, err := Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return metrics, nil
+}
+
+// syncDir syncs a directory, so a rename in it survives a crash.
+func syncDir(path string) error {
+
+	dir, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error syncing snapshot directory: %w", err)
+	}
+	defer dir.Close()
+	if err := dir.Sync(); err != nil {
+		return fmt.Errorf("error syncing snapshot directory: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package snapshot
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Schera-ole/metrics/internal/config"
+	models "github.com/Schera-ole/metrics/internal/model"
+)
+
+// testMetrics returns one metric of every type.
+func testMetrics() []models.Metric {
+	hist := models.NewHistogram(0.1, 1)
+	hist.Observe(0.5)
+	return []models.Metric{
+		{Name: "PollCount", Type: config.CounterType, Value: int64(1<<60 + 1)},
+		{Name: "Alloc", Type: config.GaugeType, Value: 1.5, Labels: map[string]string{"host": "a"}},
+		{Name: "latency", Type: config.HistogramType, Value: hist},
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	require.NoError(t, JSON.Encode(&buf, testMetrics(), now))
+	assert.Contains(t, buf.String(), `"version":1`)
+	assert.Contains(t, buf.String(), `"timestamp":"2025-01-01T12:00:00Z"`)
+
+	metrics, err := Decode(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, testMetrics(), metrics, "counters restore as exact int64 values")
+}
+
+func TestDecodeLegacy(t *testing.T) {
+	legacy := `[{"Name":"testGauge","Type":"gauge","Value":42.5},{"Name":"testCounter","Type":"counter","Value":10}]`
+	metrics, err := Decode(strings.NewReader(legacy))
+	require.NoError(t, err)
+	assert.Equal(t, []models.Metric{
+		{Name: "testGauge", Type: config.GaugeType, Value: 42.5},
+		{Name: "testCounter", Type: config.CounterType, Value: int64(10)},
+	}, metrics)
+}
+
+func TestDecodeErrors(t *testing.T) {
+	_, err := Decode(strings.NewReader(`{"version":2,"metrics":[]}`))
+	assert.ErrorIs(t, err, ErrUnsupportedVersion)
+
+	_, err = Decode(strings.NewReader(`{"version":1,"metrics":[`))
+	assert.Error(t, err)
+}
+
+func TestSaveKeepsGenerations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	for i := 1; i <= 4; i++ {
+		metrics := []models.Metric{{Name: "PollCount", Type: config.CounterType, Value: int64(i)}}
+		require.NoError(t, Save(path, metrics, JSON, 2))
+	}
+
+	for generation, want := range map[string]int64{path: 4, Generation(path, 1): 3, Generation(path, 2): 2} {
+		metrics, err := loadFile(generation)
+		require.NoError(t, err)
+		assert.Equal(t, want, metrics[0].Value, generation)
+	}
+	_, err := os.Stat(Generation(path, 3))
+	assert.ErrorIs(t, err, os.ErrNotExist, "older generations are dropped")
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 3, "no temporary files are left behind")
+}
+
+func TestLoadFallsBackToPreviousGeneration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	_, _, err := Load(path, 2)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	require.NoError(t, Save(path, testMetrics(), JSON, 2))
+	require.NoError(t, Save(path, testMetrics()[:1], JSON, 2))
+	// A snapshot truncated by a crash of a writer that did not use Save
+	require.NoError(t, os.WriteFile(path, []byte(`{"version":1,"metr`), 0644))
+
+	metrics, loadedFrom, err := Load(path, 2)
+	require.NoError(t, err)
+	assert.Equal(t, Generation(path, 1), loadedFrom)
+	assert.Equal(t, testMetrics(), metrics)
+
+	_, _, err = Load(path, 0)
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, os.ErrNotExist, "the unreadable snapshot is reported")
+}
+
+func TestBinaryEncodeDecode(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, Binary.Encode(&buf, testMetrics(), time.Now()))
+	assert.True(t, bytes.HasPrefix(buf.Bytes(), binaryMagic))
+
+	metrics, err := Decode(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, testMetrics(), metrics, "the format is detected and counters keep every bit")
+
+	var jsonBuf bytes.Buffer
+	require.NoError(t, JSON.Encode(&jsonBuf, testMetrics(), time.Now()))
+	assert.Less(t, buf.Len(), jsonBuf.Len())
+
+	_, err = Binary.Decode(&jsonBuf)
+	assert.Error(t, err, "the binary codec does not read JSON")
+}
+
+func TestBinaryDecodeErrors(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, Binary.Encode(&buf, testMetrics(), time.Now()))
+	data := buf.Bytes()
+
+	corrupted := bytes.Clone(data)
+	corrupted[len(binaryMagic)+3] ^= 0xff
+	_, err := Decode(bytes.NewReader(corrupted))
+	assert.ErrorIs(t, err, ErrChecksum)
+
+	for _, size := range []int{len(binaryMagic), len(binaryMagic) + 4, len(data) / 2, len(data) - 1} {
+		_, err = Decode(bytes.NewReader(data[:size]))
+		assert.Error(t, err, "truncated to %d bytes", size)
+	}
+}
+
+func TestCodecFor(t *testing.T) {
+	tests := []struct {
+		format string
+		path   string
+		want   Codec
+	}{
+		{format: FormatAuto, path: "metrics.json", want: JSON},
+		{format: FormatAuto, path: "metrics.bin", want: Binary},
+		{format: "", path: "logs", want: JSON},
+		{format: FormatJSON, path: "metrics.bin", want: JSON},
+		{format: FormatBinary, path: "metrics.json", want: Binary},
+	}
+	for _, tt := range tests {
+		codec, err := CodecFor(tt.format, tt.path)
+		require.NoError(t, err)
+		assert.Equal(t, tt.want.Name(), codec.Name(), "%s %s", tt.format, tt.path)
+	}
+
+	_, err := CodecFor("xml", "metrics.xml")
+	assert.Error(t, err)
+}
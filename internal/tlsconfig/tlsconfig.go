@@ -0,0 +1,102 @@
+// Package tlsconfig builds the TLS configurations of the server and the agent.
+//
+// The server may require client certificates signed by a CA (mutual TLS) and
+// restrict them to a list of common names, which identify the agents.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+)
+
+// ErrUnknownClient is returned when a client certificate has a common name that is not allowed.
+var ErrUnknownClient = errors.New("client certificate common name is not allowed")
+
+// NewServerConfig creates the TLS configuration of the server from PEM files.
+//
+// If clientCAFile is not empty, clients must present a certificate signed by that CA.
+// If allowedCNs is not empty, the common name of the client certificate must be one of them.
+func NewServerConfig(certFile, keyFile, clientCAFile string, allowedCNs []string) (*tls.Config, error) {
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading server certificate: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile == "" {
+		if len(allowedCNs) > 0 {
+			return nil, errors.New("allowed client names require a client CA")
+		}
+		return config, nil
+	}
+	pool, err := loadCertPool(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	if len(allowedCNs) > 0 {
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			if cn := PeerCN(&state); !slices.Contains(allowedCNs, cn) {
+				return fmt.Errorf("%w: %q", ErrUnknownClient, cn)
+			}
+			return nil
+		}
+	}
+	return config, nil
+}
+
+// NewClientConfig creates the TLS configuration of the agent from PEM files.
+//
+// If caFile is empty, the server certificate is verified with the system roots. If certFile
+// and keyFile are not empty, the certificate is presented to servers requiring mutual TLS.
+func NewClientConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// PeerCN returns the common name of the verified peer certificate of a connection, or an
+// empty string if the peer did not present one.
+func PeerCN(state *tls.ConnectionState) string {
+
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return state.PeerCertificates[0].Subject.CommonName
+}
+
+// loadCertPool reads the CA certificates of a PEM file.
+func loadCertPool(path string) (*x509.CertPool, error) {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in %s", path)
+	}
+	return pool, nil
+}
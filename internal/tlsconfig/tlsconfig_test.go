@@ -0,0 +1,158 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCA signs certificates for tests and writes them as PEM files.
+type testCA struct {
+	t    *testing.T
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+// newTestCA creates a self-signed CA and writes its certificate to ca.pem.
+func newTestCA(t *testing.T, dir string, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	ca := &testCA{t: t, dir: dir, cert: cert, key: key, file: filepath.Join(dir, name+".pem")}
+	ca.write(ca.file, "CERTIFICATE", der)
+	return ca
+}
+
+// issue creates a certificate for cn and returns the paths of its certificate and key files.
+func (ca *testCA) issue(cn string, usage x509.ExtKeyUsage) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(ca.t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(ca.t, err)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(ca.t, err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(ca.t, err)
+	certFile := filepath.Join(ca.dir, cn+".crt")
+	keyFile := filepath.Join(ca.dir, cn+".key")
+	ca.write(certFile, "CERTIFICATE", der)
+	ca.write(keyFile, "PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+// write writes a PEM file.
+func (ca *testCA) write(path, blockType string, der []byte) {
+	require.NoError(ca.t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	serverCert, serverKey := ca.issue("server", x509.ExtKeyUsageServerAuth)
+	agentCert, agentKey := ca.issue("agent-1", x509.ExtKeyUsageClientAuth)
+	otherCert, otherKey := ca.issue("agent-2", x509.ExtKeyUsageClientAuth)
+	rogue := newTestCA(t, dir, "rogue")
+	rogueCert, rogueKey := rogue.issue("agent-1-rogue", x509.ExtKeyUsageClientAuth)
+
+	serverConfig, err := NewServerConfig(serverCert, serverKey, ca.file, []string{"agent-1"})
+	require.NoError(t, err)
+	var identity string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity = PeerCN(r.TLS)
+	}))
+	server.TLS = serverConfig
+	server.StartTLS()
+	defer server.Close()
+
+	get := func(certFile, keyFile string) error {
+		clientConfig, err := NewClientConfig(ca.file, certFile, keyFile)
+		require.NoError(t, err)
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	require.NoError(t, get(agentCert, agentKey))
+	assert.Equal(t, "agent-1", identity)
+
+	assert.Error(t, get(otherCert, otherKey), "the common name is not allowed")
+	assert.Error(t, get(rogueCert, rogueKey), "the certificate is not signed by the client CA")
+	assert.Error(t, get("", ""), "a client certificate is required")
+}
+
+func TestServerTLSWithoutClientCA(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	serverCert, serverKey := ca.issue("server", x509.ExtKeyUsageServerAuth)
+
+	serverConfig, err := NewServerConfig(serverCert, serverKey, "", nil)
+	require.NoError(t, err)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, PeerCN(r.TLS))
+	}))
+	server.TLS = serverConfig
+	server.StartTLS()
+	defer server.Close()
+
+	clientConfig, err := NewClientConfig(ca.file, "", "")
+	require.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	// The server certificate is not trusted without the CA
+	clientConfig, err = NewClientConfig("", "", "")
+	require.NoError(t, err)
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+	_, err = client.Get(server.URL)
+	assert.Error(t, err)
+
+	_, err = NewServerConfig(serverCert, serverKey, "", []string{"agent-1"})
+	assert.Error(t, err, "allowed names require a client CA")
+	_, err = NewServerConfig(filepath.Join(dir, "missing.crt"), serverKey, "", nil)
+	assert.Error(t, err)
+	_, err = NewClientConfig(filepath.Join(dir, "missing.pem"), "", "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,4 @@
+DELETE FROM metrics WHERE labels <> '{}'::jsonb;
+ALTER TABLE metrics DROP CONSTRAINT metrics_pkey;
+ALTER TABLE metrics ADD PRIMARY KEY (name);
+ALTER TABLE metrics DROP COLUMN IF EXISTS labels;
\ No newline at end of file
@@ -0,0 +1,3 @@
+ALTER TABLE metrics ADD COLUMN labels JSONB NOT NULL DEFAULT '{}'::jsonb;
+ALTER TABLE metrics DROP CONSTRAINT metrics_pkey;
+ALTER TABLE metrics ADD PRIMARY KEY (name, labels);
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE metrics ADD COLUMN histogram JSONB NULL;
\ No newline at end of file
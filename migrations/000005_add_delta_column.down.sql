@@ -0,0 +1,2 @@
+UPDATE metrics SET value = delta WHERE type = 'counter';
+ALTER TABLE metrics DROP COLUMN IF EXISTS delta;
\ No newline at end of file
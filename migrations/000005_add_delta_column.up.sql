@@ -0,0 +1,2 @@
+ALTER TABLE metrics ADD COLUMN delta BIGINT NULL;
+UPDATE metrics SET delta = value::bigint, value = NULL WHERE type = 'counter';
\ No newline at end of file
@@ -0,0 +1,4 @@
+// Package metricspb contains the Go code generated from api/metrics.proto.
+package metricspb
+
+//go:generate protoc -I ../../api --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative ../../api/metrics.proto
@@ -0,0 +1,56 @@
+package metricspb
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrHashMismatch is returned by Verify when the hash does not match the request.
+var ErrHashMismatch = errors.New("hash mismatch")
+
+// signedBytes returns the deterministic encoding of the request without its hash.
+func (x *UpdateMetricsRequest) signedBytes() ([]byte, error) {
+	unsigned := &UpdateMetricsRequest{Metrics: x.GetMetrics()}
+	return proto.MarshalOptions{Deterministic: true}.Marshal(unsigned)
+}
+
+// Sign sets the hash of the request to the hex encoded HMAC SHA256 of its
+// deterministic encoding with an empty hash.
+func (x *UpdateMetricsRequest) Sign(key string) error {
+	data, err := x.signedBytes()
+	if err != nil {
+		return fmt.Errorf("error marshalling request: %w", err)
+	}
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write(data)
+	x.Hash = hex.EncodeToString(h.Sum(nil))
+	return nil
+}
+
+// Verify checks the hash of the request against key.
+//
+// Like the HTTP API, a request without a hash or a server without a key is accepted.
+func (x *UpdateMetricsRequest) Verify(key string) error {
+	if key == "" || x.GetHash() == "" {
+		return nil
+	}
+	expected, err := hex.DecodeString(x.GetHash())
+	if err != nil {
+		return fmt.Errorf("invalid hash format")
+	}
+	data, err := x.signedBytes()
+	if err != nil {
+		return fmt.Errorf("error marshalling request: %w", err)
+	}
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write(data)
+	if !hmac.Equal(expected, h.Sum(nil)) {
+		return ErrHashMismatch
+	}
+	return nil
+}
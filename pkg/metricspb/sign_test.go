@@ -0,0 +1,30 @@
+package metricspb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignVerify(t *testing.T) {
+	req := &UpdateMetricsRequest{Metrics: []*Metric{
+		{Id: "Alloc", Type: Metric_GAUGE, Data: &Metric_Value{Value: 1.5}, Labels: map[string]string{"b": "2", "a": "1"}},
+		{Id: "PollCount", Type: Metric_COUNTER, Data: &Metric_Delta{Delta: 3}},
+	}}
+	require.NoError(t, req.Sign("secret"))
+	assert.Len(t, req.GetHash(), 64)
+
+	assert.NoError(t, req.Verify("secret"))
+	assert.ErrorIs(t, req.Verify("other"), ErrHashMismatch)
+	assert.NoError(t, req.Verify(""), "a server without a key accepts any request")
+
+	req.Metrics[1].Data = &Metric_Delta{Delta: 4}
+	assert.ErrorIs(t, req.Verify("secret"), ErrHashMismatch)
+
+	req.Hash = "not hex"
+	assert.Error(t, req.Verify("secret"))
+
+	req.Hash = ""
+	assert.NoError(t, req.Verify("secret"), "unsigned requests are accepted like in the HTTP API")
+}